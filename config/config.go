@@ -0,0 +1,119 @@
+// Package config loads and validates the settings the server cannot start
+// without. Optional tunables stay with the component that uses them (see
+// pkg/env).
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"satunaskah/middleware"
+	"satunaskah/pkg/env"
+)
+
+// Config is the validated startup configuration.
+type Config struct {
+	Database Database
+	Auth     middleware.AuthConfig // At least one of JWTSecret or SupabaseURL is set
+	CORS     middleware.CORSConfig // Shared by REST and the WebSocket handshake
+	Proxy    middleware.ProxyConfig
+	Server   Server
+}
+
+// Database holds the Postgres connection settings.
+type Database struct {
+	User     string
+	Password string
+	Host     string
+	Port     string
+	Name     string
+}
+
+// URL returns the lib/pq connection string.
+func (d Database) URL() string {
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(d.User, d.Password),
+		Host:     d.Host + ":" + d.Port,
+		Path:     "/" + d.Name,
+		RawQuery: "sslmode=require",
+	}
+	return u.String()
+}
+
+// Server holds the HTTP listener settings.
+type Server struct {
+	Addr              string
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+}
+
+// Load reads the configuration from the environment. It reports every
+// missing or invalid required variable in a single error.
+func Load() (*Config, error) {
+	cfg := &Config{
+		Database: Database{
+			User:     env.String("user", ""),
+			Password: env.String("password", ""),
+			Host:     env.String("host", ""),
+			Port:     env.String("port", "5432"),
+			Name:     env.String("dbname", ""),
+		},
+		Auth:  middleware.AuthConfigFromEnv(),
+		CORS:  middleware.CORSConfigFromEnv(),
+		Proxy: middleware.ProxyConfigFromEnv(),
+		Server: Server{
+			Addr:              env.String("SERVER_ADDR", ":8080"),
+			ReadHeaderTimeout: env.Duration("SERVER_READ_HEADER_TIMEOUT", 5*time.Second),
+			ReadTimeout:       env.Duration("SERVER_READ_TIMEOUT", 15*time.Second),
+			WriteTimeout:      env.Duration("SERVER_WRITE_TIMEOUT", 60*time.Second),
+			IdleTimeout:       env.Duration("SERVER_IDLE_TIMEOUT", 120*time.Second),
+		},
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) validate() error {
+	var problems []string
+	for _, v := range []struct{ key, value string }{
+		{"user", c.Database.User},
+		{"password", c.Database.Password},
+		{"host", c.Database.Host},
+		{"dbname", c.Database.Name},
+	} {
+		if v.value == "" {
+			problems = append(problems, v.key+" is not set")
+		}
+	}
+
+	if c.Auth.JWTSecret == "" && c.Auth.SupabaseURL == "" {
+		problems = append(problems, "SUPABASE_JWT_SECRET or SUPABASE_URL must be set")
+	}
+	if c.Auth.SupabaseURL != "" {
+		if u, err := url.Parse(c.Auth.SupabaseURL); err != nil || u.Scheme == "" || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("SUPABASE_URL %q is not an absolute URL", c.Auth.SupabaseURL))
+		}
+	}
+
+	// Browsers refuse credentialed responses for "*", and echoing every
+	// origin instead would let any site act as a signed-in user.
+	if c.CORS.AllowCredentials && c.CORS.AllowsAnyOrigin() {
+		problems = append(problems, "CORS_ALLOW_CREDENTIALS needs CORS_ALLOWED_ORIGINS to list origins, not \"*\"")
+	}
+
+	if len(c.Proxy.Invalid) > 0 {
+		problems = append(problems, fmt.Sprintf("TRUSTED_PROXIES has invalid entries %q", c.Proxy.Invalid))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
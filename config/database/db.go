@@ -2,26 +2,16 @@ package database
 
 import (
 	"database/sql"
-	"fmt"
-	"os"
-	"strings"
 	"time"
 
+	"satunaskah/config"
 	"satunaskah/pkg/logger"
 
 	_ "github.com/lib/pq"
 )
 
-func Connect() *sql.DB {
-	dbUser := strings.TrimSpace(os.Getenv("user"))
-	dbPass := strings.TrimSpace(os.Getenv("password"))
-	dbHost := strings.TrimSpace(os.Getenv("host"))
-	dbPort := strings.TrimSpace(os.Getenv("port"))
-	dbName := strings.TrimSpace(os.Getenv("dbname"))
-
-	connStr := fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=require", dbUser, dbPass, dbHost, dbPort, dbName)
-
-	db, err := sql.Open("postgres", connStr)
+func Connect(cfg config.Database) *sql.DB {
+	db, err := sql.Open("postgres", cfg.URL())
 	if err != nil {
 		logger.Sugar.Fatalf("Failed to open database connection: %v", err)
 	}
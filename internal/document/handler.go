@@ -1,12 +1,24 @@
 package handler
 
 import (
+	"context"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"satunaskah/internal/document/model"
 	"satunaskah/internal/document/service"
+	"satunaskah/internal/storage"
 	"satunaskah/middleware"
+	"satunaskah/pkg/apperr"
+	"satunaskah/pkg/docid"
+	"satunaskah/pkg/export"
 	"satunaskah/pkg/logger"
+	"satunaskah/socket"
+	"strconv"
+	"time"
 )
 
 type DocumentHandler struct {
@@ -26,12 +38,55 @@ func (h *DocumentHandler) CreateDocument(w http.ResponseWriter, r *http.Request)
 	userID := r.Context().Value(middleware.UserIDKey).(string)
 
 	var req model.CreateDocRequest
-	_ = json.NewDecoder(r.Body).Decode(&req) // Ignore error, default to empty
+	// The body is optional; without one the document starts untitled.
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Retried or double-submitted requests carrying the same key get the same document.
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if len(idempotencyKey) > 255 {
+		http.Error(w, "Idempotency-Key too long", http.StatusBadRequest)
+		return
+	}
+
+	docID, err := h.Service.CreateDocument(userID, req, idempotencyKey)
+	if err != nil {
+		writeError(w, err, "Failed to create document")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(model.CreateDocResponse{DocID: docID})
+}
+
+// MaxImportBytes bounds the request body accepted by ImportDocument.
+const MaxImportBytes = 2 << 20
+
+func (h *DocumentHandler) ImportDocument(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MaxImportBytes)
+	var req model.ImportDocRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Format != "" && req.Format != export.FormatMarkdown && req.Format != export.FormatHTML {
+		http.Error(w, "Invalid format. Must be md or html", http.StatusBadRequest)
+		return
+	}
 
-	docID, err := h.Service.CreateDocument(userID, req.Title)
+	userID := r.Context().Value(middleware.UserIDKey).(string)
+
+	docID, err := h.Service.ImportDocument(userID, req)
 	if err != nil {
-		logger.Sugar.Errorf("Handler: Failed to create document: %v", err)
-		http.Error(w, "Failed to create document: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, err, "Failed to import document")
 		return
 	}
 
@@ -51,6 +106,11 @@ func (h *DocumentHandler) SaveDocument(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !docid.Valid(req.DocID) {
+		http.Error(w, "Invalid document_id", http.StatusBadRequest)
+		return
+	}
+
 	if len(req.Content) == 0 || string(req.Content) == "null" {
 		http.Error(w, "Content cannot be empty", http.StatusBadRequest)
 		return
@@ -58,16 +118,107 @@ func (h *DocumentHandler) SaveDocument(w http.ResponseWriter, r *http.Request) {
 
 	userID := r.Context().Value(middleware.UserIDKey).(string)
 
-	if err := h.Service.SaveDocument(userID, req); err != nil {
-		logger.Sugar.Errorf("Error saving document: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	saved, err := h.Service.SaveDocument(userID, req)
+	if err != nil {
+		writeError(w, err, "Failed to save document")
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
+	if !saved {
+		w.Write([]byte("No changes"))
+		return
+	}
 	w.Write([]byte("Document saved successfully"))
 }
 
+func (h *DocumentHandler) AppendContent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req model.AppendDocRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if !docid.Valid(req.DocID) {
+		http.Error(w, "Invalid document_id", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Content) == 0 || string(req.Content) == "null" {
+		http.Error(w, "Content cannot be empty", http.StatusBadRequest)
+		return
+	}
+
+	userID := r.Context().Value(middleware.UserIDKey).(string)
+
+	err := h.Service.AppendContent(userID, req)
+	if err != nil {
+		writeError(w, err, "Failed to append content")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Content appended successfully"))
+}
+
+func (h *DocumentHandler) AcquireEditLock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req model.EditLockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !docid.Valid(req.DocID) {
+		http.Error(w, "Invalid document_id", http.StatusBadRequest)
+		return
+	}
+
+	userID := r.Context().Value(middleware.UserIDKey).(string)
+
+	resp, err := h.Service.AcquireEditLock(userID, req.DocID)
+	if err != nil {
+		writeError(w, err, "Database error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (h *DocumentHandler) ReleaseEditLock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req model.EditLockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.LockToken == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !docid.Valid(req.DocID) {
+		http.Error(w, "Invalid document_id", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.Service.ReleaseEditLock(req.DocID, req.LockToken); err != nil {
+		writeError(w, err, "Database error")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Lock released"))
+}
+
 func (h *DocumentHandler) DeleteDocument(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodDelete {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -79,12 +230,15 @@ func (h *DocumentHandler) DeleteDocument(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "Missing docId parameter", http.StatusBadRequest)
 		return
 	}
+	if !docid.Valid(docID) {
+		http.Error(w, "Invalid docId parameter", http.StatusBadRequest)
+		return
+	}
 
 	userID := r.Context().Value(middleware.UserIDKey).(string)
 
 	if err := h.Service.DeleteDocument(docID, userID); err != nil {
-		logger.Sugar.Errorf("Handler: Failed to delete document %s: %v", docID, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err, "Failed to delete document")
 		return
 	}
 
@@ -92,6 +246,41 @@ func (h *DocumentHandler) DeleteDocument(w http.ResponseWriter, r *http.Request)
 	w.Write([]byte("Document deleted successfully"))
 }
 
+func (h *DocumentHandler) DeleteDocuments(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req model.BatchDocumentsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.IDs) > service.MaxBatchDocs {
+		http.Error(w, fmt.Sprintf("Too many ids. At most %d per request", service.MaxBatchDocs), http.StatusBadRequest)
+		return
+	}
+	for _, id := range req.IDs {
+		if !docid.Valid(id) {
+			http.Error(w, "Invalid document id: "+id, http.StatusBadRequest)
+			return
+		}
+	}
+
+	userID := r.Context().Value(middleware.UserIDKey).(string)
+
+	results, err := h.Service.DeleteDocuments(userID, req.IDs)
+	if err != nil {
+		writeError(w, err, "Database error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
 func (h *DocumentHandler) UpdateDocument(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPut {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -103,18 +292,21 @@ func (h *DocumentHandler) UpdateDocument(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "Missing docId parameter", http.StatusBadRequest)
 		return
 	}
+	if !docid.Valid(docID) {
+		http.Error(w, "Invalid docId parameter", http.StatusBadRequest)
+		return
+	}
 
 	userID := r.Context().Value(middleware.UserIDKey).(string)
 
 	var req model.UpdateDocRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Title == "" {
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Title == "" && req.Description == nil && req.CommentLimit == nil) {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	if err := h.Service.UpdateTitle(docID, userID, req.Title); err != nil {
-		logger.Sugar.Errorf("Handler: Failed to update title for doc %s: %v", docID, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := h.Service.UpdateDocument(docID, userID, req); err != nil {
+		writeError(w, err, "Failed to update document")
 		return
 	}
 
@@ -134,6 +326,11 @@ func (h *DocumentHandler) AddCollaborator(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	if !docid.Valid(req.DocID) {
+		http.Error(w, "Invalid document_id", http.StatusBadRequest)
+		return
+	}
+
 	if req.Role != "writer" && req.Role != "reviewer" && req.Role != "reader" {
 		http.Error(w, "Invalid role. Must be writer, reviewer, or reader", http.StatusBadRequest)
 		return
@@ -141,9 +338,9 @@ func (h *DocumentHandler) AddCollaborator(w http.ResponseWriter, r *http.Request
 
 	userID := r.Context().Value(middleware.UserIDKey).(string)
 
-	if err := h.Service.InviteCollaborator(userID, req); err != nil {
-		logger.Sugar.Errorf("Handler: Failed to invite collaborator: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	err := h.Service.InviteCollaborator(userID, req)
+	if err != nil {
+		writeError(w, err, "Failed to add collaborator")
 		return
 	}
 
@@ -151,6 +348,38 @@ func (h *DocumentHandler) AddCollaborator(w http.ResponseWriter, r *http.Request
 	w.Write([]byte("Collaborator added successfully"))
 }
 
+func (h *DocumentHandler) KickUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req model.KickRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !docid.Valid(req.DocID) {
+		http.Error(w, "Invalid document_id", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == "" {
+		http.Error(w, "Missing user_id", http.StatusBadRequest)
+		return
+	}
+
+	userID := r.Context().Value(middleware.UserIDKey).(string)
+
+	resp, err := h.Service.KickUser(userID, req)
+	if err != nil {
+		writeError(w, err, "Database error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
 func (h *DocumentHandler) GetDocuments(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -159,10 +388,64 @@ func (h *DocumentHandler) GetDocuments(w http.ResponseWriter, r *http.Request) {
 
 	userID := r.Context().Value(middleware.UserIDKey).(string)
 
+	// With since, only documents changed after it are listed.
+	if v := r.URL.Query().Get("since"); v != "" {
+		since, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			http.Error(w, "Invalid since parameter. Must be an RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		changes, err := h.Service.GetDocumentsChangedSince(userID, since)
+		if err != nil {
+			writeError(w, err, "Database error")
+			return
+		}
+		if changes.Documents == nil {
+			changes.Documents = []model.DocumentMetadata{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(changes)
+		return
+	}
+
 	docs, err := h.Service.GetDocuments(userID)
 	if err != nil {
-		logger.Sugar.Errorf("Error fetching documents: %v", err)
-		http.Error(w, "Database error", http.StatusInternalServerError)
+		writeError(w, err, "Database error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(docs)
+}
+
+func (h *DocumentHandler) GetDocumentsBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req model.BatchDocumentsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.IDs) > service.MaxBatchDocs {
+		http.Error(w, fmt.Sprintf("Too many ids. At most %d per request", service.MaxBatchDocs), http.StatusBadRequest)
+		return
+	}
+	for _, id := range req.IDs {
+		if !docid.Valid(id) {
+			http.Error(w, "Invalid document id: "+id, http.StatusBadRequest)
+			return
+		}
+	}
+
+	userID := r.Context().Value(middleware.UserIDKey).(string)
+
+	docs, err := h.Service.GetDocumentsBatch(userID, req.IDs)
+	if err != nil {
+		writeError(w, err, "Database error")
 		return
 	}
 
@@ -186,13 +469,16 @@ func (h *DocumentHandler) AddComment(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Document ID and Content are required", http.StatusBadRequest)
 		return
 	}
+	if !docid.Valid(req.DocID) {
+		http.Error(w, "Invalid document_id", http.StatusBadRequest)
+		return
+	}
 
 	userID := r.Context().Value(middleware.UserIDKey).(string)
 
 	resp, err := h.Service.AddComment(userID, req)
 	if err != nil {
-		logger.Sugar.Errorf("Failed to add comment: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err, "Failed to add comment")
 		return
 	}
 
@@ -211,11 +497,16 @@ func (h *DocumentHandler) GetComments(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing docId parameter", http.StatusBadRequest)
 		return
 	}
+	if !docid.Valid(docID) {
+		http.Error(w, "Invalid docId parameter", http.StatusBadRequest)
+		return
+	}
 
-	comments, err := h.Service.Repo.GetComments(docID)
+	userID := r.Context().Value(middleware.UserIDKey).(string)
+
+	comments, err := h.Service.GetComments(docID, userID)
 	if err != nil {
-		logger.Sugar.Errorf("Error fetching comments: %v", err)
-		http.Error(w, "Database error", http.StatusInternalServerError)
+		writeError(w, err, "Database error")
 		return
 	}
 
@@ -223,6 +514,59 @@ func (h *DocumentHandler) GetComments(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(comments)
 }
 
+func (h *DocumentHandler) ExportComments(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	docID := r.URL.Query().Get("docId")
+	if docID == "" {
+		http.Error(w, "Missing docId parameter", http.StatusBadRequest)
+		return
+	}
+	if !docid.Valid(docID) {
+		http.Error(w, "Invalid docId parameter", http.StatusBadRequest)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		http.Error(w, "Invalid format. Must be csv or json", http.StatusBadRequest)
+		return
+	}
+
+	userID := r.Context().Value(middleware.UserIDKey).(string)
+
+	comments, err := h.Service.ExportComments(docID, userID)
+	if err != nil {
+		writeError(w, err, "Database error")
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="comments-%s.%s"`, docID, format))
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(comments)
+		return
+	}
+
+	// encoding/csv quotes fields containing commas, quotes and newlines.
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "author_email", "quote", "content", "resolved", "created_at"})
+	for _, c := range comments {
+		cw.Write([]string{c.ID, c.AuthorEmail, c.Quote, c.Content, strconv.FormatBool(c.Resolved), c.CreatedAt.Format(time.RFC3339)})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		logger.Sugar.Errorf("Handler: Failed to write comments CSV for doc %s: %v", docID, err)
+	}
+}
+
 func (h *DocumentHandler) ResolveComment(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPut {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -237,9 +581,25 @@ func (h *DocumentHandler) ResolveComment(w http.ResponseWriter, r *http.Request)
 
 	userID := r.Context().Value(middleware.UserIDKey).(string)
 
+	// An optional body with content posts a final reply and resolves the thread.
+	var req model.ResolveCommentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Content != "" {
+		resp, err := h.Service.ResolveWithReply(commentID, userID, req)
+		if err != nil {
+			writeError(w, err, "Database error")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
 	if err := h.Service.ResolveComment(commentID, userID); err != nil {
-		logger.Sugar.Errorf("Handler: Failed to resolve comment %s: %v", commentID, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err, "Database error")
 		return
 	}
 
@@ -262,8 +622,7 @@ func (h *DocumentHandler) DeleteComment(w http.ResponseWriter, r *http.Request)
 	userID := r.Context().Value(middleware.UserIDKey).(string)
 
 	if err := h.Service.DeleteComment(commentID, userID); err != nil {
-		logger.Sugar.Errorf("Handler: Failed to delete comment %s: %v", commentID, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err, "Database error")
 		return
 	}
 
@@ -282,6 +641,10 @@ func (h *DocumentHandler) GetDocumentMembers(w http.ResponseWriter, r *http.Requ
 		http.Error(w, "Missing docId parameter", http.StatusBadRequest)
 		return
 	}
+	if !docid.Valid(docID) {
+		http.Error(w, "Invalid docId parameter", http.StatusBadRequest)
+		return
+	}
 
 	userID := r.Context().Value(middleware.UserIDKey).(string)
 
@@ -293,11 +656,454 @@ func (h *DocumentHandler) GetDocumentMembers(w http.ResponseWriter, r *http.Requ
 
 	members, err := h.Service.Repo.GetDocumentMembers(docID)
 	if err != nil {
-		logger.Sugar.Errorf("Error fetching members: %v", err)
-		http.Error(w, "Database error", http.StatusInternalServerError)
+		writeError(w, err, "Database error")
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(members)
 }
+
+func (h *DocumentHandler) GetDocumentOwner(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	docID := r.URL.Query().Get("docId")
+	if docID == "" {
+		http.Error(w, "Missing docId parameter", http.StatusBadRequest)
+		return
+	}
+	if !docid.Valid(docID) {
+		http.Error(w, "Invalid docId parameter", http.StatusBadRequest)
+		return
+	}
+
+	userID := r.Context().Value(middleware.UserIDKey).(string)
+
+	owner, err := h.Service.GetDocumentOwner(docID, userID)
+	if err != nil {
+		writeError(w, err, "Database error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(owner)
+}
+
+func (h *DocumentHandler) GetRawDocument(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	docID := r.URL.Query().Get("docId")
+	if docID == "" {
+		http.Error(w, "Missing docId parameter", http.StatusBadRequest)
+		return
+	}
+	if !docid.Valid(docID) {
+		http.Error(w, "Invalid docId parameter", http.StatusBadRequest)
+		return
+	}
+
+	userID := r.Context().Value(middleware.UserIDKey).(string)
+
+	fileName, content, err := h.Service.GetRawContent(docID, userID)
+	if err != nil {
+		writeError(w, err, "Database error")
+		return
+	}
+
+	// Written as-is so a backup restores byte for byte via create-with-content.
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, fileName))
+	w.Write(content)
+}
+
+func (h *DocumentHandler) GetContentAtRevision(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	docID := r.URL.Query().Get("docId")
+	if docID == "" {
+		http.Error(w, "Missing docId parameter", http.StatusBadRequest)
+		return
+	}
+	if !docid.Valid(docID) {
+		http.Error(w, "Invalid docId parameter", http.StatusBadRequest)
+		return
+	}
+	revision, err := strconv.ParseInt(r.URL.Query().Get("rev"), 10, 64)
+	if err != nil || revision < 1 {
+		http.Error(w, "Invalid rev parameter. Must be a positive integer", http.StatusBadRequest)
+		return
+	}
+
+	userID := r.Context().Value(middleware.UserIDKey).(string)
+
+	resp, err := h.Service.GetContentAtRevision(docID, userID, revision)
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "Revision not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeError(w, err, "Database error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (h *DocumentHandler) PreviewAsRole(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	docID := r.URL.Query().Get("docId")
+	if docID == "" {
+		http.Error(w, "Missing docId parameter", http.StatusBadRequest)
+		return
+	}
+	if !docid.Valid(docID) {
+		http.Error(w, "Invalid docId parameter", http.StatusBadRequest)
+		return
+	}
+	role := r.URL.Query().Get("role")
+	if role != socket.RoleWriter && role != socket.RoleReviewer && role != socket.RoleReader {
+		http.Error(w, "Invalid role. Must be writer, reviewer, or reader", http.StatusBadRequest)
+		return
+	}
+
+	userID := r.Context().Value(middleware.UserIDKey).(string)
+
+	resp, err := h.Service.PreviewAsRole(docID, userID, role)
+	if err != nil {
+		writeError(w, err, "Database error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (h *DocumentHandler) ExportDocument(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	docID := r.URL.Query().Get("docId")
+	if docID == "" {
+		http.Error(w, "Missing docId parameter", http.StatusBadRequest)
+		return
+	}
+	if !docid.Valid(docID) {
+		http.Error(w, "Invalid docId parameter", http.StatusBadRequest)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != export.FormatPDF && !export.IsSupported(format) {
+		http.Error(w, "Invalid format. Must be pdf, md, html, or txt", http.StatusBadRequest)
+		return
+	}
+
+	userID := r.Context().Value(middleware.UserIDKey).(string)
+
+	fileName, out, err := h.Service.ExportDocument(r.Context(), docID, userID, format)
+	if errors.Is(err, export.ErrPDFBusy) {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Too many PDF exports in progress, try again shortly", http.StatusServiceUnavailable)
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		http.Error(w, "PDF rendering timed out", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		writeError(w, err, "Failed to export document")
+		return
+	}
+
+	w.Header().Set("Content-Type", export.ContentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, fileName))
+	w.Header().Set("Content-Length", strconv.Itoa(len(out)))
+	w.Write(out)
+}
+
+func (h *DocumentHandler) GetMyRole(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	docID := r.URL.Query().Get("docId")
+	if docID == "" {
+		http.Error(w, "Missing docId parameter", http.StatusBadRequest)
+		return
+	}
+	if !docid.Valid(docID) {
+		http.Error(w, "Invalid docId parameter", http.StatusBadRequest)
+		return
+	}
+
+	userID := r.Context().Value(middleware.UserIDKey).(string)
+
+	resp, err := h.Service.GetMyRole(docID, userID)
+	if err != nil {
+		writeError(w, err, "Database error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (h *DocumentHandler) ExportDocuments(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req model.BulkExportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.IDs) == 0 {
+		http.Error(w, "At least one document ID is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.IDs) > service.MaxBulkExportDocs {
+		http.Error(w, "Too many documents in one export", http.StatusBadRequest)
+		return
+	}
+	for _, id := range req.IDs {
+		if !docid.Valid(id) {
+			http.Error(w, "Invalid document id: "+id, http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Format == "" {
+		req.Format = export.FormatMarkdown
+	}
+	if !export.IsSupported(req.Format) {
+		http.Error(w, "Invalid format. Must be md, html, or txt", http.StatusBadRequest)
+		return
+	}
+
+	userID := r.Context().Value(middleware.UserIDKey).(string)
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="documents.zip"`)
+
+	// The archive is streamed, so headers are already sent if this fails midway.
+	if err := h.Service.ExportDocuments(userID, req, w); err != nil {
+		logger.Sugar.Errorf("Handler: Failed to stream bulk export: %v", err)
+	}
+}
+
+func (h *DocumentHandler) CountDocuments(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Context().Value(middleware.UserIDKey).(string)
+
+	count, err := h.Service.Repo.CountDocuments(userID)
+	if err != nil {
+		writeError(w, err, "Database error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(count)
+}
+
+func (h *DocumentHandler) GetCommentStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	docID := r.URL.Query().Get("docId")
+	if docID == "" {
+		http.Error(w, "Missing docId parameter", http.StatusBadRequest)
+		return
+	}
+	if !docid.Valid(docID) {
+		http.Error(w, "Invalid docId parameter", http.StatusBadRequest)
+		return
+	}
+
+	userID := r.Context().Value(middleware.UserIDKey).(string)
+
+	stats, err := h.Service.GetCommentStats(docID, userID)
+	if err != nil {
+		writeError(w, err, "Database error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// PrewarmDocument loads a document into the realtime cache just before the
+// client opens its socket, so the join doesn't wait on the database.
+func (h *DocumentHandler) PrewarmDocument(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	docID := r.URL.Query().Get("docId")
+	if docID == "" {
+		http.Error(w, "Missing docId parameter", http.StatusBadRequest)
+		return
+	}
+	if !docid.Valid(docID) {
+		http.Error(w, "Invalid docId parameter", http.StatusBadRequest)
+		return
+	}
+
+	userID := r.Context().Value(middleware.UserIDKey).(string)
+
+	err := h.Service.PrewarmDocument(docID, userID)
+	if err != nil {
+		writeError(w, err, "Database error")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Document prewarmed"))
+}
+
+func (h *DocumentHandler) GetWorkspaceStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Context().Value(middleware.UserIDKey).(string)
+
+	stats, err := h.Service.Repo.GetWorkspaceStats(userID)
+	if err != nil {
+		writeError(w, err, "Database error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+func (h *DocumentHandler) GetMyComments(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit, offset, ok := pageParams(w, r, service.DefaultCommentsPageSize, service.MaxCommentsPageSize)
+	if !ok {
+		return
+	}
+
+	userID := r.Context().Value(middleware.UserIDKey).(string)
+
+	page, err := h.Service.GetMyComments(userID, limit, offset)
+	if err != nil {
+		writeError(w, err, "Database error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+func (h *DocumentHandler) GetMyCollaborators(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit, offset, ok := pageParams(w, r, service.DefaultCollaboratorsPageSize, service.MaxCollaboratorsPageSize)
+	if !ok {
+		return
+	}
+
+	userID := r.Context().Value(middleware.UserIDKey).(string)
+
+	page, err := h.Service.GetMyCollaborators(userID, limit, offset)
+	if err != nil {
+		writeError(w, err, "Database error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+func (h *DocumentHandler) GetRecentEdits(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit, offset, ok := pageParams(w, r, service.DefaultRecentEditsPageSize, service.MaxRecentEditsPageSize)
+	if !ok {
+		return
+	}
+
+	userID := r.Context().Value(middleware.UserIDKey).(string)
+
+	page, err := h.Service.GetRecentEdits(userID, limit, offset)
+	if err != nil {
+		writeError(w, err, "Database error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// writeError answers err with the status and message of the apperr.Error it
+// carries. Anything else, and internal errors, are logged with their full
+// chain and answered with 500 and fallback, keeping details out of responses.
+func writeError(w http.ResponseWriter, err error, fallback string) {
+	var appErr *apperr.Error
+	if errors.As(err, &appErr) && appErr.Code != apperr.CodeInternal {
+		http.Error(w, appErr.Message, appErr.Status)
+		return
+	}
+	logger.Sugar.Errorf("Handler: %s: %v", fallback, err)
+	http.Error(w, fallback, http.StatusInternalServerError)
+}
+
+// pageParams reads the limit (1-max, def when absent) and offset query
+// parameters, answering 400 and returning false when either is invalid.
+func pageParams(w http.ResponseWriter, r *http.Request, def, max int) (limit, offset int, ok bool) {
+	limit = def
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > max {
+			http.Error(w, fmt.Sprintf("Invalid limit. Must be 1-%d", max), http.StatusBadRequest)
+			return 0, 0, false
+		}
+		limit = n
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
+			return 0, 0, false
+		}
+		offset = n
+	}
+	return limit, offset, true
+}
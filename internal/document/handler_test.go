@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"satunaskah/internal/document/model"
+	"satunaskah/internal/document/repository"
+	"satunaskah/internal/document/service"
+	"satunaskah/middleware"
+	"satunaskah/pkg/docid"
+	"satunaskah/pkg/logger"
+	"satunaskah/socket"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(m *testing.M) {
+	logger.Init()
+	os.Exit(m.Run())
+}
+
+func TestUpdateDocument(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	docID := docid.New()
+	hub := socket.NewHub(nil)
+	h := NewDocumentHandler(&service.DocumentService{Repo: repository.NewDocumentRepository(db), Hub: hub})
+	update := func(query, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPut, "/api/documents/update"+query, strings.NewReader(body))
+		r = r.WithContext(context.WithValue(r.Context(), middleware.UserIDKey, "user-1"))
+		w := httptest.NewRecorder()
+		h.UpdateDocument(w, r)
+		return w
+	}
+
+	assert.Equal(t, http.StatusBadRequest, update("", `{"title":"Plan"}`).Code, "missing docId")
+	assert.Equal(t, http.StatusBadRequest, update("?docId=nope", `{"title":"Plan"}`).Code, "invalid docId")
+	assert.Equal(t, http.StatusBadRequest, update("?docId="+docID, `{"title":`).Code, "malformed body")
+	assert.Equal(t, http.StatusBadRequest, update("?docId="+docID, `{}`).Code, "nothing to change")
+	assert.Equal(t, http.StatusBadRequest, update("?docId="+docID, `{"title":"Plan","comment_limit":-1}`).Code, "invalid field")
+
+	mock.ExpectQuery("UPDATE documents SET").
+		WithArgs(docID, "user-1", "Plan", nil, nil, true).
+		WillReturnError(sql.ErrNoRows)
+	assert.Equal(t, http.StatusForbidden, update("?docId="+docID, `{"title":"Plan"}`).Code)
+
+	mock.ExpectQuery("UPDATE documents SET").
+		WithArgs(docID, "user-1", "Plan", "", 5, true).
+		WillReturnRows(sqlmock.NewRows([]string{"title"}).AddRow("Plan"))
+	go func() { <-hub.Broadcast }()
+	assert.Equal(t, http.StatusOK, update("?docId="+docID, `{"title":"Plan","description":"","comment_limit":5}`).Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestEditLockEndpoints(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	docID := docid.New()
+	h := NewDocumentHandler(&service.DocumentService{Repo: repository.NewDocumentRepository(db), Hub: socket.NewHub(nil)})
+	call := func(handle http.HandlerFunc, userID, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		r = r.WithContext(context.WithValue(r.Context(), middleware.UserIDKey, userID))
+		w := httptest.NewRecorder()
+		handle(w, r)
+		return w
+	}
+	expectRole := func(userID, role string) {
+		mock.ExpectQuery("SELECT owner_id FROM documents WHERE id = \\$1").WithArgs(docID).
+			WillReturnRows(sqlmock.NewRows([]string{"owner_id"}).AddRow("owner-1"))
+		mock.ExpectQuery("SELECT role FROM collaborators").WithArgs(docID, userID).
+			WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(role))
+	}
+	body := `{"document_id":"` + docID + `"}`
+
+	expectRole("reader-1", socket.RoleReader)
+	assert.Equal(t, http.StatusForbidden, call(h.AcquireEditLock, "reader-1", body).Code, "readers can't lock")
+
+	expectRole("writer-1", socket.RoleWriter)
+	w := call(h.AcquireEditLock, "writer-1", body)
+	require.Equal(t, http.StatusOK, w.Code)
+	var lock model.EditLockResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&lock))
+	assert.NotEmpty(t, lock.LockToken)
+
+	expectRole("writer-2", socket.RoleWriter)
+	assert.Equal(t, http.StatusConflict, call(h.AcquireEditLock, "writer-2", body).Code, "held by another writer")
+
+	release := func(token string) int {
+		return call(h.ReleaseEditLock, "writer-1", `{"document_id":"`+docID+`","lock_token":"`+token+`"}`).Code
+	}
+	assert.Equal(t, http.StatusConflict, release("not-the-token"))
+	assert.Equal(t, http.StatusOK, release(lock.LockToken))
+	assert.Equal(t, http.StatusConflict, release(lock.LockToken), "already released")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -2,6 +2,7 @@ package model
 
 import (
 	"encoding/json"
+	"satunaskah/pkg/delta"
 	"time"
 )
 
@@ -11,11 +12,21 @@ type CreateDocResponse struct {
 
 type CollaboratorInfo struct {
 	ID     string `json:"id"`
-	Name   string `json:"name"`
+	Name   string `json:"name"` // Display name, falling back to email
+	Email  string `json:"email"`
 	Role   string `json:"role"`
 	Avatar string `json:"avatar,omitempty"`
 }
 
+// DocumentOwner is who owns a document. Email and Name are empty when the
+// owner is missing from the user directory.
+type DocumentOwner struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"` // Display name, falling back to email
+	Email  string `json:"email"`
+	Avatar string `json:"avatar,omitempty"`
+}
+
 type DocumentMetadata struct {
 	ID        string             `json:"id"`
 	Title     string             `json:"title"`
@@ -23,14 +34,53 @@ type DocumentMetadata struct {
 	Snippet   string             `json:"snippet"`
 	IsOwner   bool               `json:"is_owner"`
 	Collab    []CollaboratorInfo `json:"collab"`
+	Preview   delta.Preview      `json:"preview"`
+
+	UnreadComments int  `json:"unread_comments"`
+	HasUpdates     bool `json:"has_updates"` // Changed since the user last opened it
+
+	Description string `json:"description"`
+
+	// Whose save last changed the content; empty before anyone has saved.
+	// The email is known while the editor is still a member.
+	LastEditorID    string     `json:"last_editor_id,omitempty"`
+	LastEditorEmail string     `json:"last_editor_email,omitempty"`
+	LastEditedAt    *time.Time `json:"last_edited_at,omitempty"`
 }
 
 type CreateDocRequest struct {
-	Title string `json:"title"`
+	Title   string          `json:"title"`
+	Content json.RawMessage `json:"content,omitempty"` // Optional initial Quill delta
+}
+
+type BatchDocumentsRequest struct {
+	IDs []string `json:"ids"`
+}
+
+// BulkDeleteResult is the outcome for one id of a bulk delete: "deleted",
+// "forbidden" (not the owner) or "not_found".
+type BulkDeleteResult struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+type ImportDocRequest struct {
+	Title   string `json:"title"`
+	Content string `json:"content"`
+	Format  string `json:"format"` // md (default) or html
+}
+
+// DocumentChanges answers GET /api/documents?since=...
+type DocumentChanges struct {
+	Documents  []DocumentMetadata `json:"documents"`
+	ServerTime time.Time          `json:"server_time"` // Pass as the next since
 }
 
+// UpdateDocRequest changes a document's details; at least one must be set.
 type UpdateDocRequest struct {
-	Title string `json:"title"`
+	Title        string  `json:"title"`
+	Description  *string `json:"description"`   // Empty string clears it
+	CommentLimit *int    `json:"comment_limit"` // Owner only; 0 restores the server default
 }
 
 type InviteRequest struct {
@@ -39,16 +89,88 @@ type InviteRequest struct {
 	Role  string `json:"role"`
 }
 
+type KickRequest struct {
+	DocID  string `json:"document_id"`
+	UserID string `json:"user_id"`
+	Remove bool   `json:"remove"` // Also revoke their collaborator access
+}
+
+type KickResponse struct {
+	Disconnected int  `json:"disconnected"` // Connections closed
+	Removed      bool `json:"removed"`
+}
+
 type SaveDocRequest struct {
+	DocID     string          `json:"document_id"`
+	Content   json.RawMessage `json:"content"`
+	LockToken string          `json:"lock_token"` // From acquire-lock
+}
+
+// AppendDocRequest carries a delta of inserts to add at the end of a document.
+type AppendDocRequest struct {
+	DocID   string          `json:"document_id"`
+	Content json.RawMessage `json:"content"`
+}
+
+type EditLockRequest struct {
+	DocID     string `json:"document_id"`
+	LockToken string `json:"lock_token,omitempty"` // Required on release
+}
+
+type EditLockResponse struct {
+	LockToken string    `json:"lock_token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// RevisionContent is a document's content as stored at one saved revision.
+type RevisionContent struct {
+	DocID    string          `json:"document_id"`
+	Revision int64           `json:"revision"`
+	Content  json.RawMessage `json:"content"`
+}
+
+// RolePreview is a document's content as a collaborator with Role receives
+// it over the socket.
+type RolePreview struct {
 	DocID   string          `json:"document_id"`
+	Role    string          `json:"role"`
 	Content json.RawMessage `json:"content"`
 }
 
+// MyRoleResponse is the caller's effective permissions on a document.
+type MyRoleResponse struct {
+	Role       string `json:"role"` // owner, writer, reviewer or reader
+	CanEdit    bool   `json:"can_edit"`
+	CanComment bool   `json:"can_comment"`
+	CanInvite  bool   `json:"can_invite"`
+	EditLocked bool   `json:"edit_locked"` // Another user holds the REST edit lock
+}
+
+// Comment visibility. Reviewer-only comments are hidden from readers; the
+// owner, writers and reviewers see them.
+const (
+	VisibilityEveryone  = "everyone"
+	VisibilityReviewers = "reviewers"
+)
+
 type CommentRequest struct {
-	DocID     string          `json:"document_id"`
-	Content   string          `json:"content"`
-	Quote     string          `json:"quote"`
-	TextRange json.RawMessage `json:"text_range"` // JSON {index, length}
+	DocID      string          `json:"document_id"`
+	Content    string          `json:"content"`
+	Quote      string          `json:"quote"`
+	TextRange  json.RawMessage `json:"text_range"`          // JSON {index, length}
+	ParentID   string          `json:"parent_id,omitempty"` // Set on threaded replies
+	Visibility string          `json:"visibility"`          // everyone (default) or reviewers; replies follow their thread
+}
+
+type ResolveCommentRequest struct {
+	DocID   string `json:"document_id"`
+	Content string `json:"content"` // Optional final reply posted before resolving
+}
+
+// TextRange anchors a comment to a span of the document, in Quill indices.
+type TextRange struct {
+	Index  int `json:"index"`
+	Length int `json:"length"`
 }
 
 type CommentResponse struct {
@@ -59,8 +181,114 @@ type CommentResponse struct {
 	CommentRequest
 }
 
+type CommentExport struct {
+	ID          string    `json:"id"`
+	AuthorEmail string    `json:"author_email"`
+	Quote       string    `json:"quote"`
+	Content     string    `json:"content"`
+	Resolved    bool      `json:"resolved"`
+	CreatedAt   time.Time `json:"created_at"`
+	Visibility  string    `json:"visibility"`
+}
+
+// MyComment is one of the current user's comments, with its document.
+type MyComment struct {
+	ID            string    `json:"id"`
+	DocID         string    `json:"document_id"`
+	DocumentTitle string    `json:"document_title"`
+	Link          string    `json:"link"` // Frontend path of the document
+	Content       string    `json:"content"`
+	Quote         string    `json:"quote"`
+	ParentID      string    `json:"parent_id,omitempty"`
+	Resolved      bool      `json:"resolved"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+type MyCommentsPage struct {
+	Comments   []MyComment `json:"comments"`
+	NextOffset *int        `json:"next_offset,omitempty"` // Absent on the last page
+}
+
+// CommentStats summarises review progress on one document. ByAuthor is keyed
+// by user id.
+type CommentStats struct {
+	Total    int            `json:"total"`
+	Resolved int            `json:"resolved"`
+	Open     int            `json:"open"`
+	Last24h  int            `json:"last_24h"` // Added in the last 24 hours
+	ByAuthor map[string]int `json:"by_author"`
+}
+
+// ActiveCollaborator is someone who collaborates on the caller's documents,
+// with their latest activity across all of them. Edits are not recorded per
+// user, so opening a document stands in for editing it.
+type ActiveCollaborator struct {
+	UserID        string     `json:"user_id"`
+	Name          string     `json:"name"` // Display name, falling back to email
+	Email         string     `json:"email"`
+	Avatar        string     `json:"avatar,omitempty"`
+	Documents     int        `json:"documents"` // How many of the caller's documents they are on
+	LastCommentAt *time.Time `json:"last_comment_at"`
+	LastOpenedAt  *time.Time `json:"last_opened_at"`
+	LastActiveAt  *time.Time `json:"last_active_at"` // The later of the two
+}
+
+type ActiveCollaboratorsPage struct {
+	Collaborators []ActiveCollaborator `json:"collaborators"`
+	NextOffset    *int                 `json:"next_offset,omitempty"` // Absent on the last page
+}
+
+// RecentEdit is one of the caller's documents whose latest saved edit was made
+// by someone else.
+type RecentEdit struct {
+	ID              string    `json:"id"`
+	Title           string    `json:"title"`
+	Link            string    `json:"link"` // Frontend path of the document
+	LastEditorID    string    `json:"last_editor_id"`
+	LastEditorEmail string    `json:"last_editor_email"` // Empty when the user directory no longer has them
+	LastEditedAt    time.Time `json:"last_edited_at"`
+}
+
+type RecentEditsPage struct {
+	Documents  []RecentEdit `json:"documents"`
+	NextOffset *int         `json:"next_offset,omitempty"` // Absent on the last page
+}
+
 type MemberResponse struct {
 	UserID string `json:"user_id"`
 	Email  string `json:"email"`
 	Role   string `json:"role"`
 }
+
+type BulkExportRequest struct {
+	IDs    []string `json:"ids"`
+	Format string   `json:"format"` // md, html or txt
+}
+
+type ExportManifestEntry struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+	File  string `json:"file"`
+}
+
+type DocumentCount struct {
+	Owned  int `json:"owned"`
+	Shared int `json:"shared"`
+}
+
+type WorkspaceStats struct {
+	DocumentsOwned  int `json:"documents_owned"`
+	DocumentsShared int `json:"documents_shared"`
+	CommentsMade    int `json:"comments_made"`
+	Collaborators   int `json:"collaborators"` // Distinct users across owned documents
+}
+
+// UserCleanup records what was done with a deleted user's documents.
+type UserCleanup struct {
+	UserID      string            `json:"user_id"`
+	Transferred map[string]string `json:"transferred"` // Document id -> new owner id
+	Deleted     []string          `json:"deleted"`
+	// Document id -> new title, for transferred documents whose title the
+	// new owner already used (UNIQUE_TITLES)
+	Retitled map[string]string `json:"retitled,omitempty"`
+}
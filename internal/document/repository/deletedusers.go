@@ -0,0 +1,158 @@
+package repository
+
+import (
+	"database/sql"
+	"satunaskah/internal/document/model"
+	"satunaskah/pkg/logger"
+)
+
+// FindDeletedUsers returns the ids of users that still own documents or have
+// collaborator or comment rows but no longer exist in auth.users. Only
+// auth.users can tell a deleted user apart from one who never signed in, so
+// without access to it this returns ErrUserDirectoryUnavailable.
+func (r *DocumentRepository) FindDeletedUsers() ([]string, error) {
+	if r.authUsersDenied.Load() {
+		return nil, ErrUserDirectoryUnavailable
+	}
+	rows, err := r.DB.Query(`
+		SELECT ids.user_id FROM (
+			SELECT owner_id AS user_id FROM documents
+			UNION SELECT user_id FROM collaborators
+			UNION SELECT user_id FROM comments
+		) ids
+		WHERE NOT EXISTS (SELECT 1 FROM auth.users u WHERE u.id = ids.user_id)
+	`)
+	if isPermissionDenied(err) {
+		r.authUsersDenied.Store(true)
+		return nil, ErrUserDirectoryUnavailable.Wrap(err)
+	}
+	if err != nil {
+		logger.Sugar.Errorf("Failed to look for deleted users: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Retitle picks the title a transferred document keeps under its new owner.
+// titlesWithPrefix lists the new owner's other titles that start with a
+// prefix.
+type Retitle func(title string, titlesWithPrefix func(prefix string) ([]string, error)) (string, error)
+
+// RemoveUser deletes everything that belongs to userID, in one transaction.
+// Each document they own goes to the writer who opened it most recently, or
+// is deleted when it has no other writer or deleteOwned is set. A
+// transferred document's title is passed through retitle, when set, so it
+// doesn't clash with the new owner's titles. Their collaborator, comment,
+// access and notification rows are removed; replies others made to their
+// comments go with them.
+func (r *DocumentRepository) RemoveUser(userID string, deleteOwned bool, retitle Retitle) (*model.UserCleanup, error) {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		logger.Sugar.Errorf("Failed to begin cleanup of user %s: %v", userID, err)
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT id, title FROM documents WHERE owner_id = $1 FOR UPDATE", userID)
+	if err != nil {
+		logger.Sugar.Errorf("Failed to lock documents of user %s: %v", userID, err)
+		return nil, err
+	}
+	var owned []string
+	titles := make(map[string]string)
+	for rows.Next() {
+		var id, title string
+		if err := rows.Scan(&id, &title); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		owned = append(owned, id)
+		titles[id] = title
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result := &model.UserCleanup{UserID: userID, Transferred: make(map[string]string), Retitled: make(map[string]string)}
+	for _, docID := range owned {
+		heir := ""
+		if !deleteOwned {
+			heir, err = nextOwner(tx, docID, userID)
+			if err != nil {
+				logger.Sugar.Errorf("Failed to pick a new owner for doc %s: %v", docID, err)
+				return nil, err
+			}
+		}
+		if heir == "" {
+			if _, err := tx.Exec("DELETE FROM documents WHERE id = $1", docID); err != nil {
+				logger.Sugar.Errorf("Failed to delete doc %s of user %s: %v", docID, userID, err)
+				return nil, err
+			}
+			result.Deleted = append(result.Deleted, docID)
+			continue
+		}
+		title := titles[docID]
+		if retitle != nil {
+			title, err = retitle(title, func(prefix string) ([]string, error) {
+				return titlesWithPrefix(tx, heir, prefix, docID)
+			})
+			if err != nil {
+				logger.Sugar.Errorf("Failed to pick a title for doc %s under %s: %v", docID, heir, err)
+				return nil, err
+			}
+		}
+		if _, err := tx.Exec("UPDATE documents SET owner_id = $1, title = $3 WHERE id = $2", heir, docID, title); err != nil {
+			logger.Sugar.Errorf("Failed to transfer doc %s to %s: %v", docID, heir, err)
+			return nil, err
+		}
+		if title != titles[docID] {
+			result.Retitled[docID] = title
+		}
+		// The new owner no longer needs a collaborator row.
+		if _, err := tx.Exec("DELETE FROM collaborators WHERE document_id = $1 AND user_id = $2", docID, heir); err != nil {
+			return nil, err
+		}
+		result.Transferred[docID] = heir
+	}
+
+	for _, table := range []string{"collaborators", "comments", "document_access", "notifications"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE user_id = $1", userID); err != nil {
+			logger.Sugar.Errorf("Failed to remove %s rows of user %s: %v", table, userID, err)
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		logger.Sugar.Errorf("Failed to commit cleanup of user %s: %v", userID, err)
+		return nil, err
+	}
+	return result, nil
+}
+
+// nextOwner returns the writer on docID, other than userID, who opened it most
+// recently, or "" when there is none.
+func nextOwner(tx *sql.Tx, docID, userID string) (string, error) {
+	var heir string
+	err := tx.QueryRow(`
+		SELECT c.user_id FROM collaborators c
+		LEFT JOIN document_access a ON a.document_id = c.document_id AND a.user_id = c.user_id
+		WHERE c.document_id = $1 AND c.role = 'writer' AND c.user_id <> $2
+		ORDER BY a.last_opened_at DESC NULLS LAST, c.user_id
+		LIMIT 1
+	`, docID, userID).Scan(&heir)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return heir, err
+}
@@ -2,26 +2,69 @@ package repository
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"satunaskah/internal/document/model"
+	"satunaskah/internal/storage"
+	"satunaskah/pkg/delta"
 	"satunaskah/pkg/logger"
+	"strings"
+	"sync/atomic"
 	"time"
+
+	"github.com/lib/pq"
 )
 
 type DocumentRepository struct {
 	DB *sql.DB
+	// Content is where document content is loaded from and saved to.
+	Content storage.ContentStore
+	// Set once auth.users turns out to be unreadable; see queryUsers.
+	authUsersDenied atomic.Bool
 }
 
 func NewDocumentRepository(db *sql.DB) *DocumentRepository {
-	return &DocumentRepository{DB: db}
+	return &DocumentRepository{DB: db, Content: storage.NewPostgresContentStore(db)}
+}
+
+// ErrDocumentIDTaken means Create hit an existing document with the same id.
+var ErrDocumentIDTaken = errors.New("document id already exists")
+
+// ErrTitleTaken means a write hit the optional documents_owner_title_key
+// index: the owner already has a document with that title.
+var ErrTitleTaken = errors.New("owner already has a document with this title")
+
+// titleTaken reports whether err is a violation of documents_owner_title_key.
+func titleTaken(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "documents_owner_title_key"
 }
 
 func (r *DocumentRepository) Create(id, content, ownerID, title string) error {
+	// The row starts empty; initial content goes through the content store.
 	_, err := r.DB.Exec(`INSERT INTO documents (id, content, updated_at, owner_id, title) VALUES ($1, $2, NOW(), $3, $4)`,
-		id, content, ownerID, title)
+		id, delta.Empty, ownerID, title)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "documents_pkey" {
+		logger.Sugar.Warnf("Document id %s already exists", id)
+		return ErrDocumentIDTaken
+	}
+	if titleTaken(err) {
+		return ErrTitleTaken
+	}
 	if err != nil {
 		logger.Sugar.Errorf("Failed to create document: %v", err)
+		return err
 	}
-	return err
+	if content == delta.Empty {
+		return nil
+	}
+	if err := r.Content.Save(id, []byte(content)); err != nil {
+		// Don't leave an empty document behind for a create that failed.
+		r.Delete(id)
+		return err
+	}
+	return nil
 }
 
 func (r *DocumentRepository) GetOwnerID(docID string) (string, error) {
@@ -42,8 +85,33 @@ func (r *DocumentRepository) GetCollaboratorRole(docID, userID string) (string,
 	return role, err
 }
 
-func (r *DocumentRepository) UpdateContent(docID, content string) error {
-	_, err := r.DB.Exec(`UPDATE documents SET content = $1, updated_at = NOW() WHERE id = $2`, content, docID)
+func (r *DocumentRepository) GetDocument(docID string) (string, string, error) {
+	var title string
+	err := r.DB.QueryRow("SELECT title FROM documents WHERE id = $1", docID).Scan(&title)
+	if err != nil {
+		logger.Sugar.Errorf("Failed to get doc %s: %v", docID, err)
+		return "", "", err
+	}
+	content, err := r.Content.Load(docID)
+	if err != nil {
+		return "", "", err
+	}
+	return title, string(content), nil
+}
+
+// UpdateContent stores content, refreshes the document's preview to match and
+// records editorID as its last editor.
+func (r *DocumentRepository) UpdateContent(docID, content, editorID string) error {
+	if err := r.Content.Save(docID, []byte(content)); err != nil {
+		return err
+	}
+	preview, err := json.Marshal(delta.PreviewOf([]byte(content)))
+	if err != nil {
+		return err
+	}
+	_, err = r.DB.Exec(`
+		UPDATE documents SET preview = $2, updated_at = NOW(), last_editor_id = $3, last_edited_at = NOW()
+		WHERE id = $1`, docID, string(preview), editorID)
 	if err != nil {
 		logger.Sugar.Errorf("Failed to update content for doc %s: %v", docID, err)
 	}
@@ -58,18 +126,128 @@ func (r *DocumentRepository) Delete(docID string) error {
 	return err
 }
 
-func (r *DocumentRepository) UpdateTitle(docID, title, ownerID string) (int64, error) {
-	result, err := r.DB.Exec("UPDATE documents SET title = $1, updated_at = NOW() WHERE id = $2 AND owner_id = $3", title, docID, ownerID)
+// DeleteOwned deletes, in one transaction, those of ids that ownerID owns.
+// It returns the owner of every id that existed, so callers can tell
+// documents owned by someone else from missing ones.
+func (r *DocumentRepository) DeleteOwned(ownerID string, ids []string) (map[string]string, error) {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		logger.Sugar.Errorf("Failed to begin bulk delete for user %s: %v", ownerID, err)
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT id, owner_id FROM documents WHERE id = ANY($1) FOR UPDATE", pq.Array(ids))
+	if err != nil {
+		logger.Sugar.Errorf("Failed to lock documents for bulk delete: %v", err)
+		return nil, err
+	}
+	owners := make(map[string]string, len(ids))
+	for rows.Next() {
+		var id, owner string
+		if err := rows.Scan(&id, &owner); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		owners[id] = owner
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM documents WHERE id = ANY($1) AND owner_id = $2", pq.Array(ids), ownerID); err != nil {
+		logger.Sugar.Errorf("Failed to bulk delete documents of user %s: %v", ownerID, err)
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		logger.Sugar.Errorf("Failed to commit bulk delete for user %s: %v", ownerID, err)
+		return nil, err
+	}
+	return owners, nil
+}
+
+// UpdateDetails changes docID's title, description and comment limit in one
+// statement; nil leaves a field as it is and a limit of 0 clears it. The
+// owner may change any of them, writers only the description. It returns the
+// document's title, or sql.ErrNoRows when userID may not make the change.
+func (r *DocumentRepository) UpdateDetails(docID, userID string, title, description *string, commentLimit *int) (string, error) {
+	ownerOnly := title != nil || commentLimit != nil
+	var current string
+	err := r.DB.QueryRow(`
+		UPDATE documents SET
+			title = COALESCE($3::text, title),
+			description = COALESCE($4::text, description),
+			comment_limit = CASE WHEN $5::int IS NULL THEN comment_limit ELSE NULLIF($5::int, 0) END,
+			updated_at = CASE WHEN $3::text IS NULL AND $4::text IS NULL THEN updated_at ELSE NOW() END
+		WHERE id = $1 AND (owner_id = $2 OR (NOT $6::bool AND EXISTS (
+			SELECT 1 FROM collaborators WHERE document_id = $1 AND user_id = $2 AND role = 'writer')))
+		RETURNING title`, docID, userID, title, description, commentLimit, ownerOnly).Scan(&current)
+	if titleTaken(err) {
+		return "", ErrTitleTaken
+	}
+	if err != nil && err != sql.ErrNoRows {
+		logger.Sugar.Errorf("Failed to update doc %s: %v", docID, err)
+	}
+	return current, err
+}
+
+// CommentQuota returns how many comments docID has, resolved ones included,
+// and its own comment limit, 0 when it has none.
+func (r *DocumentRepository) CommentQuota(docID string) (count, limit int, err error) {
+	err = r.DB.QueryRow(`
+		SELECT (SELECT COUNT(*) FROM comments WHERE document_id = $1), COALESCE(comment_limit, 0)
+		FROM documents WHERE id = $1`, docID).Scan(&count, &limit)
+	if err != nil {
+		logger.Sugar.Errorf("Failed to count comments of doc %s: %v", docID, err)
+	}
+	return count, limit, err
+}
+
+// TitlesWithPrefix returns the titles of ownerID's documents, other than
+// exceptDocID, that start with prefix.
+func (r *DocumentRepository) TitlesWithPrefix(ownerID, prefix, exceptDocID string) ([]string, error) {
+	return titlesWithPrefix(r.DB, ownerID, prefix, exceptDocID)
+}
+
+// queryer is what *sql.DB and *sql.Tx have in common for reads.
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func titlesWithPrefix(q queryer, ownerID, prefix, exceptDocID string) ([]string, error) {
+	pattern := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(prefix) + "%"
+	rows, err := q.Query("SELECT title FROM documents WHERE owner_id = $1 AND title LIKE $2 AND id <> $3", ownerID, pattern, exceptDocID)
 	if err != nil {
-		logger.Sugar.Errorf("Failed to update title for doc %s: %v", docID, err)
-		return 0, err
+		logger.Sugar.Errorf("Failed to list titles of user %s: %v", ownerID, err)
+		return nil, err
 	}
-	return result.RowsAffected()
+	defer rows.Close()
+
+	var titles []string
+	for rows.Next() {
+		var title string
+		if err := rows.Scan(&title); err != nil {
+			return nil, err
+		}
+		titles = append(titles, title)
+	}
+	return titles, rows.Err()
 }
 
 func (r *DocumentRepository) GetUserByEmail(email string) (string, error) {
 	var userID string
-	err := r.DB.QueryRow("SELECT id FROM auth.users WHERE email = $1", email).Scan(&userID)
+	rows, err := r.queryUsers("invite lookup",
+		"SELECT id FROM auth.users WHERE email = $1",
+		"SELECT id FROM profiles WHERE lower(email) = lower($1)", email)
+	if err == nil {
+		defer rows.Close()
+		if rows.Next() {
+			err = rows.Scan(&userID)
+		} else if err = rows.Err(); err == nil {
+			err = sql.ErrNoRows
+		}
+	}
 	if err != nil {
 		logger.Sugar.Errorf("Failed to get user by email %s: %v", email, err)
 	}
@@ -85,12 +263,38 @@ func (r *DocumentRepository) AddCollaborator(docID, userID, role string) error {
 	return err
 }
 
+// RemoveCollaborator revokes userID's access to docID. Removing someone who
+// is not a collaborator is not an error.
+func (r *DocumentRepository) RemoveCollaborator(docID, userID string) error {
+	_, err := r.DB.Exec(`DELETE FROM collaborators WHERE document_id = $1 AND user_id = $2`, docID, userID)
+	if err != nil {
+		logger.Sugar.Errorf("Failed to remove collaborator %s from doc %s: %v", userID, docID, err)
+	}
+	return err
+}
+
+// documentMetadataSelect selects the columns scanned into DocumentMetadata for
+// user $1. Unread comments are other users' comments newer than the user's
+// last open; documents never opened count every such comment. Readers don't
+// count reviewer-only comments, which they cannot see. A document has
+// updates when it changed after the user's last open, unless the user made
+// the last edit themselves; never opened documents always have updates.
+const documentMetadataSelect = `
+		SELECT d.id, d.title, d.description, d.updated_at, d.owner_id, d.preview, d.last_editor_id, d.last_edited_at,
+			(SELECT COUNT(*) FROM comments cm
+				WHERE cm.document_id = d.id AND cm.user_id <> $1
+				AND cm.created_at > COALESCE(a.last_opened_at, '-infinity'::timestamptz)
+				AND (cm.visibility <> 'reviewers' OR d.owner_id = $1 OR NOT EXISTS (
+					SELECT 1 FROM collaborators rc WHERE rc.document_id = d.id AND rc.user_id = $1 AND rc.role = 'reader'))) AS unread_comments,
+			(a.last_opened_at IS NULL OR (d.updated_at > a.last_opened_at
+				AND d.last_editor_id IS DISTINCT FROM $1)) AS has_updates
+		FROM documents d
+		LEFT JOIN document_access a ON a.document_id = d.id AND a.user_id = $1`
+
 func (r *DocumentRepository) GetDocumentsByUser(userID string) (*sql.Rows, error) {
-	query := `
-		SELECT id, title, updated_at, content, owner_id FROM documents WHERE owner_id = $1
-		UNION
-		SELECT d.id, d.title, d.updated_at, d.content, d.owner_id FROM documents d JOIN collaborators c ON d.id = c.document_id WHERE c.user_id = $1
-		ORDER BY updated_at DESC`
+	query := documentMetadataSelect + `
+		WHERE d.owner_id = $1 OR d.id IN (SELECT document_id FROM collaborators WHERE user_id = $1)
+		ORDER BY d.updated_at DESC`
 	rows, err := r.DB.Query(query, userID)
 	if err != nil {
 		logger.Sugar.Errorf("Failed to get documents for user %s: %v", userID, err)
@@ -98,37 +302,139 @@ func (r *DocumentRepository) GetDocumentsByUser(userID string) (*sql.Rows, error
 	return rows, err
 }
 
+// GetDocumentsChangedSince returns metadata rows for userID's documents, owned
+// or shared, updated after since, with the database's current time taken
+// before the query.
+func (r *DocumentRepository) GetDocumentsChangedSince(userID string, since time.Time) (*sql.Rows, time.Time, error) {
+	var now time.Time
+	if err := r.DB.QueryRow("SELECT NOW()").Scan(&now); err != nil {
+		logger.Sugar.Errorf("Failed to read database time: %v", err)
+		return nil, now, err
+	}
+	query := documentMetadataSelect + `
+		WHERE (d.owner_id = $1 OR d.id IN (SELECT document_id FROM collaborators WHERE user_id = $1))
+		AND d.updated_at > $2
+		ORDER BY d.updated_at DESC`
+	rows, err := r.DB.Query(query, userID, since)
+	if err != nil {
+		logger.Sugar.Errorf("Failed to get documents changed since %s for user %s: %v", since, userID, err)
+	}
+	return rows, now, err
+}
+
+// GetDocumentsByIDs returns metadata rows for the given ids that userID owns
+// or collaborates on; other ids are silently left out.
+func (r *DocumentRepository) GetDocumentsByIDs(userID string, ids []string) (*sql.Rows, error) {
+	query := documentMetadataSelect + `
+		WHERE d.id = ANY($2)
+		AND (d.owner_id = $1 OR EXISTS (SELECT 1 FROM collaborators c WHERE c.document_id = d.id AND c.user_id = $1))
+		ORDER BY d.updated_at DESC`
+	rows, err := r.DB.Query(query, userID, pq.Array(ids))
+	if err != nil {
+		logger.Sugar.Errorf("Failed to get %d documents by id for user %s: %v", len(ids), userID, err)
+	}
+	return rows, err
+}
+
+// GetDocumentOwner returns docID's owner. sql.ErrNoRows if the document
+// doesn't exist.
+func (r *DocumentRepository) GetDocumentOwner(docID string) (model.DocumentOwner, error) {
+	var owner model.DocumentOwner
+	rows, err := r.queryUsers("document owner", `
+		SELECT d.owner_id, u.email, COALESCE(u.raw_user_meta_data->>'full_name', u.raw_user_meta_data->>'name'),
+			u.raw_user_meta_data->>'avatar_url'
+		FROM documents d LEFT JOIN auth.users u ON d.owner_id = u.id WHERE d.id = $1`, `
+		SELECT d.owner_id, p.email, p.display_name, p.avatar_url
+		FROM documents d LEFT JOIN profiles p ON d.owner_id = p.id WHERE d.id = $1`, docID)
+	if err != nil {
+		logger.Sugar.Errorf("Failed to get owner of doc %s: %v", docID, err)
+		return owner, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return owner, err
+		}
+		return owner, sql.ErrNoRows
+	}
+	var email, name, avatar sql.NullString
+	if err := rows.Scan(&owner.ID, &email, &name, &avatar); err != nil {
+		return owner, err
+	}
+	owner.Email = email.String
+	owner.Name = name.String
+	if owner.Name == "" {
+		owner.Name = owner.Email
+	}
+	owner.Avatar = avatar.String
+	return owner, nil
+}
+
 func (r *DocumentRepository) GetDocumentMembers(docID string) ([]model.CollaboratorInfo, error) {
 	query := `
-		SELECT u.id, u.email, 'owner' as role FROM documents d JOIN auth.users u ON d.owner_id = u.id WHERE d.id = $1
+		SELECT d.owner_id, u.email, COALESCE(u.raw_user_meta_data->>'full_name', u.raw_user_meta_data->>'name'),
+			u.raw_user_meta_data->>'avatar_url', 'owner' as role
+		FROM documents d LEFT JOIN auth.users u ON d.owner_id = u.id WHERE d.id = $1
+		UNION ALL
+		SELECT c.user_id, u.email, COALESCE(u.raw_user_meta_data->>'full_name', u.raw_user_meta_data->>'name'),
+			u.raw_user_meta_data->>'avatar_url', c.role
+		FROM collaborators c LEFT JOIN auth.users u ON c.user_id = u.id
+		WHERE c.document_id = $1 AND c.user_id <> (SELECT owner_id FROM documents WHERE id = $1)
+	`
+	profilesQuery := `
+		SELECT d.owner_id, p.email, p.display_name, p.avatar_url, 'owner' as role
+		FROM documents d LEFT JOIN profiles p ON d.owner_id = p.id WHERE d.id = $1
 		UNION ALL
-		SELECT u.id, u.email, c.role FROM collaborators c JOIN auth.users u ON c.user_id = u.id WHERE c.document_id = $1
+		SELECT c.user_id, p.email, p.display_name, p.avatar_url, c.role
+		FROM collaborators c LEFT JOIN profiles p ON c.user_id = p.id
+		WHERE c.document_id = $1 AND c.user_id <> (SELECT owner_id FROM documents WHERE id = $1)
 	`
-	rows, err := r.DB.Query(query, docID)
+	rows, err := r.queryUsers("document members", query, profilesQuery, docID)
 	if err != nil {
 		logger.Sugar.Errorf("Failed to get document members for doc %s: %v", docID, err)
 		return nil, err
 	}
 	defer rows.Close()
 
+	// Each member is listed once. If a user appears twice (e.g. a stray
+	// self-collaborator row for the owner), the owner entry wins.
 	var members []model.CollaboratorInfo
+	seen := make(map[string]int) // user id -> index in members
 	for rows.Next() {
 		var c model.CollaboratorInfo
-		if err := rows.Scan(&c.ID, &c.Name, &c.Role); err == nil {
-			members = append(members, c)
+		var email, name, avatar sql.NullString
+		if err := rows.Scan(&c.ID, &email, &name, &avatar, &c.Role); err != nil {
+			continue
+		}
+		i, dup := seen[c.ID]
+		if dup && c.Role != "owner" {
+			continue
+		}
+		c.Email = email.String
+		c.Name = name.String
+		if c.Name == "" {
+			c.Name = c.Email
+		}
+		c.Avatar = avatar.String // Empty when the user has none, dropped by omitempty
+		if dup {
+			members[i] = c
+			continue
 		}
+		seen[c.ID] = len(members)
+		members = append(members, c)
 	}
 	return members, nil
 }
 
-func (r *DocumentRepository) AddComment(docID, userID, content, quote string, textRange interface{}) (string, time.Time, error) {
+func (r *DocumentRepository) AddComment(docID, userID, content, quote string, textRange interface{}, parentID, visibility string) (string, time.Time, error) {
 	var commentID string
 	var createdAt time.Time
 	err := r.DB.QueryRow(`
-		INSERT INTO comments (document_id, user_id, content, quote, text_range, created_at)
-		VALUES ($1, $2, $3, $4, $5, NOW())
+		INSERT INTO comments (document_id, user_id, content, quote, text_range, parent_id, visibility, created_at)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, '')::uuid, $7, NOW())
 		RETURNING id, created_at`,
-		docID, userID, content, quote, textRange,
+		docID, userID, content, quote, textRange, parentID, visibility,
 	).Scan(&commentID, &createdAt)
 	if err != nil {
 		logger.Sugar.Errorf("Failed to add comment to doc %s: %v", docID, err)
@@ -137,7 +443,7 @@ func (r *DocumentRepository) AddComment(docID, userID, content, quote string, te
 }
 
 func (r *DocumentRepository) GetComments(docID string) ([]model.CommentResponse, error) {
-	rows, err := r.DB.Query("SELECT id, document_id, user_id, content, quote, text_range, created_at, is_resolved FROM comments WHERE document_id = $1 ORDER BY created_at ASC", docID)
+	rows, err := r.DB.Query("SELECT id, document_id, user_id, content, quote, text_range, created_at, is_resolved, parent_id, visibility FROM comments WHERE document_id = $1 ORDER BY created_at ASC", docID)
 	if err != nil {
 		logger.Sugar.Errorf("Failed to get comments for doc %s: %v", docID, err)
 		return nil, err
@@ -147,14 +453,203 @@ func (r *DocumentRepository) GetComments(docID string) ([]model.CommentResponse,
 	var comments []model.CommentResponse
 	for rows.Next() {
 		var c model.CommentResponse
-		if err := rows.Scan(&c.ID, &c.DocID, &c.UserID, &c.Content, &c.Quote, &c.TextRange, &c.CreatedAt, &c.Resolved); err != nil {
+		var parentID sql.NullString
+		if err := rows.Scan(&c.ID, &c.DocID, &c.UserID, &c.Content, &c.Quote, &c.TextRange, &c.CreatedAt, &c.Resolved, &parentID, &c.Visibility); err != nil {
 			continue
 		}
+		c.ParentID = parentID.String
 		comments = append(comments, c)
 	}
 	return comments, nil
 }
 
+func (r *DocumentRepository) GetCommentsForExport(docID string) ([]model.CommentExport, error) {
+	rows, err := r.queryUsers("comment export", `
+		SELECT c.id, COALESCE(u.email, ''), COALESCE(c.quote, ''), c.content, c.is_resolved, c.created_at, c.visibility
+		FROM comments c LEFT JOIN auth.users u ON c.user_id = u.id
+		WHERE c.document_id = $1 ORDER BY c.created_at ASC`, `
+		SELECT c.id, COALESCE(p.email, ''), COALESCE(c.quote, ''), c.content, c.is_resolved, c.created_at, c.visibility
+		FROM comments c LEFT JOIN profiles p ON c.user_id = p.id
+		WHERE c.document_id = $1 ORDER BY c.created_at ASC`, docID)
+	if err != nil {
+		logger.Sugar.Errorf("Failed to get comments for export of doc %s: %v", docID, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	comments := []model.CommentExport{}
+	for rows.Next() {
+		var c model.CommentExport
+		if err := rows.Scan(&c.ID, &c.AuthorEmail, &c.Quote, &c.Content, &c.Resolved, &c.CreatedAt, &c.Visibility); err != nil {
+			continue
+		}
+		comments = append(comments, c)
+	}
+	return comments, rows.Err()
+}
+
+// GetCommentStats counts docID's comments in the database rather than
+// loading them. Reviewer-only comments are left out for a reader's role.
+func (r *DocumentRepository) GetCommentStats(docID, role string) (model.CommentStats, error) {
+	stats := model.CommentStats{ByAuthor: map[string]int{}}
+	err := r.DB.QueryRow(`
+		SELECT
+			COUNT(*),
+			COUNT(*) FILTER (WHERE is_resolved),
+			COUNT(*) FILTER (WHERE created_at > NOW() - INTERVAL '24 hours')
+		FROM comments WHERE document_id = $1 AND ($2 <> 'reader' OR visibility <> 'reviewers')`, docID, role,
+	).Scan(&stats.Total, &stats.Resolved, &stats.Last24h)
+	if err != nil {
+		logger.Sugar.Errorf("Failed to count comments for doc %s: %v", docID, err)
+		return stats, err
+	}
+	stats.Open = stats.Total - stats.Resolved
+
+	rows, err := r.DB.Query(`
+		SELECT user_id, COUNT(*) FROM comments
+		WHERE document_id = $1 AND ($2 <> 'reader' OR visibility <> 'reviewers')
+		GROUP BY user_id`, docID, role)
+	if err != nil {
+		logger.Sugar.Errorf("Failed to count comments by author for doc %s: %v", docID, err)
+		return stats, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userID string
+		var n int
+		if err := rows.Scan(&userID, &n); err != nil {
+			return stats, err
+		}
+		stats.ByAuthor[userID] = n
+	}
+	return stats, rows.Err()
+}
+
+// GetCommentsByUser returns userID's comments, newest first, on documents the
+// user can still access. Comments on documents they were removed from are excluded.
+func (r *DocumentRepository) GetCommentsByUser(userID string, limit, offset int) ([]model.MyComment, error) {
+	rows, err := r.DB.Query(`
+		SELECT c.id, c.document_id, d.title, c.content, COALESCE(c.quote, ''), c.parent_id, c.is_resolved, c.created_at
+		FROM comments c JOIN documents d ON d.id = c.document_id
+		WHERE c.user_id = $1
+		AND (d.owner_id = $1 OR EXISTS (SELECT 1 FROM collaborators co WHERE co.document_id = d.id AND co.user_id = $1))
+		ORDER BY c.created_at DESC, c.id
+		LIMIT $2 OFFSET $3`, userID, limit, offset)
+	if err != nil {
+		logger.Sugar.Errorf("Failed to get comments by user %s: %v", userID, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	comments := []model.MyComment{}
+	for rows.Next() {
+		var c model.MyComment
+		var parentID sql.NullString
+		if err := rows.Scan(&c.ID, &c.DocID, &c.DocumentTitle, &c.Content, &c.Quote, &parentID, &c.Resolved, &c.CreatedAt); err != nil {
+			continue
+		}
+		c.ParentID = parentID.String
+		comments = append(comments, c)
+	}
+	return comments, rows.Err()
+}
+
+// GetCommentVisibility returns who may see commentID. sql.ErrNoRows if it
+// doesn't exist.
+func (r *DocumentRepository) GetCommentVisibility(commentID string) (string, error) {
+	var visibility string
+	err := r.DB.QueryRow("SELECT visibility FROM comments WHERE id = $1", commentID).Scan(&visibility)
+	if err != nil && err != sql.ErrNoRows {
+		logger.Sugar.Errorf("Failed to get visibility of comment %s: %v", commentID, err)
+	}
+	return visibility, err
+}
+
+// GetCommentPath returns the ids of a comment's thread from the root down to
+// commentID, and the comment's document. sql.ErrNoRows if it doesn't exist.
+func (r *DocumentRepository) GetCommentPath(commentID string) (string, []string, error) {
+	rows, err := r.DB.Query(`
+		WITH RECURSIVE chain AS (
+			SELECT id, parent_id, document_id, 0 AS up FROM comments WHERE id = $1
+			UNION ALL
+			SELECT c.id, c.parent_id, c.document_id, chain.up + 1
+			FROM comments c JOIN chain ON c.id = chain.parent_id
+			WHERE chain.up < 100
+		)
+		SELECT id, document_id FROM chain ORDER BY up DESC`, commentID)
+	if err != nil {
+		logger.Sugar.Errorf("Failed to get thread of comment %s: %v", commentID, err)
+		return "", nil, err
+	}
+	defer rows.Close()
+
+	var docID string
+	var path []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id, &docID); err != nil {
+			return "", nil, err
+		}
+		path = append(path, id)
+	}
+	if err := rows.Err(); err != nil {
+		return "", nil, err
+	}
+	if len(path) == 0 {
+		return "", nil, sql.ErrNoRows
+	}
+	return docID, path, nil
+}
+
+func (r *DocumentRepository) GetCommentDocID(commentID string) (string, error) {
+	var docID string
+	err := r.DB.QueryRow("SELECT document_id FROM comments WHERE id = $1", commentID).Scan(&docID)
+	if err != nil && err != sql.ErrNoRows {
+		logger.Sugar.Errorf("Failed to get document for comment %s: %v", commentID, err)
+	}
+	return docID, err
+}
+
+// ReplyAndResolve posts a reply under parentID (commentID, or an ancestor when
+// the thread is at its depth limit) and marks commentID resolved in one transaction.
+func (r *DocumentRepository) ReplyAndResolve(commentID, parentID, docID, userID, content, visibility string) (string, time.Time, error) {
+	var replyID string
+	var createdAt time.Time
+
+	tx, err := r.DB.Begin()
+	if err != nil {
+		logger.Sugar.Errorf("Failed to begin transaction for comment %s: %v", commentID, err)
+		return "", createdAt, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE comments SET is_resolved = TRUE WHERE id = $1 AND document_id = $2", commentID, docID)
+	if err != nil {
+		logger.Sugar.Errorf("Failed to resolve comment %s: %v", commentID, err)
+		return "", createdAt, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return "", createdAt, sql.ErrNoRows
+	}
+
+	err = tx.QueryRow(`
+		INSERT INTO comments (document_id, user_id, content, parent_id, visibility, created_at)
+		VALUES ($1, $2, $3, $4, $5, NOW())
+		RETURNING id, created_at`,
+		docID, userID, content, parentID, visibility,
+	).Scan(&replyID, &createdAt)
+	if err != nil {
+		logger.Sugar.Errorf("Failed to add reply to comment %s: %v", commentID, err)
+		return "", createdAt, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		logger.Sugar.Errorf("Failed to commit reply to comment %s: %v", commentID, err)
+		return "", createdAt, err
+	}
+	return replyID, createdAt, nil
+}
+
 func (r *DocumentRepository) ResolveComment(commentID, userID string) (string, error) {
 	var docID string
 	err := r.DB.QueryRow(`
@@ -192,3 +687,130 @@ func (r *DocumentRepository) CheckAccess(docID, userID string) (bool, error) {
 	}
 	return hasAccess, err
 }
+
+func (r *DocumentRepository) CountDocuments(userID string) (model.DocumentCount, error) {
+	var count model.DocumentCount
+	if err := r.DB.QueryRow("SELECT COUNT(*) FROM documents WHERE owner_id = $1", userID).Scan(&count.Owned); err != nil {
+		logger.Sugar.Errorf("Failed to count owned documents for user %s: %v", userID, err)
+		return count, err
+	}
+	if err := r.DB.QueryRow("SELECT COUNT(*) FROM collaborators WHERE user_id = $1", userID).Scan(&count.Shared); err != nil {
+		logger.Sugar.Errorf("Failed to count shared documents for user %s: %v", userID, err)
+		return count, err
+	}
+	return count, nil
+}
+
+// GetActiveCollaborators returns the distinct collaborators on ownerID's
+// documents, most recently active first (last comment or last open, on any
+// of those documents). Users no longer in the user directory are still
+// listed, without email or name.
+func (r *DocumentRepository) GetActiveCollaborators(ownerID string, limit, offset int) ([]model.ActiveCollaborator, error) {
+	people := `
+		WITH people AS (
+			SELECT c.user_id, COUNT(*) AS documents, MAX(cm.at) AS last_comment_at, MAX(a.last_opened_at) AS last_opened_at
+			FROM collaborators c
+			JOIN documents d ON d.id = c.document_id AND d.owner_id = $1
+			LEFT JOIN LATERAL (
+				SELECT MAX(created_at) AS at FROM comments WHERE document_id = c.document_id AND user_id = c.user_id
+			) cm ON true
+			LEFT JOIN document_access a ON a.document_id = c.document_id AND a.user_id = c.user_id
+			WHERE c.user_id <> $1
+			GROUP BY c.user_id
+		)`
+	order := `
+		ORDER BY GREATEST(p.last_comment_at, p.last_opened_at) DESC NULLS LAST, p.user_id
+		LIMIT $2 OFFSET $3`
+	query := people + `
+		SELECT p.user_id, u.email, COALESCE(u.raw_user_meta_data->>'full_name', u.raw_user_meta_data->>'name'),
+			u.raw_user_meta_data->>'avatar_url', p.documents, p.last_comment_at, p.last_opened_at
+		FROM people p LEFT JOIN auth.users u ON u.id = p.user_id` + order
+	profilesQuery := people + `
+		SELECT p.user_id, pr.email, pr.display_name, pr.avatar_url, p.documents, p.last_comment_at, p.last_opened_at
+		FROM people p LEFT JOIN profiles pr ON pr.id = p.user_id` + order
+
+	rows, err := r.queryUsers("active collaborators", query, profilesQuery, ownerID, limit, offset)
+	if err != nil {
+		logger.Sugar.Errorf("Failed to get active collaborators of user %s: %v", ownerID, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	collaborators := []model.ActiveCollaborator{}
+	for rows.Next() {
+		var c model.ActiveCollaborator
+		var email, name, avatar sql.NullString
+		var commented, opened sql.NullTime
+		if err := rows.Scan(&c.UserID, &email, &name, &avatar, &c.Documents, &commented, &opened); err != nil {
+			return nil, err
+		}
+		c.Email = email.String
+		c.Name = name.String
+		if c.Name == "" {
+			c.Name = c.Email
+		}
+		c.Avatar = avatar.String
+		if commented.Valid {
+			c.LastCommentAt = &commented.Time
+			c.LastActiveAt = c.LastCommentAt
+		}
+		if opened.Valid {
+			c.LastOpenedAt = &opened.Time
+			if c.LastActiveAt == nil || opened.Time.After(*c.LastActiveAt) {
+				c.LastActiveAt = c.LastOpenedAt
+			}
+		}
+		collaborators = append(collaborators, c)
+	}
+	return collaborators, rows.Err()
+}
+
+// GetRecentEditsByOthers returns ownerID's documents whose last saved edit
+// was made by someone other than the owner, most recently edited first.
+func (r *DocumentRepository) GetRecentEditsByOthers(ownerID string, limit, offset int) ([]model.RecentEdit, error) {
+	where := `
+		WHERE d.owner_id = $1 AND d.last_editor_id IS NOT NULL AND d.last_editor_id <> d.owner_id
+		ORDER BY d.last_edited_at DESC, d.id
+		LIMIT $2 OFFSET $3`
+	query := `
+		SELECT d.id, d.title, d.last_editor_id, u.email, d.last_edited_at
+		FROM documents d LEFT JOIN auth.users u ON u.id = d.last_editor_id` + where
+	profilesQuery := `
+		SELECT d.id, d.title, d.last_editor_id, pr.email, d.last_edited_at
+		FROM documents d LEFT JOIN profiles pr ON pr.id = d.last_editor_id` + where
+
+	rows, err := r.queryUsers("recent edits", query, profilesQuery, ownerID, limit, offset)
+	if err != nil {
+		logger.Sugar.Errorf("Failed to get recent edits on documents of user %s: %v", ownerID, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	edits := []model.RecentEdit{}
+	for rows.Next() {
+		var e model.RecentEdit
+		var email sql.NullString
+		if err := rows.Scan(&e.ID, &e.Title, &e.LastEditorID, &email, &e.LastEditedAt); err != nil {
+			return nil, err
+		}
+		e.LastEditorEmail = email.String
+		edits = append(edits, e)
+	}
+	return edits, rows.Err()
+}
+
+func (r *DocumentRepository) GetWorkspaceStats(userID string) (model.WorkspaceStats, error) {
+	var stats model.WorkspaceStats
+	err := r.DB.QueryRow(`
+		SELECT
+			(SELECT COUNT(*) FROM documents WHERE owner_id = $1),
+			(SELECT COUNT(*) FROM collaborators WHERE user_id = $1),
+			(SELECT COUNT(*) FROM comments WHERE user_id = $1),
+			(SELECT COUNT(DISTINCT c.user_id) FROM collaborators c JOIN documents d ON d.id = c.document_id WHERE d.owner_id = $1)`,
+		userID,
+	).Scan(&stats.DocumentsOwned, &stats.DocumentsShared, &stats.CommentsMade, &stats.Collaborators)
+	if err != nil {
+		logger.Sugar.Errorf("Failed to get workspace stats for user %s: %v", userID, err)
+	}
+	return stats, err
+}
@@ -0,0 +1,299 @@
+package repository
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+
+	"satunaskah/internal/document/model"
+	"satunaskah/pkg/logger"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(m *testing.M) {
+	logger.Init()
+	os.Exit(m.Run())
+}
+
+func TestGetDocumentMembersListsOwnerOnce(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	docID := "5d41402a-bc4b-42a7-9f4e-0c8b9d2e1a3f"
+	cols := []string{"id", "email", "name", "avatar", "role"}
+	// A leftover collaborator row for the owner arrives before the owner row.
+	mock.ExpectQuery("FROM documents d LEFT JOIN auth.users").
+		WithArgs(docID).
+		WillReturnRows(sqlmock.NewRows(cols).
+			AddRow("owner-1", "owner@example.com", "Owner", nil, "writer").
+			AddRow("owner-1", "owner@example.com", "Owner", nil, "owner").
+			AddRow("user-2", "two@example.com", nil, "https://example.com/two.png", "reader"))
+
+	members, err := NewDocumentRepository(db).GetDocumentMembers(docID)
+	require.NoError(t, err)
+	require.Len(t, members, 2)
+
+	assert.Equal(t, "owner-1", members[0].ID)
+	assert.Equal(t, "owner", members[0].Role)
+	assert.Equal(t, "Owner", members[0].Name)
+	assert.Empty(t, members[0].Avatar)
+
+	assert.Equal(t, "user-2", members[1].ID)
+	assert.Equal(t, "two@example.com", members[1].Name, "name falls back to email")
+	assert.Equal(t, "https://example.com/two.png", members[1].Avatar)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetCommentStats(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	docID := "5d41402a-bc4b-42a7-9f4e-0c8b9d2e1a3f"
+	mock.ExpectQuery("FILTER").WithArgs(docID, "writer").
+		WillReturnRows(sqlmock.NewRows([]string{"total", "resolved", "recent"}).AddRow(5, 2, 1))
+	mock.ExpectQuery("GROUP BY user_id").WithArgs(docID, "writer").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "count"}).AddRow("user-1", 3).AddRow("user-2", 2))
+
+	stats, err := NewDocumentRepository(db).GetCommentStats(docID, "writer")
+	require.NoError(t, err)
+	assert.Equal(t, 5, stats.Total)
+	assert.Equal(t, 2, stats.Resolved)
+	assert.Equal(t, 3, stats.Open)
+	assert.Equal(t, 1, stats.Last24h)
+	assert.Equal(t, map[string]int{"user-1": 3, "user-2": 2}, stats.ByAuthor)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCommentCountsLeaveReviewerOnlyOutForReaders(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	docID := "5d41402a-bc4b-42a7-9f4e-0c8b9d2e1a3f"
+	hidden := `\$2 <> 'reader' OR visibility <> 'reviewers'`
+	mock.ExpectQuery("FILTER(.|\n)*"+hidden).WithArgs(docID, "reader").
+		WillReturnRows(sqlmock.NewRows([]string{"total", "resolved", "recent"}).AddRow(2, 1, 0))
+	mock.ExpectQuery(hidden+"(.|\n)*GROUP BY user_id").WithArgs(docID, "reader").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "count"}).AddRow("user-1", 2))
+
+	stats, err := NewDocumentRepository(db).GetCommentStats(docID, "reader")
+	require.NoError(t, err)
+	assert.Equal(t, 2, stats.Total)
+	assert.Equal(t, map[string]int{"user-1": 2}, stats.ByAuthor)
+
+	// The document list's unread count applies the same rule per document.
+	mock.ExpectQuery(`cm.visibility <> 'reviewers' OR d.owner_id = \$1 OR NOT EXISTS(.|\n)*rc.role = 'reader'(.|\n)*AS unread_comments`).
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	rows, err := NewDocumentRepository(db).GetDocumentsByUser("user-1")
+	require.NoError(t, err)
+	rows.Close()
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRemoveUserTransfersOrDeletesOwnedDocuments(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, title FROM documents WHERE owner_id").WithArgs("gone").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title"}).AddRow("doc-shared", "Plan").AddRow("doc-solo", "Notes"))
+	mock.ExpectQuery("c.role = 'writer'").WithArgs("doc-shared", "gone").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow("writer-1"))
+	mock.ExpectExec("UPDATE documents SET owner_id").WithArgs("writer-1", "doc-shared", "Plan").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM collaborators WHERE document_id").WithArgs("doc-shared", "writer-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("c.role = 'writer'").WithArgs("doc-solo", "gone").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}))
+	mock.ExpectExec("DELETE FROM documents WHERE id").WithArgs("doc-solo").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	for _, table := range []string{"collaborators", "comments", "document_access", "notifications"} {
+		mock.ExpectExec("DELETE FROM " + table + " WHERE user_id").WithArgs("gone").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+
+	result, err := NewDocumentRepository(db).RemoveUser("gone", false, nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"doc-shared": "writer-1"}, result.Transferred)
+	assert.Equal(t, []string{"doc-solo"}, result.Deleted)
+	assert.Empty(t, result.Retitled)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRemoveUserRetitlesClashingTransfers(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, title FROM documents WHERE owner_id").WithArgs("gone").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title"}).AddRow("doc-1", "Untitled Document"))
+	mock.ExpectQuery("c.role = 'writer'").WithArgs("doc-1", "gone").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow("writer-1"))
+	// The heir's titles are read inside the transaction.
+	mock.ExpectQuery("SELECT title FROM documents WHERE owner_id = \\$1 AND title LIKE").
+		WithArgs("writer-1", "Untitled%", "doc-1").
+		WillReturnRows(sqlmock.NewRows([]string{"title"}).AddRow("Untitled Document"))
+	mock.ExpectExec("UPDATE documents SET owner_id").WithArgs("writer-1", "doc-1", "Untitled Document (2)").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM collaborators WHERE document_id").WithArgs("doc-1", "writer-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	for _, table := range []string{"collaborators", "comments", "document_access", "notifications"} {
+		mock.ExpectExec("DELETE FROM " + table + " WHERE user_id").WithArgs("gone").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+
+	retitle := func(title string, titlesWithPrefix func(string) ([]string, error)) (string, error) {
+		used, err := titlesWithPrefix("Untitled")
+		if err != nil || len(used) == 0 {
+			return title, err
+		}
+		return title + " (2)", nil
+	}
+	result, err := NewDocumentRepository(db).RemoveUser("gone", false, retitle)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"doc-1": "Untitled Document (2)"}, result.Retitled)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetActiveCollaborators(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	commented := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	opened := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	cols := []string{"user_id", "email", "name", "avatar", "documents", "last_comment_at", "last_opened_at"}
+	mock.ExpectQuery("FROM people p LEFT JOIN auth.users").
+		WithArgs("owner-1", 11, 0).
+		WillReturnRows(sqlmock.NewRows(cols).
+			AddRow("user-2", "two@example.com", nil, nil, 3, commented, opened).
+			AddRow("gone", nil, nil, nil, 1, nil, nil))
+
+	people, err := NewDocumentRepository(db).GetActiveCollaborators("owner-1", 11, 0)
+	require.NoError(t, err)
+	require.Len(t, people, 2)
+
+	assert.Equal(t, "two@example.com", people[0].Name)
+	assert.Equal(t, 3, people[0].Documents)
+	assert.Equal(t, commented, *people[0].LastCommentAt)
+	assert.Equal(t, opened, *people[0].LastActiveAt, "the later of comment and open")
+
+	assert.Equal(t, "gone", people[1].UserID, "users missing from the directory are kept")
+	assert.Nil(t, people[1].LastActiveAt)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetRecentEditsByOthers(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	edited := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	mock.ExpectQuery("last_editor_id <> d.owner_id").
+		WithArgs("owner-1", 21, 0).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title", "last_editor_id", "email", "last_edited_at"}).
+			AddRow("doc-1", "Plan", "user-2", "two@example.com", edited).
+			AddRow("doc-2", "Notes", "gone", nil, edited.Add(-time.Hour)))
+
+	edits, err := NewDocumentRepository(db).GetRecentEditsByOthers("owner-1", 21, 0)
+	require.NoError(t, err)
+	require.Len(t, edits, 2)
+
+	assert.Equal(t, "user-2", edits[0].LastEditorID)
+	assert.Equal(t, "two@example.com", edits[0].LastEditorEmail)
+	assert.Equal(t, edited, edits[0].LastEditedAt)
+	assert.Empty(t, edits[1].LastEditorEmail, "editors missing from the directory are kept")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetDocumentOwner(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectQuery("FROM documents d LEFT JOIN auth.users u ON d.owner_id = u.id WHERE d.id = \\$1").
+		WithArgs("doc-1").
+		WillReturnRows(sqlmock.NewRows([]string{"owner_id", "email", "name", "avatar"}).
+			AddRow("owner-1", "owner@example.com", nil, "https://example.com/a.png"))
+	mock.ExpectQuery("FROM documents d LEFT JOIN auth.users u").
+		WithArgs("orphaned").
+		WillReturnRows(sqlmock.NewRows([]string{"owner_id", "email", "name", "avatar"}).AddRow("gone", nil, nil, nil))
+	mock.ExpectQuery("FROM documents d LEFT JOIN auth.users u").
+		WithArgs("missing").
+		WillReturnRows(sqlmock.NewRows([]string{"owner_id", "email", "name", "avatar"}))
+
+	repo := NewDocumentRepository(db)
+	owner, err := repo.GetDocumentOwner("doc-1")
+	require.NoError(t, err)
+	assert.Equal(t, model.DocumentOwner{ID: "owner-1", Name: "owner@example.com", Email: "owner@example.com", Avatar: "https://example.com/a.png"}, owner)
+
+	owner, err = repo.GetDocumentOwner("orphaned")
+	require.NoError(t, err, "an owner missing from the directory is not an error")
+	assert.Equal(t, model.DocumentOwner{ID: "gone"}, owner)
+
+	_, err = repo.GetDocumentOwner("missing")
+	assert.Equal(t, sql.ErrNoRows, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUpdateDetails(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	docID := "5d41402a-bc4b-42a7-9f4e-0c8b9d2e1a3f"
+	title, description, limit := "Plan", "About this", 0
+	repo := NewDocumentRepository(db)
+
+	// A description alone is open to writers; the current title comes back.
+	mock.ExpectQuery("UPDATE documents SET").
+		WithArgs(docID, "writer-1", nil, description, nil, false).
+		WillReturnRows(sqlmock.NewRows([]string{"title"}).AddRow("Old title"))
+	current, err := repo.UpdateDetails(docID, "writer-1", nil, &description, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "Old title", current)
+
+	// The title and the comment limit are the owner's.
+	mock.ExpectQuery("UPDATE documents SET").
+		WithArgs(docID, "writer-1", nil, nil, limit, true).
+		WillReturnError(sql.ErrNoRows)
+	_, err = repo.UpdateDetails(docID, "writer-1", nil, nil, &limit)
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	mock.ExpectQuery("UPDATE documents SET").
+		WithArgs(docID, "owner-1", title, description, limit, true).
+		WillReturnError(&pq.Error{Code: "23505", Constraint: "documents_owner_title_key"})
+	_, err = repo.UpdateDetails(docID, "owner-1", &title, &description, &limit)
+	assert.ErrorIs(t, err, ErrTitleTaken)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetDocumentsChangedSince(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	now := time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)
+	since := now.Add(-time.Hour)
+	mock.ExpectQuery("SELECT NOW\\(\\)").WillReturnRows(sqlmock.NewRows([]string{"now"}).AddRow(now))
+	mock.ExpectQuery("AND d.updated_at > \\$2").WithArgs("user-1", since).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	rows, serverTime, err := NewDocumentRepository(db).GetDocumentsChangedSince("user-1", since)
+	require.NoError(t, err)
+	rows.Close()
+	assert.Equal(t, now, serverTime, "the next since is the database's time, read before listing")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
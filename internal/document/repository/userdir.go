@@ -0,0 +1,42 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"satunaskah/pkg/apperr"
+	"satunaskah/pkg/logger"
+
+	"github.com/lib/pq"
+)
+
+// ErrUserDirectoryUnavailable means neither auth.users nor the profiles table
+// could be read, so emails and members cannot be resolved.
+var ErrUserDirectoryUnavailable = apperr.New(http.StatusServiceUnavailable, "user_directory_unavailable", "User directory unavailable")
+
+// isPermissionDenied reports whether err is Postgres insufficient_privilege.
+func isPermissionDenied(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "42501"
+}
+
+// queryUsers runs authQuery against auth.users, falling back to profilesQuery
+// once the database refuses access to the auth schema. After the first
+// refusal, auth.users is no longer tried.
+func (r *DocumentRepository) queryUsers(what, authQuery, profilesQuery string, args ...interface{}) (*sql.Rows, error) {
+	if !r.authUsersDenied.Load() {
+		rows, err := r.DB.Query(authQuery, args...)
+		if !isPermissionDenied(err) {
+			return rows, err
+		}
+		r.authUsersDenied.Store(true)
+		logger.Sugar.Warnf("No SELECT permission on auth.users (%v); reading users from profiles instead", err)
+	}
+
+	rows, err := r.DB.Query(profilesQuery, args...)
+	if isPermissionDenied(err) {
+		logger.Sugar.Errorf("Cannot read users for %s: no access to auth.users or profiles: %v", what, err)
+		return nil, ErrUserDirectoryUnavailable.Wrap(err)
+	}
+	return rows, err
+}
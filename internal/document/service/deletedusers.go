@@ -0,0 +1,81 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"satunaskah/internal/document/model"
+	"satunaskah/internal/document/repository"
+	"satunaskah/pkg/logger"
+	"satunaskah/socket"
+	"time"
+)
+
+// CleanupDeletedUser removes a deleted Supabase user's data: their documents
+// are handed to another writer or deleted (see DeleteOrphanedDocs), and their
+// collaborator and comment rows are removed. Open rooms are updated to match
+// and any sockets the user still has are closed.
+func (s *DocumentService) CleanupDeletedUser(userID string) (*model.UserCleanup, error) {
+	result, err := s.Repo.RemoveUser(userID, s.DeleteOrphanedDocs, s.transferTitle())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, docID := range result.Deleted {
+		s.Hub.RemoveDocument(docID)
+	}
+	for docID, ownerID := range result.Transferred {
+		s.Hub.SetOwner(docID, ownerID)
+	}
+	for docID, title := range result.Retitled {
+		payload, _ := json.Marshal(socket.MetadataPayload{Title: title})
+		s.Hub.Broadcast <- socket.WSMessage{Type: socket.MetadataType, DocID: docID, Payload: payload}
+	}
+	s.Hub.DisconnectUser("", userID, socket.CloseAccountDeleted, "account deleted")
+
+	logger.Sugar.Infof("Service: Cleaned up deleted user %s (%d documents transferred, %d deleted)",
+		userID, len(result.Transferred), len(result.Deleted))
+	return result, nil
+}
+
+// ReconcileDeletedUsers cleans up every user that still has rows here but no
+// longer exists in auth.users, and returns how many it cleaned up.
+func (s *DocumentService) ReconcileDeletedUsers() (int, error) {
+	ids, err := s.Repo.FindDeletedUsers()
+	if err != nil {
+		return 0, err
+	}
+	cleaned := 0
+	for _, id := range ids {
+		if _, err := s.CleanupDeletedUser(id); err != nil {
+			return cleaned, err
+		}
+		cleaned++
+	}
+	return cleaned, nil
+}
+
+// DeletedUserWorker runs ReconcileDeletedUsers every DeletedUserInterval. It
+// stops for good when auth.users cannot be read, since deleted users cannot
+// be told apart from users who never signed in.
+func (s *DocumentService) DeletedUserWorker() {
+	if s.DeletedUserInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.DeletedUserInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n, err := s.ReconcileDeletedUsers()
+		if errors.Is(err, repository.ErrUserDirectoryUnavailable) {
+			logger.Sugar.Warnf("Deleted user cleanup disabled: %v", err)
+			return
+		}
+		if err != nil {
+			logger.Sugar.Errorf("Deleted user cleanup failed after %d users: %v", n, err)
+			continue
+		}
+		if n > 0 {
+			logger.Sugar.Infof("Cleaned up %d deleted users", n)
+		}
+	}
+}
@@ -1,58 +1,250 @@
 package service
 
 import (
-	"crypto/rand"
+	"archive/zip"
+	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"satunaskah/internal/document/model"
 	"satunaskah/internal/document/repository"
+	"satunaskah/pkg/apperr"
+	"satunaskah/pkg/delta"
+	"satunaskah/pkg/docid"
+	"satunaskah/pkg/env"
+	"satunaskah/pkg/export"
 	"satunaskah/pkg/logger"
 	"satunaskah/socket"
 	"strings"
+	"time"
 )
 
+// MaxBulkExportDocs caps how many documents a single bulk export may include.
+const MaxBulkExportDocs = 100
+
+// Page sizes for GET /api/me/comments.
+const (
+	DefaultCommentsPageSize = 50
+	MaxCommentsPageSize     = 100
+)
+
+// Page sizes for GET /api/me/collaborators.
+const (
+	DefaultCollaboratorsPageSize = 50
+	MaxCollaboratorsPageSize     = 100
+)
+
+// Page sizes for GET /api/documents/recent.
+const (
+	DefaultRecentEditsPageSize = 20
+	MaxRecentEditsPageSize     = 100
+)
+
+// ChangedSinceOverlap is how far server_time trails the database clock in
+// GET /api/documents?since. updated_at is the writing transaction's start time,
+// so a save that started before the list was read but commits after it
+// carries an updated_at older than the read; the overlap lets the next call
+// still find it, at the cost of returning recent changes twice.
+const ChangedSinceOverlap = 10 * time.Second
+
+// DocumentLinkPath is the frontend route of a document, formatted with its id.
+const DocumentLinkPath = "/documents/%s"
+
+// ErrLockConflict means the caller does not hold the document's edit lock.
+var ErrLockConflict = apperr.New(http.StatusConflict, "lock_conflict", "edit lock conflict")
+
+// ErrNoAccess means the caller is neither the owner nor a collaborator, or
+// the document doesn't exist; the two are not told apart.
+var ErrNoAccess = apperr.New(http.StatusForbidden, "no_access", "Unauthorized or document not found")
+
+// ErrForbidden means the caller can access the document but their role does
+// not allow the action.
+var ErrForbidden = apperr.New(http.StatusForbidden, "forbidden", "unauthorized")
+
+// ErrUserNotFound means no user has the email an invite was sent to.
+var ErrUserNotFound = apperr.New(http.StatusNotFound, "user_not_found", "user not found with that email")
+
+// RoleOwner is reported by GetMyRole for the document owner, who otherwise
+// acts as a writer.
+const RoleOwner = "owner"
+
+// MaxBatchDocs caps how many ids one batch metadata request may ask for.
+const MaxBatchDocs = 100
+
 type DocumentService struct {
 	Repo *repository.DocumentRepository
 	Hub  *socket.Hub
+	// EscapeCommentHTML HTML-escapes comment text before it is stored.
+	EscapeCommentHTML bool
+	// MaxContentBytes bounds stored document content on every write path.
+	MaxContentBytes int
+	// MaxContentChars bounds the characters in stored documents, counted as
+	// the user sees them rather than in bytes.
+	MaxContentChars int
+	// PDF renders PDF exports from their HTML export.
+	PDF export.PDFRenderer
+	// DeleteOrphanedDocs deletes a deleted user's documents instead of handing
+	// them to a remaining writer.
+	DeleteOrphanedDocs bool
+	// DeletedUserInterval is how often DeletedUserWorker looks for deleted
+	// users; zero disables it.
+	DeletedUserInterval time.Duration
+	// UniqueTitles is one of the UniqueTitles* modes; off allows duplicates.
+	UniqueTitles string
+	// MaxCommentsPerDoc caps comments on documents without their own limit;
+	// zero means no cap.
+	MaxCommentsPerDoc int
+
+	idempotency *idempotencyCache
 }
 
 func NewDocumentService(repo *repository.DocumentRepository, hub *socket.Hub) *DocumentService {
-	return &DocumentService{Repo: repo, Hub: hub}
+	return &DocumentService{
+		Repo:              repo,
+		Hub:               hub,
+		EscapeCommentHTML: env.Bool("COMMENT_ESCAPE_HTML", false),
+		MaxContentBytes:   env.Int("DOC_MAX_CONTENT_BYTES", 2<<20),
+		MaxContentChars:   env.Int("DOC_MAX_CONTENT_CHARS", 50000),
+		PDF: export.NewLimitedPDF(
+			export.Wkhtmltopdf{Path: env.String("WKHTMLTOPDF_PATH", "wkhtmltopdf")},
+			env.Int("PDF_MAX_CONCURRENT", 2),
+			env.Duration("PDF_RENDER_TIMEOUT", 30*time.Second),
+		),
+		DeleteOrphanedDocs:  env.String("DELETED_USER_DOCS", "transfer") == "delete",
+		DeletedUserInterval: env.Duration("DELETED_USER_RECONCILE_INTERVAL", time.Hour),
+		UniqueTitles:        env.String("UNIQUE_TITLES", UniqueTitlesOff),
+		MaxCommentsPerDoc:   env.Int("MAX_COMMENTS_PER_DOC", 2000),
+		idempotency:         newIdempotencyCache(),
+	}
+}
+
+// CreateDocument creates a document, seeded with req.Content when given and
+// empty otherwise. When idempotencyKey is set, repeated calls with the same key
+// from the same user return the first document's id.
+func (s *DocumentService) CreateDocument(userID string, req model.CreateDocRequest, idempotencyKey string) (string, error) {
+	content := delta.Empty
+	if len(req.Content) > 0 && string(req.Content) != "null" {
+		if err := s.validateContent(req.Content); err != nil {
+			return "", err
+		}
+		content = string(req.Content)
+	}
+
+	if idempotencyKey == "" {
+		return s.createDocument(userID, req.Title, content)
+	}
+	return s.idempotency.Do(userID+":"+idempotencyKey, func() (string, error) {
+		return s.createDocument(userID, req.Title, content)
+	})
 }
 
-func (s *DocumentService) CreateDocument(userID, title string) (string, error) {
-	docID := generateDocID()
-	if docID == "" {
-		logger.Sugar.Error("Service: Failed to generate document ID")
-		return "", errors.New("failed to generate document ID")
+// ImportDocument converts Markdown or HTML into a Quill delta and creates a new
+// document owned by userID with that content.
+func (s *DocumentService) ImportDocument(userID string, req model.ImportDocRequest) (string, error) {
+	var d delta.Delta
+	switch req.Format {
+	case "", export.FormatMarkdown:
+		d = export.MarkdownToDelta(req.Content)
+	case export.FormatHTML:
+		d = export.HTMLToDelta(req.Content)
+	default:
+		return "", validationError("unsupported import format: %s", req.Format)
+	}
+
+	content, err := json.Marshal(d)
+	if err != nil {
+		logger.Sugar.Errorf("Service: Failed to encode imported content: %v", err)
+		return "", apperr.Internal(err, "failed to encode imported content")
+	}
+	// The converted document is held to the same limits as one sent as a delta.
+	if err := s.validateContent(content); err != nil {
+		return "", err
 	}
+	return s.createDocument(userID, req.Title, string(content))
+}
+
+// createAttempts bounds how many fresh ids, or numbered titles, createDocument
+// tries when one is already taken.
+const createAttempts = 3
+
+func (s *DocumentService) createDocument(userID, title, content string) (string, error) {
+	// New documents may leave the title out; renames may not.
+	title, ok := socket.CleanTitle(title)
 	if title == "" {
 		title = "Untitled Document"
+	} else if !ok {
+		return "", validationError("title exceeds %d characters", socket.MaxTitleLength)
 	}
-	err := s.Repo.Create(docID, `{"ops":[]}`, userID, title)
-	if err != nil {
-		logger.Sugar.Errorf("Service: Failed to create document for user %s: %v", userID, err)
-	} else {
+	for attempt := 1; attempt <= createAttempts; attempt++ {
+		docTitle, err := s.uniqueTitle(userID, "", title)
+		if err != nil {
+			return "", err
+		}
+		docID := docid.New()
+		if docID == "" {
+			logger.Sugar.Error("Service: Failed to generate document ID")
+			return "", apperr.Internal(errors.New("empty id"), "failed to generate document ID")
+		}
+		err = s.Repo.Create(docID, content, userID, docTitle)
+		if errors.Is(err, repository.ErrDocumentIDTaken) {
+			logger.Sugar.Warnf("Service: Generated id %s collided (attempt %d/%d), retrying", docID, attempt, createAttempts)
+			continue
+		}
+		if errors.Is(err, repository.ErrTitleTaken) {
+			if s.UniqueTitles != UniqueTitlesNumber {
+				return "", ErrTitleTaken
+			}
+			// A concurrent create took the numbered title; pick the next.
+			logger.Sugar.Warnf("Service: Title %q was taken meanwhile (attempt %d/%d), retrying", docTitle, attempt, createAttempts)
+			continue
+		}
+		if err != nil {
+			logger.Sugar.Errorf("Service: Failed to create document for user %s: %v", userID, err)
+			return "", apperr.Internal(err, "failed to create document")
+		}
 		logger.Sugar.Infof("Service: Document created %s by %s", docID, userID)
+		return docID, nil
 	}
-	return docID, err
+	logger.Sugar.Errorf("Service: Failed to create document for user %s: no free id or title after %d attempts", userID, createAttempts)
+	return "", apperr.Internal(fmt.Errorf("no unused id or title after %d attempts", createAttempts), "failed to create document")
 }
 
-func (s *DocumentService) SaveDocument(userID string, req model.SaveDocRequest) error {
+// SaveDocument stores req.Content and sends it to the open room. It reports
+// false, without writing, when the content is what was last saved or what an
+// identical save still in flight is writing.
+func (s *DocumentService) SaveDocument(userID string, req model.SaveDocRequest) (bool, error) {
+	if err := s.validateContent(req.Content); err != nil {
+		return false, err
+	}
+
 	// Permission Check
 	role, err := s.getUserRole(req.DocID, userID)
 	if err != nil {
-		return err
+		return false, err
 	}
-	if role != "writer" {
+	if !socket.CanPerform(role, socket.UpdateType) {
 		logger.Sugar.Warnf("Service: User %s tried to save doc %s without writer role", userID, req.DocID)
-		return errors.New("unauthorized: only writers can save")
+		return false, ErrForbidden.Withf("only writers can save")
+	}
+
+	// REST saves overwrite the whole document, so only the edit lock holder may save.
+	if !s.Hub.CheckEditLock(req.DocID, userID, req.LockToken) {
+		return false, ErrLockConflict.Withf("acquire the edit lock before saving")
+	}
+
+	// Chatty autosaves often resend the same content.
+	claimed, undo := s.Hub.ClaimSave(req.DocID, req.Content)
+	if !claimed {
+		return false, nil
 	}
 
 	// Update DB
-	if err := s.Repo.UpdateContent(req.DocID, string(req.Content)); err != nil {
-		return err
+	if err := s.Repo.UpdateContent(req.DocID, string(req.Content), userID); err != nil {
+		undo()
+		return false, apperr.Internal(err, "failed to save doc %s", req.DocID)
 	}
 
 	// Broadcast
@@ -62,74 +254,309 @@ func (s *DocumentService) SaveDocument(userID string, req model.SaveDocRequest)
 		UserID:  userID,
 		Payload: req.Content,
 	}
+	return true, nil
+}
+
+// AppendContent adds req.Content to the end of the document server-side, so
+// integrations don't have to fetch, modify and save over live edits. It needs
+// writer access and is refused while another user holds the edit lock, whose
+// next full save would drop it. The appended delta must be inserts only, and
+// the combined document must stay within the content limits.
+func (s *DocumentService) AppendContent(userID string, req model.AppendDocRequest) error {
+	addition, err := delta.Parse(req.Content)
+	if err != nil {
+		return validationError("content must be a Quill delta")
+	}
+	if err := addition.Validate(); err != nil {
+		return validationError("%v", err)
+	}
+	if len(addition.Ops) == 0 {
+		return validationError("content to append cannot be empty")
+	}
+
+	role, err := s.getUserRole(req.DocID, userID)
+	if err != nil {
+		return err
+	}
+	if !socket.CanPerform(role, socket.UpdateType) {
+		logger.Sugar.Warnf("Service: User %s tried to append to doc %s without writer role", userID, req.DocID)
+		return ErrNoAccess
+	}
+	if holder := s.Hub.EditLockHolder(req.DocID); holder != "" && holder != userID {
+		return ErrLockConflict.Withf("another user holds the edit lock")
+	}
+
+	_, err = s.Hub.Append(req.DocID, userID, addition, func(content []byte) error {
+		return s.validateContent(content)
+	})
+	return apperr.Internal(err, "failed to append to doc %s", req.DocID)
+}
+
+// AcquireEditLock grants a writer the advisory edit lock used by REST saves.
+func (s *DocumentService) AcquireEditLock(userID, docID string) (*model.EditLockResponse, error) {
+	role, err := s.getUserRole(docID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !socket.CanPerform(role, socket.UpdateType) {
+		logger.Sugar.Warnf("Service: User %s tried to lock doc %s without writer role", userID, docID)
+		return nil, ErrForbidden.Withf("only writers can lock")
+	}
+
+	token, expiresAt, err := s.Hub.AcquireEditLock(docID, userID)
+	if errors.Is(err, socket.ErrEditLocked) {
+		return nil, ErrLockConflict.Withf("%v", err)
+	}
+	if err != nil {
+		return nil, apperr.Internal(err, "failed to lock doc %s", docID)
+	}
+	return &model.EditLockResponse{LockToken: token, ExpiresAt: expiresAt}, nil
+}
+
+// ReleaseEditLock drops the edit lock if the token still holds it.
+func (s *DocumentService) ReleaseEditLock(docID, token string) error {
+	if !s.Hub.ReleaseEditLock(docID, token) {
+		return ErrLockConflict.Withf("lock token is not current")
+	}
 	return nil
 }
 
 func (s *DocumentService) DeleteDocument(docID, userID string) error {
 	ownerID, err := s.Repo.GetOwnerID(docID)
+	if err == sql.ErrNoRows {
+		return ErrNoAccess
+	}
 	if err != nil {
-		return err
+		return apperr.Internal(err, "failed to look up owner of doc %s", docID)
 	}
 	if ownerID != userID {
 		logger.Sugar.Warnf("Service: User %s tried to delete doc %s owned by %s", userID, docID, ownerID)
-		return errors.New("unauthorized: only owner can delete")
+		return ErrForbidden.Withf("only owner can delete")
 	}
 
 	if err := s.Repo.Delete(docID); err != nil {
-		return err
+		return apperr.Internal(err, "failed to delete doc %s", docID)
 	}
 	logger.Sugar.Infof("Service: Document %s deleted by %s", docID, userID)
 	s.Hub.RemoveDocument(docID)
 	return nil
 }
 
-func (s *DocumentService) UpdateTitle(docID, userID, title string) error {
-	rowsAffected, err := s.Repo.UpdateTitle(docID, title, userID)
+// DeleteDocuments deletes the listed documents userID owns and reports a
+// result per distinct id. Documents owned by others are left alone.
+func (s *DocumentService) DeleteDocuments(userID string, ids []string) ([]model.BulkDeleteResult, error) {
+	unique := make([]string, 0, len(ids))
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+
+	owners, err := s.Repo.DeleteOwned(userID, unique)
 	if err != nil {
-		return err
+		return nil, apperr.Internal(err, "failed to delete %d documents", len(unique))
 	}
-	if rowsAffected == 0 {
-		return errors.New("document not found or unauthorized")
+
+	results := make([]model.BulkDeleteResult, 0, len(unique))
+	for _, id := range unique {
+		owner, found := owners[id]
+		switch {
+		case !found:
+			results = append(results, model.BulkDeleteResult{ID: id, Status: "not_found"})
+		case owner != userID:
+			logger.Sugar.Warnf("Service: User %s tried to bulk delete doc %s owned by %s", userID, id, owner)
+			results = append(results, model.BulkDeleteResult{ID: id, Status: "forbidden"})
+		default:
+			s.Hub.RemoveDocument(id)
+			results = append(results, model.BulkDeleteResult{ID: id, Status: "deleted"})
+		}
+	}
+	logger.Sugar.Infof("Service: Bulk delete by %s processed %d documents", userID, len(results))
+	return results, nil
+}
+
+// UpdateDocument applies req's changes to docID together or not at all.
+// Every field is checked before anything is written. The owner may change
+// all of them, writers only the description. A comment limit replaces
+// MaxCommentsPerDoc for docID; 0 clears it.
+func (s *DocumentService) UpdateDocument(docID, userID string, req model.UpdateDocRequest) error {
+	var requested, description *string
+	if req.Title != "" {
+		title, err := sanitizeTitle(req.Title)
+		if err != nil {
+			return err
+		}
+		requested = &title
+	}
+	if req.Description != nil {
+		cleaned, err := sanitizeDescription(*req.Description)
+		if err != nil {
+			return err
+		}
+		description = &cleaned
+	}
+	if limit := req.CommentLimit; limit != nil && (*limit < 0 || *limit > MaxCommentLimit) {
+		return validationError("comment_limit must be 0-%d", MaxCommentLimit)
+	}
+
+	var title *string
+	var current string
+	var err error
+	for attempt := 1; ; attempt++ {
+		if requested != nil {
+			chosen, err := s.uniqueTitle(userID, docID, *requested)
+			if err != nil {
+				return err
+			}
+			title = &chosen
+		}
+		current, err = s.Repo.UpdateDetails(docID, userID, title, description, req.CommentLimit)
+		if errors.Is(err, repository.ErrTitleTaken) && s.UniqueTitles == UniqueTitlesNumber && attempt < createAttempts {
+			continue // Taken by a concurrent write; pick the next number
+		}
+		break
+	}
+	if errors.Is(err, repository.ErrTitleTaken) {
+		return ErrTitleTaken
+	}
+	if err == sql.ErrNoRows {
+		return ErrNoAccess
+	}
+	if err != nil {
+		return apperr.Internal(err, "failed to update doc %s", docID)
+	}
+	if title == nil && description == nil {
+		return nil // Editors don't show the comment limit
+	}
+
+	// Let open editors show the new details. An empty UserID reaches every
+	// client, including the editing user's other tabs.
+	payload, _ := json.Marshal(socket.MetadataPayload{Title: current, Description: description})
+	s.Hub.Broadcast <- socket.WSMessage{
+		Type:    socket.MetadataType,
+		DocID:   docID,
+		Payload: payload,
 	}
 	return nil
 }
 
 func (s *DocumentService) InviteCollaborator(userID string, req model.InviteRequest) error {
 	ownerID, err := s.Repo.GetOwnerID(req.DocID)
+	if err == sql.ErrNoRows {
+		return ErrNoAccess
+	}
 	if err != nil {
-		return err
+		return apperr.Internal(err, "failed to look up owner of doc %s", req.DocID)
 	}
 	if ownerID != userID {
 		logger.Sugar.Warnf("Service: User %s tried to invite to doc %s without ownership", userID, req.DocID)
-		return errors.New("unauthorized: only owner can invite")
+		return ErrForbidden.Withf("only owner can invite")
 	}
 
 	targetUserID, err := s.Repo.GetUserByEmail(req.Email)
+	if errors.Is(err, repository.ErrUserDirectoryUnavailable) {
+		return err
+	}
 	if err != nil {
 		logger.Sugar.Warnf("Service: Invite failed, user email %s not found", req.Email)
-		return errors.New("user not found with that email")
+		return ErrUserNotFound.Wrap(err)
+	}
+	if targetUserID == ownerID {
+		return validationError("the owner cannot be added as a collaborator")
 	}
 
-	return s.Repo.AddCollaborator(req.DocID, targetUserID, req.Role)
+	if err := s.Repo.AddCollaborator(req.DocID, targetUserID, req.Role); err != nil {
+		return apperr.Internal(err, "failed to add collaborator to doc %s", req.DocID)
+	}
+	s.Hub.NotifyDashboard(targetUserID, req.DocID, socket.DashboardInvited)
+	return nil
+}
+
+// KickUser disconnects targetID from docID's room and, when req.Remove is
+// set, revokes their access first so they cannot rejoin. Only the owner may
+// kick, and the owner cannot be kicked.
+func (s *DocumentService) KickUser(userID string, req model.KickRequest) (*model.KickResponse, error) {
+	ownerID, err := s.Repo.GetOwnerID(req.DocID)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoAccess
+	}
+	if err != nil {
+		return nil, apperr.Internal(err, "failed to look up owner of doc %s", req.DocID)
+	}
+	if ownerID != userID {
+		logger.Sugar.Warnf("Service: User %s tried to kick from doc %s without ownership", userID, req.DocID)
+		return nil, ErrNoAccess
+	}
+	if req.UserID == ownerID {
+		return nil, validationError("the owner cannot be removed from their document")
+	}
+
+	if req.Remove {
+		if err := s.Repo.RemoveCollaborator(req.DocID, req.UserID); err != nil {
+			return nil, apperr.Internal(err, "failed to remove %s from doc %s", req.UserID, req.DocID)
+		}
+	}
+	n := s.Hub.DisconnectUser(req.DocID, req.UserID, socket.CloseRemovedByOwner, "removed by owner")
+	logger.Sugar.Infof("Service: User %s kicked from doc %s by owner (%d connections, removed=%t)", req.UserID, req.DocID, n, req.Remove)
+	return &model.KickResponse{Disconnected: n, Removed: req.Remove}, nil
 }
 
 func (s *DocumentService) GetDocuments(userID string) ([]model.DocumentMetadata, error) {
 	rows, err := s.Repo.GetDocumentsByUser(userID)
 	if err != nil {
-		return nil, err
+		return nil, apperr.Internal(err, "failed to list documents")
 	}
+	return s.scanDocuments(rows, userID), nil
+}
+
+// GetDocumentsChangedSince returns the user's documents updated after since,
+// and the time to pass as since on the next call, ChangedSinceOverlap before
+// the database's time.
+func (s *DocumentService) GetDocumentsChangedSince(userID string, since time.Time) (*model.DocumentChanges, error) {
+	rows, now, err := s.Repo.GetDocumentsChangedSince(userID, since)
+	if err != nil {
+		return nil, apperr.Internal(err, "failed to list changed documents")
+	}
+	return &model.DocumentChanges{Documents: s.scanDocuments(rows, userID), ServerTime: now.Add(-ChangedSinceOverlap)}, nil
+}
+
+// GetDocumentsBatch returns metadata for the ids the user can access, in one
+// query. Inaccessible or unknown ids are omitted.
+func (s *DocumentService) GetDocumentsBatch(userID string, ids []string) ([]model.DocumentMetadata, error) {
+	rows, err := s.Repo.GetDocumentsByIDs(userID, ids)
+	if err != nil {
+		return nil, apperr.Internal(err, "failed to list documents")
+	}
+	docs := s.scanDocuments(rows, userID)
+	if docs == nil {
+		docs = []model.DocumentMetadata{}
+	}
+	return docs, nil
+}
+
+// scanDocuments reads documentMetadataSelect rows and closes them.
+func (s *DocumentService) scanDocuments(rows *sql.Rows, userID string) []model.DocumentMetadata {
 	defer rows.Close()
 
 	var docs []model.DocumentMetadata
 	for rows.Next() {
 		var doc model.DocumentMetadata
-		var content string
 		var ownerID string
-		if err := rows.Scan(&doc.ID, &doc.Title, &doc.UpdatedAt, &content, &ownerID); err != nil {
+		var preview []byte
+		var editorID sql.NullString
+		var editedAt sql.NullTime
+		if err := rows.Scan(&doc.ID, &doc.Title, &doc.Description, &doc.UpdatedAt, &ownerID, &preview, &editorID, &editedAt, &doc.UnreadComments, &doc.HasUpdates); err != nil {
 			continue
 		}
 		doc.IsOwner = (ownerID == userID)
-		doc.Snippet = getSnippetFromContent(content)
+		// Previews, snippet included, are stored on save, so the list never
+		// loads content; documents not saved since show an empty one.
+		if preview != nil {
+			json.Unmarshal(preview, &doc.Preview)
+		}
+		doc.Snippet, doc.Preview.Snippet = doc.Preview.Snippet, ""
 
 		// Fetch collaborators
 		members, _ := s.Repo.GetDocumentMembers(doc.ID)
@@ -137,19 +564,107 @@ func (s *DocumentService) GetDocuments(userID string) ([]model.DocumentMetadata,
 		if doc.Collab == nil {
 			doc.Collab = []model.CollaboratorInfo{}
 		}
+		doc.LastEditorID = editorID.String
+		if editedAt.Valid {
+			doc.LastEditedAt = &editedAt.Time
+		}
+		for _, m := range doc.Collab {
+			if m.ID == doc.LastEditorID {
+				doc.LastEditorEmail = m.Email
+				break
+			}
+		}
 		docs = append(docs, doc)
 	}
-	return docs, nil
+	return docs
+}
+
+// GetMyComments returns one page of the user's comments across documents.
+func (s *DocumentService) GetMyComments(userID string, limit, offset int) (*model.MyCommentsPage, error) {
+	// Fetch one extra row to learn whether another page follows.
+	comments, err := s.Repo.GetCommentsByUser(userID, limit+1, offset)
+	if err != nil {
+		return nil, apperr.Internal(err, "failed to list comments")
+	}
+	page := &model.MyCommentsPage{Comments: comments}
+	if len(comments) > limit {
+		page.Comments = comments[:limit]
+		next := offset + limit
+		page.NextOffset = &next
+	}
+	for i := range page.Comments {
+		page.Comments[i].Link = fmt.Sprintf(DocumentLinkPath, page.Comments[i].DocID)
+	}
+	return page, nil
+}
+
+// GetMyCollaborators returns one page of the people on userID's documents,
+// most recently active first.
+func (s *DocumentService) GetMyCollaborators(userID string, limit, offset int) (*model.ActiveCollaboratorsPage, error) {
+	// Fetch one extra row to learn whether another page follows.
+	people, err := s.Repo.GetActiveCollaborators(userID, limit+1, offset)
+	if err != nil {
+		return nil, apperr.Internal(err, "failed to list collaborators")
+	}
+	page := &model.ActiveCollaboratorsPage{Collaborators: people}
+	if len(people) > limit {
+		page.Collaborators = people[:limit]
+		next := offset + limit
+		page.NextOffset = &next
+	}
+	return page, nil
+}
+
+// GetRecentEdits returns one page of userID's documents last edited by a
+// collaborator, most recent first.
+func (s *DocumentService) GetRecentEdits(userID string, limit, offset int) (*model.RecentEditsPage, error) {
+	// Fetch one extra row to learn whether another page follows.
+	edits, err := s.Repo.GetRecentEditsByOthers(userID, limit+1, offset)
+	if err != nil {
+		return nil, apperr.Internal(err, "failed to list recent edits")
+	}
+	page := &model.RecentEditsPage{Documents: edits}
+	if len(edits) > limit {
+		page.Documents = edits[:limit]
+		next := offset + limit
+		page.NextOffset = &next
+	}
+	for i := range page.Documents {
+		page.Documents[i].Link = fmt.Sprintf(DocumentLinkPath, page.Documents[i].ID)
+	}
+	return page, nil
 }
 
 func (s *DocumentService) AddComment(userID string, req model.CommentRequest) (*model.CommentResponse, error) {
+	if err := s.sanitizeComment(&req); err != nil {
+		return nil, err
+	}
+
 	role, err := s.getUserRole(req.DocID, userID)
 	if err != nil {
 		return nil, err
 	}
-	if role != "writer" && role != "reviewer" {
+	if !socket.CanPerform(role, socket.CommentType) {
 		logger.Sugar.Warnf("Service: User %s tried to comment on doc %s without permission", userID, req.DocID)
-		return nil, errors.New("unauthorized")
+		return nil, ErrForbidden.Withf("your role cannot comment")
+	}
+
+	if err := s.validateTextRange(req.DocID, req.TextRange); err != nil {
+		return nil, err
+	}
+	if err := s.checkCommentQuota(req.DocID); err != nil {
+		return nil, err
+	}
+
+	parentID, err := s.resolveParent(req.DocID, req.ParentID)
+	if err != nil {
+		return nil, err
+	}
+	req.ParentID = parentID
+	if parentID != "" {
+		if req.Visibility, err = s.threadVisibility(parentID); err != nil {
+			return nil, err
+		}
 	}
 
 	var textRange interface{}
@@ -157,9 +672,9 @@ func (s *DocumentService) AddComment(userID string, req model.CommentRequest) (*
 		textRange = string(req.TextRange)
 	}
 
-	commentID, createdAt, err := s.Repo.AddComment(req.DocID, userID, req.Content, req.Quote, textRange)
+	commentID, createdAt, err := s.Repo.AddComment(req.DocID, userID, req.Content, req.Quote, textRange, req.ParentID, req.Visibility)
 	if err != nil {
-		return nil, err
+		return nil, apperr.Internal(err, "failed to add comment to doc %s", req.DocID)
 	}
 
 	resp := &model.CommentResponse{
@@ -182,70 +697,415 @@ func (s *DocumentService) AddComment(userID string, req model.CommentRequest) (*
 
 func (s *DocumentService) ResolveComment(commentID, userID string) error {
 	docID, err := s.Repo.ResolveComment(commentID, userID)
+	if err == sql.ErrNoRows {
+		return ErrForbidden.Withf("comment not found or not yours to resolve")
+	}
 	if err != nil {
-		return err
+		return apperr.Internal(err, "failed to resolve comment %s", commentID)
 	}
 	payload, _ := json.Marshal(map[string]interface{}{"id": commentID})
 	s.Hub.Broadcast <- socket.WSMessage{Type: socket.CommentUpdateType, DocID: docID, UserID: userID, Payload: payload}
 	return nil
 }
 
+// ResolveWithReply posts a final reply on a comment thread and resolves it
+// atomically. Only the owner, writers and reviewers may do this.
+func (s *DocumentService) ResolveWithReply(commentID, userID string, req model.ResolveCommentRequest) (*model.CommentResponse, error) {
+	docID, err := s.Repo.GetCommentDocID(commentID)
+	if err == sql.ErrNoRows {
+		return nil, validationError("comment not found")
+	}
+	if err != nil {
+		return nil, apperr.Internal(err, "failed to look up comment %s", commentID)
+	}
+	if req.DocID != "" && req.DocID != docID {
+		return nil, validationError("comment does not belong to this document")
+	}
+
+	role, err := s.getUserRole(docID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !socket.CanPerform(role, socket.CommentUpdateType) {
+		logger.Sugar.Warnf("Service: User %s tried to resolve comment %s without permission", userID, commentID)
+		return nil, ErrForbidden.Withf("your role cannot resolve comments")
+	}
+
+	parentID, err := s.resolveParent(docID, commentID)
+	if err != nil {
+		return nil, err
+	}
+	reply := model.CommentRequest{DocID: docID, Content: req.Content, ParentID: parentID}
+	if err := s.sanitizeComment(&reply); err != nil {
+		return nil, err
+	}
+	if reply.Visibility, err = s.threadVisibility(parentID); err != nil {
+		return nil, err
+	}
+	if err := s.checkCommentQuota(docID); err != nil {
+		return nil, err
+	}
+
+	replyID, createdAt, err := s.Repo.ReplyAndResolve(commentID, parentID, docID, userID, reply.Content, reply.Visibility)
+	if err != nil {
+		return nil, apperr.Internal(err, "failed to resolve comment %s", commentID)
+	}
+
+	resp := &model.CommentResponse{
+		ID:             replyID,
+		UserID:         userID,
+		CreatedAt:      createdAt,
+		CommentRequest: reply,
+	}
+	replyPayload, _ := json.Marshal(resp)
+	s.Hub.Broadcast <- socket.WSMessage{Type: socket.CommentType, DocID: docID, UserID: userID, Payload: replyPayload}
+	updatePayload, _ := json.Marshal(map[string]interface{}{"id": commentID, "resolved": true})
+	s.Hub.Broadcast <- socket.WSMessage{Type: socket.CommentUpdateType, DocID: docID, UserID: userID, Payload: updatePayload}
+	return resp, nil
+}
+
 func (s *DocumentService) DeleteComment(commentID, userID string) error {
 	docID, err := s.Repo.DeleteComment(commentID, userID)
+	if err == sql.ErrNoRows {
+		return ErrForbidden.Withf("comment not found or not yours to delete")
+	}
 	if err != nil {
-		return err
+		return apperr.Internal(err, "failed to delete comment %s", commentID)
 	}
 	payload, _ := json.Marshal(map[string]string{"id": commentID})
 	s.Hub.Broadcast <- socket.WSMessage{Type: socket.CommentDeleteType, DocID: docID, UserID: userID, Payload: payload}
 	return nil
 }
 
-func (s *DocumentService) getUserRole(docID, userID string) (string, error) {
-	ownerID, err := s.Repo.GetOwnerID(docID)
-	if err == nil && ownerID == userID {
-		return "writer", nil
+// ExportDocuments streams a ZIP archive of the requested documents to w.
+// Documents the user cannot access are skipped rather than failing the archive.
+func (s *DocumentService) ExportDocuments(userID string, req model.BulkExportRequest, w io.Writer) error {
+	zw := zip.NewWriter(w)
+	manifest := make([]model.ExportManifestEntry, 0, len(req.IDs))
+
+	for _, docID := range req.IDs {
+		// Each entry is what ExportDocument would give: the live copy of an
+		// open room, redacted for readers.
+		title, content, err := s.contentForUser(docID, userID)
+		if err != nil {
+			logger.Sugar.Warnf("Service: Skipping doc %s in bulk export for user %s: %v", docID, userID, err)
+			continue
+		}
+
+		out, err := export.Render(req.Format, title, content)
+		if err != nil {
+			logger.Sugar.Errorf("Service: Failed to render doc %s as %s: %v", docID, req.Format, err)
+			continue
+		}
+
+		fileName := fmt.Sprintf("%s-%s.%s", exportFileName(title), docID[:min(8, len(docID))], req.Format)
+		f, err := zw.Create(fileName)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(out); err != nil {
+			return err
+		}
+		manifest = append(manifest, model.ExportManifestEntry{ID: docID, Title: title, File: fileName})
 	}
-	role, err := s.Repo.GetCollaboratorRole(docID, userID)
-	if err == nil {
-		return role, nil
+
+	f, err := zw.Create("manifest.json")
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(manifest); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// GetRawContent returns the document's Quill delta exactly as the hub would
+// serve it to userID: the live in-memory copy when the room is open, else the
+// stored content. Readers get confidential ranges redacted. The returned name
+// is a suggested download file name.
+func (s *DocumentService) GetRawContent(docID, userID string) (string, []byte, error) {
+	title, content, err := s.contentForUser(docID, userID)
+	if err != nil {
+		return "", nil, err
+	}
+	name := fmt.Sprintf("%s-%s.json", exportFileName(title), docID[:min(8, len(docID))])
+	return name, content, nil
+}
+
+// ExportDocument renders one document in format (md, html, txt or pdf) from
+// the same content GetRawContent serves. PDFs are rendered from the HTML
+// export by s.PDF, which bounds concurrency and time; export.ErrPDFBusy and
+// context.DeadlineExceeded are returned as-is for the handler to map. PDF is
+// refused as unsupported when s.PDF is nil.
+func (s *DocumentService) ExportDocument(ctx context.Context, docID, userID, format string) (string, []byte, error) {
+	if !export.IsSupported(format) && (format != export.FormatPDF || s.PDF == nil) {
+		return "", nil, validationError("unsupported export format %q", format)
+	}
+
+	title, content, err := s.contentForUser(docID, userID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	renderAs := format
+	if format == export.FormatPDF {
+		renderAs = export.FormatHTML
+	}
+	out, err := export.Render(renderAs, title, content)
+	if err != nil {
+		return "", nil, err
+	}
+	if format == export.FormatPDF {
+		if out, err = s.PDF.RenderPDF(ctx, out); err != nil {
+			return "", nil, err
+		}
+	}
+
+	name := fmt.Sprintf("%s-%s.%s", exportFileName(title), docID[:min(8, len(docID))], format)
+	return name, out, nil
+}
+
+// GetContentAtRevision returns docID as it was stored at revision, redacted
+// for readers. storage.ErrNotFound means the document never had that revision
+// or it has been pruned.
+func (s *DocumentService) GetContentAtRevision(docID, userID string, revision int64) (*model.RevisionContent, error) {
+	hasAccess, err := s.Repo.CheckAccess(docID, userID)
+	if err != nil {
+		return nil, apperr.Internal(err, "failed to check access to doc %s", docID)
+	}
+	if !hasAccess {
+		return nil, ErrNoAccess
+	}
+
+	content, err := s.Repo.Content.LoadRevision(docID, revision)
+	if err != nil {
+		return nil, apperr.Internal(err, "failed to load revision %d of doc %s", revision, docID)
+	}
+	role, err := s.getUserRole(docID, userID)
+	if err != nil {
+		return nil, err
 	}
-	return "reader", nil // Default or error
+	return &model.RevisionContent{
+		DocID:    docID,
+		Revision: revision,
+		Content:  socket.ContentForRole(role, content),
+	}, nil
 }
 
-func generateDocID() string {
-	b := make([]byte, 16)
-	if _, err := rand.Read(b); err != nil {
-		return ""
+// PreviewAsRole returns docID's current content as a collaborator with role
+// would receive it, so the owner can check what redaction hides. Owner-only.
+func (s *DocumentService) PreviewAsRole(docID, userID, role string) (*model.RolePreview, error) {
+	ownerID, err := s.Repo.GetOwnerID(docID)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoAccess
+	}
+	if err != nil {
+		return nil, apperr.Internal(err, "failed to look up owner of doc %s", docID)
+	}
+	if ownerID != userID {
+		return nil, ErrForbidden.Withf("only the owner can preview roles")
 	}
-	b[6] = (b[6] & 0x0f) | 0x40
-	b[8] = (b[8] & 0x3f) | 0x80
-	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+
+	// The live copy of an open room is newer than the stored one.
+	content, ok := s.Hub.GetCachedContent(docID)
+	if !ok {
+		_, stored, err := s.Repo.GetDocument(docID)
+		if err != nil {
+			return nil, apperr.Internal(err, "failed to load doc %s", docID)
+		}
+		content = []byte(stored)
+	}
+	return &model.RolePreview{
+		DocID:   docID,
+		Role:    role,
+		Content: socket.ContentForRole(role, content),
+	}, nil
 }
 
-func getSnippetFromContent(contentJSON string) string {
-	type QuillOp struct {
-		Insert interface{} `json:"insert"`
+// contentForUser returns the title and the content userID may see: the live
+// copy when the room is open, else the stored one, redacted for readers.
+func (s *DocumentService) contentForUser(docID, userID string) (string, []byte, error) {
+	hasAccess, err := s.Repo.CheckAccess(docID, userID)
+	if err != nil {
+		return "", nil, apperr.Internal(err, "failed to check access to doc %s", docID)
+	}
+	if !hasAccess {
+		return "", nil, ErrNoAccess
 	}
-	type QuillDelta struct {
-		Ops []QuillOp `json:"ops"`
+
+	title, stored, err := s.Repo.GetDocument(docID)
+	if err != nil {
+		return "", nil, apperr.Internal(err, "failed to load doc %s", docID)
+	}
+	content, ok := s.Hub.GetCachedContent(docID)
+	if !ok {
+		content = []byte(stored)
+	}
+	role, err := s.getUserRole(docID, userID)
+	if err != nil {
+		return "", nil, err
+	}
+	return title, socket.ContentForRole(role, content), nil
+}
+
+// GetComments returns the comments on docID that userID's role may see.
+func (s *DocumentService) GetComments(docID, userID string) ([]model.CommentResponse, error) {
+	role, err := s.commentViewerRole(docID, userID)
+	if err != nil {
+		return nil, err
 	}
-	var delta QuillDelta
-	if err := json.Unmarshal([]byte(contentJSON), &delta); err != nil {
-		return ""
+	comments, err := s.Repo.GetComments(docID)
+	if err != nil {
+		return nil, apperr.Internal(err, "failed to get comments on doc %s", docID)
 	}
-	var sb strings.Builder
-	for _, op := range delta.Ops {
-		if str, ok := op.Insert.(string); ok {
-			sb.WriteString(str)
+	visible := comments[:0]
+	for _, c := range comments {
+		if socket.CommentVisibleTo(role, c.Visibility) {
+			visible = append(visible, c)
 		}
-		if sb.Len() > 100 {
-			break
+	}
+	return visible, nil
+}
+
+// ExportComments returns docID's comments with author emails for export,
+// limited to those userID's role may see.
+func (s *DocumentService) ExportComments(docID, userID string) ([]model.CommentExport, error) {
+	role, err := s.commentViewerRole(docID, userID)
+	if err != nil {
+		return nil, err
+	}
+	comments, err := s.Repo.GetCommentsForExport(docID)
+	if err != nil {
+		return nil, apperr.Internal(err, "failed to get comments for export of doc %s", docID)
+	}
+	visible := comments[:0]
+	for _, c := range comments {
+		if socket.CommentVisibleTo(role, c.Visibility) {
+			visible = append(visible, c)
 		}
 	}
-	res := strings.TrimSpace(sb.String())
-	res = strings.ReplaceAll(res, "\n", " ")
-	if len(res) > 100 {
-		return res[:100] + "..."
+	return visible, nil
+}
+
+// commentViewerRole checks that userID can access docID and returns the role
+// that decides which comments they see.
+func (s *DocumentService) commentViewerRole(docID, userID string) (string, error) {
+	hasAccess, err := s.Repo.CheckAccess(docID, userID)
+	if err != nil {
+		return "", apperr.Internal(err, "failed to check access to doc %s", docID)
+	}
+	if !hasAccess {
+		return "", ErrNoAccess
+	}
+	return s.getUserRole(docID, userID)
+}
+
+// GetDocumentOwner returns docID's owner if userID can access it.
+func (s *DocumentService) GetDocumentOwner(docID, userID string) (model.DocumentOwner, error) {
+	hasAccess, err := s.Repo.CheckAccess(docID, userID)
+	if err != nil {
+		return model.DocumentOwner{}, apperr.Internal(err, "failed to check access to doc %s", docID)
+	}
+	if !hasAccess {
+		return model.DocumentOwner{}, ErrNoAccess
+	}
+	owner, err := s.Repo.GetDocumentOwner(docID)
+	if err == sql.ErrNoRows {
+		return owner, ErrNoAccess
+	}
+	return owner, apperr.Internal(err, "failed to get owner of doc %s", docID)
+}
+
+// GetCommentStats returns comment counts for docID if userID can access it.
+func (s *DocumentService) GetCommentStats(docID, userID string) (model.CommentStats, error) {
+	hasAccess, err := s.Repo.CheckAccess(docID, userID)
+	if err != nil {
+		return model.CommentStats{}, apperr.Internal(err, "failed to check access to doc %s", docID)
+	}
+	if !hasAccess {
+		return model.CommentStats{}, ErrNoAccess
+	}
+	// Readers don't count the reviewer-only comments they cannot see.
+	role, err := s.getUserRole(docID, userID)
+	if err != nil {
+		return model.CommentStats{}, err
+	}
+	stats, err := s.Repo.GetCommentStats(docID, role)
+	return stats, apperr.Internal(err, "failed to count comments on doc %s", docID)
+}
+
+// PrewarmDocument loads docID into the hub ahead of userID's socket join.
+func (s *DocumentService) PrewarmDocument(docID, userID string) error {
+	hasAccess, err := s.Repo.CheckAccess(docID, userID)
+	if err != nil {
+		return apperr.Internal(err, "failed to check access to doc %s", docID)
+	}
+	if !hasAccess {
+		return ErrNoAccess
+	}
+	return apperr.Internal(s.Hub.Prewarm(docID), "failed to prewarm doc %s", docID)
+}
+
+// GetMyRole reports what userID may do on docID, using the same rules as
+// the write paths so clients don't have to duplicate them.
+func (s *DocumentService) GetMyRole(docID, userID string) (*model.MyRoleResponse, error) {
+	hasAccess, err := s.Repo.CheckAccess(docID, userID)
+	if err != nil {
+		return nil, apperr.Internal(err, "failed to check access to doc %s", docID)
+	}
+	if !hasAccess {
+		return nil, ErrNoAccess
+	}
+
+	ownerID, err := s.Repo.GetOwnerID(docID)
+	if err != nil {
+		return nil, apperr.Internal(err, "failed to look up owner of doc %s", docID)
+	}
+	role, err := s.getUserRole(docID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &model.MyRoleResponse{
+		Role:       role,
+		CanEdit:    socket.CanPerform(role, socket.UpdateType),
+		CanComment: socket.CanPerform(role, socket.CommentType),
+		CanInvite:  ownerID == userID,
+	}
+	if ownerID == userID {
+		resp.Role = RoleOwner
+	}
+	if holder := s.Hub.EditLockHolder(docID); holder != "" && holder != userID {
+		resp.EditLocked = true
+	}
+	return resp, nil
+}
+
+func (s *DocumentService) getUserRole(docID, userID string) (string, error) {
+	ownerID, err := s.Repo.GetOwnerID(docID)
+	if err == nil && ownerID == userID {
+		return socket.RoleWriter, nil
+	}
+	role, err := s.Repo.GetCollaboratorRole(docID, userID)
+	if err == nil {
+		return role, nil
+	}
+	return socket.RoleReader, nil // Default or error
+}
+
+// exportFileName turns a document title into a safe archive entry name.
+func exportFileName(title string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		case r == ' ':
+			return '-'
+		}
+		return -1
+	}, strings.TrimSpace(title))
+	if name == "" {
+		return "document"
 	}
-	return res
+	return name
 }
@@ -0,0 +1,442 @@
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"satunaskah/internal/document/model"
+	"satunaskah/internal/document/repository"
+	"satunaskah/pkg/docid"
+	"satunaskah/pkg/logger"
+	"satunaskah/socket"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(m *testing.M) {
+	logger.Init()
+	os.Exit(m.Run())
+}
+
+var pkeyViolation = &pq.Error{Code: "23505", Constraint: "documents_pkey"}
+
+func TestCreateDocumentRetriesTakenID(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectExec("INSERT INTO documents").WillReturnError(pkeyViolation)
+	mock.ExpectExec("INSERT INTO documents").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	s := &DocumentService{Repo: repository.NewDocumentRepository(db)}
+	docID, err := s.createDocument("user-1", "", `{"ops":[]}`)
+	require.NoError(t, err)
+	assert.True(t, docid.Valid(docID))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCreateDocumentGivesUpAfterAttempts(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	for i := 0; i < createAttempts; i++ {
+		mock.ExpectExec("INSERT INTO documents").WillReturnError(pkeyViolation)
+	}
+
+	s := &DocumentService{Repo: repository.NewDocumentRepository(db)}
+	docID, err := s.createDocument("user-1", "", `{"ops":[]}`)
+	assert.Error(t, err)
+	assert.Empty(t, docID)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestImportIsHeldToContentLimits(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	repo := repository.NewDocumentRepository(db)
+
+	s := &DocumentService{Repo: repo, MaxContentChars: 20}
+	_, err = s.ImportDocument("user-1", model.ImportDocRequest{Content: "<p>" + strings.Repeat("x", 21) + "</p>", Format: "html"})
+	assert.ErrorIs(t, err, ErrValidation, "over the character limit")
+
+	// Formatting adds to the converted delta, not to the characters.
+	s = &DocumentService{Repo: repo, MaxContentBytes: 200}
+	_, err = s.ImportDocument("user-1", model.ImportDocRequest{Content: strings.Repeat("**a** ", 10)})
+	assert.ErrorIs(t, err, ErrValidation, "over the byte limit once converted")
+	assert.NoError(t, mock.ExpectationsWereMet(), "nothing is created")
+}
+
+func TestUniqueTitlesNumberDuplicates(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	titles := sqlmock.NewRows([]string{"title"}).AddRow("Notes").AddRow("Notes (2)").AddRow("Notes 2024")
+	mock.ExpectQuery("SELECT title FROM documents").WithArgs("user-1", "Notes%", "").WillReturnRows(titles)
+	// A concurrent create takes "Notes (3)" first, so the next number is used.
+	mock.ExpectExec("INSERT INTO documents").
+		WithArgs(sqlmock.AnyArg(), `{"ops":[]}`, "user-1", "Notes (3)").
+		WillReturnError(&pq.Error{Code: "23505", Constraint: "documents_owner_title_key"})
+	titles = sqlmock.NewRows([]string{"title"}).AddRow("Notes").AddRow("Notes (2)").AddRow("Notes (3)")
+	mock.ExpectQuery("SELECT title FROM documents").WithArgs("user-1", "Notes%", "").WillReturnRows(titles)
+	mock.ExpectExec("INSERT INTO documents").
+		WithArgs(sqlmock.AnyArg(), `{"ops":[]}`, "user-1", "Notes (4)").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	s := &DocumentService{Repo: repository.NewDocumentRepository(db), UniqueTitles: UniqueTitlesNumber}
+	_, err = s.createDocument("user-1", "Notes", `{"ops":[]}`)
+	require.NoError(t, err)
+
+	s.UniqueTitles = UniqueTitlesReject
+	// LIKE wildcards in the title match only themselves.
+	mock.ExpectQuery("SELECT title FROM documents").WithArgs("user-1", `50\%\_off\\%`, "").
+		WillReturnRows(sqlmock.NewRows([]string{"title"}).AddRow(`50%_off\`))
+	_, err = s.createDocument("user-1", `50%_off\`, `{"ops":[]}`)
+	assert.ErrorIs(t, err, ErrTitleTaken)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCommentQuota(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	docID := docid.New()
+	quota := func(count, limit int) {
+		mock.ExpectQuery("SELECT \\(SELECT COUNT\\(\\*\\) FROM comments").WithArgs(docID).
+			WillReturnRows(sqlmock.NewRows([]string{"count", "limit"}).AddRow(count, limit))
+	}
+	s := &DocumentService{Repo: repository.NewDocumentRepository(db), MaxCommentsPerDoc: 5}
+
+	quota(4, 0)
+	assert.NoError(t, s.checkCommentQuota(docID))
+	quota(5, 0)
+	assert.ErrorIs(t, s.checkCommentQuota(docID), ErrValidation)
+	// The owner raised this document's limit.
+	quota(5, 10)
+	assert.NoError(t, s.checkCommentQuota(docID))
+
+	tooMany, none := MaxCommentLimit+1, 0
+	assert.ErrorIs(t, s.UpdateDocument(docID, "user-1", model.UpdateDocRequest{CommentLimit: &tooMany}), ErrValidation)
+	mock.ExpectQuery("UPDATE documents SET").WithArgs(docID, "user-2", nil, nil, 0, true).WillReturnError(sql.ErrNoRows)
+	assert.ErrorIs(t, s.UpdateDocument(docID, "user-2", model.UpdateDocRequest{CommentLimit: &none}), ErrNoAccess, "only the owner may")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTitlesAreSanitized(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	docID := docid.New()
+	mock.ExpectExec("INSERT INTO documents").
+		WithArgs(sqlmock.AnyArg(), `{"ops":[]}`, "user-1", "Untitled Document").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("UPDATE documents SET").
+		WithArgs(docID, "user-1", "Release notes v2", nil, nil, true).
+		WillReturnRows(sqlmock.NewRows([]string{"title"}).AddRow("Release notes v2"))
+
+	hub := socket.NewHub(nil)
+	s := &DocumentService{Repo: repository.NewDocumentRepository(db), Hub: hub}
+
+	_, err = s.createDocument("user-1", " \x00\n ", `{"ops":[]}`)
+	require.NoError(t, err, "a title of only control characters falls back to the default")
+
+	_, err = s.createDocument("user-1", strings.Repeat("x", socket.MaxTitleLength+1), `{"ops":[]}`)
+	assert.ErrorIs(t, err, ErrValidation)
+
+	go func() { <-hub.Broadcast }()
+	require.NoError(t, s.UpdateDocument(docID, "user-1", model.UpdateDocRequest{Title: "  Release\x1b notes\nv2 "}))
+
+	for _, bad := range []string{"   ", "\r\n\x00", strings.Repeat("é", socket.MaxTitleLength+1)} {
+		assert.ErrorIs(t, s.UpdateDocument(docID, "user-1", model.UpdateDocRequest{Title: bad}), ErrValidation, "%q", bad)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDescriptionsAreSanitized(t *testing.T) {
+	for in, want := range map[string]string{
+		"":                      "",
+		"   ":                   "",
+		" Notes\x00 for\tv2\n ": "Notes for\tv2",
+		"line one\nline two":    "line one\nline two",
+	} {
+		got, err := sanitizeDescription(in)
+		require.NoError(t, err, "%q", in)
+		assert.Equal(t, want, got, "%q", in)
+	}
+	_, err := sanitizeDescription(strings.Repeat("é", MaxDescriptionLength+1))
+	assert.ErrorIs(t, err, ErrValidation)
+}
+
+func TestUpdateDocumentChecksEveryFieldFirst(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	docID := docid.New()
+	hub := socket.NewHub(nil)
+	s := &DocumentService{Repo: repository.NewDocumentRepository(db), Hub: hub}
+	description, limit, tooMany := " About\x1b this ", 20, MaxCommentLimit+1
+
+	// A bad field stops the whole update before anything is written.
+	long := strings.Repeat("x", MaxDescriptionLength+1)
+	assert.ErrorIs(t, s.UpdateDocument(docID, "user-1", model.UpdateDocRequest{Title: "Plan", Description: &long}), ErrValidation)
+	assert.ErrorIs(t, s.UpdateDocument(docID, "user-1", model.UpdateDocRequest{Title: "Plan", CommentLimit: &tooMany}), ErrValidation)
+
+	// A writer may change the description alone, but not with the title.
+	mock.ExpectQuery("UPDATE documents SET").
+		WithArgs(docID, "writer-1", "Plan", "About this", nil, true).
+		WillReturnError(sql.ErrNoRows)
+	assert.ErrorIs(t, s.UpdateDocument(docID, "writer-1", model.UpdateDocRequest{Title: "Plan", Description: &description}), ErrNoAccess)
+	mock.ExpectQuery("UPDATE documents SET").
+		WithArgs(docID, "writer-1", nil, "About this", nil, false).
+		WillReturnRows(sqlmock.NewRows([]string{"title"}).AddRow("Old title"))
+	go func() { <-hub.Broadcast }()
+	require.NoError(t, s.UpdateDocument(docID, "writer-1", model.UpdateDocRequest{Description: &description}))
+
+	// The owner's changes are written together and announced once.
+	mock.ExpectQuery("UPDATE documents SET").
+		WithArgs(docID, "user-1", "Plan", "About this", 20, true).
+		WillReturnRows(sqlmock.NewRows([]string{"title"}).AddRow("Plan"))
+	done := make(chan socket.WSMessage, 1)
+	go func() { done <- <-hub.Broadcast }()
+	require.NoError(t, s.UpdateDocument(docID, "user-1", model.UpdateDocRequest{Title: "Plan", Description: &description, CommentLimit: &limit}))
+	msg := <-done
+	assert.Equal(t, socket.MetadataType, msg.Type)
+	assert.JSONEq(t, `{"title":"Plan","description":"About this"}`, string(msg.Payload))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDeleteDocumentsReportsEachID(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	mine, theirs, missing := docid.New(), docid.New(), docid.New()
+	ids := []string{mine, theirs, missing}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, owner_id FROM documents WHERE id = ANY\\(\\$1\\) FOR UPDATE").
+		WithArgs(pq.Array(ids)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "owner_id"}).AddRow(mine, "user-1").AddRow(theirs, "user-2"))
+	mock.ExpectExec("DELETE FROM documents WHERE id = ANY\\(\\$1\\) AND owner_id = \\$2").
+		WithArgs(pq.Array(ids), "user-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	s := &DocumentService{Repo: repository.NewDocumentRepository(db), Hub: socket.NewHub(nil)}
+	results, err := s.DeleteDocuments("user-1", append(ids, mine))
+	require.NoError(t, err)
+	assert.Equal(t, []model.BulkDeleteResult{
+		{ID: mine, Status: "deleted"},
+		{ID: theirs, Status: "forbidden"},
+		{ID: missing, Status: "not_found"},
+	}, results)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetDocumentsReportsUpdatesSinceLastOpen(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	opened := time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)
+	later := opened.Add(time.Hour)
+	// has_updates for each document as the query computes it from the
+	// document row and the user's document_access row.
+	hasUpdates := func(lastOpened *time.Time, updatedAt time.Time, lastEditor string) bool {
+		return lastOpened == nil || (updatedAt.After(*lastOpened) && lastEditor != "user-1")
+	}
+	mock.ExpectQuery(`\(a\.last_opened_at IS NULL OR \(d\.updated_at > a\.last_opened_at\s+AND d\.last_editor_id IS DISTINCT FROM \$1\)\) AS has_updates`).
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title", "description", "updated_at", "owner_id", "preview", "last_editor_id", "last_edited_at", "unread_comments", "has_updates"}).
+			AddRow("never-opened", "A", "", opened, "user-1", []byte(`{"word_count":2,"snippet":"Hello there"}`), "user-2", opened, 0, hasUpdates(nil, opened, "user-2")).
+			AddRow("edited-by-other", "B", "", later, "user-1", nil, "user-2", later, 0, hasUpdates(&opened, later, "user-2")).
+			AddRow("own-edit", "C", "", later, "user-1", nil, "user-1", later, 0, hasUpdates(&opened, later, "user-1")))
+	for range 3 {
+		mock.ExpectQuery("FROM documents d LEFT JOIN auth.users").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "email", "name", "avatar", "role"}))
+	}
+
+	s := &DocumentService{Repo: repository.NewDocumentRepository(db)}
+	docs, err := s.GetDocuments("user-1")
+	require.NoError(t, err)
+	require.Len(t, docs, 3)
+	assert.True(t, docs[0].HasUpdates, "a document never opened has updates")
+	assert.Equal(t, "Hello there", docs[0].Snippet, "read from the stored preview")
+	assert.Equal(t, 2, docs[0].Preview.WordCount)
+	assert.Empty(t, docs[0].Preview.Snippet)
+	assert.True(t, docs[1].HasUpdates, "another user edited it after the last open")
+	assert.False(t, docs[2].HasUpdates, "the user's own last edit is not an update")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestChangedSinceServerTimeOverlaps(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	now := time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)
+	since := now.Add(-time.Hour)
+	mock.ExpectQuery("SELECT NOW\\(\\)").WillReturnRows(sqlmock.NewRows([]string{"now"}).AddRow(now))
+	mock.ExpectQuery("AND d.updated_at > \\$2").WithArgs("user-1", since).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	s := &DocumentService{Repo: repository.NewDocumentRepository(db)}
+	changes, err := s.GetDocumentsChangedSince("user-1", since)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(-ChangedSinceOverlap), changes.ServerTime, "saves still committing at now are found next time")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPreviewAsRoleRedactsForReaders(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+
+	docID := docid.New()
+	content := `{"ops":[{"insert":"Public "},{"insert":"secret","attributes":{"confidential":true}},{"insert":"\n"}]}`
+	for i := 0; i < 2; i++ {
+		mock.ExpectQuery("SELECT owner_id FROM documents WHERE id = \\$1").
+			WithArgs(docID).
+			WillReturnRows(sqlmock.NewRows([]string{"owner_id"}).AddRow("user-1"))
+		mock.ExpectQuery("SELECT title FROM documents WHERE id = \\$1").
+			WithArgs(docID).
+			WillReturnRows(sqlmock.NewRows([]string{"title"}).AddRow("Plan"))
+		mock.ExpectQuery("SELECT content FROM documents WHERE id = \\$1").
+			WithArgs(docID).
+			WillReturnRows(sqlmock.NewRows([]string{"content"}).AddRow([]byte(content)))
+	}
+	mock.ExpectQuery("SELECT owner_id FROM documents WHERE id = \\$1").
+		WithArgs(docID).
+		WillReturnRows(sqlmock.NewRows([]string{"owner_id"}).AddRow("user-1"))
+
+	s := &DocumentService{Repo: repository.NewDocumentRepository(db), Hub: socket.NewHub(nil)}
+
+	reader, err := s.PreviewAsRole(docID, "user-1", socket.RoleReader)
+	require.NoError(t, err)
+	assert.Equal(t, socket.RoleReader, reader.Role)
+	assert.Contains(t, string(reader.Content), "Public")
+	assert.NotContains(t, string(reader.Content), "secret")
+
+	writer, err := s.PreviewAsRole(docID, "user-1", socket.RoleWriter)
+	require.NoError(t, err)
+	assert.JSONEq(t, content, string(writer.Content))
+
+	_, err = s.PreviewAsRole(docID, "user-2", socket.RoleReader)
+	assert.ErrorIs(t, err, ErrForbidden)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPreviewAsRoleReadsCachedContentFirst(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	docID := docid.New()
+	hub := socket.NewHub(db)
+	mock.ExpectQuery("SELECT owner_id, title FROM documents WHERE id = \\$1").
+		WithArgs(docID).
+		WillReturnRows(sqlmock.NewRows([]string{"owner_id", "title"}).AddRow("user-1", "Plan"))
+	mock.ExpectQuery("SELECT content FROM documents WHERE id = \\$1").
+		WithArgs(docID).
+		WillReturnRows(sqlmock.NewRows([]string{"content"}).AddRow([]byte(`{"ops":[{"insert":"Cached\n"}]}`)))
+	require.NoError(t, hub.Prewarm(docID))
+
+	// Only the owner is looked up; the document itself is not loaded again.
+	mock.ExpectQuery("SELECT owner_id FROM documents WHERE id = \\$1").
+		WithArgs(docID).
+		WillReturnRows(sqlmock.NewRows([]string{"owner_id"}).AddRow("user-1"))
+	s := &DocumentService{Repo: repository.NewDocumentRepository(db), Hub: hub}
+	preview, err := s.PreviewAsRole(docID, "user-1", socket.RoleWriter)
+	require.NoError(t, err)
+	assert.Contains(t, string(preview.Content), "Cached")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTextRangeMustLieWithinTheDocument(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	docID := docid.New()
+	hub := socket.NewHub(db)
+	mock.ExpectQuery("SELECT owner_id, title FROM documents WHERE id = \\$1").
+		WithArgs(docID).
+		WillReturnRows(sqlmock.NewRows([]string{"owner_id", "title"}).AddRow("user-1", "Plan"))
+	mock.ExpectQuery("SELECT content FROM documents WHERE id = \\$1").
+		WithArgs(docID).
+		WillReturnRows(sqlmock.NewRows([]string{"content"}).AddRow([]byte(`{"ops":[{"insert":"Hello\n"}]}`)))
+	require.NoError(t, hub.Prewarm(docID))
+	s := &DocumentService{Repo: repository.NewDocumentRepository(db), Hub: hub}
+
+	assert.NoError(t, s.validateTextRange(docID, []byte(`{"index":2,"length":4}`)))
+	assert.NoError(t, s.validateTextRange(docID, []byte(`{"index":6,"length":0}`)))
+	assert.ErrorIs(t, s.validateTextRange(docID, []byte(`{"index":2,"length":5}`)), ErrValidation)
+	assert.ErrorIs(t, s.validateTextRange(docID, []byte(`{"index":7,"length":0}`)), ErrValidation)
+	assert.ErrorIs(t, s.validateTextRange(docID, []byte(`{"index":2,"length":9223372036854775807}`)), ErrValidation, "the end would overflow")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestBulkExportUsesTheLiveCopyRedactedForReaders(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	docID, otherID := docid.New(), docid.New()
+	hub := socket.NewHub(db)
+	mock.ExpectQuery("SELECT owner_id, title FROM documents WHERE id = \\$1").
+		WithArgs(docID).
+		WillReturnRows(sqlmock.NewRows([]string{"owner_id", "title"}).AddRow("user-1", "Plan"))
+	mock.ExpectQuery("SELECT content FROM documents WHERE id = \\$1").
+		WithArgs(docID).
+		WillReturnRows(sqlmock.NewRows([]string{"content"}).
+			AddRow([]byte(`{"ops":[{"insert":"Live "},{"insert":"secret","attributes":{"confidential":true}},{"insert":"\n"}]}`)))
+	require.NoError(t, hub.Prewarm(docID))
+
+	mock.ExpectQuery("SELECT EXISTS").WithArgs(docID, "user-2").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery("SELECT title FROM documents WHERE id = \\$1").
+		WithArgs(docID).
+		WillReturnRows(sqlmock.NewRows([]string{"title"}).AddRow("Plan"))
+	mock.ExpectQuery("SELECT content FROM documents WHERE id = \\$1").
+		WithArgs(docID).
+		WillReturnRows(sqlmock.NewRows([]string{"content"}).AddRow([]byte(`{"ops":[{"insert":"Stored\n"}]}`)))
+	mock.ExpectQuery("SELECT owner_id FROM documents WHERE id = \\$1").
+		WithArgs(docID).
+		WillReturnRows(sqlmock.NewRows([]string{"owner_id"}).AddRow("user-1"))
+	mock.ExpectQuery("SELECT role FROM collaborators").WithArgs(docID, "user-2").
+		WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(socket.RoleReader))
+	mock.ExpectQuery("SELECT EXISTS").WithArgs(otherID, "user-2").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+
+	s := &DocumentService{Repo: repository.NewDocumentRepository(db), Hub: hub}
+	var archive bytes.Buffer
+	require.NoError(t, s.ExportDocuments("user-2", model.BulkExportRequest{IDs: []string{docID, otherID}, Format: "txt"}, &archive))
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	zr, err := zip.NewReader(bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+	require.NoError(t, err)
+	require.Len(t, zr.File, 2, "the document and the manifest; the other id is skipped")
+	f, err := zr.File[0].Open()
+	require.NoError(t, err)
+	text, err := io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Contains(t, string(text), "Live")
+	assert.NotContains(t, string(text), "Stored")
+	assert.NotContains(t, string(text), "secret")
+}
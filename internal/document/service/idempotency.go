@@ -0,0 +1,57 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// IdempotencyKeyTTL is how long a creation result is remembered per key.
+const IdempotencyKeyTTL = 5 * time.Minute
+
+type idempotencyEntry struct {
+	docID     string
+	err       error
+	done      chan struct{}
+	expiresAt time.Time
+}
+
+// idempotencyCache remembers the result of recent keyed creations so a retried
+// or double-submitted request returns the original document id.
+type idempotencyCache struct {
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+}
+
+func newIdempotencyCache() *idempotencyCache {
+	return &idempotencyCache{entries: make(map[string]*idempotencyEntry)}
+}
+
+// Do runs fn once per key within IdempotencyKeyTTL. Concurrent callers with the
+// same key wait for the first call and share its result. Failed calls are
+// forgotten so the client can retry.
+func (c *idempotencyCache) Do(key string, fn func() (string, error)) (string, error) {
+	c.mu.Lock()
+	now := time.Now()
+	for k, e := range c.entries {
+		if now.After(e.expiresAt) {
+			delete(c.entries, k)
+		}
+	}
+	if e, ok := c.entries[key]; ok {
+		c.mu.Unlock()
+		<-e.done
+		return e.docID, e.err
+	}
+	e := &idempotencyEntry{done: make(chan struct{}), expiresAt: now.Add(IdempotencyKeyTTL)}
+	c.entries[key] = e
+	c.mu.Unlock()
+
+	e.docID, e.err = fn()
+	if e.err != nil {
+		c.mu.Lock()
+		delete(c.entries, key)
+		c.mu.Unlock()
+	}
+	close(e.done)
+	return e.docID, e.err
+}
@@ -0,0 +1,95 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"satunaskah/internal/document/repository"
+	"satunaskah/pkg/apperr"
+	"satunaskah/socket"
+)
+
+// Modes for DocumentService.UniqueTitles.
+const (
+	UniqueTitlesOff    = "off"    // Duplicate titles are allowed
+	UniqueTitlesReject = "reject" // A title the owner already uses is refused
+	UniqueTitlesNumber = "number" // " (2)", " (3)", ... is appended until it is free
+)
+
+// ErrTitleTaken means the owner already has a document with the title and
+// UniqueTitles is UniqueTitlesReject.
+var ErrTitleTaken = apperr.New(http.StatusConflict, "title_taken", "you already have a document with this title")
+
+// maxTitleSuffix bounds the number tried by UniqueTitlesNumber.
+const maxTitleSuffix = 999
+
+// uniqueTitle returns the title to store for ownerID's document docID (empty
+// on create) under s.UniqueTitles. Titles of docID itself don't count, so a
+// document keeps its own title.
+func (s *DocumentService) uniqueTitle(ownerID, docID, title string) (string, error) {
+	return chooseTitle(s.UniqueTitles, title, func(prefix string) ([]string, error) {
+		titles, err := s.Repo.TitlesWithPrefix(ownerID, prefix, docID)
+		if err != nil {
+			return nil, apperr.Internal(err, "failed to look up titles of user %s", ownerID)
+		}
+		return titles, nil
+	})
+}
+
+// ChooseTitle applies UNIQUE_TITLES to a rename sent over the socket, so the
+// hub can use it as its socket.TitleChooser.
+func (s *DocumentService) ChooseTitle(ownerID, docID, title string) (string, error) {
+	return s.uniqueTitle(ownerID, docID, title)
+}
+
+// transferTitle is passed to RemoveUser: with UNIQUE_TITLES on, a document
+// handed to an heir who already uses its title is numbered. It is never
+// refused, as a transfer can't be.
+func (s *DocumentService) transferTitle() repository.Retitle {
+	if s.UniqueTitles != UniqueTitlesReject && s.UniqueTitles != UniqueTitlesNumber {
+		return nil
+	}
+	return func(title string, titlesWithPrefix func(string) ([]string, error)) (string, error) {
+		return chooseTitle(UniqueTitlesNumber, title, titlesWithPrefix)
+	}
+}
+
+// chooseTitle applies mode to title. titlesWithPrefix lists the owner's
+// other titles that start with a prefix.
+func chooseTitle(mode, title string, titlesWithPrefix func(prefix string) ([]string, error)) (string, error) {
+	if mode != UniqueTitlesReject && mode != UniqueTitlesNumber {
+		return title, nil
+	}
+
+	// Numbered candidates may shorten the title to fit the suffix, so every
+	// title sharing the part that always survives is loaded.
+	runes := []rune(title)
+	prefix := string(runes[:min(len(runes), socket.MaxTitleLength-len(numberedSuffix(maxTitleSuffix)))])
+	titles, err := titlesWithPrefix(prefix)
+	if err != nil {
+		return "", err
+	}
+	used := make(map[string]bool, len(titles))
+	for _, t := range titles {
+		used[t] = true
+	}
+
+	if !used[title] {
+		return title, nil
+	}
+	if mode == UniqueTitlesReject {
+		return "", ErrTitleTaken
+	}
+	for n := 2; n <= maxTitleSuffix; n++ {
+		suffix := numberedSuffix(n)
+		candidate := string(runes[:min(len(runes), socket.MaxTitleLength-len(suffix))]) + suffix
+		if !used[candidate] {
+			return candidate, nil
+		}
+	}
+	return "", ErrTitleTaken.Withf("no free numbered title for %q", title)
+}
+
+// numberedSuffix is appended to the nth document with the same title.
+func numberedSuffix(n int) string {
+	return fmt.Sprintf(" (%d)", n)
+}
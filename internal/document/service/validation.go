@@ -0,0 +1,237 @@
+package service
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"html"
+	"net/http"
+	"satunaskah/internal/document/model"
+	"satunaskah/pkg/apperr"
+	"satunaskah/pkg/delta"
+	"satunaskah/pkg/docid"
+	"satunaskah/socket"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	MaxCommentLength = 5000
+	MaxQuoteLength   = 5000
+	// MaxCommentDepth is how many levels a comment thread may have; a
+	// top-level comment is level 1.
+	MaxCommentDepth = 3
+	// MaxCommentLimit bounds the comment limit an owner may give a document.
+	MaxCommentLimit = 100000
+	// MaxDescriptionLength bounds document descriptions, in characters.
+	MaxDescriptionLength = 500
+)
+
+// ErrValidation marks errors caused by bad client input.
+var ErrValidation = apperr.New(http.StatusBadRequest, "validation_failed", "validation failed")
+
+func validationError(format string, args ...interface{}) error {
+	return ErrValidation.Withf(format, args...)
+}
+
+// sanitizeText removes control characters other than newlines and tabs.
+func sanitizeText(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' {
+			return r
+		}
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// sanitizeComment cleans and bounds a comment request in place. Comments are
+// rendered as plain text by the frontend; set COMMENT_ESCAPE_HTML=true to also
+// HTML-escape content and quote before they are stored.
+func (s *DocumentService) sanitizeComment(req *model.CommentRequest) error {
+	req.Content = strings.TrimSpace(sanitizeText(req.Content))
+	req.Quote = sanitizeText(req.Quote)
+
+	if req.Content == "" {
+		return validationError("comment content is required")
+	}
+	if utf8.RuneCountInString(req.Content) > MaxCommentLength {
+		return validationError("comment exceeds %d characters", MaxCommentLength)
+	}
+	if utf8.RuneCountInString(req.Quote) > MaxQuoteLength {
+		return validationError("quote exceeds %d characters", MaxQuoteLength)
+	}
+
+	if len(req.TextRange) > 0 && string(req.TextRange) != "null" {
+		if _, err := parseTextRange(req.TextRange); err != nil {
+			return err
+		}
+	}
+
+	switch req.Visibility {
+	case "":
+		req.Visibility = model.VisibilityEveryone
+	case model.VisibilityEveryone, model.VisibilityReviewers:
+	default:
+		return validationError("visibility must be %q or %q", model.VisibilityEveryone, model.VisibilityReviewers)
+	}
+
+	if s.EscapeCommentHTML {
+		req.Content = html.EscapeString(req.Content)
+		req.Quote = html.EscapeString(req.Quote)
+	}
+	return nil
+}
+
+// sanitizeTitle applies socket.CleanTitle, so titles set over REST follow the
+// same rule as renames over the socket.
+func sanitizeTitle(title string) (string, error) {
+	cleaned, ok := socket.CleanTitle(title)
+	if ok {
+		return cleaned, nil
+	}
+	if cleaned == "" {
+		return "", validationError("title is required")
+	}
+	return "", validationError("title exceeds %d characters", socket.MaxTitleLength)
+}
+
+// sanitizeDescription cleans a document description like comment text: control
+// characters other than newlines and tabs are removed and the ends trimmed.
+// An empty description is allowed and clears it.
+func sanitizeDescription(description string) (string, error) {
+	description = strings.TrimSpace(sanitizeText(description))
+	if utf8.RuneCountInString(description) > MaxDescriptionLength {
+		return "", validationError("description exceeds %d characters", MaxDescriptionLength)
+	}
+	return description, nil
+}
+
+// checkCommentQuota refuses another comment on docID once it has as many as
+// its own limit, or MaxCommentsPerDoc when it has none. Resolved comments
+// count; deleted ones free their place.
+func (s *DocumentService) checkCommentQuota(docID string) error {
+	count, limit, err := s.Repo.CommentQuota(docID)
+	if err != nil {
+		return apperr.Internal(err, "failed to count comments of doc %s", docID)
+	}
+	if limit == 0 {
+		limit = s.MaxCommentsPerDoc
+	}
+	if limit > 0 && count >= limit {
+		return validationError("document has reached its limit of %d comments", limit)
+	}
+	return nil
+}
+
+// parseTextRange decodes a text_range that must be exactly {index:int, length:int}.
+func parseTextRange(raw json.RawMessage) (model.TextRange, error) {
+	var parsed struct {
+		Index  *int `json:"index"`
+		Length *int `json:"length"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&parsed); err != nil || parsed.Index == nil || parsed.Length == nil {
+		return model.TextRange{}, validationError("text_range must be {index:int, length:int}")
+	}
+	if *parsed.Index < 0 || *parsed.Length < 0 {
+		return model.TextRange{}, validationError("text_range index and length must be non-negative")
+	}
+	return model.TextRange{Index: *parsed.Index, Length: *parsed.Length}, nil
+}
+
+// validateTextRange checks that a comment anchor lies within the document,
+// using the live hub copy when the room is open and the stored row otherwise.
+func (s *DocumentService) validateTextRange(docID string, raw json.RawMessage) error {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil
+	}
+	textRange, err := parseTextRange(raw)
+	if err != nil {
+		return err
+	}
+
+	content, ok := s.Hub.GetCachedContent(docID)
+	if !ok {
+		_, stored, err := s.Repo.GetDocument(docID)
+		if err != nil {
+			return apperr.Internal(err, "failed to load doc %s", docID)
+		}
+		content = []byte(stored)
+	}
+
+	d, err := delta.Parse(content)
+	if err != nil {
+		return apperr.Internal(err, "failed to parse content of doc %s", docID)
+	}
+	if docLength := d.Length(); textRange.Index > docLength || textRange.Length > docLength-textRange.Index {
+		return validationError("text_range %d+%d is outside the document (length %d)", textRange.Index, textRange.Length, docLength)
+	}
+	return nil
+}
+
+// validateContent checks that content is a well-formed document delta within
+// MaxContentBytes and MaxContentChars. Shared by the create and save paths.
+func (s *DocumentService) validateContent(content json.RawMessage) error {
+	if len(content) == 0 || string(content) == "null" {
+		return validationError("content cannot be empty")
+	}
+	if s.MaxContentBytes > 0 && len(content) > s.MaxContentBytes {
+		return validationError("content exceeds %d bytes", s.MaxContentBytes)
+	}
+	d, err := delta.Parse(content)
+	if err != nil {
+		return validationError("content must be a Quill delta")
+	}
+	if err := d.Validate(); err != nil {
+		return validationError("%v", err)
+	}
+	if n := d.CharCount(); s.MaxContentChars > 0 && n > s.MaxContentChars {
+		return validationError("content has %d characters, the maximum is %d", n, s.MaxContentChars)
+	}
+	return nil
+}
+
+// resolveParent checks that parentID is a comment on docID and returns the
+// comment a reply should attach to. Replies that would nest deeper than
+// MaxCommentDepth attach to the deepest allowed ancestor instead, becoming a
+// sibling of the comment they answer.
+func (s *DocumentService) resolveParent(docID, parentID string) (string, error) {
+	if parentID == "" {
+		return "", nil
+	}
+	if !docid.Valid(parentID) {
+		return "", validationError("invalid parent_id")
+	}
+	parentDocID, path, err := s.Repo.GetCommentPath(parentID)
+	if err == sql.ErrNoRows {
+		return "", validationError("parent comment not found")
+	}
+	if err != nil {
+		return "", apperr.Internal(err, "failed to look up parent comment %s", parentID)
+	}
+	if parentDocID != docID {
+		return "", validationError("parent comment belongs to another document")
+	}
+	if len(path) >= MaxCommentDepth {
+		return path[MaxCommentDepth-2], nil
+	}
+	return parentID, nil
+}
+
+// threadVisibility returns the visibility of parentID's thread, which its
+// replies share so a reviewer-only discussion stays hidden from readers.
+func (s *DocumentService) threadVisibility(parentID string) (string, error) {
+	visibility, err := s.Repo.GetCommentVisibility(parentID)
+	if err == sql.ErrNoRows {
+		return "", validationError("parent comment not found")
+	}
+	if err != nil {
+		return "", apperr.Internal(err, "failed to look up visibility of comment %s", parentID)
+	}
+	return visibility, nil
+}
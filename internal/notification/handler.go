@@ -0,0 +1,44 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"satunaskah/internal/notification/model"
+	"satunaskah/internal/notification/repository"
+	"satunaskah/middleware"
+	"satunaskah/pkg/docid"
+)
+
+type NotificationHandler struct {
+	Repo *repository.NotificationRepository
+}
+
+func NewNotificationHandler(repo *repository.NotificationRepository) *NotificationHandler {
+	return &NotificationHandler{Repo: repo}
+}
+
+// ReadAll marks every unread notification of the caller as read, or only
+// those for docId when given, and answers {"marked": n}.
+func (h *NotificationHandler) ReadAll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	docID := r.URL.Query().Get("docId")
+	if docID != "" && !docid.Valid(docID) {
+		http.Error(w, "Invalid docId parameter", http.StatusBadRequest)
+		return
+	}
+
+	userID := r.Context().Value(middleware.UserIDKey).(string)
+
+	marked, err := h.Repo.MarkAllRead(userID, docID)
+	if err != nil {
+		http.Error(w, "Failed to mark notifications read", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(model.ReadAllResponse{Marked: marked})
+}
@@ -0,0 +1,21 @@
+package model
+
+// Notification types stored in notifications.type.
+const (
+	TypeDocumentEdited = "document_edited"
+)
+
+type Editor struct {
+	UserID string `json:"user_id"`
+	Name   string `json:"name"`
+}
+
+// DocumentEditedPayload summarizes who changed a document while its owner was away.
+type DocumentEditedPayload struct {
+	Title   string   `json:"title"`
+	Editors []Editor `json:"editors"`
+}
+
+type ReadAllResponse struct {
+	Marked int64 `json:"marked"`
+}
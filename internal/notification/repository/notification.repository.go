@@ -0,0 +1,51 @@
+package repository
+
+import (
+	"database/sql"
+	"satunaskah/pkg/logger"
+	"time"
+)
+
+type NotificationRepository struct {
+	DB *sql.DB
+}
+
+func NewNotificationRepository(db *sql.DB) *NotificationRepository {
+	return &NotificationRepository{DB: db}
+}
+
+// CreateUnlessRecent inserts a notification for userID unless one of the same
+// type for the same document was created within window. It reports whether a
+// row was inserted.
+func (r *NotificationRepository) CreateUnlessRecent(userID, docID, kind string, payload []byte, window time.Duration) (bool, error) {
+	res, err := r.DB.Exec(`
+		INSERT INTO notifications (user_id, document_id, type, payload)
+		SELECT $1, $2, $3, $4
+		WHERE NOT EXISTS (
+			SELECT 1 FROM notifications
+			WHERE user_id = $1 AND document_id = $2 AND type = $3
+			AND created_at > NOW() - $5 * INTERVAL '1 second')`,
+		userID, docID, kind, payload, window.Seconds(),
+	)
+	if err != nil {
+		logger.Sugar.Errorf("Failed to create %s notification for user %s on doc %s: %v", kind, userID, docID, err)
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// MarkAllRead marks userID's unread notifications as read, only those for
+// docID when it is set, and returns how many it marked.
+func (r *NotificationRepository) MarkAllRead(userID, docID string) (int64, error) {
+	res, err := r.DB.Exec(`
+		UPDATE notifications SET read_at = NOW()
+		WHERE user_id = $1 AND read_at IS NULL AND ($2 = '' OR document_id = $2)`,
+		userID, docID,
+	)
+	if err != nil {
+		logger.Sugar.Errorf("Failed to mark notifications read for user %s: %v", userID, err)
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,34 @@
+package repository
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMarkAllReadIsScopedToTheUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	repo := NewNotificationRepository(db)
+
+	mock.ExpectExec("UPDATE notifications SET read_at").
+		WithArgs("user-1", "").
+		WillReturnResult(sqlmock.NewResult(0, 4))
+	marked, err := repo.MarkAllRead("user-1", "")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), marked)
+
+	docID := "5d41402a-bc4b-42a7-9f4e-0c8b9d2e1a3f"
+	mock.ExpectExec("UPDATE notifications SET read_at").
+		WithArgs("user-1", docID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	marked, err = repo.MarkAllRead("user-1", docID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), marked)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,30 @@
+package repository
+
+import (
+	"database/sql"
+	"satunaskah/pkg/logger"
+)
+
+type ProfileRepository struct {
+	DB *sql.DB
+}
+
+func NewProfileRepository(db *sql.DB) *ProfileRepository {
+	return &ProfileRepository{DB: db}
+}
+
+// Upsert stores the identity details from a user's token so lookups don't
+// need to read auth.users.
+func (r *ProfileRepository) Upsert(userID, email, displayName, avatarURL string) error {
+	_, err := r.DB.Exec(`
+		INSERT INTO profiles (id, email, display_name, avatar_url, updated_at)
+		VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), NULLIF($4, ''), NOW())
+		ON CONFLICT (id) DO UPDATE SET
+			email = EXCLUDED.email, display_name = EXCLUDED.display_name,
+			avatar_url = EXCLUDED.avatar_url, updated_at = NOW()`,
+		userID, email, displayName, avatarURL)
+	if err != nil {
+		logger.Sugar.Errorf("Failed to upsert profile for user %s: %v", userID, err)
+	}
+	return err
+}
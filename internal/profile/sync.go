@@ -0,0 +1,69 @@
+// Package profile mirrors token identity details into the app-owned profiles
+// table, so reads never depend on access to Supabase's auth schema.
+package profile
+
+import (
+	"net/http"
+	"satunaskah/internal/profile/repository"
+	"satunaskah/middleware"
+	"sync"
+	"time"
+)
+
+// SyncInterval is how often an unchanged profile is rewritten.
+const SyncInterval = 10 * time.Minute
+
+type syncState struct {
+	key    string
+	syncAt time.Time
+}
+
+// Syncer upserts the authenticated user's profile at most once per
+// SyncInterval, or sooner when their token details change.
+type Syncer struct {
+	Repo *repository.ProfileRepository
+
+	mu   sync.Mutex
+	seen map[string]syncState // userID -> last synced details
+}
+
+func NewSyncer(repo *repository.ProfileRepository) *Syncer {
+	return &Syncer{Repo: repo, seen: make(map[string]syncState)}
+}
+
+// Middleware must run after AuthMiddleware. Sync failures are logged by the
+// repository and never fail the request.
+func (s *Syncer) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := r.Context().Value(middleware.UserIDKey).(string)
+		email, _ := r.Context().Value(middleware.EmailKey).(string)
+		name, _ := r.Context().Value(middleware.DisplayNameKey).(string)
+		avatar, _ := r.Context().Value(middleware.AvatarURLKey).(string)
+
+		if userID != "" && s.due(userID, email+"\x00"+name+"\x00"+avatar) {
+			if err := s.Repo.Upsert(userID, email, name, avatar); err != nil {
+				s.forget(userID)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// due reports whether userID needs a sync and, if so, records it as synced.
+func (s *Syncer) due(userID, key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if st, ok := s.seen[userID]; ok && st.key == key && now.Sub(st.syncAt) < SyncInterval {
+		return false
+	}
+	s.seen[userID] = syncState{key: key, syncAt: now}
+	return true
+}
+
+func (s *Syncer) forget(userID string) {
+	s.mu.Lock()
+	delete(s.seen, userID)
+	s.mu.Unlock()
+}
@@ -0,0 +1,106 @@
+// Package storage abstracts where document content (the Quill delta JSON)
+// lives, so large documents can move out of the documents row later without
+// touching the repository or hub.
+package storage
+
+import (
+	"database/sql"
+	"errors"
+
+	"satunaskah/pkg/logger"
+)
+
+// ErrNotFound means the store holds no content for the document, or no such
+// revision of it.
+var ErrNotFound = errors.New("document content not found")
+
+// RevisionsKept is how many of each document's latest revisions are kept;
+// older ones are pruned on save.
+const RevisionsKept = 200
+
+// ContentStore loads and saves a document's content. Implementations only
+// handle the content itself; callers keep documents metadata such as
+// updated_at and preview current.
+//
+// Revisions are snapshots: every Save stores the full content under the next
+// revision number (1 for the first save), so LoadRevision is a lookup rather
+// than a replay of edits. A save covers whatever the hub batched since the
+// previous one, not each keystroke.
+type ContentStore interface {
+	Load(docID string) ([]byte, error)
+	Save(docID string, content []byte) error
+	LoadRevision(docID string, revision int64) ([]byte, error)
+}
+
+// PostgresContentStore keeps content inline in the documents.content column.
+type PostgresContentStore struct {
+	DB *sql.DB
+}
+
+func NewPostgresContentStore(db *sql.DB) *PostgresContentStore {
+	return &PostgresContentStore{DB: db}
+}
+
+func (s *PostgresContentStore) Load(docID string) ([]byte, error) {
+	var content []byte
+	err := s.DB.QueryRow("SELECT content FROM documents WHERE id = $1", docID).Scan(&content)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		logger.Sugar.Errorf("Failed to load content of doc %s: %v", docID, err)
+	}
+	return content, err
+}
+
+// Save updates documents.content and records the snapshot in
+// document_revisions in one transaction. The documents row lock taken by the
+// update serializes concurrent saves, so revision numbers never collide.
+func (s *PostgresContentStore) Save(docID string, content []byte) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		logger.Sugar.Errorf("Failed to begin save of doc %s: %v", docID, err)
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE documents SET content = $1 WHERE id = $2", content, docID)
+	if err != nil {
+		logger.Sugar.Errorf("Failed to save content of doc %s: %v", docID, err)
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+
+	var revision int64
+	err = tx.QueryRow(`
+		INSERT INTO document_revisions (document_id, revision, content)
+		SELECT $1, COALESCE(MAX(revision), 0) + 1, $2 FROM document_revisions WHERE document_id = $1
+		RETURNING revision`, docID, content).Scan(&revision)
+	if err != nil {
+		logger.Sugar.Errorf("Failed to record revision of doc %s: %v", docID, err)
+		return err
+	}
+	if revision > RevisionsKept {
+		if _, err := tx.Exec("DELETE FROM document_revisions WHERE document_id = $1 AND revision <= $2",
+			docID, revision-RevisionsKept); err != nil {
+			logger.Sugar.Errorf("Failed to prune revisions of doc %s: %v", docID, err)
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresContentStore) LoadRevision(docID string, revision int64) ([]byte, error) {
+	var content []byte
+	err := s.DB.QueryRow("SELECT content FROM document_revisions WHERE document_id = $1 AND revision = $2",
+		docID, revision).Scan(&content)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		logger.Sugar.Errorf("Failed to load revision %d of doc %s: %v", revision, docID, err)
+	}
+	return content, err
+}
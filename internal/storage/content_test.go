@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"os"
+	"testing"
+
+	"satunaskah/pkg/logger"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(m *testing.M) {
+	logger.Init()
+	os.Exit(m.Run())
+}
+
+func TestPostgresContentStore(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	store := NewPostgresContentStore(db)
+	content := []byte(`{"ops":[{"insert":"hi\n"}]}`)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE documents SET content = \\$1 WHERE id = \\$2").
+		WithArgs(content, "doc-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("INSERT INTO document_revisions").
+		WithArgs("doc-1", content).
+		WillReturnRows(sqlmock.NewRows([]string{"revision"}).AddRow(RevisionsKept + 5))
+	mock.ExpectExec("DELETE FROM document_revisions").
+		WithArgs("doc-1", int64(5)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	require.NoError(t, store.Save("doc-1", content))
+
+	mock.ExpectQuery("SELECT content FROM documents WHERE id = \\$1").
+		WithArgs("doc-1").
+		WillReturnRows(sqlmock.NewRows([]string{"content"}).AddRow(content))
+	got, err := store.Load("doc-1")
+	require.NoError(t, err)
+	assert.Equal(t, content, got)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE documents SET content").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+	assert.ErrorIs(t, store.Save("gone", content), ErrNotFound)
+
+	mock.ExpectQuery("FROM document_revisions WHERE document_id = \\$1 AND revision = \\$2").
+		WithArgs("doc-1", int64(3)).
+		WillReturnRows(sqlmock.NewRows([]string{"content"}).AddRow(content))
+	got, err = store.LoadRevision("doc-1", 3)
+	require.NoError(t, err)
+	assert.Equal(t, content, got)
+
+	mock.ExpectQuery("FROM document_revisions").WillReturnRows(sqlmock.NewRows([]string{"content"}))
+	_, err = store.LoadRevision("doc-1", 999)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	mock.ExpectQuery("SELECT content FROM documents").WillReturnRows(sqlmock.NewRows([]string{"content"}))
+	_, err = store.Load("gone")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
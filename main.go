@@ -3,6 +3,7 @@ package main
 import (
 	"net/http"
 	"os"
+	"satunaskah/config"
 	"satunaskah/config/database"
 	"satunaskah/pkg/logger"
 	"satunaskah/router"
@@ -19,17 +20,38 @@ func main() {
 		logger.Sugar.Warn("No .env file found, using environment variables from OS")
 	}
 
-	db := database.Connect()
+	cfg, err := config.Load()
+	if err != nil {
+		logger.Sugar.Fatalf("Startup aborted: %v", err)
+	}
+
+	db := database.Connect(cfg.Database)
 	defer db.Close()
 
 	hub := socket.NewHub(db)
+	pingInterval, pongTimeout := hub.Keepalive()
+	logger.Sugar.Infof("WebSocket keepalive: ping every %s, disconnect after %s without pong", pingInterval, pongTimeout)
 	go hub.Run()
 	go hub.SaveWorker()
+	go hub.SweepWorker()
+
+	mux, docService := router.Setup(cfg, db, hub)
+	go docService.DeletedUserWorker()
+
+	// WriteTimeout only bounds ordinary HTTP responses: gorilla/websocket clears
+	// the connection deadlines when it hijacks the socket on upgrade, and the
+	// client write pump sets its own per-message write deadline after that.
+	srv := &http.Server{
+		Addr:              cfg.Server.Addr,
+		Handler:           mux,
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		ReadTimeout:       cfg.Server.ReadTimeout,
+		WriteTimeout:      cfg.Server.WriteTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
+	}
 
-	mux := router.Setup(db, hub)
-
-	logger.Log.Info("Go Backend listening on :8080")
-	if err := http.ListenAndServe(":8080", mux); err != nil {
+	logger.Sugar.Infof("Go Backend listening on %s", srv.Addr)
+	if err := srv.ListenAndServe(); err != nil {
 		logger.Sugar.Errorw("Server failed", "error", err)
 		os.Exit(1)
 	}
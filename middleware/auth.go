@@ -2,18 +2,15 @@ package middleware
 
 import (
 	"context"
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"math/big"
 	"net/http"
-	"os"
 	"strings"
 	"sync"
 	"time"
 
+	"satunaskah/pkg/env"
 	"satunaskah/pkg/logger"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -21,101 +18,156 @@ import (
 
 type contextKey string
 
-const UserIDKey contextKey = "userID"
+const (
+	UserIDKey      contextKey = "userID"
+	DisplayNameKey contextKey = "displayName" // Name sourced from the token, may be empty
+	IsAnonymousKey contextKey = "isAnonymous" // Supabase anonymous (guest) sign-in
+	EmailKey       contextKey = "email"       // Email claim, empty for guests
+	AvatarURLKey   contextKey = "avatarURL"   // user_metadata.avatar_url, may be empty
+)
 
-// --- JWKS Caching Logic ---
+// AllowedJWTAlgs are the only signing algorithms accepted, whatever the token
+// header claims: Supabase's legacy HS256 secret and its ES256 signing keys.
+var AllowedJWTAlgs = []string{"HS256", "ES256"}
 
-var (
-	jwksCache     = make(map[string]*ecdsa.PublicKey)
-	jwksCacheMux  sync.RWMutex
-	lastJWKSFetch time.Time
-)
+// DefaultJWTLeeway is the clock skew tolerated on exp/nbf/iat when JWT_LEEWAY is unset.
+const DefaultJWTLeeway = 30 * time.Second
 
-type JWKS struct {
-	Keys []JWK `json:"keys"`
+// withinLeewayOnly reports whether claims are valid only because of leeway,
+// i.e. the token is already expired or not yet valid by the server's clock.
+func withinLeewayOnly(claims jwt.MapClaims, now time.Time) bool {
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil && now.After(exp.Time) {
+		return true
+	}
+	if nbf, err := claims.GetNotBefore(); err == nil && nbf != nil && now.Before(nbf.Time) {
+		return true
+	}
+	return false
 }
 
-type JWK struct {
-	Kid string `json:"kid"`
-	Kty string `json:"kty"`
-	Alg string `json:"alg"`
-	Crv string `json:"crv"`
-	X   string `json:"x"`
-	Y   string `json:"y"`
+// AuthErrorHeader repeats the 401 error code ("no_token", "token_expired" or
+// "invalid_token") as a plain header, so clients that can only see response
+// headers, such as a failed WebSocket handshake probed with fetch, can tell
+// the cases apart.
+const AuthErrorHeader = "X-Auth-Error"
+
+// tokenError is the JSON body of a 401 caused by a missing or bad bearer
+// token. Code is "no_token" when none was sent, "token_expired" when the
+// client should refresh its session and retry, or "invalid_token" when it must
+// sign in again.
+type tokenError struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
 }
 
-func getSupabasePublicKey(kid string) (*ecdsa.PublicKey, error) {
-	// 1. Check Cache (Read Lock)
-	jwksCacheMux.RLock()
-	key, exists := jwksCache[kid]
-	jwksCacheMux.RUnlock()
-	if exists {
-		return key, nil
+// writeTokenError sends a 401 with an RFC 6750 WWW-Authenticate challenge. An
+// empty description sends the bare challenge used when no token was given.
+func writeTokenError(w http.ResponseWriter, code, description, message string) {
+	challenge := "Bearer"
+	if description != "" {
+		challenge = fmt.Sprintf(`Bearer error="invalid_token", error_description=%q`, description)
 	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	w.Header().Set(AuthErrorHeader, code)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(tokenError{Error: code, Message: message})
+}
 
-	// 2. Fetch from Supabase (Write Lock)
-	jwksCacheMux.Lock()
-	defer jwksCacheMux.Unlock()
+// AuthConfig holds everything the auth middleware needs to verify tokens.
+type AuthConfig struct {
+	JWTSecret   string        // HS256 secret; HS256 tokens are rejected when empty
+	SupabaseURL string        // Project URL serving the ES256 JWKS; ES256 tokens are rejected when empty
+	Audience    string        // Required "aud" claim; empty skips the check
+	Leeway      time.Duration // Clock skew tolerated on exp/nbf/iat
+	HTTPClient  *http.Client  // Used for JWKS fetches; a client with DefaultJWKSTimeout when nil
+}
 
-	// Double-check cache in case another goroutine just updated it
-	if key, exists := jwksCache[kid]; exists {
-		return key, nil
+// AuthConfigFromEnv reads AuthConfig from SUPABASE_JWT_SECRET, SUPABASE_URL,
+// JWT_AUDIENCE and JWT_LEEWAY.
+func AuthConfigFromEnv() AuthConfig {
+	return AuthConfig{
+		JWTSecret:   env.String("SUPABASE_JWT_SECRET", ""),
+		SupabaseURL: strings.TrimRight(env.String("SUPABASE_URL", ""), "/"),
+		Audience:    env.String("JWT_AUDIENCE", ""),
+		// Tolerate small client clock skew (mobile devices) on time-based claims.
+		Leeway: env.Duration("JWT_LEEWAY", DefaultJWTLeeway),
 	}
+}
 
-	// Rate limit: Don't fetch more than once every 10 seconds
-	if time.Since(lastJWKSFetch) < 10*time.Second {
-		logger.Sugar.Infof("DEBUG: Rate limit active. Key %s not found in cache.", kid)
-		return nil, fmt.Errorf("key %s not found (rate limit active)", kid)
-	}
+// authenticator verifies bearer tokens against one AuthConfig and owns the
+// JWKS key cache for it.
+type authenticator struct {
+	cfg  AuthConfig
+	keys *jwksKeys
+}
 
-	supabaseURL := os.Getenv("SUPABASE_URL")
-	if supabaseURL == "" {
-		logger.Sugar.Error("ERROR: SUPABASE_URL environment variable is not set")
-		return nil, fmt.Errorf("SUPABASE_URL environment variable is not set")
+func newAuthenticator(cfg AuthConfig) *authenticator {
+	client := cfg.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: DefaultJWKSTimeout}
 	}
+	return &authenticator{cfg: cfg, keys: newJWKSKeys(cfg.SupabaseURL, client)}
+}
 
-	logger.Sugar.Infof("DEBUG: Fetching JWKS from %s/auth/v1/.well-known/jwks.json", supabaseURL)
-	resp, err := http.Get(supabaseURL + "/auth/v1/.well-known/jwks.json")
-	if err != nil {
-		logger.Sugar.Errorf("ERROR: Failed to fetch JWKS: %v", err)
-		return nil, fmt.Errorf("failed to fetch JWKS: %v", err)
-	}
-	defer resp.Body.Close()
+// NewAuthMiddleware returns middleware that rejects requests without a valid
+// Supabase JWT and puts the caller's identity in the request context.
+func NewAuthMiddleware(cfg AuthConfig) func(http.Handler) http.Handler {
+	return newAuthenticator(cfg).wrap
+}
 
-	var jwks JWKS
-	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
-		logger.Sugar.Errorf("ERROR: Failed to decode JWKS JSON: %v", err)
-		return nil, fmt.Errorf("failed to decode JWKS: %v", err)
-	}
+var (
+	defaultAuthOnce sync.Once
+	defaultAuth     func(http.Handler) http.Handler
+)
 
-	lastJWKSFetch = time.Now()
-	logger.Sugar.Infof("DEBUG: Fetched %d keys from Supabase", len(jwks.Keys))
-
-	// Parse and cache keys
-	for _, k := range jwks.Keys {
-		if k.Kty == "EC" && k.Crv == "P-256" {
-			xBytes, _ := base64.RawURLEncoding.DecodeString(k.X)
-			yBytes, _ := base64.RawURLEncoding.DecodeString(k.Y)
-
-			if len(xBytes) > 0 && len(yBytes) > 0 {
-				jwksCache[k.Kid] = &ecdsa.PublicKey{
-					Curve: elliptic.P256(),
-					X:     new(big.Int).SetBytes(xBytes),
-					Y:     new(big.Int).SetBytes(yBytes),
-				}
-			}
+// AuthMiddleware is NewAuthMiddleware with AuthConfigFromEnv, read once on
+// first use. Every call shares the same JWKS cache.
+func AuthMiddleware(next http.Handler) http.Handler {
+	defaultAuthOnce.Do(func() {
+		defaultAuth = NewAuthMiddleware(AuthConfigFromEnv())
+	})
+	return defaultAuth(next)
+}
+
+// keyFunc picks the verification key for token by its signing method. ctx
+// bounds any JWKS fetch it needs.
+func (a *authenticator) keyFunc(ctx context.Context, token *jwt.Token) (interface{}, error) {
+	// 1. Check for HMAC (HS256) - Standard Supabase Token
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		if a.cfg.JWTSecret == "" {
+			logger.Sugar.Error("ERROR: HS256 token received but no JWT secret is configured")
+			return nil, fmt.Errorf("server is not configured to validate HS256 JWTs")
 		}
+		return []byte(a.cfg.JWTSecret), nil
 	}
 
-	if key, exists := jwksCache[kid]; exists {
+	// 2. Check for ECDSA (ES256) - Fetch Public Key from Supabase JWKS
+	if _, ok := token.Method.(*jwt.SigningMethodECDSA); ok {
+		kid, ok := token.Header["kid"].(string)
+		if !ok {
+			logger.Sugar.Error("ERROR: Token header missing 'kid'")
+			return nil, fmt.Errorf("missing 'kid' header in token")
+		}
+		key, err := a.keys.get(ctx, kid)
+		if err != nil {
+			logger.Sugar.Errorf("ERROR: Failed to get public key for kid %s: %v", kid, err)
+			return nil, err
+		}
 		return key, nil
 	}
 
-	logger.Sugar.Errorf("ERROR: Key ID %s not found in Supabase JWKS", kid)
-	return nil, fmt.Errorf("key id %s not found in Supabase JWKS", kid)
+	logger.Sugar.Errorf("ERROR: Unexpected signing method: %v", token.Header["alg"])
+	return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 }
 
-func AuthMiddleware(next http.Handler) http.Handler {
+func (a *authenticator) wrap(next http.Handler) http.Handler {
+	leeway := a.cfg.Leeway
+	opts := []jwt.ParserOption{jwt.WithValidMethods(AllowedJWTAlgs), jwt.WithLeeway(leeway)}
+	if a.cfg.Audience != "" {
+		opts = append(opts, jwt.WithAudience(a.cfg.Audience))
+	}
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// 7. A user tries to connect. The middleware intercepts the request and looks for the JWT token.
 		// For WebSockets, tokens are often passed in the query string
@@ -130,44 +182,23 @@ func AuthMiddleware(next http.Handler) http.Handler {
 
 		if tokenString == "" {
 			logger.Sugar.Info("DEBUG: No token provided in request")
-			http.Error(w, "Unauthorized: No token provided", http.StatusUnauthorized)
+			writeTokenError(w, "no_token", "", "No token provided; pass it as ?token= or a Bearer header")
 			return
 		}
 
 		// Validate Token
 		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			// 1. Check for HMAC (HS256) - Standard Supabase Token
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
-				jwtSecret := os.Getenv("SUPABASE_JWT_SECRET")
-				if jwtSecret == "" {
-					logger.Sugar.Fatal("FATAL: SUPABASE_JWT_SECRET environment variable not set.")
-					return nil, fmt.Errorf("server is not configured to validate JWTs")
-				}
-				return []byte(jwtSecret), nil
-			}
-
-			// 2. Check for ECDSA (ES256) - Fetch Public Key from Supabase JWKS
-			if _, ok := token.Method.(*jwt.SigningMethodECDSA); ok {
-				kid, ok := token.Header["kid"].(string)
-				if !ok {
-					logger.Sugar.Error("ERROR: Token header missing 'kid'")
-					return nil, fmt.Errorf("missing 'kid' header in token")
-				}
-				key, err := getSupabasePublicKey(kid)
-				if err != nil {
-					logger.Sugar.Errorf("ERROR: Failed to get public key for kid %s: %v", kid, err)
-					return nil, err
-				}
-				return key, nil
-			}
-
-			logger.Sugar.Errorf("ERROR: Unexpected signing method: %v", token.Header["alg"])
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		})
+			return a.keyFunc(r.Context(), token)
+		}, opts...)
 
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			logger.Sugar.Infof("Expired token: %v", err)
+			writeTokenError(w, "token_expired", "expired", "Token has expired; refresh and retry")
+			return
+		}
 		if err != nil || !token.Valid {
 			logger.Sugar.Warnf("Invalid token: %v", err)
-			http.Error(w, "Unauthorized: Invalid or expired token", http.StatusUnauthorized)
+			writeTokenError(w, "invalid_token", "invalid", "Token is malformed or its signature is invalid")
 			return
 		}
 
@@ -175,19 +206,49 @@ func AuthMiddleware(next http.Handler) http.Handler {
 		claims, ok := token.Claims.(jwt.MapClaims)
 		if !ok {
 			logger.Sugar.Error("ERROR: Could not parse token claims")
-			http.Error(w, "Unauthorized: Could not parse token claims", http.StatusUnauthorized)
+			writeTokenError(w, "invalid_token", "invalid", "Could not parse token claims")
 			return
 		}
+		if leeway > 0 && withinLeewayOnly(claims, time.Now()) {
+			logger.Sugar.Debugf("Token for sub %v accepted within %s clock skew leeway", claims["sub"], leeway)
+		}
 		// It extracts the user ID (the 'sub' claim) from the token.
 		userID, ok := claims["sub"].(string)
 		if !ok {
 			logger.Sugar.Error("ERROR: User ID (sub) claim is missing or invalid")
-			http.Error(w, "Unauthorized: User ID (sub) claim is missing or invalid", http.StatusUnauthorized)
+			writeTokenError(w, "invalid_token", "invalid", "User ID (sub) claim is missing or invalid")
 			return
 		}
 		// If the token is valid and the user ID is found, it adds the userID to the request's context.
 		// The request is then passed to the next handler in the chain (our wsHandler from main.go).
 		ctx := context.WithValue(r.Context(), UserIDKey, userID)
+		ctx = context.WithValue(ctx, DisplayNameKey, displayNameFromClaims(claims))
+		isAnonymous, _ := claims["is_anonymous"].(bool)
+		ctx = context.WithValue(ctx, IsAnonymousKey, isAnonymous)
+		email, _ := claims["email"].(string)
+		ctx = context.WithValue(ctx, EmailKey, email)
+		ctx = context.WithValue(ctx, AvatarURLKey, avatarURLFromClaims(claims))
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// displayNameFromClaims picks a display name from Supabase user metadata,
+// falling back to the email claim.
+func displayNameFromClaims(claims jwt.MapClaims) string {
+	if meta, ok := claims["user_metadata"].(map[string]interface{}); ok {
+		for _, key := range []string{"full_name", "name"} {
+			if name, ok := meta[key].(string); ok && strings.TrimSpace(name) != "" {
+				return strings.TrimSpace(name)
+			}
+		}
+	}
+	email, _ := claims["email"].(string)
+	return email
+}
+
+// avatarURLFromClaims reads the avatar Supabase stores in user metadata.
+func avatarURLFromClaims(claims jwt.MapClaims) string {
+	meta, _ := claims["user_metadata"].(map[string]interface{})
+	avatar, _ := meta["avatar_url"].(string)
+	return strings.TrimSpace(avatar)
+}
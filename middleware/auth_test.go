@@ -0,0 +1,155 @@
+package middleware
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"satunaskah/pkg/logger"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testSecret = "test-secret"
+
+func TestMain(m *testing.M) {
+	logger.Init()
+	os.Exit(m.Run())
+}
+
+// newTestAuth returns an authenticator that trusts testSecret for HS256.
+func newTestAuth() *authenticator {
+	return newAuthenticator(AuthConfig{JWTSecret: testSecret, Leeway: DefaultJWTLeeway})
+}
+
+// authStatus runs a request carrying token through a and returns the status code.
+func authStatus(t *testing.T, a *authenticator, token string) int {
+	t.Helper()
+	return authRequest(t, a, token).Code
+}
+
+func authRequest(t *testing.T, a *authenticator, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	h := a.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func testClaims() jwt.MapClaims {
+	return jwt.MapClaims{"sub": "user-1", "exp": time.Now().Add(time.Hour).Unix()}
+}
+
+// withECKey installs a P-256 key in a's JWKS cache under kid.
+func withECKey(t *testing.T, a *authenticator, kid string) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	a.keys.mu.Lock()
+	a.keys.cache[kid] = &key.PublicKey
+	a.keys.mu.Unlock()
+	return key
+}
+
+func TestAuthMiddlewareAcceptsAllowedAlgorithms(t *testing.T) {
+	a := newTestAuth()
+
+	hs, err := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims()).SignedString([]byte(testSecret))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, authStatus(t, a, hs))
+
+	key := withECKey(t, a, "es256-key")
+	es := jwt.NewWithClaims(jwt.SigningMethodES256, testClaims())
+	es.Header["kid"] = "es256-key"
+	signed, err := es.SignedString(key)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, authStatus(t, a, signed))
+}
+
+func TestAuthMiddlewareRejectsUnexpectedAlgorithms(t *testing.T) {
+	a := newTestAuth()
+
+	// Same HMAC secret, but an algorithm outside the allowlist.
+	hs512, err := jwt.NewWithClaims(jwt.SigningMethodHS512, testClaims()).SignedString([]byte(testSecret))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, authStatus(t, a, hs512))
+
+	none, err := jwt.NewWithClaims(jwt.SigningMethodNone, testClaims()).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, authStatus(t, a, none))
+
+	// ECDSA with a different curve/hash than ES256.
+	key384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	withECKey(t, a, "es384-key")
+	es384 := jwt.NewWithClaims(jwt.SigningMethodES384, testClaims())
+	es384.Header["kid"] = "es384-key"
+	signed, err := es384.SignedString(key384)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, authStatus(t, a, signed))
+}
+
+func TestAuthMiddlewareDistinguishesExpiredTokens(t *testing.T) {
+	a := newTestAuth()
+
+	expired, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub": "user-1",
+		"exp": time.Now().Add(-time.Hour).Unix(),
+	}).SignedString([]byte(testSecret))
+	require.NoError(t, err)
+
+	rec := authRequest(t, a, expired)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, `Bearer error="invalid_token", error_description="expired"`, rec.Header().Get("WWW-Authenticate"))
+	assert.Contains(t, rec.Body.String(), `"error":"token_expired"`)
+	assert.Equal(t, "token_expired", rec.Header().Get(AuthErrorHeader))
+
+	wrongKey, err := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims()).SignedString([]byte("other-secret"))
+	require.NoError(t, err)
+
+	rec = authRequest(t, a, wrongKey)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, `Bearer error="invalid_token", error_description="invalid"`, rec.Header().Get("WWW-Authenticate"))
+	assert.Contains(t, rec.Body.String(), `"error":"invalid_token"`)
+	assert.Equal(t, "invalid_token", rec.Header().Get(AuthErrorHeader))
+
+	rec = authRequest(t, a, "")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, "Bearer", rec.Header().Get("WWW-Authenticate"))
+	assert.Equal(t, "no_token", rec.Header().Get(AuthErrorHeader))
+	assert.Contains(t, rec.Body.String(), `"error":"no_token"`)
+}
+
+func TestAuthMiddlewareChecksAudience(t *testing.T) {
+	a := newAuthenticator(AuthConfig{JWTSecret: testSecret, Audience: "authenticated"})
+
+	claims := testClaims()
+	claims["aud"] = "authenticated"
+	ok, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(testSecret))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, authStatus(t, a, ok))
+
+	claims["aud"] = "anon"
+	wrong, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(testSecret))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, authStatus(t, a, wrong))
+}
+
+func TestAuthMiddlewareWithoutSecretRejectsHS256(t *testing.T) {
+	a := newAuthenticator(AuthConfig{SupabaseURL: "https://project.supabase.co"})
+
+	hs, err := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims()).SignedString([]byte(testSecret))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, authStatus(t, a, hs))
+}
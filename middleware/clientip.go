@@ -0,0 +1,93 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"satunaskah/pkg/env"
+)
+
+// ProxyConfig lists the reverse proxies (load balancers, the hosting
+// platform's edge) whose forwarding headers are believed.
+type ProxyConfig struct {
+	TrustedProxies []*net.IPNet
+	Invalid        []string // TRUSTED_PROXIES entries that did not parse; reported by config validation
+}
+
+// ProxyConfigFromEnv reads ProxyConfig from TRUSTED_PROXIES, a comma
+// separated list of IPs and CIDRs. Empty by default: no proxy is trusted.
+func ProxyConfigFromEnv() ProxyConfig {
+	var cfg ProxyConfig
+	for _, entry := range strings.Split(env.String("TRUSTED_PROXIES", ""), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil {
+				bits := 8 * len(ip.To16())
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 32
+				}
+				cfg.TrustedProxies = append(cfg.TrustedProxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+		} else if _, network, err := net.ParseCIDR(entry); err == nil {
+			cfg.TrustedProxies = append(cfg.TrustedProxies, network)
+			continue
+		}
+		cfg.Invalid = append(cfg.Invalid, entry)
+	}
+	return cfg
+}
+
+// trusted reports whether ip belongs to a trusted proxy.
+func (c ProxyConfig) trusted(ip net.IP) bool {
+	for _, network := range c.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client behind r. Forwarding headers
+// are only read when the direct peer is a trusted proxy, since anyone can
+// send them: X-Forwarded-For is walked from the right past trusted proxies,
+// and the first address they did not add is the client. Without it
+// X-Real-IP is used, and otherwise the peer address.
+func (c ProxyConfig) ClientIP(r *http.Request) string {
+	peer := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+	peerIP := net.ParseIP(peer)
+	if peerIP == nil || !c.trusted(peerIP) {
+		return peer
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	if len(hops) > 0 {
+		client := peerIP
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(hops[i]))
+			if ip == nil {
+				break // Garbage, so the hop before it can't be vouched for
+			}
+			client = ip
+			if !c.trusted(ip) {
+				break
+			}
+		}
+		return client.String()
+	}
+
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+	return peer
+}
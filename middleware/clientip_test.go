@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientIPTrustsOnlyConfiguredProxies(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 192.168.1.1, bogus")
+	cfg := ProxyConfigFromEnv()
+	assert.Equal(t, []string{"bogus"}, cfg.Invalid)
+
+	request := func(remote string, headers ...string) string {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remote
+		for i := 0; i+1 < len(headers); i += 2 {
+			r.Header.Add(headers[i], headers[i+1])
+		}
+		return cfg.ClientIP(r)
+	}
+
+	// Headers from an untrusted peer are ignored.
+	assert.Equal(t, "203.0.113.9", request("203.0.113.9:5000", "X-Forwarded-For", "1.2.3.4"))
+	// The rightmost address not added by a trusted proxy is the client; a
+	// spoofed entry further left is not believed.
+	assert.Equal(t, "198.51.100.7", request("10.1.2.3:5000", "X-Forwarded-For", "1.2.3.4, 198.51.100.7, 10.9.9.9"))
+	assert.Equal(t, "198.51.100.7", request("192.168.1.1:5000", "X-Forwarded-For", "198.51.100.7"))
+	// Every hop trusted: the leftmost is as far back as it goes.
+	assert.Equal(t, "10.0.0.5", request("10.1.2.3:5000", "X-Forwarded-For", "10.0.0.5"))
+	assert.Equal(t, "198.51.100.8", request("10.1.2.3:5000", "X-Real-IP", "198.51.100.8"))
+	assert.Equal(t, "10.1.2.3", request("10.1.2.3:5000"))
+	assert.Equal(t, "192.168.1.2", request("192.168.1.2:5000", "X-Real-IP", "198.51.100.8"))
+}
@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// RequireContentType returns middleware that answers 415 Unsupported Media
+// Type to requests whose body is not one of the given media types (e.g.
+// "application/json"). Parameters such as charset are ignored. Requests
+// without a body pass, so endpoints whose body is optional keep working.
+func RequireContentType(types ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Body == nil || r.Body == http.NoBody {
+				next.ServeHTTP(w, r)
+				return
+			}
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err == nil {
+				for _, t := range types {
+					if strings.EqualFold(mediaType, t) {
+						next.ServeHTTP(w, r)
+						return
+					}
+				}
+			}
+			w.Header().Set("Accept", strings.Join(types, ", "))
+			http.Error(w, "Unsupported Content-Type, expected "+strings.Join(types, " or "), http.StatusUnsupportedMediaType)
+		})
+	}
+}
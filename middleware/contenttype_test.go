@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequireContentType(t *testing.T) {
+	h := RequireContentType("application/json")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	cases := []struct {
+		contentType string
+		body        string
+		want        int
+	}{
+		{"application/json", `{}`, http.StatusNoContent},
+		{"Application/JSON; charset=utf-8", `{}`, http.StatusNoContent},
+		{"text/plain", `{}`, http.StatusUnsupportedMediaType},
+		{"application/x-www-form-urlencoded", `a=b`, http.StatusUnsupportedMediaType},
+		{"", `{}`, http.StatusUnsupportedMediaType},
+		{"", "", http.StatusNoContent}, // No body to check
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodPost, "/api/documents/save", strings.NewReader(c.body))
+		if c.body == "" {
+			req.Body = http.NoBody
+		}
+		if c.contentType != "" {
+			req.Header.Set("Content-Type", c.contentType)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		assert.Equal(t, c.want, rec.Code, "Content-Type %q", c.contentType)
+	}
+}
@@ -1,21 +1,121 @@
 package middleware
 
-import "net/http"
-
-// CORSMiddleware handles Cross-Origin Resource Sharing headers
-func CORSMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Allow requests from any origin
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
-
-		// Handle preflight OPTIONS request immediately
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusOK)
-			return
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"satunaskah/pkg/env"
+)
+
+// Request headers browsers may send cross-origin, and response headers
+// scripts may read.
+const (
+	corsAllowHeaders  = "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, Idempotency-Key, X-Request-ID"
+	corsExposeHeaders = "WWW-Authenticate, " + AuthErrorHeader + ", X-Request-ID, Retry-After, Content-Disposition"
+	corsAllowMethods  = "POST, GET, OPTIONS, PUT, DELETE"
+)
+
+// DefaultCORSMaxAge is how long browsers may cache a preflight response.
+const DefaultCORSMaxAge = 10 * time.Minute
+
+// CORSConfig decides which browser origins may call the API and open
+// WebSockets.
+type CORSConfig struct {
+	AllowedOrigins   []string      // Exact origins, e.g. https://app.example.com; "*" allows any
+	AllowCredentials bool          // Send Access-Control-Allow-Credentials; needs explicit origins
+	MaxAge           time.Duration // Preflight cache lifetime
+}
+
+// CORSConfigFromEnv reads CORSConfig from CORS_ALLOWED_ORIGINS (comma
+// separated, "*" by default) and CORS_ALLOW_CREDENTIALS.
+func CORSConfigFromEnv() CORSConfig {
+	var origins []string
+	for _, o := range strings.Split(env.String("CORS_ALLOWED_ORIGINS", "*"), ",") {
+		if o = strings.TrimRight(strings.TrimSpace(o), "/"); o != "" {
+			origins = append(origins, o)
 		}
+	}
+	return CORSConfig{
+		AllowedOrigins:   origins,
+		AllowCredentials: env.Bool("CORS_ALLOW_CREDENTIALS", false),
+		MaxAge:           DefaultCORSMaxAge,
+	}
+}
+
+// AllowsAnyOrigin reports whether AllowedOrigins contains "*".
+func (c CORSConfig) AllowsAnyOrigin() bool {
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsOrigin reports whether a browser at origin may make requests.
+func (c CORSConfig) AllowsOrigin(origin string) bool {
+	for _, o := range c.AllowedOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckOrigin is the WebSocket handshake's origin check. Requests without an
+// Origin header come from non-browser clients and are allowed; browsers must
+// send an allowed origin, as for REST calls.
+func (c CORSConfig) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	return origin == "" || c.AllowsOrigin(origin)
+}
+
+// NewCORSMiddleware returns middleware that sets CORS headers for allowed
+// origins and answers preflight requests itself. With credentials, or with a
+// list of origins, the caller's origin is echoed rather than "*".
+func NewCORSMiddleware(cfg CORSConfig) func(http.Handler) http.Handler {
+	anyOrigin := cfg.AllowsAnyOrigin() && !cfg.AllowCredentials
+	maxAge := strconv.Itoa(int(cfg.MaxAge.Seconds()))
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			allowed := origin != "" && cfg.AllowsOrigin(origin)
+
+			h := w.Header()
+			if !anyOrigin {
+				// The response differs by origin, so caches must key on it.
+				h.Add("Vary", "Origin")
+			}
+			if allowed {
+				if anyOrigin {
+					h.Set("Access-Control-Allow-Origin", "*")
+				} else {
+					h.Set("Access-Control-Allow-Origin", origin)
+				}
+				if cfg.AllowCredentials {
+					h.Set("Access-Control-Allow-Credentials", "true")
+				}
+				// Let the frontend read the 401 challenge to tell expired tokens from invalid ones.
+				h.Set("Access-Control-Expose-Headers", corsExposeHeaders)
+			}
+
+			// Handle preflight OPTIONS request immediately
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				if !allowed {
+					http.Error(w, "Origin not allowed", http.StatusForbidden)
+					return
+				}
+				h.Set("Access-Control-Allow-Methods", corsAllowMethods)
+				h.Set("Access-Control-Allow-Headers", corsAllowHeaders)
+				h.Set("Access-Control-Max-Age", maxAge)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
 
-		next.ServeHTTP(w, r)
-	})
+			next.ServeHTTP(w, r)
+		})
+	}
 }
@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// preflight sends an OPTIONS preflight from origin through cfg's middleware.
+func preflight(t *testing.T, cfg CORSConfig, origin string) *httptest.ResponseRecorder {
+	t.Helper()
+	h := NewCORSMiddleware(cfg)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("preflight reached the handler")
+	}))
+	req := httptest.NewRequest(http.MethodOptions, "/api/documents/create", nil)
+	req.Header.Set("Origin", origin)
+	req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	req.Header.Set("Access-Control-Request-Headers", "authorization, idempotency-key, x-request-id")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestPreflightAnyOrigin(t *testing.T) {
+	rec := preflight(t, CORSConfig{AllowedOrigins: []string{"*"}, MaxAge: DefaultCORSMaxAge}, "https://app.example.com")
+
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "*", rec.Header().Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "600", rec.Header().Get("Access-Control-Max-Age"))
+	for _, header := range []string{"Authorization", "Idempotency-Key", "X-Request-ID"} {
+		assert.Contains(t, rec.Header().Get("Access-Control-Allow-Headers"), header)
+	}
+}
+
+func TestPreflightWithCredentialsEchoesOrigin(t *testing.T) {
+	cfg := CORSConfig{AllowedOrigins: []string{"https://app.example.com"}, AllowCredentials: true}
+	rec := preflight(t, cfg, "https://app.example.com")
+
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "https://app.example.com", rec.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", rec.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "Origin", rec.Header().Get("Vary"))
+
+	rec = preflight(t, cfg, "https://evil.example.com")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Credentials"))
+}
+
+func TestCORSOnActualRequest(t *testing.T) {
+	cfg := CORSConfig{AllowedOrigins: []string{"https://app.example.com"}}
+	h := NewCORSMiddleware(cfg)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/documents", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusTeapot, rec.Code)
+	assert.Equal(t, "https://app.example.com", rec.Header().Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, rec.Header().Get("Access-Control-Expose-Headers"), AuthErrorHeader)
+
+	// Other origins still reach the handler but get no CORS headers, so the
+	// browser withholds the response.
+	req.Header.Set("Origin", "https://evil.example.com")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusTeapot, rec.Code)
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestCheckOrigin(t *testing.T) {
+	cfg := CORSConfig{AllowedOrigins: []string{"https://app.example.com"}}
+	req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	assert.True(t, cfg.CheckOrigin(req), "non-browser clients send no Origin")
+
+	req.Header.Set("Origin", "https://APP.example.com")
+	assert.True(t, cfg.CheckOrigin(req))
+	req.Header.Set("Origin", "https://evil.example.com")
+	assert.False(t, cfg.CheckOrigin(req))
+}
@@ -0,0 +1,268 @@
+package middleware
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"satunaskah/pkg/logger"
+)
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+type JWK struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// DefaultJWKSTimeout bounds a JWKS fetch when AuthConfig has no HTTPClient,
+// so a slow Supabase endpoint fails the request instead of hanging it.
+const DefaultJWKSTimeout = 5 * time.Second
+
+// jwksMinRefresh rate-limits JWKS fetches triggered by unknown key ids.
+const jwksMinRefresh = 10 * time.Second
+
+// jwksKeys caches the ES256 public keys published by a Supabase project.
+type jwksKeys struct {
+	supabaseURL string
+	client      *http.Client
+
+	mu        sync.RWMutex
+	cache     map[string]*ecdsa.PublicKey
+	lastFetch time.Time  // When the last fetch started
+	inflight  *jwksFetch // The fetch under way, shared by everyone waiting on it
+}
+
+// jwksFetch is one JWKS fetch; err is set before done is closed.
+type jwksFetch struct {
+	done chan struct{}
+	err  error
+}
+
+func newJWKSKeys(supabaseURL string, client *http.Client) *jwksKeys {
+	return &jwksKeys{
+		supabaseURL: supabaseURL,
+		client:      client,
+		cache:       make(map[string]*ecdsa.PublicKey),
+	}
+}
+
+// get returns the key for kid, fetching the JWKS when it isn't cached yet.
+// Concurrent misses share one fetch, which runs without holding mu so
+// cached keys keep being served. The caller stops waiting when ctx ends; the
+// fetch carries on for the others, bounded by the HTTP client's timeout.
+func (k *jwksKeys) get(ctx context.Context, kid string) (*ecdsa.PublicKey, error) {
+	// 1. Check Cache (Read Lock)
+	k.mu.RLock()
+	key, exists := k.cache[kid]
+	k.mu.RUnlock()
+	if exists {
+		return key, nil
+	}
+
+	// 2. Join or start a fetch (Write Lock)
+	k.mu.Lock()
+	// Double-check cache in case another goroutine just updated it
+	if key, exists := k.cache[kid]; exists {
+		k.mu.Unlock()
+		return key, nil
+	}
+	f := k.inflight
+	if f == nil {
+		// Rate limit: Don't fetch more than once every 10 seconds
+		if time.Since(k.lastFetch) < jwksMinRefresh {
+			k.mu.Unlock()
+			logger.Sugar.Infof("DEBUG: Rate limit active. Key %s not found in cache.", kid)
+			return nil, fmt.Errorf("key %s not found (rate limit active)", kid)
+		}
+		if k.supabaseURL == "" {
+			k.mu.Unlock()
+			logger.Sugar.Error("ERROR: ES256 token received but no Supabase URL is configured")
+			return nil, fmt.Errorf("Supabase URL is not configured")
+		}
+		// Counted from the start, so neither failures nor callers giving up
+		// let the next miss fetch again at once.
+		k.lastFetch = time.Now()
+		f = &jwksFetch{done: make(chan struct{})}
+		k.inflight = f
+		go k.refresh(f)
+	}
+	k.mu.Unlock()
+
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	k.mu.RLock()
+	key, exists = k.cache[kid]
+	k.mu.RUnlock()
+	if exists {
+		return key, nil
+	}
+	logger.Sugar.Errorf("ERROR: Key ID %s not found in Supabase JWKS", kid)
+	return nil, fmt.Errorf("key id %s not found in Supabase JWKS", kid)
+}
+
+// refresh runs f and caches the keys it finds.
+func (k *jwksKeys) refresh(f *jwksFetch) {
+	jwks, err := k.fetch(context.Background())
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.inflight = nil
+	f.err = err
+	defer close(f.done)
+	if err != nil {
+		return
+	}
+	logger.Sugar.Infof("DEBUG: Fetched %d keys from Supabase", len(jwks.Keys))
+
+	// Parse and cache keys
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty == "EC" && jwk.Crv == "P-256" {
+			xBytes, _ := base64.RawURLEncoding.DecodeString(jwk.X)
+			yBytes, _ := base64.RawURLEncoding.DecodeString(jwk.Y)
+
+			if len(xBytes) > 0 && len(yBytes) > 0 {
+				k.cache[jwk.Kid] = &ecdsa.PublicKey{
+					Curve: elliptic.P256(),
+					X:     new(big.Int).SetBytes(xBytes),
+					Y:     new(big.Int).SetBytes(yBytes),
+				}
+			}
+		}
+	}
+}
+
+// jwksRetryDelays are the pauses between JWKS fetch attempts, so a momentary
+// network or DNS failure doesn't fail every ES256 request until the rate
+// limit allows another fetch.
+var jwksRetryDelays = []time.Duration{50 * time.Millisecond, 150 * time.Millisecond}
+
+// fetch downloads the JWKS, retrying transport errors and 5xx or 429
+// responses with backoff. Other responses fail at once.
+func (k *jwksKeys) fetch(ctx context.Context) (*JWKS, error) {
+	jwksURL := k.supabaseURL + "/auth/v1/.well-known/jwks.json"
+	for attempt := 0; ; attempt++ {
+		jwks, retry, err := k.fetchOnce(ctx, jwksURL)
+		if err == nil || !retry || attempt == len(jwksRetryDelays) {
+			return jwks, err
+		}
+		logger.Sugar.Warnf("JWKS fetch attempt %d failed, retrying: %v", attempt+1, err)
+		select {
+		case <-time.After(jwksRetryDelays[attempt]):
+		case <-ctx.Done():
+			return nil, err
+		}
+	}
+}
+
+// fetchOnce makes a single JWKS request. retry reports whether a failure
+// may be transient.
+func (k *jwksKeys) fetchOnce(ctx context.Context, jwksURL string) (jwks *JWKS, retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, jwksURL, nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to build JWKS request: %v", err)
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		logger.Sugar.Errorf("ERROR: Failed to fetch JWKS: %v", err)
+		return nil, ctx.Err() == nil, fmt.Errorf("failed to fetch JWKS: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		logger.Sugar.Errorf("ERROR: JWKS endpoint returned %s", resp.Status)
+		retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return nil, retry, fmt.Errorf("failed to fetch JWKS: %s", resp.Status)
+	}
+
+	jwks = &JWKS{}
+	if err := json.NewDecoder(resp.Body).Decode(jwks); err != nil {
+		logger.Sugar.Errorf("ERROR: Failed to decode JWKS JSON: %v", err)
+		return nil, false, fmt.Errorf("failed to decode JWKS: %v", err)
+	}
+	return jwks, false, nil
+}
+
+// JWKSProbeInterval is how long a JWKSProbe reuses its last result.
+const JWKSProbeInterval = 30 * time.Second
+
+// JWKSProbe checks that the Supabase JWKS endpoint answers, for readiness
+// checks. Results are cached for JWKSProbeInterval so frequent probes cost at
+// most one request per interval.
+type JWKSProbe struct {
+	supabaseURL string
+	client      *http.Client
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	lastErr   error
+}
+
+// NewJWKSProbe probes the JWKS endpoint of cfg.SupabaseURL with the same
+// HTTP client settings the auth middleware uses.
+func NewJWKSProbe(cfg AuthConfig) *JWKSProbe {
+	client := cfg.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: DefaultJWKSTimeout}
+	}
+	return &JWKSProbe{supabaseURL: cfg.SupabaseURL, client: client}
+}
+
+// Configured reports whether there is a JWKS endpoint to probe.
+func (p *JWKSProbe) Configured() bool {
+	return p.supabaseURL != ""
+}
+
+// Check fetches the JWKS, or returns the cached result of a recent fetch.
+// It fails only when the endpoint is unreachable or answers with an error,
+// not when it lists no keys.
+func (p *JWKSProbe) Check(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.checkedAt.IsZero() && time.Since(p.checkedAt) < JWKSProbeInterval {
+		return p.lastErr
+	}
+
+	p.lastErr = p.fetch(ctx)
+	p.checkedAt = time.Now()
+	if p.lastErr != nil {
+		logger.Sugar.Warnf("JWKS readiness check failed: %v", p.lastErr)
+	}
+	return p.lastErr
+}
+
+func (p *JWKSProbe) fetch(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.supabaseURL+"/auth/v1/.well-known/jwks.json", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("JWKS endpoint returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package middleware
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// jwkOf encodes the public half of key the way Supabase publishes it.
+func jwkOf(kid string, key *ecdsa.PrivateKey) JWK {
+	return JWK{
+		Kid: kid,
+		Kty: "EC",
+		Alg: "ES256",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		Y:   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+// jwksServer serves jwks at the Supabase JWKS path and counts the fetches.
+func jwksServer(t *testing.T, jwks JWKS) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/auth/v1/.well-known/jwks.json" {
+			http.NotFound(w, r)
+			return
+		}
+		hits.Add(1)
+		json.NewEncoder(w).Encode(jwks)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+func TestJWKSFetchParsesAndCachesKeys(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	srv, hits := jwksServer(t, JWKS{Keys: []JWK{
+		jwkOf("kid-1", key),
+		{Kid: "rsa", Kty: "RSA"}, // Not an ES256 key, skipped
+	}})
+	keys := newJWKSKeys(srv.URL, srv.Client())
+
+	got, err := keys.get(context.Background(), "kid-1")
+	require.NoError(t, err)
+	assert.True(t, got.Equal(&key.PublicKey))
+
+	_, err = keys.get(context.Background(), "kid-1")
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), hits.Load(), "cached key must not refetch")
+
+	// Unknown kids within the refresh window don't hammer the endpoint.
+	_, err = keys.get(context.Background(), "rsa")
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), hits.Load())
+}
+
+func TestAuthMiddlewareVerifiesES256AgainstJWKS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	srv, _ := jwksServer(t, JWKS{Keys: []JWK{jwkOf("kid-1", key)}})
+	a := newAuthenticator(AuthConfig{SupabaseURL: srv.URL, HTTPClient: srv.Client()})
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, testClaims())
+	token.Header["kid"] = "kid-1"
+	signed, err := token.SignedString(key)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, authStatus(t, a, signed))
+}
+
+func TestJWKSTimeoutIsUnauthorized(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(func() {
+		close(release)
+		srv.Close()
+	})
+
+	client := srv.Client()
+	client.Timeout = 100 * time.Millisecond
+	a := newAuthenticator(AuthConfig{SupabaseURL: srv.URL, HTTPClient: client})
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, testClaims())
+	token.Header["kid"] = "kid-1"
+	signed, err := token.SignedString(key)
+	require.NoError(t, err)
+
+	start := time.Now()
+	rec := authRequest(t, a, signed)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"error":"invalid_token"`)
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestJWKSFetchRetriesTransientFailures(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) < 3 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(JWKS{Keys: []JWK{jwkOf("kid-1", key)}})
+	}))
+	t.Cleanup(srv.Close)
+	keys := newJWKSKeys(srv.URL, srv.Client())
+
+	got, err := keys.get(context.Background(), "kid-1")
+	require.NoError(t, err)
+	assert.True(t, got.Equal(&key.PublicKey))
+	assert.Equal(t, int32(3), hits.Load())
+}
+
+func TestJWKSFetchRateLimitsAfterRetriesAreExhausted(t *testing.T) {
+	var hits atomic.Int32
+	status := http.StatusBadGateway
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	keys := newJWKSKeys(srv.URL, srv.Client())
+
+	_, err := keys.get(context.Background(), "kid-1")
+	assert.Error(t, err)
+	assert.Equal(t, int32(len(jwksRetryDelays)+1), hits.Load())
+
+	_, err = keys.get(context.Background(), "kid-1")
+	assert.ErrorContains(t, err, "rate limit")
+	assert.Equal(t, int32(len(jwksRetryDelays)+1), hits.Load())
+
+	// Client errors are not retried.
+	status = http.StatusNotFound
+	keys.mu.Lock()
+	keys.lastFetch = time.Time{}
+	keys.mu.Unlock()
+	hits.Store(0)
+	_, err = keys.get(context.Background(), "kid-1")
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), hits.Load())
+}
+
+func TestJWKSFetchDoesNotBlockCachedKeys(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	var hits atomic.Int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) > 1 {
+			<-release
+		}
+		json.NewEncoder(w).Encode(JWKS{Keys: []JWK{jwkOf("kid-1", key)}})
+	}))
+	t.Cleanup(srv.Close)
+	keys := newJWKSKeys(srv.URL, srv.Client())
+	_, err = keys.get(context.Background(), "kid-1")
+	require.NoError(t, err)
+
+	// Two misses share the second fetch, which hangs.
+	keys.mu.Lock()
+	keys.lastFetch = time.Time{}
+	keys.mu.Unlock()
+	errs := make(chan error, 2)
+	for _, kid := range []string{"kid-2", "kid-3"} {
+		go func(kid string) {
+			_, err := keys.get(context.Background(), kid)
+			errs <- err
+		}(kid)
+	}
+	require.Eventually(t, func() bool { return hits.Load() == 2 }, time.Second, 5*time.Millisecond)
+
+	got, err := keys.get(context.Background(), "kid-1")
+	require.NoError(t, err, "a cached key is served while the fetch hangs")
+	assert.True(t, got.Equal(&key.PublicKey))
+
+	// A caller that gives up doesn't reset the rate limit.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = keys.get(ctx, "kid-4")
+	assert.ErrorIs(t, err, context.Canceled)
+
+	close(release)
+	assert.ErrorContains(t, <-errs, "not found in Supabase JWKS")
+	assert.ErrorContains(t, <-errs, "not found in Supabase JWKS")
+	_, err = keys.get(context.Background(), "kid-4")
+	assert.ErrorContains(t, err, "rate limit")
+	assert.Equal(t, int32(2), hits.Load())
+}
+
+func TestJWKSProbeCachesResult(t *testing.T) {
+	var hits atomic.Int32
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+
+	p := NewJWKSProbe(AuthConfig{SupabaseURL: srv.URL, HTTPClient: srv.Client()})
+	require.True(t, p.Configured())
+	assert.NoError(t, p.Check(context.Background()))
+
+	status = http.StatusBadGateway
+	assert.NoError(t, p.Check(context.Background()), "cached success within the interval")
+	assert.Equal(t, int32(1), hits.Load())
+
+	p.checkedAt = time.Now().Add(-JWKSProbeInterval)
+	assert.Error(t, p.Check(context.Background()))
+	assert.Equal(t, int32(2), hits.Load())
+
+	assert.False(t, NewJWKSProbe(AuthConfig{JWTSecret: "s"}).Configured())
+}
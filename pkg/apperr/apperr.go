@@ -0,0 +1,73 @@
+// Package apperr provides errors that carry the HTTP status and stable code a
+// handler should answer with, along with the cause that produced them, so
+// failures keep their context from the repository up to the log line.
+package apperr
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// CodeInternal is the code of unexpected failures; see Internal.
+const CodeInternal = "internal"
+
+// Error is an application error. Message is safe to show to clients; Err,
+// the cause, is meant for logs.
+type Error struct {
+	Status  int    // HTTP status to answer with
+	Code    string // Stable, machine-readable kind, e.g. "no_access"
+	Message string
+	Err     error // May be nil
+}
+
+// New returns an error without a cause, typically a package-level sentinel.
+func New(status int, code, message string) *Error {
+	return &Error{Status: status, Code: code, Message: message}
+}
+
+// Error returns the message followed by the cause chain.
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
+	return e.Message + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is an *Error with the same code, so errors built
+// from a sentinel with Withf or Wrap still match it.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// Withf returns a copy of e whose message is made more specific with the
+// formatted detail, e.g. "unauthorized: only the owner can delete".
+func (e *Error) Withf(format string, args ...interface{}) *Error {
+	return &Error{Status: e.Status, Code: e.Code, Message: e.Message + ": " + fmt.Sprintf(format, args...), Err: e.Err}
+}
+
+// Wrap returns a copy of e caused by err.
+func (e *Error) Wrap(err error) *Error {
+	return &Error{Status: e.Status, Code: e.Code, Message: e.Message, Err: err}
+}
+
+// Internal adds the formatted context to an unexpected failure. When err
+// already carries an *Error, its status and code are kept and the context
+// only lengthens the chain; otherwise the result is a 500 with CodeInternal.
+// Internal(nil, ...) is nil.
+func Internal(err error, format string, args ...interface{}) error {
+	if err == nil {
+		return nil
+	}
+	context := fmt.Sprintf(format, args...)
+	var known *Error
+	if errors.As(err, &known) {
+		return fmt.Errorf("%s: %w", context, err)
+	}
+	return &Error{Status: http.StatusInternalServerError, Code: CodeInternal, Message: context, Err: err}
+}
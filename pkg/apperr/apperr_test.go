@@ -0,0 +1,45 @@
+package apperr
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errTest = New(http.StatusConflict, "test_conflict", "conflict")
+
+func TestDerivedErrorsMatchTheirSentinel(t *testing.T) {
+	err := errTest.Withf("lock held by %s", "user-2")
+	assert.True(t, errors.Is(err, errTest))
+	assert.Equal(t, "conflict: lock held by user-2", err.Error())
+	assert.Equal(t, http.StatusConflict, err.Status)
+
+	wrapped := errTest.Wrap(sql.ErrNoRows)
+	assert.True(t, errors.Is(wrapped, errTest))
+	assert.True(t, errors.Is(wrapped, sql.ErrNoRows))
+	assert.Equal(t, "conflict: sql: no rows in result set", wrapped.Error())
+
+	assert.False(t, errors.Is(New(http.StatusConflict, "other", "conflict"), errTest))
+}
+
+func TestInternalKeepsTheChain(t *testing.T) {
+	assert.NoError(t, Internal(nil, "load doc %s", "d1"))
+
+	err := Internal(sql.ErrConnDone, "load doc %s", "d1")
+	var appErr *Error
+	require.True(t, errors.As(err, &appErr))
+	assert.Equal(t, http.StatusInternalServerError, appErr.Status)
+	assert.Equal(t, CodeInternal, appErr.Code)
+	assert.True(t, errors.Is(err, sql.ErrConnDone))
+	assert.Equal(t, "load doc d1: sql: connection is already closed", err.Error())
+
+	// Known errors keep their status; the context only lengthens the chain.
+	err = Internal(errTest.Withf("held"), "save doc %s", "d1")
+	require.True(t, errors.As(err, &appErr))
+	assert.Equal(t, http.StatusConflict, appErr.Status)
+	assert.Equal(t, "save doc d1: conflict: held", err.Error())
+}
@@ -0,0 +1,206 @@
+package delta
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Op is a single Quill delta operation.
+type Op struct {
+	Insert     interface{}            `json:"insert,omitempty"`
+	Delete     int                    `json:"delete,omitempty"`
+	Retain     int                    `json:"retain,omitempty"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+}
+
+// Delta is a Quill document or change, stored as {"ops":[...]}.
+type Delta struct {
+	Ops []Op `json:"ops"`
+}
+
+// Line is one block of a document: its inline ops (without the trailing
+// newline) and the block attributes carried by that newline.
+type Line struct {
+	Ops   []Op
+	Attrs map[string]interface{}
+}
+
+// Empty is the content of a freshly created document.
+const Empty = `{"ops":[]}`
+
+// Parse decodes raw delta JSON.
+func Parse(content []byte) (Delta, error) {
+	var d Delta
+	if err := json.Unmarshal(content, &d); err != nil {
+		return Delta{}, err
+	}
+	return d, nil
+}
+
+// Validate checks that a document delta only contains well-formed inserts.
+func (d Delta) Validate() error {
+	for _, op := range d.Ops {
+		if op.Insert == nil {
+			return errors.New("document delta may only contain insert operations")
+		}
+		switch op.Insert.(type) {
+		case string, map[string]interface{}:
+		default:
+			return errors.New("insert must be a string or an embed object")
+		}
+	}
+	return nil
+}
+
+// Text returns the plain text of all string inserts.
+func (d Delta) Text() string {
+	var sb strings.Builder
+	for _, op := range d.Ops {
+		if str, ok := op.Insert.(string); ok {
+			sb.WriteString(str)
+		}
+	}
+	return sb.String()
+}
+
+// Length returns the document length the way Quill counts it: UTF-16 code
+// units for text and 1 for every embed.
+func (d Delta) Length() int {
+	n := 0
+	for _, op := range d.Ops {
+		switch v := op.Insert.(type) {
+		case string:
+			n += len(utf16.Encode([]rune(v)))
+		case map[string]interface{}:
+			n++
+		}
+	}
+	return n
+}
+
+// CharCount returns the number of characters a reader would count: Unicode
+// code points across all string inserts, so an emoji or a CJK ideograph is
+// one character regardless of its byte or UTF-16 size. Embeds are ignored.
+func (d Delta) CharCount() int {
+	n := 0
+	for _, op := range d.Ops {
+		if str, ok := op.Insert.(string); ok {
+			n += utf8.RuneCountInString(str)
+		}
+	}
+	return n
+}
+
+// Lines splits a document delta into its blocks.
+func (d Delta) Lines() []Line {
+	var lines []Line
+	var current []Op
+	for _, op := range d.Ops {
+		str, ok := op.Insert.(string)
+		if !ok {
+			current = append(current, op)
+			continue
+		}
+		parts := strings.Split(str, "\n")
+		for i, part := range parts {
+			if part != "" {
+				current = append(current, Op{Insert: part, Attributes: op.Attributes})
+			}
+			if i < len(parts)-1 {
+				lines = append(lines, Line{Ops: current, Attrs: op.Attributes})
+				current = nil
+			}
+		}
+	}
+	if len(current) > 0 {
+		lines = append(lines, Line{Ops: current})
+	}
+	return lines
+}
+
+// RedactionMark replaces every redacted character.
+const RedactionMark = "█"
+
+// Redact replaces the text of inserts carrying attr with RedactionMark and
+// embeds with a single mark, preserving newlines and the Quill length of every
+// op so indices computed on the full document stay valid. Redacted ops carry
+// only a "redacted" attribute (plus any block attributes on newlines).
+func (d Delta) Redact(attr string) Delta {
+	out := Delta{Ops: make([]Op, 0, len(d.Ops))}
+	for _, op := range d.Ops {
+		if _, ok := op.Attributes[attr]; !ok || op.Insert == nil {
+			out.Ops = append(out.Ops, op)
+			continue
+		}
+
+		str, isText := op.Insert.(string)
+		if !isText {
+			out.Ops = append(out.Ops, Op{Insert: RedactionMark, Attributes: map[string]interface{}{"redacted": true}})
+			continue
+		}
+
+		var sb strings.Builder
+		for _, r := range str {
+			if r == '\n' {
+				sb.WriteRune(r)
+				continue
+			}
+			sb.WriteString(strings.Repeat(RedactionMark, len(utf16.Encode([]rune{r}))))
+		}
+		attrs := map[string]interface{}{"redacted": true}
+		for _, block := range []string{"header", "list", "blockquote", "code-block", "align"} {
+			if v, ok := op.Attributes[block]; ok {
+				attrs[block] = v
+			}
+		}
+		out.Ops = append(out.Ops, Op{Insert: sb.String(), Attributes: attrs})
+	}
+	return out
+}
+
+// Append returns d followed by other, as Quill's concat does: a text insert
+// that continues one with the same attributes is merged into it. The result
+// ends in a newline, as every Quill document must, adding one if other
+// does not.
+func (d Delta) Append(other Delta) Delta {
+	out := Delta{Ops: make([]Op, 0, len(d.Ops)+len(other.Ops)+1)}
+	out.Ops = append(out.Ops, d.Ops...)
+	for _, op := range other.Ops {
+		out.push(op)
+	}
+	if n := len(out.Ops); n == 0 || !strings.HasSuffix(insertText(out.Ops[n-1]), "\n") {
+		out.push(Op{Insert: "\n"})
+	}
+	return out
+}
+
+// push appends op, merging it into the last op when both are text inserts
+// with the same attributes.
+func (d *Delta) push(op Op) {
+	if n := len(d.Ops); n > 0 {
+		last := &d.Ops[n-1]
+		prev, prevText := last.Insert.(string)
+		next, nextText := op.Insert.(string)
+		if prevText && nextText && sameAttributes(last.Attributes, op.Attributes) {
+			last.Insert = prev + next
+			return
+		}
+	}
+	d.Ops = append(d.Ops, op)
+}
+
+func insertText(op Op) string {
+	str, _ := op.Insert.(string)
+	return str
+}
+
+func sameAttributes(a, b map[string]interface{}) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,145 @@
+package delta
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedactPreservesLength(t *testing.T) {
+	d, err := Parse([]byte(`{"ops":[
+		{"insert":"Public "},
+		{"insert":"secret 😀\nplan","attributes":{"confidential":true,"bold":true}},
+		{"insert":{"image":"x.png"},"attributes":{"confidential":true}},
+		{"insert":" end\n"}
+	]}`))
+	require.NoError(t, err)
+
+	redacted := d.Redact("confidential")
+
+	assert.Equal(t, d.Length(), redacted.Length())
+	assert.NotContains(t, redacted.Text(), "secret")
+	assert.Equal(t, "Public █████████\n█████ end\n", redacted.Text())
+	assert.Equal(t, map[string]interface{}{"redacted": true}, redacted.Ops[1].Attributes)
+}
+
+func TestPreview(t *testing.T) {
+	p := PreviewOf([]byte(`{"ops":[
+		{"insert":"intro text\n"},
+		{"insert":"Quarterly "},
+		{"insert":"Plan","attributes":{"bold":true}},
+		{"insert":"\n","attributes":{"header":1}},
+		{"insert":{"image":"https://example.com/a.png"}},
+		{"insert":"two words\n"}
+	]}`))
+
+	assert.Equal(t, "Quarterly Plan", p.Heading)
+	assert.Equal(t, "https://example.com/a.png", p.Image)
+	assert.Equal(t, 6, p.WordCount)
+	assert.Equal(t, "intro text Quarterly Plan two words", p.Snippet)
+
+	assert.Equal(t, Preview{}, PreviewOf([]byte(Empty)))
+	assert.Equal(t, Preview{}, PreviewOf([]byte(`not json`)))
+}
+
+func TestCharCountMultibyte(t *testing.T) {
+	d, err := Parse([]byte(`{"ops":[
+		{"insert":"hi 😀"},
+		{"insert":{"image":"https://example.com/a.png"}},
+		{"insert":"漢字\n"}
+	]}`))
+	require.NoError(t, err)
+
+	// "hi 😀" is 4 characters, "漢字\n" is 3; the embed is not text.
+	assert.Equal(t, 7, d.CharCount())
+	// Quill length counts the emoji as two UTF-16 units and the embed as one.
+	assert.Equal(t, 9, d.Length())
+	assert.Greater(t, len(d.Text()), d.CharCount())
+}
+
+func TestSnippet(t *testing.T) {
+	cases := []struct {
+		name, content, want string
+	}{
+		{"leading embed", `{"ops":[{"insert":{"image":"a.png"}},{"insert":"\nCaption text\n"}]}`, "Caption text"},
+		{"heading first", `{"ops":[{"insert":"Title"},{"insert":"\n","attributes":{"header":1}},{"insert":"\n\nBody   line\n"}]}`, "Title Body line"},
+		{"only newlines", `{"ops":[{"insert":"\n\n\n"}]}`, ""},
+		{"image only", `{"ops":[{"insert":{"image":"a.png"}},{"insert":"\n"}]}`, "[Image]"},
+		{"other embed only", `{"ops":[{"insert":{"video":"v.mp4"}},{"insert":"\n"}]}`, "[Embed]"},
+		{"invalid", `not json`, ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, SnippetOf([]byte(tc.content)))
+		})
+	}
+
+	long := SnippetOf([]byte(`{"ops":[{"insert":"` + strings.Repeat("世界 ", 60) + `\n"}]}`))
+	assert.True(t, strings.HasSuffix(long, "..."))
+	assert.Equal(t, MaxSnippet, len([]rune(strings.TrimSuffix(long, "..."))))
+}
+
+func TestAppend(t *testing.T) {
+	bold := map[string]interface{}{"bold": true}
+	doc := Delta{Ops: []Op{{Insert: "Agenda", Attributes: bold}, {Insert: "\n"}}}
+
+	got := doc.Append(Delta{Ops: []Op{{Insert: "Notes\n"}, {Insert: "done", Attributes: bold}}})
+	assert.Equal(t, []Op{
+		{Insert: "Agenda", Attributes: bold},
+		{Insert: "\nNotes\n"},
+		{Insert: "done", Attributes: bold},
+		{Insert: "\n"},
+	}, got.Ops, "plain text merges with the trailing newline; a final newline is added")
+	assert.Len(t, doc.Ops, 2, "the original is untouched")
+
+	empty := Delta{}.Append(Delta{Ops: []Op{{Insert: "x\n"}}})
+	assert.Equal(t, []Op{{Insert: "x\n"}}, empty.Ops)
+}
+
+func TestDiffFindsTheChangedSpan(t *testing.T) {
+	doc := func(text string) Delta { return Delta{Ops: []Op{{Insert: text}}} }
+
+	e, changed := Diff(doc("Hello world\n"), doc("Hello, world\n"))
+	assert.True(t, changed)
+	assert.Equal(t, Edit{Index: 5, Delete: 0, Insert: 1}, e)
+
+	e, _ = Diff(doc("Hello world\n"), doc("Hello\n"))
+	assert.Equal(t, Edit{Index: 5, Delete: 6, Insert: 0}, e)
+
+	// Indices are Quill's: an emoji is two units, an embed one.
+	withImage := Delta{Ops: []Op{{Insert: "😀"}, {Insert: map[string]interface{}{"image": "x.png"}}, {Insert: "a\n"}}}
+	e, _ = Diff(withImage, Delta{Ops: []Op{{Insert: "😀"}, {Insert: map[string]interface{}{"image": "x.png"}}, {Insert: "ab\n"}}})
+	assert.Equal(t, Edit{Index: 4, Delete: 0, Insert: 1}, e)
+
+	_, changed = Diff(doc("same\n"), doc("same\n"))
+	assert.False(t, changed)
+}
+
+func TestTransformRange(t *testing.T) {
+	// The range covers units 10-14.
+	cases := []struct {
+		name          string
+		edit          Edit
+		index, length int
+	}{
+		{"insert before", Edit{Index: 2, Insert: 3}, 13, 5},
+		{"insert at start", Edit{Index: 10, Insert: 3}, 13, 5},
+		{"insert inside", Edit{Index: 12, Insert: 3}, 10, 8},
+		{"insert at end", Edit{Index: 15, Insert: 3}, 10, 5},
+		{"insert after", Edit{Index: 20, Insert: 3}, 10, 5},
+		{"delete before", Edit{Index: 2, Delete: 4}, 6, 5},
+		{"delete inside", Edit{Index: 11, Delete: 2}, 10, 3},
+		{"delete over start", Edit{Index: 8, Delete: 4}, 8, 3},
+		{"delete over end", Edit{Index: 13, Delete: 4}, 10, 3},
+		{"delete all of it", Edit{Index: 5, Delete: 20}, 5, 0},
+		{"replace inside", Edit{Index: 11, Delete: 2, Insert: 5}, 10, 8},
+		{"replace spanning it", Edit{Index: 5, Delete: 20, Insert: 30}, 10, 5},
+		{"replace exactly it", Edit{Index: 10, Delete: 5, Insert: 4}, 10, 5},
+	}
+	for _, c := range cases {
+		index, length := c.edit.TransformRange(10, 5)
+		assert.Equal(t, []int{c.index, c.length}, []int{index, length}, c.name)
+	}
+}
@@ -0,0 +1,79 @@
+package delta
+
+import "unicode/utf16"
+
+// embedUnit stands in for an embed when comparing documents unit by unit.
+const embedUnit = 0xFFFC
+
+// Edit is a change between two versions of a document, in Quill indices:
+// the Delete units starting at Index were replaced by Insert new ones.
+type Edit struct {
+	Index  int
+	Delete int
+	Insert int
+}
+
+// Diff returns the Edit that turns old into new, found by trimming the text
+// both share at the start and at the end, and false when they are the same.
+// A single keystroke or paste gives the exact change; edits far apart in one
+// update, or a replace-all, are seen as one replacement spanning them.
+func Diff(old, new Delta) (Edit, bool) {
+	a, b := units(old), units(new)
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	e := Edit{Index: prefix, Delete: len(a) - prefix - suffix, Insert: len(b) - prefix - suffix}
+	return e, e.Delete > 0 || e.Insert > 0
+}
+
+// TransformRange returns where the range at index with length lies after e.
+// Text inserted where the range starts goes before it and text inserted where
+// it ends goes after it; deleted text leaves the range, which shrinks to an
+// empty range when all of it is gone. A replacement covering the whole range
+// leaves it where it was: it may be several edits merged by Diff, so whether
+// the range's text survived can't be told.
+func (e Edit) TransformRange(index, length int) (int, int) {
+	if e.Delete > 0 && e.Insert > 0 && e.Index <= index && index+length <= e.Index+e.Delete {
+		return index, length
+	}
+	start := e.shift(index, true)
+	end := e.shift(index+length, false)
+	if end < start {
+		end = start
+	}
+	return start, end - start
+}
+
+// shift moves pos, the start or end of a range, past e.
+func (e Edit) shift(pos int, isStart bool) int {
+	switch {
+	case pos < e.Index || (!isStart && pos == e.Index):
+		return pos
+	case pos >= e.Index+e.Delete:
+		return pos + e.Insert - e.Delete
+	case isStart:
+		return e.Index + e.Insert
+	default:
+		return e.Index
+	}
+}
+
+// units returns the document as Quill counts it: UTF-16 code units for text
+// and one unit per embed.
+func units(d Delta) []uint16 {
+	var u []uint16
+	for _, op := range d.Ops {
+		switch v := op.Insert.(type) {
+		case string:
+			u = append(u, utf16.Encode([]rune(v))...)
+		case map[string]interface{}:
+			u = append(u, embedUnit)
+		}
+	}
+	return u
+}
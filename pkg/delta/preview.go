@@ -0,0 +1,134 @@
+package delta
+
+import (
+	"strings"
+	"unicode"
+)
+
+// MaxPreviewHeading bounds the heading text kept in a Preview, in runes.
+const MaxPreviewHeading = 200
+
+// MaxSnippet bounds a Snippet, in runes, before the trailing "...".
+const MaxSnippet = 100
+
+// Preview is a small summary of a document for list views.
+type Preview struct {
+	Heading   string `json:"heading,omitempty"` // Text of the first header line
+	Image     string `json:"image,omitempty"`   // Source of the first image embed
+	WordCount int    `json:"word_count"`
+	Snippet   string `json:"snippet,omitempty"` // Stored with the preview so lists needn't load content
+}
+
+// Preview summarizes d. An empty document yields a zero Preview.
+func (d Delta) Preview() Preview {
+	var p Preview
+	for _, line := range d.Lines() {
+		if p.Heading != "" {
+			break
+		}
+		if line.Attrs["header"] == nil {
+			continue
+		}
+		var sb strings.Builder
+		for _, op := range line.Ops {
+			if s, ok := op.Insert.(string); ok {
+				sb.WriteString(s)
+			}
+		}
+		heading := []rune(strings.TrimSpace(sb.String()))
+		if len(heading) > MaxPreviewHeading {
+			heading = heading[:MaxPreviewHeading]
+		}
+		p.Heading = string(heading)
+	}
+
+	var text strings.Builder
+	for _, op := range d.Ops {
+		switch insert := op.Insert.(type) {
+		case string:
+			text.WriteString(insert)
+		case map[string]interface{}:
+			if src, ok := insert["image"].(string); ok && p.Image == "" {
+				p.Image = src
+			}
+			// Embeds separate words on either side.
+			text.WriteByte(' ')
+		}
+	}
+	p.WordCount = len(strings.Fields(text.String()))
+	p.Snippet = d.Snippet()
+	return p
+}
+
+// PreviewOf parses content and summarizes it, returning a zero Preview for
+// content that is not a valid delta.
+func PreviewOf(content []byte) Preview {
+	d, err := Parse(content)
+	if err != nil {
+		return Preview{}
+	}
+	return d.Preview()
+}
+
+// Snippet returns the document's text for list views: whitespace, including
+// blank lines, collapsed to single spaces and cut at MaxSnippet runes.
+// Documents with embeds but no text read "[Image]" (or "[Embed]" when none
+// of them is an image).
+func (d Delta) Snippet() string {
+	var snippet []rune
+	space := false // A separator is pending before the next visible rune
+	hasImage, hasEmbed := false, false
+
+	add := func(text string) bool {
+		for _, r := range text {
+			if unicode.IsSpace(r) {
+				space = len(snippet) > 0
+				continue
+			}
+			if space {
+				snippet = append(snippet, ' ')
+				space = false
+			}
+			snippet = append(snippet, r)
+			if len(snippet) > MaxSnippet {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, op := range d.Ops {
+		switch insert := op.Insert.(type) {
+		case string:
+			if !add(insert) {
+				return strings.TrimSpace(string(snippet[:MaxSnippet])) + "..."
+			}
+		case map[string]interface{}:
+			hasEmbed = true
+			if _, ok := insert["image"]; ok {
+				hasImage = true
+			}
+			add(" ")
+		}
+	}
+
+	switch {
+	case len(snippet) > 0:
+		return string(snippet)
+	case hasImage:
+		return "[Image]"
+	case hasEmbed:
+		return "[Embed]"
+	}
+	return ""
+}
+
+// SnippetOf parses content and returns its Snippet, or "" for content that
+// is not a valid delta.
+func SnippetOf(content []byte) string {
+	d, err := Parse(content)
+	if err != nil {
+		return ""
+	}
+	return d.Snippet()
+}
@@ -0,0 +1,28 @@
+package docid
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewIsValid(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		assert.True(t, Valid(New()))
+	}
+}
+
+func TestValidRejectsMalformed(t *testing.T) {
+	for _, id := range []string{
+		"",
+		"doc-1",
+		"0f8fad5b-d9cb-469f-a165-70867728950",   // too short
+		"0f8fad5b-d9cb-469f-a165-70867728950e1", // too long
+		"0f8fad5bd-9cb-469f-a165-70867728950e",  // misplaced hyphen
+		"0F8FAD5B-D9CB-469F-A165-70867728950E",  // uppercase
+		"0f8fad5b-d9cb-469f-a165-70867728950'",
+	} {
+		assert.False(t, Valid(id), id)
+	}
+	assert.True(t, Valid("0f8fad5b-d9cb-469f-a165-70867728950e"))
+}
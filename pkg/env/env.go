@@ -0,0 +1,61 @@
+package env
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"satunaskah/pkg/logger"
+)
+
+// String returns the trimmed value of key, or def when unset.
+func String(key, def string) string {
+	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
+		return v
+	}
+	return def
+}
+
+// Int returns key parsed as an int, or def when unset or invalid.
+func Int(key string, def int) int {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		logger.Sugar.Warnf("Invalid integer for %s (%q), using default %d", key, v, def)
+		return def
+	}
+	return n
+}
+
+// Duration returns key parsed with time.ParseDuration (e.g. "30s"), or def
+// when unset or invalid.
+func Duration(key string, def time.Duration) time.Duration {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		logger.Sugar.Warnf("Invalid duration for %s (%q), using default %s", key, v, def)
+		return def
+	}
+	return d
+}
+
+// Bool returns key parsed with strconv.ParseBool, or def when unset or invalid.
+func Bool(key string, def bool) bool {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		logger.Sugar.Warnf("Invalid boolean for %s (%q), using default %t", key, v, def)
+		return def
+	}
+	return b
+}
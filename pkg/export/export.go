@@ -0,0 +1,256 @@
+package export
+
+import (
+	"fmt"
+	"html"
+	"strings"
+
+	"satunaskah/pkg/delta"
+)
+
+const (
+	FormatMarkdown = "md"
+	FormatHTML     = "html"
+	FormatText     = "txt"
+)
+
+// IsSupported reports whether format is one of the text export formats.
+func IsSupported(format string) bool {
+	switch format {
+	case FormatMarkdown, FormatHTML, FormatText:
+		return true
+	}
+	return false
+}
+
+// ContentType returns the MIME type for an export format.
+func ContentType(format string) string {
+	switch format {
+	case FormatMarkdown:
+		return "text/markdown; charset=utf-8"
+	case FormatHTML:
+		return "text/html; charset=utf-8"
+	case FormatPDF:
+		return "application/pdf"
+	default:
+		return "text/plain; charset=utf-8"
+	}
+}
+
+// Render converts stored Quill delta JSON into the requested format.
+func Render(format, title string, content []byte) ([]byte, error) {
+	d, err := delta.Parse(content)
+	if err != nil {
+		return nil, fmt.Errorf("invalid document content: %w", err)
+	}
+	switch format {
+	case FormatMarkdown:
+		return []byte(ToMarkdown(d)), nil
+	case FormatHTML:
+		return []byte(ToHTML(title, d)), nil
+	case FormatText:
+		return []byte(d.Text()), nil
+	}
+	return nil, fmt.Errorf("unsupported export format: %s", format)
+}
+
+// ToMarkdown renders a document delta as Markdown.
+func ToMarkdown(d delta.Delta) string {
+	var sb strings.Builder
+	inCode := false
+	for _, line := range d.Lines() {
+		_, isCode := line.Attrs["code-block"]
+		if isCode != inCode {
+			sb.WriteString("```\n")
+			inCode = isCode
+		}
+		if isCode {
+			sb.WriteString(plainText(line.Ops))
+			sb.WriteString("\n")
+			continue
+		}
+
+		if level, ok := headerLevel(line.Attrs); ok {
+			sb.WriteString(strings.Repeat("#", level) + " ")
+		}
+		switch line.Attrs["list"] {
+		case "bullet":
+			sb.WriteString("- ")
+		case "ordered":
+			sb.WriteString("1. ")
+		}
+		if isSet(line.Attrs, "blockquote") {
+			sb.WriteString("> ")
+		}
+
+		for _, op := range line.Ops {
+			sb.WriteString(markdownInline(op))
+		}
+		sb.WriteString("\n")
+	}
+	if inCode {
+		sb.WriteString("```\n")
+	}
+	return sb.String()
+}
+
+func markdownInline(op delta.Op) string {
+	if embed, ok := op.Insert.(map[string]interface{}); ok {
+		if src, ok := embed["image"].(string); ok {
+			return "![](" + src + ")"
+		}
+		return ""
+	}
+	text, _ := op.Insert.(string)
+	if isSet(op.Attributes, "code") {
+		text = "`" + text + "`"
+	}
+	if isSet(op.Attributes, "bold") {
+		text = "**" + text + "**"
+	}
+	if isSet(op.Attributes, "italic") {
+		text = "_" + text + "_"
+	}
+	if isSet(op.Attributes, "strike") {
+		text = "~~" + text + "~~"
+	}
+	if link, ok := op.Attributes["link"].(string); ok {
+		text = "[" + text + "](" + link + ")"
+	}
+	return text
+}
+
+// ToHTML renders a document delta as a standalone HTML page.
+func ToHTML(title string, d delta.Delta) string {
+	var sb strings.Builder
+	sb.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n")
+	sb.WriteString("<title>" + html.EscapeString(title) + "</title>\n</head>\n<body>\n")
+
+	openList := ""
+	inCode := false
+	for _, line := range d.Lines() {
+		list, _ := line.Attrs["list"].(string)
+		if list != openList {
+			if openList != "" {
+				sb.WriteString(closeListTag(openList))
+			}
+			if list != "" {
+				sb.WriteString(openListTag(list))
+			}
+			openList = list
+		}
+		_, isCode := line.Attrs["code-block"]
+		if isCode != inCode {
+			if isCode {
+				sb.WriteString("<pre><code>")
+			} else {
+				sb.WriteString("</code></pre>\n")
+			}
+			inCode = isCode
+		}
+		if isCode {
+			sb.WriteString(html.EscapeString(plainText(line.Ops)) + "\n")
+			continue
+		}
+
+		var inner strings.Builder
+		for _, op := range line.Ops {
+			inner.WriteString(htmlInline(op))
+		}
+		body := inner.String()
+		if body == "" {
+			body = "<br>"
+		}
+
+		switch {
+		case list != "":
+			sb.WriteString("<li>" + body + "</li>\n")
+		case isSet(line.Attrs, "blockquote"):
+			sb.WriteString("<blockquote>" + body + "</blockquote>\n")
+		default:
+			if level, ok := headerLevel(line.Attrs); ok {
+				sb.WriteString(fmt.Sprintf("<h%d>%s</h%d>\n", level, body, level))
+			} else {
+				sb.WriteString("<p>" + body + "</p>\n")
+			}
+		}
+	}
+	if inCode {
+		sb.WriteString("</code></pre>\n")
+	}
+	if openList != "" {
+		sb.WriteString(closeListTag(openList))
+	}
+	sb.WriteString("</body>\n</html>\n")
+	return sb.String()
+}
+
+func htmlInline(op delta.Op) string {
+	if embed, ok := op.Insert.(map[string]interface{}); ok {
+		if src, ok := embed["image"].(string); ok {
+			return `<img src="` + html.EscapeString(src) + `">`
+		}
+		return ""
+	}
+	text, _ := op.Insert.(string)
+	text = html.EscapeString(text)
+	if isSet(op.Attributes, "code") {
+		text = "<code>" + text + "</code>"
+	}
+	if isSet(op.Attributes, "bold") {
+		text = "<strong>" + text + "</strong>"
+	}
+	if isSet(op.Attributes, "italic") {
+		text = "<em>" + text + "</em>"
+	}
+	if isSet(op.Attributes, "strike") {
+		text = "<s>" + text + "</s>"
+	}
+	if link, ok := op.Attributes["link"].(string); ok {
+		text = `<a href="` + html.EscapeString(link) + `">` + text + "</a>"
+	}
+	return text
+}
+
+func openListTag(list string) string {
+	if list == "ordered" {
+		return "<ol>\n"
+	}
+	return "<ul>\n"
+}
+
+func closeListTag(list string) string {
+	if list == "ordered" {
+		return "</ol>\n"
+	}
+	return "</ul>\n"
+}
+
+func plainText(ops []delta.Op) string {
+	var sb strings.Builder
+	for _, op := range ops {
+		if str, ok := op.Insert.(string); ok {
+			sb.WriteString(str)
+		}
+	}
+	return sb.String()
+}
+
+func headerLevel(attrs map[string]interface{}) (int, bool) {
+	// JSON numbers decode as float64.
+	if level, ok := attrs["header"].(float64); ok && level >= 1 && level <= 6 {
+		return int(level), true
+	}
+	return 0, false
+}
+
+func isSet(attrs map[string]interface{}, key string) bool {
+	v, ok := attrs[key]
+	if !ok {
+		return false
+	}
+	if b, isBool := v.(bool); isBool {
+		return b
+	}
+	return v != nil
+}
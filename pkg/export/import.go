@@ -0,0 +1,345 @@
+package export
+
+import (
+	"html"
+	"regexp"
+	"strings"
+
+	"satunaskah/pkg/delta"
+)
+
+var (
+	headingRe  = regexp.MustCompile(`^(#{1,6})\s+(.*)$`)
+	bulletRe   = regexp.MustCompile(`^\s*[-*+]\s+(.*)$`)
+	orderedRe  = regexp.MustCompile(`^\s*\d+[.)]\s+(.*)$`)
+	quoteRe    = regexp.MustCompile(`^>\s?(.*)$`)
+	linkRe     = regexp.MustCompile(`^\[([^\]]*)\]\(([^)\s]+)\)`)
+	imageRe    = regexp.MustCompile(`^!\[([^\]]*)\]\(([^)\s]+)\)`)
+	tagRe      = regexp.MustCompile(`^<(/?)([a-zA-Z][a-zA-Z0-9]*)([^>]*)>`)
+	hrefRe     = regexp.MustCompile(`(?i)\bhref\s*=\s*["']([^"']*)["']`)
+	srcRe      = regexp.MustCompile(`(?i)\bsrc\s*=\s*["']([^"']*)["']`)
+	spaceRe    = regexp.MustCompile(`\s+`)
+	skipTagsRe = regexp.MustCompile(`(?is)<(script|style)[^>]*>.*?</(script|style)>`)
+)
+
+// MarkdownToDelta converts Markdown into a Quill document delta. Headings,
+// emphasis, lists, links, images, quotes and fenced code blocks are mapped to
+// Quill formats; anything else is kept as plain text.
+func MarkdownToDelta(src string) delta.Delta {
+	b := &builder{}
+	inCode := false
+	for _, line := range strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inCode = !inCode
+			continue
+		}
+		if inCode {
+			b.text(line, nil)
+			b.newline(map[string]interface{}{"code-block": true})
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		var blockAttrs map[string]interface{}
+		if m := headingRe.FindStringSubmatch(line); m != nil {
+			blockAttrs = map[string]interface{}{"header": len(m[1])}
+			line = m[2]
+		} else if m := bulletRe.FindStringSubmatch(line); m != nil {
+			blockAttrs = map[string]interface{}{"list": "bullet"}
+			line = m[1]
+		} else if m := orderedRe.FindStringSubmatch(line); m != nil {
+			blockAttrs = map[string]interface{}{"list": "ordered"}
+			line = m[1]
+		} else if m := quoteRe.FindStringSubmatch(line); m != nil {
+			blockAttrs = map[string]interface{}{"blockquote": true}
+			line = m[1]
+		}
+
+		b.markdownInline(line, nil)
+		b.newline(blockAttrs)
+	}
+	return b.delta()
+}
+
+// markdownInline parses emphasis, code spans, links and images in a single line.
+// Unmatched markers are emitted as literal text.
+func (b *builder) markdownInline(s string, attrs map[string]interface{}) {
+	var literal strings.Builder
+	flush := func() {
+		b.text(literal.String(), attrs)
+		literal.Reset()
+	}
+
+	for i := 0; i < len(s); {
+		rest := s[i:]
+
+		if m := imageRe.FindStringSubmatch(rest); m != nil {
+			flush()
+			b.embed(map[string]interface{}{"image": m[2]})
+			i += len(m[0])
+			continue
+		}
+		if m := linkRe.FindStringSubmatch(rest); m != nil {
+			flush()
+			b.markdownInline(m[1], withAttr(attrs, "link", m[2]))
+			i += len(m[0])
+			continue
+		}
+
+		matched := false
+		for _, marker := range []struct{ token, attr string }{
+			{"`", "code"}, {"**", "bold"}, {"__", "bold"}, {"~~", "strike"}, {"*", "italic"}, {"_", "italic"},
+		} {
+			if !strings.HasPrefix(rest, marker.token) {
+				continue
+			}
+			end := strings.Index(rest[len(marker.token):], marker.token)
+			if end <= 0 {
+				continue
+			}
+			inner := rest[len(marker.token) : len(marker.token)+end]
+			flush()
+			if marker.attr == "code" {
+				b.text(inner, withAttr(attrs, "code", true))
+			} else {
+				b.markdownInline(inner, withAttr(attrs, marker.attr, true))
+			}
+			i += len(marker.token)*2 + end
+			matched = true
+			break
+		}
+		if matched {
+			continue
+		}
+
+		literal.WriteByte(s[i])
+		i++
+	}
+	flush()
+}
+
+// HTMLToDelta converts a fragment of HTML into a Quill document delta.
+// Unknown tags are dropped and their text content is kept.
+func HTMLToDelta(src string) delta.Delta {
+	b := &builder{}
+	src = skipTagsRe.ReplaceAllString(src, "")
+
+	var inline []struct {
+		tag   string
+		key   string
+		value interface{}
+	}
+	var lists []string
+	var blockAttrs map[string]interface{}
+	inPre := false
+
+	currentAttrs := func() map[string]interface{} {
+		var attrs map[string]interface{}
+		for _, a := range inline {
+			attrs = withAttr(attrs, a.key, a.value)
+		}
+		return attrs
+	}
+	endLine := func(force bool) {
+		if b.lineHasContent || force {
+			b.newline(blockAttrs)
+		}
+	}
+
+	for len(src) > 0 {
+		m := tagRe.FindStringSubmatch(src)
+		if m == nil {
+			next := strings.IndexByte(src[1:], '<')
+			chunk := src
+			if next >= 0 {
+				chunk = src[:next+1]
+			}
+			src = src[len(chunk):]
+
+			text := html.UnescapeString(chunk)
+			if inPre {
+				lines := strings.Split(text, "\n")
+				for i, line := range lines {
+					b.text(line, nil)
+					if i < len(lines)-1 {
+						b.newline(blockAttrs)
+					}
+				}
+				continue
+			}
+			text = spaceRe.ReplaceAllString(text, " ")
+			if !b.lineHasContent {
+				text = strings.TrimLeft(text, " ")
+			}
+			b.text(text, currentAttrs())
+			continue
+		}
+		src = src[len(m[0]):]
+
+		closing := m[1] == "/"
+		tag := strings.ToLower(m[2])
+		switch tag {
+		case "h1", "h2", "h3", "h4", "h5", "h6":
+			endLine(false)
+			blockAttrs = nil
+			if !closing {
+				blockAttrs = map[string]interface{}{"header": int(tag[1] - '0')}
+			}
+		case "p", "div":
+			endLine(false)
+			blockAttrs = nil
+		case "blockquote":
+			endLine(false)
+			blockAttrs = nil
+			if !closing {
+				blockAttrs = map[string]interface{}{"blockquote": true}
+			}
+		case "pre":
+			endLine(false)
+			blockAttrs = nil
+			inPre = !closing
+			if inPre {
+				blockAttrs = map[string]interface{}{"code-block": true}
+			}
+		case "ul", "ol":
+			endLine(false)
+			blockAttrs = nil
+			if closing {
+				if len(lists) > 0 {
+					lists = lists[:len(lists)-1]
+				}
+			} else if tag == "ol" {
+				lists = append(lists, "ordered")
+			} else {
+				lists = append(lists, "bullet")
+			}
+		case "li":
+			endLine(false)
+			blockAttrs = nil
+			if !closing && len(lists) > 0 {
+				blockAttrs = map[string]interface{}{"list": lists[len(lists)-1]}
+			}
+		case "br":
+			endLine(true)
+		case "img":
+			if s := srcRe.FindStringSubmatch(m[3]); s != nil {
+				b.embed(map[string]interface{}{"image": html.UnescapeString(s[1])})
+			}
+		case "strong", "b", "em", "i", "u", "s", "strike", "del", "code", "a":
+			if inPre {
+				continue
+			}
+			if closing {
+				for i := len(inline) - 1; i >= 0; i-- {
+					if inline[i].tag == tag {
+						inline = append(inline[:i], inline[i+1:]...)
+						break
+					}
+				}
+				continue
+			}
+			key, value := inlineFormat(tag, m[3])
+			if key == "" {
+				continue
+			}
+			inline = append(inline, struct {
+				tag   string
+				key   string
+				value interface{}
+			}{tag, key, value})
+		}
+	}
+	endLine(false)
+	return b.delta()
+}
+
+func inlineFormat(tag, rawAttrs string) (string, interface{}) {
+	switch tag {
+	case "strong", "b":
+		return "bold", true
+	case "em", "i":
+		return "italic", true
+	case "u":
+		return "underline", true
+	case "s", "strike", "del":
+		return "strike", true
+	case "code":
+		return "code", true
+	case "a":
+		if m := hrefRe.FindStringSubmatch(rawAttrs); m != nil {
+			return "link", html.UnescapeString(m[1])
+		}
+	}
+	return "", nil
+}
+
+// builder accumulates ops, merging adjacent text with identical attributes.
+type builder struct {
+	ops            []delta.Op
+	lineHasContent bool
+}
+
+func (b *builder) text(s string, attrs map[string]interface{}) {
+	if s == "" {
+		return
+	}
+	b.lineHasContent = true
+	if n := len(b.ops); n > 0 {
+		if prev, ok := b.ops[n-1].Insert.(string); ok && !strings.HasSuffix(prev, "\n") && sameAttrs(b.ops[n-1].Attributes, attrs) {
+			b.ops[n-1].Insert = prev + s
+			return
+		}
+	}
+	b.ops = append(b.ops, delta.Op{Insert: s, Attributes: attrs})
+}
+
+func (b *builder) embed(value map[string]interface{}) {
+	b.lineHasContent = true
+	b.ops = append(b.ops, delta.Op{Insert: value})
+}
+
+func (b *builder) newline(blockAttrs map[string]interface{}) {
+	b.lineHasContent = false
+	if len(blockAttrs) == 0 {
+		if n := len(b.ops); n > 0 {
+			if prev, ok := b.ops[n-1].Insert.(string); ok && b.ops[n-1].Attributes == nil {
+				b.ops[n-1].Insert = prev + "\n"
+				return
+			}
+		}
+	}
+	b.ops = append(b.ops, delta.Op{Insert: "\n", Attributes: blockAttrs})
+}
+
+func (b *builder) delta() delta.Delta {
+	if b.lineHasContent {
+		b.newline(nil)
+	}
+	if b.ops == nil {
+		b.ops = []delta.Op{}
+	}
+	return delta.Delta{Ops: b.ops}
+}
+
+func withAttr(attrs map[string]interface{}, key string, value interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(attrs)+1)
+	for k, v := range attrs {
+		out[k] = v
+	}
+	out[key] = value
+	return out
+}
+
+func sameAttrs(a, b map[string]interface{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,45 @@
+package export
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMarkdownToDelta(t *testing.T) {
+	d := MarkdownToDelta("# Notes\n\nSome **bold** and [a link](https://example.com)\n- item\n```\ncode\n```\nunclosed *marker")
+
+	b, err := json.Marshal(d)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"ops":[
+		{"insert":"Notes"},{"insert":"\n","attributes":{"header":1}},
+		{"insert":"Some "},{"insert":"bold","attributes":{"bold":true}},{"insert":" and "},
+		{"insert":"a link","attributes":{"link":"https://example.com"}},{"insert":"\n"},
+		{"insert":"item"},{"insert":"\n","attributes":{"list":"bullet"}},
+		{"insert":"code"},{"insert":"\n","attributes":{"code-block":true}},
+		{"insert":"unclosed *marker\n"}
+	]}`, string(b))
+}
+
+func TestHTMLToDelta(t *testing.T) {
+	d := HTMLToDelta(`<h2>Title</h2><p>Hello <em>there</em> &amp; <blink>bye</blink></p><script>alert(1)</script>`)
+
+	b, err := json.Marshal(d)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"ops":[
+		{"insert":"Title"},{"insert":"\n","attributes":{"header":2}},
+		{"insert":"Hello "},{"insert":"there","attributes":{"italic":true}},{"insert":" & bye\n"}
+	]}`, string(b))
+}
+
+func TestMarkdownRoundTrip(t *testing.T) {
+	src := "# Title\n- one\n- two\n"
+	b, err := json.Marshal(MarkdownToDelta(src))
+	require.NoError(t, err)
+
+	out, err := Render(FormatMarkdown, "Title", b)
+	require.NoError(t, err)
+	assert.Equal(t, src, string(out))
+}
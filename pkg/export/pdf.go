@@ -0,0 +1,78 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// FormatPDF is rendered from the HTML export by a PDFRenderer.
+const FormatPDF = "pdf"
+
+// ErrPDFBusy means no render slot freed up before the render deadline.
+var ErrPDFBusy = errors.New("too many PDF exports in progress")
+
+// PDFRenderer turns a standalone HTML document into PDF.
+type PDFRenderer interface {
+	RenderPDF(ctx context.Context, html []byte) ([]byte, error)
+}
+
+// Wkhtmltopdf renders with the wkhtmltopdf binary at Path. Images, scripts
+// and local files are disabled, so rendering user content never makes the
+// server fetch URLs or read its own disk.
+type Wkhtmltopdf struct {
+	Path string
+}
+
+func (w Wkhtmltopdf) RenderPDF(ctx context.Context, html []byte) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, w.Path,
+		"--quiet", "--no-images", "--disable-javascript", "--disable-local-file-access",
+		"-", "-")
+	cmd.Stdin = bytes.NewReader(html)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("wkhtmltopdf: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// LimitedPDF bounds another renderer: at most maxConcurrent renders run at
+// once, and waiting for a slot plus rendering must finish within timeout.
+type LimitedPDF struct {
+	renderer PDFRenderer
+	slots    chan struct{}
+	timeout  time.Duration
+}
+
+func NewLimitedPDF(renderer PDFRenderer, maxConcurrent int, timeout time.Duration) *LimitedPDF {
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+	return &LimitedPDF{renderer: renderer, slots: make(chan struct{}, maxConcurrent), timeout: timeout}
+}
+
+func (l *LimitedPDF) RenderPDF(ctx context.Context, html []byte) ([]byte, error) {
+	if l.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.timeout)
+		defer cancel()
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ErrPDFBusy
+	}
+	defer func() { <-l.slots }()
+
+	return l.renderer.RenderPDF(ctx, html)
+}
@@ -0,0 +1,63 @@
+package export
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakePDF renders instantly unless hold is set; it then waits for hold to
+// close, or for the context too when honorCtx is true.
+type fakePDF struct {
+	hold     chan struct{}
+	honorCtx bool
+}
+
+func (f fakePDF) RenderPDF(ctx context.Context, html []byte) ([]byte, error) {
+	if f.hold != nil {
+		done := ctx.Done()
+		if !f.honorCtx {
+			done = nil
+		}
+		select {
+		case <-f.hold:
+		case <-done:
+			return nil, ctx.Err()
+		}
+	}
+	return append([]byte("%PDF "), html...), nil
+}
+
+func TestLimitedPDFBoundsConcurrency(t *testing.T) {
+	hold := make(chan struct{})
+	l := NewLimitedPDF(fakePDF{hold: hold}, 1, 50*time.Millisecond)
+
+	first := make(chan error, 1)
+	go func() {
+		_, err := l.RenderPDF(context.Background(), []byte("<p>a</p>"))
+		first <- err
+	}()
+	require.Eventually(t, func() bool { return len(l.slots) == 1 }, time.Second, 5*time.Millisecond)
+
+	// The only slot is taken, so a second render gives up at the deadline.
+	_, err := l.RenderPDF(context.Background(), []byte("<p>b</p>"))
+	assert.ErrorIs(t, err, ErrPDFBusy)
+
+	close(hold)
+	require.NoError(t, <-first)
+
+	out, err := l.RenderPDF(context.Background(), []byte("<p>c</p>"))
+	require.NoError(t, err)
+	assert.Equal(t, "%PDF <p>c</p>", string(out))
+}
+
+func TestLimitedPDFTimesOutSlowRender(t *testing.T) {
+	l := NewLimitedPDF(fakePDF{hold: make(chan struct{}), honorCtx: true}, 1, 50*time.Millisecond)
+
+	_, err := l.RenderPDF(context.Background(), []byte("<p>a</p>"))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Len(t, l.slots, 0, "slot released after the timeout")
+}
@@ -0,0 +1,49 @@
+// Package flags holds per-deployment feature flags, read from FEATURE_<NAME>
+// environment variables, so features can be switched on or off without a
+// code change.
+package flags
+
+import "satunaskah/pkg/env"
+
+// Known flags.
+const (
+	PDFExport        = "PDF_EXPORT"        // format=pdf on single-document export
+	Append           = "APPEND"            // POST /api/documents/append
+	Prewarm          = "PREWARM"           // POST /api/documents/prewarm
+	CommentsSnapshot = "COMMENTS_SNAPSHOT" // COMMENTS_SNAPSHOT over WebSocket
+	SocketRename     = "SOCKET_RENAME"     // METADATA renames over WebSocket
+	RangeLocks       = "RANGE_LOCKS"       // LOCK_RANGE claims over WebSocket
+)
+
+// Defaults lists every known flag with its value when its variable is unset.
+// Features already released default to on; new ones should start off until
+// they are rolled out.
+var Defaults = map[string]bool{
+	PDFExport:        true,
+	Append:           true,
+	Prewarm:          true,
+	CommentsSnapshot: true,
+	SocketRename:     true,
+	RangeLocks:       false,
+}
+
+// Flags maps flag names to whether they are on.
+type Flags map[string]bool
+
+// FromEnv reads every known flag from FEATURE_<NAME>, e.g. FEATURE_PDF_EXPORT.
+func FromEnv() Flags {
+	f := make(Flags, len(Defaults))
+	for name, def := range Defaults {
+		f[name] = env.Bool("FEATURE_"+name, def)
+	}
+	return f
+}
+
+// Enabled reports whether name is on. Known flags missing from f take their
+// default, so a nil Flags has every default; unknown flags are off.
+func (f Flags) Enabled(name string) bool {
+	if on, ok := f[name]; ok {
+		return on
+	}
+	return Defaults[name]
+}
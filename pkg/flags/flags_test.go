@@ -0,0 +1,30 @@
+package flags
+
+import (
+	"os"
+	"testing"
+
+	"satunaskah/pkg/logger"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	logger.Init()
+	os.Exit(m.Run())
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("FEATURE_PDF_EXPORT", "false")
+	t.Setenv("FEATURE_APPEND", "")
+	t.Setenv("FEATURE_SUGGESTIONS", "true")
+
+	f := FromEnv()
+	assert.False(t, f.Enabled(PDFExport))
+	assert.True(t, f.Enabled(Append), "unset takes the default")
+	assert.False(t, f.Enabled("SUGGESTIONS"), "unknown flags are off")
+
+	var none Flags
+	assert.True(t, none.Enabled(PDFExport))
+	assert.False(t, none.Enabled("SUGGESTIONS"))
+}
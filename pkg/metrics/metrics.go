@@ -0,0 +1,15 @@
+package metrics
+
+import "expvar"
+
+// Counters and gauges published through expvar at /debug/vars.
+var (
+	// DeadLetters counts documents written to the dead-letter directory after
+	// repeated save failures.
+	DeadLetters = expvar.NewInt("dead_letter_saves")
+
+	// Hub document cache size, split into raw and gzip-compressed entries.
+	CacheRawBytes        = expvar.NewInt("document_cache_raw_bytes")
+	CacheCompressedBytes = expvar.NewInt("document_cache_compressed_bytes")
+	CacheCompressedDocs  = expvar.NewInt("document_cache_compressed_docs")
+)
@@ -0,0 +1,63 @@
+package router
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"satunaskah/middleware"
+	"satunaskah/pkg/flags"
+	"satunaskah/pkg/logger"
+	"time"
+)
+
+// ReadinessTimeout bounds the dependency checks of one /readyz request.
+const ReadinessTimeout = 3 * time.Second
+
+type readiness struct {
+	Status string            `json:"status"` // "ready" or "not_ready"
+	Checks map[string]string `json:"checks"`
+}
+
+// readyHandler reports whether the server can serve requests: the database
+// answers, and tokens can be verified. An unreachable JWKS endpoint only
+// makes the server unready when there is no HS256 secret to fall back on.
+func readyHandler(db *sql.DB, hasSecret bool, jwks *middleware.JWKSProbe) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), ReadinessTimeout)
+		defer cancel()
+
+		res := readiness{Status: "ready", Checks: map[string]string{"database": "ok", "jwks": "ok"}}
+		if err := db.PingContext(ctx); err != nil {
+			logger.Sugar.Warnf("Readiness: database ping failed: %v", err)
+			res.Checks["database"] = "unreachable"
+			res.Status = "not_ready"
+		}
+		if !jwks.Configured() {
+			res.Checks["jwks"] = "not_configured"
+		} else if err := jwks.Check(ctx); err != nil {
+			res.Checks["jwks"] = "unreachable"
+			if !hasSecret {
+				res.Status = "not_ready"
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if res.Status != "ready" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+// flagsHandler reports the feature flags this server started with.
+func flagsHandler(features flags.Flags) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		current := make(map[string]bool, len(flags.Defaults))
+		for name := range flags.Defaults {
+			current[name] = features.Enabled(name)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(current)
+	}
+}
@@ -2,41 +2,116 @@ package router
 
 import (
 	"database/sql"
+	"expvar"
 	"net/http"
+	"satunaskah/config"
 	docHandler "satunaskah/internal/document"
 	"satunaskah/internal/document/repository"
 	"satunaskah/internal/document/service"
+	notifHandler "satunaskah/internal/notification"
+	"satunaskah/internal/profile"
+	profileRepo "satunaskah/internal/profile/repository"
 	"satunaskah/middleware"
+	"satunaskah/pkg/flags"
 	"satunaskah/socket"
 )
 
-func Setup(db *sql.DB, hub *socket.Hub) http.Handler {
+// Setup wires the routes. It also returns the document service, whose
+// background worker the caller starts alongside the hub's.
+func Setup(cfg *config.Config, db *sql.DB, hub *socket.Hub) (http.Handler, *service.DocumentService) {
 	mux := http.NewServeMux()
 
-	// WebSocket
+	// Every authenticated request also keeps the user's profile row current.
+	authenticate := middleware.NewAuthMiddleware(cfg.Auth)
+	profileSync := profile.NewSyncer(profileRepo.NewProfileRepository(db))
+	auth := func(next http.Handler) http.Handler {
+		return authenticate(profileSync.Middleware(next))
+	}
+
+	// WebSocket. Browsers don't preflight the handshake, so the same origin
+	// rules are applied to it directly.
+	hub.CheckOrigin = cfg.CORS.CheckOrigin
+	hub.ClientIP = cfg.Proxy.ClientIP
 	wsHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		userID := r.Context().Value(middleware.UserIDKey).(string)
-		socket.ServeWs(hub, w, r, userID)
+		displayName, _ := r.Context().Value(middleware.DisplayNameKey).(string)
+		// Guests (anonymous sign-ins) have no name in their token, so they may pick one.
+		if isAnonymous, _ := r.Context().Value(middleware.IsAnonymousKey).(bool); isAnonymous && displayName == "" {
+			displayName = r.URL.Query().Get("name")
+		}
+		socket.ServeWs(hub, w, r, userID, displayName)
 	})
-	mux.Handle("/ws", middleware.AuthMiddleware(wsHandler))
+	mux.Handle("/ws", auth(wsHandler))
+	mux.Handle("/ws/view", auth(wsHandler))
+	mux.Handle("/ws/dashboard", auth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		socket.ServeDashboard(hub, w, r, r.Context().Value(middleware.UserIDKey).(string))
+	})))
 
 	// REST API
 	docRepo := repository.NewDocumentRepository(db)
+	docRepo.Content = hub.Content // One content backend for REST and realtime paths
 	docService := service.NewDocumentService(docRepo, hub)
+	hub.CommentAdder = docService // COMMENT messages are stored like REST comments
+	hub.Titles = docService       // Socket renames follow UNIQUE_TITLES like REST ones
+	// Socket UPDATEs are held to the limits REST saves are.
+	hub.MaxContentBytes = docService.MaxContentBytes
+	hub.MaxContentChars = docService.MaxContentChars
+	// Routes and message types are gated by the same flags.
+	features := hub.Features
+	if !features.Enabled(flags.PDFExport) {
+		docService.PDF = nil
+	}
 	docHandler := docHandler.NewDocumentHandler(docService)
-	auth := middleware.AuthMiddleware
+	// Endpoints that read a JSON body answer 415 to any other content type.
+	requireJSON := middleware.RequireContentType("application/json")
 
-	mux.Handle("/api/documents/create", auth(http.HandlerFunc(docHandler.CreateDocument)))
+	mux.Handle("/api/documents/create", auth(requireJSON(http.HandlerFunc(docHandler.CreateDocument))))
+	mux.Handle("/api/documents/import", auth(requireJSON(http.HandlerFunc(docHandler.ImportDocument))))
 	mux.Handle("/api/documents/delete", auth(http.HandlerFunc(docHandler.DeleteDocument)))
-	mux.Handle("/api/documents/update", auth(http.HandlerFunc(docHandler.UpdateDocument)))
+	mux.Handle("/api/documents/delete-bulk", auth(requireJSON(http.HandlerFunc(docHandler.DeleteDocuments))))
+	mux.Handle("/api/documents/update", auth(requireJSON(http.HandlerFunc(docHandler.UpdateDocument))))
 	mux.Handle("/api/documents", auth(http.HandlerFunc(docHandler.GetDocuments)))
-	mux.Handle("/api/documents/invite", auth(http.HandlerFunc(docHandler.AddCollaborator)))
-	mux.Handle("/api/documents/comments/add", auth(http.HandlerFunc(docHandler.AddComment)))
+	mux.Handle("/api/documents/batch", auth(requireJSON(http.HandlerFunc(docHandler.GetDocumentsBatch))))
+	mux.Handle("/api/documents/count", auth(http.HandlerFunc(docHandler.CountDocuments)))
+	mux.Handle("/api/documents/recent", auth(http.HandlerFunc(docHandler.GetRecentEdits)))
+	mux.Handle("/api/documents/invite", auth(requireJSON(http.HandlerFunc(docHandler.AddCollaborator))))
+	mux.Handle("/api/documents/kick", auth(requireJSON(http.HandlerFunc(docHandler.KickUser))))
+	mux.Handle("/api/documents/comments/add", auth(requireJSON(http.HandlerFunc(docHandler.AddComment))))
 	mux.Handle("/api/documents/comments", auth(http.HandlerFunc(docHandler.GetComments)))
-	mux.Handle("/api/documents/comments/resolve", auth(http.HandlerFunc(docHandler.ResolveComment)))
+	mux.Handle("/api/documents/comments/export", auth(http.HandlerFunc(docHandler.ExportComments)))
+	mux.Handle("/api/documents/comments/stats", auth(http.HandlerFunc(docHandler.GetCommentStats)))
+	mux.Handle("/api/documents/comments/resolve", auth(requireJSON(http.HandlerFunc(docHandler.ResolveComment))))
 	mux.Handle("/api/documents/comments/delete", auth(http.HandlerFunc(docHandler.DeleteComment)))
 	mux.Handle("/api/documents/members", auth(http.HandlerFunc(docHandler.GetDocumentMembers)))
-	mux.Handle("/api/documents/save", auth(http.HandlerFunc(docHandler.SaveDocument)))
+	mux.Handle("/api/documents/owner", auth(http.HandlerFunc(docHandler.GetDocumentOwner)))
+	mux.Handle("/api/documents/my-role", auth(http.HandlerFunc(docHandler.GetMyRole)))
+	mux.Handle("/api/documents/raw", auth(http.HandlerFunc(docHandler.GetRawDocument)))
+	mux.Handle("/api/documents/export", auth(http.HandlerFunc(docHandler.ExportDocument)))
+	if features.Enabled(flags.Prewarm) {
+		mux.Handle("/api/documents/prewarm", auth(http.HandlerFunc(docHandler.PrewarmDocument)))
+	}
+	mux.Handle("/api/documents/at-revision", auth(http.HandlerFunc(docHandler.GetContentAtRevision)))
+	mux.Handle("/api/documents/preview-as", auth(http.HandlerFunc(docHandler.PreviewAsRole)))
+	mux.Handle("/api/documents/save", auth(requireJSON(http.HandlerFunc(docHandler.SaveDocument))))
+	if features.Enabled(flags.Append) {
+		mux.Handle("/api/documents/append", auth(requireJSON(http.HandlerFunc(docHandler.AppendContent))))
+	}
+	mux.Handle("/api/documents/acquire-lock", auth(requireJSON(http.HandlerFunc(docHandler.AcquireEditLock))))
+	mux.Handle("/api/documents/release-lock", auth(requireJSON(http.HandlerFunc(docHandler.ReleaseEditLock))))
+	mux.Handle("/api/documents/export-bulk", auth(requireJSON(http.HandlerFunc(docHandler.ExportDocuments))))
+	mux.Handle("/api/me/stats", auth(http.HandlerFunc(docHandler.GetWorkspaceStats)))
+	mux.Handle("/api/me/comments", auth(http.HandlerFunc(docHandler.GetMyComments)))
+	mux.Handle("/api/me/collaborators", auth(http.HandlerFunc(docHandler.GetMyCollaborators)))
+
+	notifHandler := notifHandler.NewNotificationHandler(hub.Notifications)
+	mux.Handle("/api/notifications/read-all", auth(http.HandlerFunc(notifHandler.ReadAll)))
+
+	// Readiness for load balancers and orchestrators (unauthenticated)
+	mux.Handle("/readyz", readyHandler(db, cfg.Auth.JWTSecret != "", middleware.NewJWKSProbe(cfg.Auth)))
+
+	// Runtime metrics (expvar JSON)
+	mux.Handle("/debug/vars", auth(expvar.Handler()))
+	mux.Handle("/debug/flags", auth(flagsHandler(features)))
 
-	return middleware.CORSMiddleware(mux)
+	return middleware.NewCORSMiddleware(cfg.CORS)(mux), docService
 }
@@ -0,0 +1,119 @@
+package socket
+
+import (
+	"encoding/json"
+	"time"
+
+	"satunaskah/internal/document/model"
+	"satunaskah/pkg/delta"
+	"satunaskah/pkg/logger"
+)
+
+// anchorEdit is a change to a room's content, kept until the next save so
+// comment ranges can follow it.
+type anchorEdit struct {
+	delta.Edit
+	At time.Time
+}
+
+// recordAnchorEdit notes how an update changes docID from old to updated,
+// and returns that edit unless nothing changed. Must be called with h.mu
+// held.
+func (h *Hub) recordAnchorEdit(docID string, old, updated []byte) (delta.Edit, bool) {
+	before, err := delta.Parse(old)
+	if err != nil {
+		return delta.Edit{}, false
+	}
+	after, err := delta.Parse(updated)
+	if err != nil {
+		return delta.Edit{}, false
+	}
+	e, changed := delta.Diff(before, after)
+	if changed {
+		h.anchorEdits[docID] = append(h.anchorEdits[docID], anchorEdit{Edit: e, At: time.Now()})
+	}
+	return e, changed
+}
+
+// takeAnchorEdits returns and clears the edits recorded for docID.
+// Must be called with h.mu held.
+func (h *Hub) takeAnchorEdits(docID string) []anchorEdit {
+	edits := h.anchorEdits[docID]
+	delete(h.anchorEdits, docID)
+	return edits
+}
+
+// restoreAnchorEdits puts back the edits of a failed save, ahead of any made
+// since. Must be called with h.mu held.
+func (h *Hub) restoreAnchorEdits(docID string, edits []anchorEdit) {
+	if len(edits) > 0 {
+		h.anchorEdits[docID] = append(edits, h.anchorEdits[docID]...)
+	}
+}
+
+// shiftCommentRanges moves the text_range of docID's open comments through
+// edits so their highlights stay on the text they were made on. A comment is
+// only moved by edits made after it was created; its range already accounts
+// for earlier ones. Resolved comments are left as they are. The ranges are
+// read and written in one transaction with the rows locked, so shifts from a
+// close-save and an auto-save running at once apply one after the other.
+func (h *Hub) shiftCommentRanges(docID string, edits []anchorEdit) {
+	if len(edits) == 0 || h.db == nil {
+		return
+	}
+	tx, err := h.db.Begin()
+	if err != nil {
+		logger.Sugar.Errorf("Failed to begin moving comment ranges of doc %s: %v", docID, err)
+		return
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(`
+		SELECT id, text_range, created_at FROM comments
+		WHERE document_id = $1 AND NOT is_resolved AND text_range IS NOT NULL
+		ORDER BY id FOR UPDATE`, docID)
+	if err != nil {
+		logger.Sugar.Errorf("Failed to load comment ranges of doc %s: %v", docID, err)
+		return
+	}
+	shifted := map[string]string{} // comment id -> new text_range
+	for rows.Next() {
+		var id, raw string
+		var createdAt time.Time
+		if err := rows.Scan(&id, &raw, &createdAt); err != nil {
+			continue
+		}
+		var r struct {
+			Index  *int `json:"index"`
+			Length *int `json:"length"`
+		}
+		if json.Unmarshal([]byte(raw), &r) != nil || r.Index == nil || r.Length == nil {
+			continue
+		}
+		index, length := *r.Index, *r.Length
+		for _, e := range edits {
+			if e.At.After(createdAt) {
+				index, length = e.TransformRange(index, length)
+			}
+		}
+		if index != *r.Index || length != *r.Length {
+			updated, _ := json.Marshal(model.TextRange{Index: index, Length: length})
+			shifted[id] = string(updated)
+		}
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		logger.Sugar.Errorf("Failed to load comment ranges of doc %s: %v", docID, err)
+		return
+	}
+
+	for id, textRange := range shifted {
+		if _, err := tx.Exec("UPDATE comments SET text_range = $1 WHERE id = $2", textRange, id); err != nil {
+			logger.Sugar.Errorf("Failed to move range of comment %s: %v", id, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		logger.Sugar.Errorf("Failed to commit comment ranges of doc %s: %v", docID, err)
+	}
+}
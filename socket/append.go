@@ -0,0 +1,158 @@
+package socket
+
+import (
+	"encoding/json"
+
+	"satunaskah/pkg/delta"
+)
+
+// appendRequest asks Run to append to a document; see Hub.Append.
+type appendRequest struct {
+	docID    string
+	userID   string
+	addition delta.Delta
+	check    func([]byte) error
+	reply    chan appendResult
+}
+
+type appendResult struct {
+	content []byte
+	err     error
+	// closed means the room is not open: the caller appends to the stored
+	// copy and then sends docID on appendDone.
+	closed bool
+}
+
+// Append adds addition to the end of docID and returns the new content.
+// check vets the combined content before anything changes. An open room's
+// copy is changed inside Run, so it is atomic with live UPDATEs; it is left
+// for auto-save and relayed to the room as an UPDATE from userID. Otherwise
+// the stored copy is rewritten on the caller's goroutine, and joins and
+// other appends to docID wait until it has been.
+func (h *Hub) Append(docID, userID string, addition delta.Delta, check func([]byte) error) ([]byte, error) {
+	reply := make(chan appendResult, 1)
+	h.appends <- appendRequest{docID: docID, userID: userID, addition: addition, check: check, reply: reply}
+	res := <-reply
+	if !res.closed {
+		return res.content, res.err
+	}
+	defer func() { h.appendDone <- docID }()
+	return h.appendStored(appendRequest{docID: docID, userID: userID, addition: addition, check: check})
+}
+
+// appendStored appends to docID's stored copy. Run holds back joins meanwhile,
+// so no room can open on the old content.
+func (h *Hub) appendStored(req appendRequest) ([]byte, error) {
+	stored, err := h.Content.Load(req.docID)
+	if err != nil {
+		return nil, err
+	}
+	content, err := appendTo(stored, req)
+	if err != nil {
+		return nil, err
+	}
+	sum, preview := previewUpdate(content, 0)
+	if _, _, _, err := h.persist(req.docID, content, preview, req.userID); err != nil {
+		// The content may have been written without the row, so a REST save
+		// must not be skipped as unchanged.
+		h.mu.Lock()
+		delete(h.previewSums, req.docID)
+		h.mu.Unlock()
+		return nil, err
+	}
+	h.mu.Lock()
+	// A REST save of the content from before the append is a change again.
+	h.previewSums[req.docID] = sum
+	// Keep a prewarmed copy in step with what was stored.
+	if _, warm := h.prewarmed[req.docID]; warm {
+		h.setContent(req.docID, content)
+	}
+	h.queueDashboardEvent(dashboardKey{DocID: req.docID, Event: DashboardUpdated})
+	h.mu.Unlock()
+	return content, nil
+}
+
+// appendTo returns current with req's addition appended, once req.check has
+// accepted it.
+func appendTo(current []byte, req appendRequest) ([]byte, error) {
+	base, err := delta.Parse(current)
+	if err != nil {
+		return nil, err
+	}
+	content, err := json.Marshal(base.Append(req.addition))
+	if err != nil {
+		return nil, err
+	}
+	if err := req.check(content); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// startAppend applies an appendRequest to an open room, or hands a closed
+// room's append back to its caller. Appends to a document whose stored copy
+// is already being appended to wait their turn. Only Run calls it.
+func (h *Hub) startAppend(req appendRequest) {
+	if held, busy := h.storedAppends[req.docID]; busy {
+		held.appends = append(held.appends, req)
+		return
+	}
+	h.mu.Lock()
+	open := h.Rooms[req.docID] != nil
+	current, _ := h.cachedContent(req.docID)
+	h.mu.Unlock()
+	if !open {
+		h.storedAppends[req.docID] = &heldForAppend{}
+		req.reply <- appendResult{closed: true}
+		return
+	}
+
+	content, err := appendTo(current, req)
+	if err != nil {
+		req.reply <- appendResult{err: err}
+		return
+	}
+	h.mu.Lock()
+	h.setContent(req.docID, content)
+	h.DirtyDocs[req.docID] = true
+	h.Revisions[req.docID]++
+	revision := h.Revisions[req.docID]
+	h.updatedBy[req.docID] = ""
+	h.recordEditor(req.docID, req.userID)
+	h.queueDashboardEvent(dashboardKey{DocID: req.docID, Event: DashboardUpdated})
+	h.mu.Unlock()
+	h.relay(WSMessage{Type: UpdateType, DocID: req.docID, UserID: req.userID, Payload: content, Revision: revision})
+	req.reply <- appendResult{content: content}
+}
+
+// heldForAppend is what arrived for a document while its stored copy was
+// being appended to.
+type heldForAppend struct {
+	joins   []*Client
+	appends []appendRequest
+}
+
+// holdJoin keeps client out of its room while the stored copy is being
+// appended to, and reports whether it did. Only Run calls it.
+func (h *Hub) holdJoin(client *Client) bool {
+	held, busy := h.storedAppends[client.DocID]
+	if busy {
+		held.joins = append(held.joins, client)
+	}
+	return busy
+}
+
+// finishAppend lets through what was held for docID once its stored copy
+// has been appended to. Only Run calls it.
+func (h *Hub) finishAppend(docID string) {
+	held := h.storedAppends[docID]
+	delete(h.storedAppends, docID)
+	for _, req := range held.appends {
+		h.startAppend(req)
+	}
+	for _, client := range held.joins {
+		if !h.holdJoin(client) {
+			h.join(client)
+		}
+	}
+}
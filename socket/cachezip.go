@@ -0,0 +1,135 @@
+package socket
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"satunaskah/pkg/logger"
+	"satunaskah/pkg/metrics"
+	"time"
+)
+
+// Defaults for compressing idle cache entries.
+const (
+	DefaultCacheCompressMinBytes = 64 << 10
+	DefaultCacheCompressIdle     = 5 * time.Minute
+)
+
+// setContent stores raw content for docID and marks it recently used.
+// Must be called with h.mu held.
+func (h *Hub) setContent(docID string, content []byte) {
+	h.DocumentCache[docID] = content
+	delete(h.compressedCache, docID)
+	delete(h.docLengths, docID)
+	h.cacheTouched[docID] = time.Now()
+}
+
+// cachedContent returns docID's content, inflating a compressed entry back
+// into DocumentCache first. Must be called with h.mu held.
+func (h *Hub) cachedContent(docID string) ([]byte, bool) {
+	if content, ok := h.DocumentCache[docID]; ok {
+		return content, true
+	}
+	compressed, ok := h.compressedCache[docID]
+	if !ok {
+		return nil, false
+	}
+	content, err := gunzip(compressed)
+	if err != nil {
+		// Cannot happen for data we compressed ourselves; keep the entry so it isn't lost.
+		logger.Sugar.Errorf("Failed to inflate cached content of doc %s: %v", docID, err)
+		return nil, false
+	}
+	h.setContent(docID, content)
+	return content, true
+}
+
+// dropContent forgets all cached content of docID. Must be called with h.mu held.
+func (h *Hub) dropContent(docID string) {
+	delete(h.DocumentCache, docID)
+	delete(h.compressedCache, docID)
+	delete(h.cacheTouched, docID)
+	delete(h.docLengths, docID)
+}
+
+// compressIdle gzips saved cache entries of at least CacheCompressMinBytes
+// that have not been read or changed for CacheCompressIdle. Compression runs
+// outside the lock; an entry touched meanwhile is left raw.
+func (h *Hub) compressIdle() {
+	type candidate struct {
+		content []byte
+		touched time.Time
+	}
+	candidates := make(map[string]candidate)
+
+	h.mu.Lock()
+	now := time.Now()
+	for docID, content := range h.DocumentCache {
+		if h.DirtyDocs[docID] || len(content) < h.CacheCompressMinBytes {
+			continue
+		}
+		if touched := h.cacheTouched[docID]; now.Sub(touched) >= h.CacheCompressIdle {
+			candidates[docID] = candidate{content: content, touched: touched}
+		}
+	}
+	h.mu.Unlock()
+
+	for docID, c := range candidates {
+		compressed, err := gzipBytes(c.content)
+		if err != nil {
+			logger.Sugar.Errorf("Failed to compress cached content of doc %s: %v", docID, err)
+			continue
+		}
+		if len(compressed) >= len(c.content) {
+			continue
+		}
+		h.mu.Lock()
+		if !h.DirtyDocs[docID] && h.cacheTouched[docID].Equal(c.touched) {
+			if _, ok := h.DocumentCache[docID]; ok {
+				delete(h.DocumentCache, docID)
+				h.compressedCache[docID] = compressed
+			}
+		}
+		h.mu.Unlock()
+	}
+
+	h.publishCacheMetrics()
+}
+
+// publishCacheMetrics updates the cache size gauges.
+func (h *Hub) publishCacheMetrics() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var raw, compressed int64
+	for _, content := range h.DocumentCache {
+		raw += int64(len(content))
+	}
+	for _, content := range h.compressedCache {
+		compressed += int64(len(content))
+	}
+	metrics.CacheRawBytes.Set(raw)
+	metrics.CacheCompressedBytes.Set(compressed)
+	metrics.CacheCompressedDocs.Set(int64(len(h.compressedCache)))
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gunzip(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
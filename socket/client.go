@@ -2,61 +2,137 @@ package socket
 
 import (
 	"database/sql"
-	"encoding/json"
+	"errors"
+	"net"
 	"net/http"
+	"satunaskah/pkg/docid"
 	"satunaskah/pkg/logger"
+	"strings"
 	"time"
+	"unicode"
 
 	"github.com/gorilla/websocket"
 )
 
+// Application close codes (4000-4999) sent when the server rejects a connection
+// after the upgrade, so the frontend can show an accurate message.
+const (
+	CloseBadRequest       = 4400
+	CloseAccountDeleted   = 4401
+	CloseAccessDenied     = 4403
+	CloseDocumentNotFound = 4404
+	CloseRemovedByOwner   = 4410
+	CloseTooManyRooms     = 4429
+	CloseInternalError    = 4500
+)
+
+// writeWait bounds each write to a client; the HTTP server's WriteTimeout does
+// not apply once the connection has been upgraded.
+const writeWait = 10 * time.Second
+
+// Keepalive defaults: the server pings every DefaultPingInterval and drops a
+// client that has not answered with a pong within DefaultPongTimeout.
+const (
+	DefaultPingInterval = 30 * time.Second
+	DefaultPongTimeout  = 60 * time.Second
+)
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	// CheckOrigin allows us to connect from our Next.js dev server
+	// Origins are checked per hub in ServeWs.
 	CheckOrigin: func(r *http.Request) bool { return true },
+	// The first supported version the client offers is echoed back.
+	Subprotocols: SupportedProtocols,
 }
 
-func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request, userID string) {
+// MaxDisplayNameLength bounds display names shown on cursors and presence.
+const MaxDisplayNameLength = 50
+
+func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request, userID, displayName string) {
+	// A client asking only for protocol versions we don't speak is refused
+	// before the upgrade, since it could not understand our messages.
+	if !protocolAcceptable(r) {
+		logger.Sugar.Warnf("Connection rejected: Unsupported protocol versions %v", websocket.Subprotocols(r))
+		http.Error(w, "Unsupported WebSocket protocol version", http.StatusBadRequest)
+		return
+	}
+
 	// 9. The HTTP connection is upgraded to a persistent WebSocket connection.
-	conn, err := upgrader.Upgrade(w, r, nil)
+	up := upgrader
+	if hub.CheckOrigin != nil {
+		up.CheckOrigin = hub.CheckOrigin
+	}
+	conn, err := up.Upgrade(w, r, nil)
 	if err != nil {
 		logger.Sugar.Error(err)
 		return
 	}
+	protocol := conn.Subprotocol()
+	if protocol == "" {
+		protocol = ProtocolV1 // Clients from before versioning
+	}
 
 	docID := r.URL.Query().Get("docId")
 	if docID == "" {
 		logger.Sugar.Error("Missing docId")
+		closeWithReason(conn, CloseBadRequest, "missing docId")
+		return
+	}
+	if !docid.Valid(docID) {
+		logger.Sugar.Warnf("Connection rejected: Malformed docId %q", docID)
+		closeWithReason(conn, CloseBadRequest, "invalid docId")
 		return
 	}
 
 	// --- Determine User Role ---
-	// Default to Reader
-	role := RoleReader
-
-	// 1. Check if Owner (Implicit Writer)
-	var ownerID string
-	var title string
-	err = hub.db.QueryRow("SELECT owner_id, title FROM documents WHERE id = $1", docID).Scan(&ownerID, &title)
-	if err == sql.ErrNoRows {
-		logger.Sugar.Warnf("Connection rejected: Document %s not found", docID)
-		return // Close connection if document doesn't exist
-	} else if err != nil {
-		logger.Sugar.Errorf("Database error checking owner: %v", err)
-		return
+	var role string
+
+	// 1. Check if Owner (Implicit Writer). An open room already knows its
+	// owner and title; otherwise they are read here and seed the room.
+	title, ownerID, cached := hub.DocMeta(docID)
+	if !cached {
+		err = hub.db.QueryRow("SELECT owner_id, title FROM documents WHERE id = $1", docID).Scan(&ownerID, &title)
+		if err == sql.ErrNoRows {
+			logger.Sugar.Warnf("Connection rejected: Document %s not found", docID)
+			closeWithReason(conn, CloseDocumentNotFound, "document not found")
+			return
+		} else if err != nil {
+			logger.Sugar.Errorf("Database error checking owner: %v", err)
+			closeWithReason(conn, CloseInternalError, "internal error")
+			return
+		}
 	}
 
 	if ownerID == userID {
 		role = RoleWriter
 	} else {
-		// 2. Check Collaborators Table (You need to create this table in your DB)
-		var dbRole string
-		if err := hub.db.QueryRow("SELECT role FROM collaborators WHERE document_id = $1 AND user_id = $2", docID, userID).Scan(&dbRole); err == nil {
-			role = dbRole
+		// 2. Check Collaborators Table. Users who are neither owner nor collaborator are rejected.
+		err := hub.db.QueryRow("SELECT role FROM collaborators WHERE document_id = $1 AND user_id = $2", docID, userID).Scan(&role)
+		if err == sql.ErrNoRows {
+			logger.Sugar.Warnf("Connection rejected: User %s has no access to document %s", userID, docID)
+			closeWithReason(conn, CloseAccessDenied, "access denied")
+			return
+		} else if err != nil {
+			logger.Sugar.Errorf("Database error checking collaborator role: %v", err)
+			closeWithReason(conn, CloseInternalError, "internal error")
+			return
 		}
 	}
 
+	// View mode ("preview as reader", dashboards) always joins as a reader,
+	// whatever the user's real role, and never sends edits or comments.
+	viewOnly := r.URL.Path == "/ws/view" || r.URL.Query().Get("mode") == "view"
+	if viewOnly {
+		role = RoleReader
+	}
+
+	// Record when this user last opened the document (drives unread comment counts).
+	if _, err := hub.db.Exec(`INSERT INTO document_access (document_id, user_id, last_opened_at) VALUES ($1, $2, NOW())
+		ON CONFLICT (document_id, user_id) DO UPDATE SET last_opened_at = NOW()`, docID, userID); err != nil {
+		logger.Sugar.Errorf("Failed to record open of doc %s by %s: %v", docID, userID, err)
+	}
+
 	// 10. A `Client` struct is created to represent this user's connection.
 	// It holds references to the Hub, the connection itself, and the user/document IDs.
 	client := &Client{
@@ -65,12 +141,37 @@ func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request, userID string) {
 		DocID:  docID,
 		UserID: userID,
 		Role:   role,
-		Title:  title,
 		Send:   make(chan []byte, 256),
+
+		ViewOnly:    viewOnly,
+		DisplayName: normalizeDisplayName(displayName, userID),
+		Protocol:    protocol,
+
+		resumeFrom: r.URL.Query().Get("resume"),
+		meta:       docMeta{Title: title, OwnerID: ownerID},
+
+		resumeRevision: parseRevision(r.URL.Query().Get("revision")),
+
+		ConnectedAt: time.Now(),
+		ClientIP:    hub.clientIP(r),
+		admitted:    make(chan bool, 1),
+	}
+
+	// Reject oversized frames before they are buffered; gorilla closes the
+	// connection with 1009 (message too big) when the limit is exceeded.
+	if hub.MaxMessageBytes > 0 {
+		conn.SetReadLimit(hub.MaxMessageBytes)
 	}
 
 	// 11. The newly created client is sent to the Hub's `Register` channel to be formally added to a room.
+	// Run refuses it when the user already has MaxRoomsPerUser documents
+	// open, so a client can't hold thousands of rooms.
 	client.Hub.Register <- client
+	if !<-client.admitted {
+		closeWithReason(conn, CloseTooManyRooms, "too many open documents")
+		return
+	}
+	logConnected(client, r)
 
 	// 12. Two goroutines are started for this client. They run concurrently and handle reading and writing messages.
 	// This is a standard and efficient pattern for WebSockets in Go.
@@ -79,6 +180,37 @@ func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request, userID string) {
 	go client.readPump()
 }
 
+// normalizeDisplayName trims and bounds a display name, falling back to a
+// truncated user id when none is available.
+func normalizeDisplayName(name, userID string) string {
+	name = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name))
+	if runes := []rune(name); len(runes) > MaxDisplayNameLength {
+		name = string(runes[:MaxDisplayNameLength])
+	}
+	if name == "" {
+		name = userID
+		if len(name) > 8 {
+			name = name[:8]
+		}
+	}
+	return name
+}
+
+// closeWithReason sends a close frame with an application code and a
+// human-readable reason, then closes the underlying connection.
+func closeWithReason(conn *websocket.Conn, code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	if err := conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second)); err != nil {
+		logger.Sugar.Warnf("Failed to send close frame (%d %s): %v", code, reason, err)
+	}
+	conn.Close()
+}
+
 func (c *Client) readPump() {
 	// This function runs in a loop, constantly waiting for new messages from the client's browser.
 	defer func() {
@@ -86,22 +218,35 @@ func (c *Client) readPump() {
 		//  and the connection is closed.
 		c.Hub.Unregister <- c
 		c.Conn.Close()
+		logDisconnected(c)
 	}()
 
+	// A client that stops answering pings hits the read deadline, which ends
+	// this loop and unregisters it. Each pong pushes the deadline back.
+	c.Conn.SetReadDeadline(time.Now().Add(c.Hub.PongTimeout))
+	c.Conn.SetPongHandler(func(string) error {
+		return c.Conn.SetReadDeadline(time.Now().Add(c.Hub.PongTimeout))
+	})
+
 	for {
 		// 15. A user performs an action (like typing), and their browser sends a message.
 		//  This line reads that message from the WebSocket.
 		_, rawMessage, err := c.Conn.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+			c.setDisconnectReason(readErrorReason(err))
+			if errors.Is(err, websocket.ErrReadLimit) {
+				logger.Sugar.Warnf("Closing connection for user %s on doc %s: message exceeded %d bytes", c.UserID, c.DocID, c.Hub.MaxMessageBytes)
+			} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				logger.Sugar.Infof("Closing connection for user %s on doc %s: no pong within %s", c.UserID, c.DocID, c.Hub.PongTimeout)
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				logger.Sugar.Errorf("error: %v", err)
 			}
 			break
 		}
 
 		// Unmarshal the message so the hub can inspect its type.
-		var msg WSMessage
-		if err := json.Unmarshal(rawMessage, &msg); err != nil {
+		msg, err := c.decodeMessage(rawMessage)
+		if err != nil {
 			logger.Sugar.Errorf("Error unmarshalling message: %v", err)
 			continue
 		}
@@ -111,15 +256,46 @@ func (c *Client) readPump() {
 		// Set server-authoritative fields to prevent spoofing.
 		msg.DocID = c.DocID
 		msg.UserID = c.UserID
+		msg.Revision = 0
+		msg.from = c.ResumeToken
 
 		// --- RBAC: Enforce Permissions ---
-		switch msg.Type {
-		case UpdateType:
-			// Only Writers can edit text
-			if c.Role != RoleWriter {
-				logger.Sugar.Warnf("Permission Denied: User %s (Role: %s) tried to edit doc %s", c.UserID, c.Role, c.DocID)
+		// View-only connections act as readers whatever the user's role.
+		role := c.Role
+		if c.ViewOnly {
+			role = RoleReader
+		}
+		if !CanPerform(role, msg.Type) {
+			logger.Sugar.Warnf("Permission Denied: User %s (Role: %s) sent %s on doc %s", c.UserID, role, msg.Type, c.DocID)
+			if msg.Type == CommentType {
+				c.denyComment(msg)
+			}
+			continue
+		}
+		if !c.Hub.MessageEnabled(msg.Type) {
+			logger.Sugar.Warnf("Dropped %s from user %s on doc %s: feature is off", msg.Type, c.UserID, c.DocID)
+			continue
+		}
+		if msg.Type == CommentsSnapshotType {
+			c.sendCommentsSnapshot()
+			continue
+		}
+		// Comments are stored and broadcast by the CommentAdder, never
+		// relayed as sent.
+		if msg.Type == CommentType {
+			if c.Hub.CommentAdder == nil {
+				logger.Sugar.Warnf("Dropped comment from user %s on doc %s: no comment store", c.UserID, c.DocID)
+			} else {
+				c.addComment(msg)
+			}
+			continue
+		}
+		if msg.Type == MetadataType {
+			renamed, ok := c.rename(msg)
+			if !ok {
 				continue
 			}
+			msg = renamed
 		}
 
 		// 16. The validated message is sent to the Hub's `Broadcast` channel for processing and distribution to other clients.
@@ -130,15 +306,24 @@ func (c *Client) readPump() {
 
 func (c *Client) writePump() {
 	// This function runs in a loop, waiting for messages that need to be sent *to* the client's browser.
-	ticker := time.NewTicker(30 * time.Second) // Send ping every 30s
+	ticker := time.NewTicker(c.Hub.PingInterval)
 	defer ticker.Stop()
 
 	for {
 		select {
-		case message := <-c.Send:
-			c.Conn.WriteMessage(websocket.TextMessage, message)
-		// A ticker sends a 'ping' message every 30 seconds to keep the connection alive and detect if it has dropped.
+		case message, ok := <-c.Send:
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				// The hub closed the channel.
+				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.Conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+		// A ticker sends a 'ping' message every PingInterval to keep the connection alive and detect if it has dropped.
 		case <-ticker.C:
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return // Connection is dead
 			}
@@ -0,0 +1,145 @@
+package socket
+
+import (
+	"encoding/json"
+	"errors"
+
+	"satunaskah/internal/document/model"
+	"satunaskah/pkg/apperr"
+	"satunaskah/pkg/logger"
+)
+
+// CommentLister loads a document's comments for COMMENTS_SNAPSHOT replies.
+type CommentLister interface {
+	GetComments(docID string) ([]model.CommentResponse, error)
+}
+
+// CommentAdder stores comments sent over the socket. The document service
+// implements it, so they pass the same checks as comments added over REST and
+// are broadcast to the room the same way.
+type CommentAdder interface {
+	AddComment(userID string, req model.CommentRequest) (*model.CommentResponse, error)
+}
+
+// CommentAckPayload answers a COMMENT sent over the socket, to the sender
+// only. ClientID echoes the id the client gave its optimistic copy; Comment
+// is what was stored, or Error says why nothing was.
+type CommentAckPayload struct {
+	ClientID string                 `json:"client_id,omitempty"`
+	Comment  *model.CommentResponse `json:"comment,omitempty"`
+	Error    string                 `json:"error,omitempty"`
+}
+
+// CommentVisibleTo reports whether a client with role may see a comment with
+// the given visibility. Readers don't see reviewer-only comments.
+func CommentVisibleTo(role, visibility string) bool {
+	return role != RoleReader || visibility != model.VisibilityReviewers
+}
+
+// commentVisibility reads the visibility of a COMMENT payload. Comments that
+// don't state one are visible to everyone.
+func commentVisibility(payload json.RawMessage) string {
+	var comment struct {
+		Visibility string `json:"visibility"`
+	}
+	if json.Unmarshal(payload, &comment) != nil || comment.Visibility == "" {
+		return model.VisibilityEveryone
+	}
+	return comment.Visibility
+}
+
+// directMessage is a message for one client only, handed to Run so the send
+// never races with Unregister closing the client's channel.
+type directMessage struct {
+	client  *Client
+	payload []byte
+}
+
+// sendCommentsSnapshot answers a COMMENTS_SNAPSHOT request with the room's
+// current comments, leaving out those c's role may not see. Being in the room
+// already proves access. Comments added
+// after the client joined may arrive both live and in the snapshot; clients
+// dedupe by id. It runs on c's read goroutine so the query never blocks Run.
+func (c *Client) sendCommentsSnapshot() {
+	comments, err := c.Hub.Comments.GetComments(c.DocID)
+	if err != nil {
+		logger.Sugar.Errorf("Failed to load comments snapshot of doc %s for user %s: %v", c.DocID, c.UserID, err)
+		return
+	}
+	visible := []model.CommentResponse{}
+	for _, comment := range comments {
+		if CommentVisibleTo(c.Role, comment.Visibility) {
+			visible = append(visible, comment)
+		}
+	}
+	comments = visible
+	payload, err := json.Marshal(comments)
+	if err != nil {
+		logger.Sugar.Errorf("Error marshalling comments snapshot: %v", err)
+		return
+	}
+	msg, _ := json.Marshal(WSMessage{Type: CommentsSnapshotType, DocID: c.DocID, Payload: payload})
+	c.Hub.direct <- directMessage{client: c, payload: msg}
+}
+
+// addComment stores a COMMENT sent by c through the hub's CommentAdder and
+// acks it to c with the stored comment's id. It runs on c's read goroutine
+// so the database work never blocks Run.
+func (c *Client) addComment(msg WSMessage) {
+	var req struct {
+		model.CommentRequest
+		ClientID string `json:"client_id"`
+	}
+	var ack CommentAckPayload
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		logger.Sugar.Warnf("Dropped malformed comment from user %s on doc %s", c.UserID, c.DocID)
+		ack.Error = "malformed comment"
+	} else {
+		ack.ClientID = req.ClientID
+		req.DocID = c.DocID
+		ack.Comment, err = c.Hub.CommentAdder.AddComment(c.UserID, req.CommentRequest)
+		var appErr *apperr.Error
+		if errors.As(err, &appErr) && appErr.Code != apperr.CodeInternal {
+			ack.Error = appErr.Message
+		} else if err != nil {
+			logger.Sugar.Errorf("Failed to add comment from user %s on doc %s: %v", c.UserID, c.DocID, err)
+			ack.Error = "failed to add comment"
+		}
+	}
+	c.ackComment(ack)
+}
+
+// denyComment acks a COMMENT that c's role may not send with an error, so the
+// sender can drop its optimistic copy instead of waiting for an ack.
+func (c *Client) denyComment(msg WSMessage) {
+	var req struct {
+		ClientID string `json:"client_id"`
+	}
+	_ = json.Unmarshal(msg.Payload, &req)
+	c.ackComment(CommentAckPayload{ClientID: req.ClientID, Error: "your role cannot comment"})
+}
+
+// ackComment sends ack to c alone.
+func (c *Client) ackComment(ack CommentAckPayload) {
+	payload, _ := json.Marshal(ack)
+	reply, _ := json.Marshal(WSMessage{Type: CommentAckType, DocID: c.DocID, Payload: payload})
+	c.Hub.direct <- directMessage{client: c, payload: reply}
+}
+
+// deliver sends dm if its client is still connected. Only Run calls it.
+func (h *Hub) deliver(dm directMessage) {
+	h.mu.Lock()
+	_, connected := h.Rooms[dm.client.DocID][dm.client]
+	if dm.client.Dashboard {
+		_, connected = h.dashboards[dm.client.UserID][dm.client]
+	}
+	h.mu.Unlock()
+	if !connected {
+		return
+	}
+	select {
+	case dm.client.Send <- dm.payload:
+	default:
+		logger.Sugar.Warnf("Client %s's send buffer was full; dropped direct message.", dm.client.UserID)
+	}
+}
@@ -0,0 +1,86 @@
+package socket
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"satunaskah/pkg/logger"
+
+	"github.com/gorilla/websocket"
+)
+
+// Why a connection ended, as logged when it does.
+const (
+	DisconnectNormal     = "normal"      // The client closed the connection
+	DisconnectError      = "error"       // The connection broke
+	DisconnectTimeout    = "timeout"     // No pong within PongTimeout
+	DisconnectTooLarge   = "too_large"   // A message exceeded MaxMessageBytes
+	DisconnectBufferFull = "buffer_full" // The client fell too far behind
+	DisconnectKicked     = "kicked"      // Removed by the owner or account deletion
+	DisconnectReplaced   = "replaced"    // A resumed connection took its place
+	DisconnectDeleted    = "deleted"     // The document was deleted
+)
+
+// setDisconnectReason records why the server is ending c's connection. The
+// first reason wins: closing the connection makes the read pump fail, which
+// must not overwrite the cause.
+func (c *Client) setDisconnectReason(reason string) {
+	c.disconnectReason.CompareAndSwap(nil, &reason)
+}
+
+// readErrorReason classifies the error that ended c's read pump.
+func readErrorReason(err error) string {
+	if errors.Is(err, websocket.ErrReadLimit) {
+		return DisconnectTooLarge
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return DisconnectTimeout
+	}
+	if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
+		return DisconnectNormal
+	}
+	return DisconnectError
+}
+
+// clientIP returns the address of the client behind r, see Hub.ClientIP.
+func (h *Hub) clientIP(r *http.Request) string {
+	if h.ClientIP == nil {
+		return r.RemoteAddr
+	}
+	return h.ClientIP(r)
+}
+
+// logConnected records an accepted connection. forwarded_for is logged as
+// sent, next to the client_ip it was trusted to give or not.
+func logConnected(c *Client, r *http.Request) {
+	logger.Sugar.Infow("WebSocket connected",
+		"user_id", c.UserID,
+		"doc_id", c.DocID,
+		"role", c.Role,
+		"view_only", c.ViewOnly,
+		"protocol", c.Protocol,
+		"client_ip", c.ClientIP,
+		"remote_addr", r.RemoteAddr,
+		"forwarded_for", r.Header.Get("X-Forwarded-For"),
+		"origin", r.Header.Get("Origin"),
+	)
+}
+
+// logDisconnected records how long c was connected and why it ended, with
+// the same identifying fields as logConnected.
+func logDisconnected(c *Client) {
+	reason := DisconnectError
+	if r := c.disconnectReason.Load(); r != nil {
+		reason = *r
+	}
+	logger.Sugar.Infow("WebSocket disconnected",
+		"user_id", c.UserID,
+		"doc_id", c.DocID,
+		"role", c.Role,
+		"client_ip", c.ClientIP,
+		"connected_seconds", time.Since(c.ConnectedAt).Seconds(),
+		"reason", reason,
+	)
+}
@@ -0,0 +1,130 @@
+package socket
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"satunaskah/pkg/delta"
+	"satunaskah/pkg/logger"
+)
+
+// CursorThrottle is the minimum gap between relayed cursor updates from one
+// user in a room, about 20 per second. Updates arriving sooner are coalesced
+// and the latest one is relayed when the gap ends.
+const CursorThrottle = 50 * time.Millisecond
+
+// cursorKey identifies one user's cursor in one room.
+type cursorKey struct {
+	DocID  string
+	UserID string
+}
+
+// Selection is a user's selected range in Quill indices. A caret is a
+// selection of length 0.
+type Selection struct {
+	Index  int `json:"index"`
+	Length int `json:"length"`
+}
+
+// parseCursor decodes a CURSOR payload: either a selection object or, from
+// older clients, a bare caret position.
+func parseCursor(payload json.RawMessage) (Selection, error) {
+	var sel Selection
+	payload = bytes.TrimSpace(payload)
+	if len(payload) > 0 && payload[0] == '{' {
+		if err := json.Unmarshal(payload, &sel); err != nil {
+			return Selection{}, err
+		}
+	} else if err := json.Unmarshal(payload, &sel.Index); err != nil {
+		return Selection{}, errors.New("cursor payload must be a position or {index, length}")
+	}
+	if sel.Index < 0 || sel.Length < 0 {
+		return Selection{}, fmt.Errorf("negative selection %d+%d", sel.Index, sel.Length)
+	}
+	return sel, nil
+}
+
+// applyCursor validates a CURSOR message against the document and records
+// the selection in the sender's presence. It reports whether the message
+// should be relayed. Must be called with h.mu held.
+func (h *Hub) applyCursor(msg WSMessage) bool {
+	sel, err := parseCursor(msg.Payload)
+	if err == nil {
+		if length := h.docLength(msg.DocID); sel.Index+sel.Length > length {
+			err = fmt.Errorf("selection %d+%d is outside the document (length %d)", sel.Index, sel.Length, length)
+		}
+	}
+	if err != nil {
+		logger.Sugar.Debugf("Dropped cursor from user %s on doc %s: %v", msg.UserID, msg.DocID, err)
+		return false
+	}
+
+	if status, ok := h.Presence[msg.DocID][msg.UserID]; ok {
+		status.CursorPos = sel.Index
+		status.Selection = &sel
+		h.Presence[msg.DocID][msg.UserID] = status
+	}
+	return true
+}
+
+// docLength returns the Quill length of docID's cached content, computing it
+// at most once per content change. Must be called with h.mu held.
+func (h *Hub) docLength(docID string) int {
+	if n, ok := h.docLengths[docID]; ok {
+		return n
+	}
+	content, _ := h.cachedContent(docID)
+	d, err := delta.Parse(content)
+	if err != nil {
+		return 0
+	}
+	n := d.Length()
+	h.docLengths[docID] = n
+	return n
+}
+
+// throttleCursor reports whether msg must wait for CursorThrottle. A held
+// message replaces any earlier one still waiting, and Run relays it when the
+// flush timer fires. Must be called with h.mu held.
+func (h *Hub) throttleCursor(msg WSMessage) bool {
+	key := cursorKey{DocID: msg.DocID, UserID: msg.UserID}
+	if _, waiting := h.cursorPending[key]; waiting {
+		h.cursorPending[key] = msg
+		return true
+	}
+	wait := CursorThrottle - time.Since(h.cursorSent[key])
+	if wait <= 0 {
+		h.cursorSent[key] = time.Now()
+		return false
+	}
+	h.cursorPending[key] = msg
+	time.AfterFunc(wait, func() {
+		h.cursorFlush <- key
+	})
+	return true
+}
+
+// takePendingCursor returns the cursor update held for key, if any, and
+// counts it as sent.
+func (h *Hub) takePendingCursor(key cursorKey) (WSMessage, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	msg, ok := h.cursorPending[key]
+	if ok {
+		delete(h.cursorPending, key)
+		h.cursorSent[key] = time.Now()
+	}
+	return msg, ok
+}
+
+// forgetCursor drops throttle state for a user leaving docID. Must be called
+// with h.mu held.
+func (h *Hub) forgetCursor(docID, userID string) {
+	key := cursorKey{DocID: docID, UserID: userID}
+	delete(h.cursorSent, key)
+	delete(h.cursorPending, key)
+}
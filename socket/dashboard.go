@@ -0,0 +1,214 @@
+package socket
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"satunaskah/pkg/logger"
+)
+
+// DashboardType is the only message sent over /ws/dashboard.
+const DashboardType = "DASHBOARD"
+
+// Dashboard events, each telling the dashboard to refetch one document.
+const (
+	DashboardUpdated = "updated"       // Content, title or description changed
+	DashboardComment = "comment_added" // A comment or reply was posted
+	DashboardInvited = "invited"       // The user was given access
+)
+
+// DefaultDashboardDebounce is used when DASHBOARD_DEBOUNCE is unset.
+const DefaultDashboardDebounce = 2 * time.Second
+
+// DashboardPayload is the payload of a DASHBOARD message.
+type DashboardPayload struct {
+	DocID string `json:"document_id"`
+	Event string `json:"event"`
+}
+
+// dashboardKey identifies a pending dashboard event. An empty UserID sends it
+// to everyone with access to the document; readers are left out when
+// skipReaders is set.
+type dashboardKey struct {
+	DocID       string
+	Event       string
+	UserID      string
+	skipReaders bool
+}
+
+// ServeDashboard upgrades r to a dashboard connection for userID, which only
+// receives DASHBOARD events about documents the user can access.
+func ServeDashboard(hub *Hub, w http.ResponseWriter, r *http.Request, userID string) {
+	up := upgrader
+	if hub.CheckOrigin != nil {
+		up.CheckOrigin = hub.CheckOrigin
+	}
+	conn, err := up.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Sugar.Error(err)
+		return
+	}
+
+	client := &Client{
+		Hub:         hub,
+		Conn:        conn,
+		UserID:      userID,
+		Send:        make(chan []byte, 64),
+		Protocol:    conn.Subprotocol(),
+		Dashboard:   true,
+		ConnectedAt: time.Now(),
+		ClientIP:    hub.clientIP(r),
+	}
+	logConnected(client, r)
+
+	hub.Register <- client
+	go client.writePump()
+	go client.dashboardReadPump()
+}
+
+// dashboardReadPump keeps the connection alive and unregisters it when it
+// ends. Messages from the client are ignored.
+func (c *Client) dashboardReadPump() {
+	defer func() {
+		c.Hub.Unregister <- c
+		c.Conn.Close()
+		logDisconnected(c)
+	}()
+
+	c.Conn.SetReadLimit(1024)
+	c.Conn.SetReadDeadline(time.Now().Add(c.Hub.PongTimeout))
+	c.Conn.SetPongHandler(func(string) error {
+		return c.Conn.SetReadDeadline(time.Now().Add(c.Hub.PongTimeout))
+	})
+	for {
+		if _, _, err := c.Conn.ReadMessage(); err != nil {
+			c.setDisconnectReason(readErrorReason(err))
+			return
+		}
+	}
+}
+
+// addDashboard registers a dashboard connection. Only Run calls it.
+func (h *Hub) addDashboard(client *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.dashboards[client.UserID] == nil {
+		h.dashboards[client.UserID] = make(map[*Client]bool)
+	}
+	h.dashboards[client.UserID][client] = true
+}
+
+// removeDashboard unregisters a dashboard connection. Only Run calls it, so
+// closing Send never races with a send.
+func (h *Hub) removeDashboard(client *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.dashboards[client.UserID][client]; !ok {
+		return
+	}
+	delete(h.dashboards[client.UserID], client)
+	if len(h.dashboards[client.UserID]) == 0 {
+		delete(h.dashboards, client.UserID)
+	}
+	close(client.Send)
+}
+
+// NotifyDashboard tells userID's dashboards about event on docID.
+func (h *Hub) NotifyDashboard(userID, docID, event string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.queueDashboardEvent(dashboardKey{DocID: docID, Event: event, UserID: userID})
+}
+
+// dashboardEventFor queues the dashboard event, if any, that msg stands for.
+// Must be called with h.mu held.
+func (h *Hub) dashboardEventFor(msg WSMessage) {
+	switch msg.Type {
+	case UpdateType, MetadataType:
+		h.queueDashboardEvent(dashboardKey{DocID: msg.DocID, Event: DashboardUpdated})
+	case CommentType:
+		hidden := !CommentVisibleTo(RoleReader, commentVisibility(msg.Payload))
+		h.queueDashboardEvent(dashboardKey{DocID: msg.DocID, Event: DashboardComment, skipReaders: hidden})
+	}
+}
+
+// queueDashboardEvent sends key's event once DashboardDebounce has passed;
+// the same event for the same document within that window is sent once.
+// Nothing is queued while no dashboard is connected. Must be called with
+// h.mu held.
+func (h *Hub) queueDashboardEvent(key dashboardKey) {
+	if len(h.dashboards) == 0 || h.dashboardPending[key] {
+		return
+	}
+	if key.UserID != "" && len(h.dashboards[key.UserID]) == 0 {
+		return
+	}
+	h.dashboardPending[key] = true
+	time.AfterFunc(h.DashboardDebounce, func() { h.flushDashboardEvent(key) })
+}
+
+// flushDashboardEvent sends key's event to the dashboards of everyone it is
+// for. Sends go through Run like other direct messages.
+func (h *Hub) flushDashboardEvent(key dashboardKey) {
+	h.mu.Lock()
+	delete(h.dashboardPending, key)
+	h.mu.Unlock()
+
+	recipients := []string{key.UserID}
+	if key.UserID == "" {
+		var err error
+		if recipients, err = h.documentAudience(key.DocID, key.skipReaders); err != nil {
+			logger.Sugar.Errorf("Failed to load members of doc %s for dashboards: %v", key.DocID, err)
+			return
+		}
+	}
+
+	payload, _ := json.Marshal(DashboardPayload{DocID: key.DocID, Event: key.Event})
+	msg, _ := json.Marshal(WSMessage{Type: DashboardType, DocID: key.DocID, Payload: payload})
+	var clients []*Client
+	seen := make(map[string]bool, len(recipients))
+	h.mu.Lock()
+	for _, userID := range recipients {
+		if seen[userID] {
+			continue // A leftover collaborator row of the owner
+		}
+		seen[userID] = true
+		for client := range h.dashboards[userID] {
+			clients = append(clients, client)
+		}
+	}
+	h.mu.Unlock()
+	for _, client := range clients {
+		h.direct <- directMessage{client: client, payload: msg}
+	}
+}
+
+// documentAudience returns the owner and collaborators of docID, without
+// readers when skipReaders is set.
+func (h *Hub) documentAudience(docID string, skipReaders bool) ([]string, error) {
+	if h.db == nil {
+		return nil, nil
+	}
+	rows, err := h.db.Query(`
+		SELECT owner_id, 'owner' FROM documents WHERE id = $1
+		UNION
+		SELECT user_id, role FROM collaborators WHERE document_id = $1`, docID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []string
+	for rows.Next() {
+		var userID, role string
+		if err := rows.Scan(&userID, &role); err != nil {
+			return nil, err
+		}
+		if skipReaders && role == RoleReader {
+			continue
+		}
+		users = append(users, userID)
+	}
+	return users, rows.Err()
+}
@@ -0,0 +1,43 @@
+package socket
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"satunaskah/pkg/logger"
+	"satunaskah/pkg/metrics"
+	"time"
+)
+
+// deadLetter is the on-disk record of content that could not be persisted.
+type deadLetter struct {
+	DocID    string          `json:"document_id"`
+	FailedAt time.Time       `json:"failed_at"`
+	Failures int             `json:"failures"`
+	Content  json.RawMessage `json:"content"`
+}
+
+// writeDeadLetter stores content in DeadLetterDir so it can be recovered by
+// hand if the database keeps rejecting it or the process dies.
+func (h *Hub) writeDeadLetter(docID string, content []byte, failures int) {
+	if err := os.MkdirAll(h.DeadLetterDir, 0o700); err != nil {
+		logger.Sugar.Errorf("Failed to create dead-letter dir %s: %v", h.DeadLetterDir, err)
+		return
+	}
+
+	now := time.Now().UTC()
+	data, err := json.Marshal(deadLetter{DocID: docID, FailedAt: now, Failures: failures, Content: content})
+	if err != nil {
+		logger.Sugar.Errorf("Failed to encode dead letter for doc %s: %v", docID, err)
+		return
+	}
+
+	path := filepath.Join(h.DeadLetterDir, fmt.Sprintf("%s-%s.json", filepath.Base(docID), now.Format("20060102T150405.000000000")))
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		logger.Sugar.Errorf("Failed to write dead letter for doc %s: %v", docID, err)
+		return
+	}
+	metrics.DeadLetters.Add(1)
+	logger.Sugar.Warnf("Wrote dead letter for doc %s after %d failed saves: %s", docID, failures, path)
+}
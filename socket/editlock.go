@@ -0,0 +1,88 @@
+package socket
+
+import (
+	"errors"
+	"time"
+)
+
+// DefaultEditLockTTL is how long an edit lock lasts unless renewed.
+const DefaultEditLockTTL = 2 * time.Minute
+
+// ErrEditLocked is returned when another user holds an unexpired edit lock.
+var ErrEditLocked = errors.New("document is locked by another user")
+
+// editLock is an advisory lock for REST "manual save" editing, held by one
+// user at a time per document.
+type editLock struct {
+	Token     string
+	UserID    string
+	ExpiresAt time.Time
+}
+
+// AcquireEditLock grants userID the edit lock on docID for EditLockTTL. A user
+// who already holds the lock gets the same token with a renewed expiry.
+func (h *Hub) AcquireEditLock(docID, userID string) (string, time.Time, error) {
+	h.lockMu.Lock()
+	defer h.lockMu.Unlock()
+
+	now := time.Now()
+	lock, held := h.editLocks[docID]
+	if held && now.Before(lock.ExpiresAt) && lock.UserID != userID {
+		return "", time.Time{}, ErrEditLocked
+	}
+	if !held || lock.UserID != userID || !now.Before(lock.ExpiresAt) {
+		token := newToken()
+		if token == "" {
+			return "", time.Time{}, errors.New("failed to generate lock token")
+		}
+		lock = editLock{Token: token, UserID: userID}
+	}
+	lock.ExpiresAt = now.Add(h.EditLockTTL)
+	h.editLocks[docID] = lock
+	return lock.Token, lock.ExpiresAt, nil
+}
+
+// CheckEditLock reports whether token is the current, unexpired edit lock
+// on docID held by userID.
+func (h *Hub) CheckEditLock(docID, userID, token string) bool {
+	h.lockMu.Lock()
+	defer h.lockMu.Unlock()
+
+	lock, held := h.editLocks[docID]
+	return held && token != "" && lock.Token == token && lock.UserID == userID && time.Now().Before(lock.ExpiresAt)
+}
+
+// EditLockHolder returns the user holding an unexpired edit lock on docID,
+// or "" when the document is unlocked.
+func (h *Hub) EditLockHolder(docID string) string {
+	h.lockMu.Lock()
+	defer h.lockMu.Unlock()
+
+	if lock, held := h.editLocks[docID]; held && time.Now().Before(lock.ExpiresAt) {
+		return lock.UserID
+	}
+	return ""
+}
+
+// ReleaseEditLock drops the lock on docID if token matches it.
+func (h *Hub) ReleaseEditLock(docID, token string) bool {
+	h.lockMu.Lock()
+	defer h.lockMu.Unlock()
+
+	if lock, held := h.editLocks[docID]; held && lock.Token == token {
+		delete(h.editLocks, docID)
+		return true
+	}
+	return false
+}
+
+// releaseEditLockOf drops userID's lock on docID, e.g. when their last
+// connection to the room closes.
+func (h *Hub) releaseEditLockOf(docID, userID string) {
+	h.lockMu.Lock()
+	defer h.lockMu.Unlock()
+
+	if lock, held := h.editLocks[docID]; held && lock.UserID == userID {
+		delete(h.editLocks, docID)
+	}
+}
@@ -0,0 +1,111 @@
+package socket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEditLockAcquireRenewAndRelease(t *testing.T) {
+	hub := NewHub(nil)
+	docID := "0b1c2d3e-4f5a-46b7-8c9d-0e1f2a3b4c5d"
+
+	token, expiresAt, err := hub.AcquireEditLock(docID, "user1")
+	require.NoError(t, err)
+	assert.NotEmpty(t, token)
+	assert.True(t, hub.CheckEditLock(docID, "user1", token))
+	assert.Equal(t, "user1", hub.EditLockHolder(docID))
+
+	// The holder renews: same token, later expiry.
+	time.Sleep(time.Millisecond)
+	renewed, renewedUntil, err := hub.AcquireEditLock(docID, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, token, renewed)
+	assert.True(t, renewedUntil.After(expiresAt))
+
+	_, _, err = hub.AcquireEditLock(docID, "user2")
+	assert.ErrorIs(t, err, ErrEditLocked)
+	assert.False(t, hub.CheckEditLock(docID, "user2", token), "the token is only good for its holder")
+
+	assert.False(t, hub.ReleaseEditLock(docID, "not-the-token"))
+	assert.Equal(t, "user1", hub.EditLockHolder(docID), "a wrong token leaves the lock held")
+	assert.True(t, hub.ReleaseEditLock(docID, token))
+	assert.Empty(t, hub.EditLockHolder(docID))
+	assert.False(t, hub.CheckEditLock(docID, "user1", token))
+}
+
+func TestEditLockExpires(t *testing.T) {
+	hub := NewHub(nil)
+	hub.EditLockTTL = 20 * time.Millisecond
+	docID := "0b1c2d3e-4f5a-46b7-8c9d-0e1f2a3b4c5d"
+
+	token, _, err := hub.AcquireEditLock(docID, "user1")
+	require.NoError(t, err)
+	time.Sleep(2 * hub.EditLockTTL)
+
+	assert.Empty(t, hub.EditLockHolder(docID))
+	assert.False(t, hub.CheckEditLock(docID, "user1", token))
+	// An expired lock is not renewed; its holder starts over with a new token.
+	again, _, err := hub.AcquireEditLock(docID, "user1")
+	require.NoError(t, err)
+	assert.NotEqual(t, token, again)
+
+	time.Sleep(2 * hub.EditLockTTL)
+	_, _, err = hub.AcquireEditLock(docID, "user2")
+	assert.NoError(t, err, "an expired lock does not block others")
+}
+
+func TestEditLockReleasedOnHoldersLastDisconnect(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+
+	hub := NewHub(db)
+	go hub.Run()
+	wsURL := newTestServer(t, hub)
+
+	docID := "0b1c2d3e-4f5a-46b7-8c9d-0e1f2a3b4c5d"
+	expectJoin(mock, docID, "user2", "user1")
+	expectJoin(mock, docID, "user1", "user1")
+	expectJoin(mock, docID, "user1", "user1")
+	mock.ExpectQuery("SELECT content FROM documents WHERE id = \\$1").
+		WithArgs(docID).
+		WillReturnRows(sqlmock.NewRows([]string{"content"}).AddRow([]byte(`{"ops":[]}`)))
+
+	observer, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+docID+"&user_id=user2", nil)
+	require.NoError(t, err)
+	defer observer.Close()
+	tabA, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+docID+"&user_id=user1", nil)
+	require.NoError(t, err)
+	defer tabA.Close()
+	tabB, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+docID+"&user_id=user1", nil)
+	require.NoError(t, err)
+	defer tabB.Close()
+	waitForConnections := func(want int) {
+		for {
+			for _, s := range readPresence(t, observer, 2) {
+				if s.UserID == "user1" && s.ConnectionCount == want {
+					return
+				}
+			}
+		}
+	}
+	waitForConnections(2)
+
+	_, _, err = hub.AcquireEditLock(docID, "user1")
+	require.NoError(t, err)
+
+	// Another tab of the holder is still open.
+	tabA.Close()
+	waitForConnections(1)
+	assert.Equal(t, "user1", hub.EditLockHolder(docID))
+
+	tabB.Close()
+	readPresence(t, observer, 1)
+	assert.Empty(t, hub.EditLockHolder(docID))
+}
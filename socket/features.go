@@ -0,0 +1,18 @@
+package socket
+
+import "satunaskah/pkg/flags"
+
+// messageFlags maps client message types that sit behind a feature flag to
+// that flag.
+var messageFlags = map[string]string{
+	CommentsSnapshotType: flags.CommentsSnapshot,
+	MetadataType:         flags.SocketRename,
+	LockRangeType:        flags.RangeLocks,
+}
+
+// MessageEnabled reports whether clients may send msgType on this deployment.
+// Types without a flag are always enabled.
+func (h *Hub) MessageEnabled(msgType string) bool {
+	flag, gated := messageFlags[msgType]
+	return !gated || h.Features.Enabled(flag)
+}
@@ -0,0 +1,49 @@
+package socket
+
+import "time"
+
+const (
+	// HeartbeatInterval is how often clients are expected to send HEARTBEAT
+	// while a document is open, even when the user does nothing.
+	HeartbeatInterval = 20 * time.Second
+	// PresenceIdleAfter marks a user idle once none of their tabs has sent
+	// anything for this long, i.e. after three missed heartbeats.
+	PresenceIdleAfter = 3 * HeartbeatInterval
+)
+
+// touchPresence records activity by userID in docID and reports whether it
+// brought them back from idle. Must be called with h.mu held.
+func (h *Hub) touchPresence(docID, userID string) bool {
+	status, ok := h.Presence[docID][userID]
+	if !ok {
+		return false
+	}
+	woke := status.Idle
+	status.LastSeen = time.Now()
+	status.Idle = false
+	h.Presence[docID][userID] = status
+	return woke
+}
+
+// markIdle flags users not seen since PresenceIdleAfter before now and
+// returns the rooms whose presence changed.
+func (h *Hub) markIdle(now time.Time) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var changed []string
+	for docID, users := range h.Presence {
+		flipped := false
+		for userID, status := range users {
+			if !status.Idle && now.Sub(status.LastSeen) >= PresenceIdleAfter {
+				status.Idle = true
+				users[userID] = status
+				flipped = true
+			}
+		}
+		if flipped {
+			changed = append(changed, docID)
+		}
+	}
+	return changed
+}
@@ -1,10 +1,21 @@
 package socket
 
 import (
+	"bytes"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	docrepo "satunaskah/internal/document/repository"
+	notifrepo "satunaskah/internal/notification/repository"
+	"satunaskah/internal/storage"
+	"satunaskah/pkg/delta"
+	"satunaskah/pkg/env"
+	"satunaskah/pkg/flags"
 	"satunaskah/pkg/logger"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -20,10 +31,27 @@ const (
 	CommentUpdateType  = "COMMENT_UPDATE"  // Comment resolved/edited
 	CommentDeleteType  = "COMMENT_DELETE"  // Comment deleted
 	MetadataType       = "METADATA"        // Document title/info
+	SessionType        = "SESSION"         // Resume token issued on join
+	ResumedType        = "RESUMED"         // Reconnect was current; content not resent
+	SaveStatusType     = "SAVE_STATUS"     // Result of the latest auto-save
+	HeartbeatType      = "HEARTBEAT"       // Client is still open; never relayed
+	CommentAckType     = "COMMENT_ACK"     // Result of a COMMENT the client sent
+	// Sent by a client to request the room's comments, and as the reply to it
+	CommentsSnapshotType = "COMMENTS_SNAPSHOT"
 
 	RoleWriter   = "writer"
 	RoleReviewer = "reviewer"
 	RoleReader   = "reader"
+
+	// ConfidentialAttr marks Quill ranges that readers must never receive.
+	ConfidentialAttr = "confidential"
+
+	// PresenceDebounce is the window in which presence changes for a room are
+	// collapsed into a single broadcast.
+	PresenceDebounce = 250 * time.Millisecond
+
+	// OrphanSweepInterval is how often SweepWorker looks for leaked room state.
+	OrphanSweepInterval = time.Minute
 )
 
 type WSMessage struct {
@@ -31,24 +59,151 @@ type WSMessage struct {
 	DocID   string          `json:"document_id"`
 	UserID  string          `json:"user_id"`
 	Payload json.RawMessage `json:"payload"`
+	// Revision numbers relayed UPDATEs, so a client can resume from the last
+	// one it received. Set by the hub only.
+	Revision int64 `json:"revision,omitempty"`
+
+	from string // ResumeToken of the sending connection, if any
 }
 
 type UserStatus struct {
-	UserID    string    `json:"user_id"`
-	CursorPos int       `json:"cursor_pos"` // Or a more complex {line, ch} object
-	LastSeen  time.Time `json:"last_seen"`
+	UserID      string     `json:"user_id"`
+	DisplayName string     `json:"display_name"`
+	Color       string     `json:"color"`
+	CursorPos   int        `json:"cursor_pos"`          // Caret index, kept for older clients
+	Selection   *Selection `json:"selection,omitempty"` // Latest CURSOR range, once one is sent
+	LastSeen    time.Time  `json:"last_seen"`
+	Idle        bool       `json:"idle"` // Nothing from any tab for PresenceIdleAfter
+	// Open connections (tabs) this user has in the room
+	ConnectionCount int `json:"connection_count"`
+}
+
+// MetadataPayload carries document details shown alongside the editor.
+type MetadataPayload struct {
+	Title       string  `json:"title"`
+	Description *string `json:"description,omitempty"` // Set when it changed
+}
+
+// SaveStatusPayload tells clients whether the canonical copy has been persisted.
+type SaveStatusPayload struct {
+	Status    string     `json:"status"` // "saved" or "failed"
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	Message   string     `json:"message,omitempty"`
 }
+
+// Hub owns every open room. Its exported maps (Rooms, DocumentCache,
+// DirtyDocs, Revisions, Presence) are guarded by mu and mutated by Run and
+// the workers; reading them directly from any other goroutine is a data race.
+// Code outside the hub goes through the accessor methods (GetCachedContent,
+// IsDirty, RoomSize, ...), which lock and return copies.
 type Hub struct {
 	Rooms      map[string]map[*Client]bool
 	Broadcast  chan WSMessage
 	Register   chan *Client
 	Unregister chan *Client
 	db         *sql.DB
+	// userClients indexes the connections in Rooms by user; it changes
+	// with Rooms, under mu.
+	userClients map[string]map[*Client]bool
+	// Content is where document content is loaded from and saved to.
+	Content storage.ContentStore
 	// Track document state in memory
-	DocumentCache map[string][]byte
+	DocumentCache map[string][]byte // Raw content; idle entries move to compressedCache
 	DirtyDocs     map[string]bool
+	Revisions     map[string]int64 // docID -> number of updates applied since the room opened
 	mu            sync.Mutex
 	Presence      map[string]map[string]UserStatus // docID -> userID -> status
+	docMeta       map[string]docMeta               // docID -> title and owner of an open room
+	// Pending debounced presence broadcasts
+	presenceTimers map[string]*time.Timer
+	presenceFlush  chan string
+	// Per-user cursor throttling; see throttleCursor
+	cursorSent    map[cursorKey]time.Time
+	cursorPending map[cursorKey]WSMessage
+	cursorFlush   chan cursorKey
+	// Replies meant for a single client, such as comment snapshots
+	direct chan directMessage
+	// REST appends; see Append. storedAppends holds what arrives for a
+	// document whose stored copy is being appended to; only Run touches it.
+	appends       chan appendRequest
+	appendDone    chan string
+	storedAppends map[string]*heldForAppend
+	// docID -> until when content cached for a room that is not open, by
+	// Prewarm or for an emptied room, is kept
+	prewarmed map[string]time.Time
+	// EmptyRoomGrace is how long an emptied room's content stays cached for
+	// a quick reopen; zero drops it at once.
+	EmptyRoomGrace time.Duration
+	// Comments answers COMMENTS_SNAPSHOT requests.
+	Comments CommentLister
+	// CommentAdder stores COMMENT messages from clients; they are dropped
+	// when nil.
+	CommentAdder CommentAdder
+	// Titles applies UNIQUE_TITLES to socket renames; titles are stored as
+	// sent when nil.
+	Titles TitleChooser
+	// Reconnect support
+	roomEpochs   map[string]uint64
+	nextEpoch    uint64
+	resumeStates map[string]resumeState // resume token -> state
+	// MaxRoomsPerUser caps the distinct documents one user may have open at once.
+	MaxRoomsPerUser int
+	// MaxPresenceUsers caps the users listed in presence broadcasts; larger
+	// rooms list only the most recently active. Zero lists everyone.
+	MaxPresenceUsers int
+	// MaxMessageBytes is the largest frame accepted from a client.
+	MaxMessageBytes int64
+	// CheckOrigin decides which browser origins may open sockets; any may
+	// when nil.
+	CheckOrigin func(r *http.Request) bool
+	// ClientIP resolves the client address behind proxies, for logs; the
+	// peer address is used when nil.
+	ClientIP func(r *http.Request) string
+	// Features gates message types still being rolled out; see MessageEnabled.
+	Features flags.Flags
+	// Keepalive: ping cadence, and how long a client may go without a pong.
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+	// Dead-letter fallback for documents that repeatedly fail to save
+	saveFailures    map[string]int
+	MaxSaveFailures int
+	DeadLetterDir   string
+	// Gzipped cache entries of idle rooms, and when each entry was last used
+	compressedCache       map[string][]byte
+	cacheTouched          map[string]time.Time
+	docLengths            map[string]int // Quill length of cached content, for cursor checks
+	CacheCompressMinBytes int
+	CacheCompressIdle     time.Duration
+	// Content hash of each document's last save, whose preview is stored with
+	// it; a save of the same content is skipped
+	previewSums map[string]uint64
+	// Owner notifications for edits made while the owner is away
+	editors             map[string]map[string]string // docID -> userID -> display name, since last save
+	lastEditors         map[string]string            // docID -> user whose update was applied last
+	Notifications       *notifrepo.NotificationRepository
+	OwnerNotifyInterval time.Duration
+	// Advisory edit locks for REST manual-save editing; guarded by lockMu,
+	// which is never held while acquiring mu.
+	lockMu      sync.Mutex
+	editLocks   map[string]editLock // docID -> lock
+	EditLockTTL time.Duration
+	// docID -> content changes since the last save, for moving comment
+	// ranges; guarded by mu
+	anchorEdits map[string][]anchorEdit
+	// userID -> /ws/dashboard connections, and the events waiting out
+	// DashboardDebounce; guarded by mu
+	dashboards        map[string]map[*Client]bool
+	dashboardPending  map[dashboardKey]bool
+	DashboardDebounce time.Duration
+	// docID -> userID -> advisory LOCK_RANGE claim; guarded by mu
+	rangeClaims  map[string]map[string]RangeClaim
+	RangeLockTTL time.Duration
+	// Limits on socket UPDATEs, set to the REST save limits; zero is none.
+	MaxContentBytes int
+	MaxContentChars int
+	// updatedBy is the ResumeToken of the connection that sent a room's
+	// latest UPDATE, or "" when it came from elsewhere (docID -> token).
+	updatedBy map[string]string
 }
 
 type Client struct {
@@ -58,145 +213,542 @@ type Client struct {
 	UserID string
 	Send   chan []byte
 	Role   string // Store the user's role
-	Title  string // Document title
+
+	ViewOnly    bool   // Joined via /ws/view; forced to reader, edits dropped
+	DisplayName string // Server-sourced name shown in presence
+	Protocol    string // Negotiated protocol version, e.g. ProtocolV1
+
+	ResumeToken string // Issued to this connection on join
+	resumeFrom  string // Token presented when reconnecting
+	ConnectedAt time.Time
+
+	// The last revision the reconnecting client received, or -1 if not given.
+	resumeRevision int64
+
+	meta docMeta // Read at connect; seeds the room's state if this client opens it
+	// Run answers true once the client has joined, or false when it was
+	// refused; ServeWs starts its pumps only after that.
+	admitted chan bool
+
+	Dashboard bool // Joined /ws/dashboard; in no room, only gets DASHBOARD events
+
+	ClientIP         string                 // Client address (see Hub.ClientIP), for logs
+	disconnectReason atomic.Pointer[string] // Set by whoever ends the connection
+}
+
+// docMeta is per-document state loaded once when a room opens.
+type docMeta struct {
+	Title   string
+	OwnerID string
 }
 
 func NewHub(db *sql.DB) *Hub {
 	return &Hub{
 		Rooms:         make(map[string]map[*Client]bool),
+		userClients:   make(map[string]map[*Client]bool),
 		Broadcast:     make(chan WSMessage),
 		Register:      make(chan *Client),
 		Unregister:    make(chan *Client),
 		db:            db,
+		Content:       storage.NewPostgresContentStore(db),
 		DocumentCache: make(map[string][]byte),
 		DirtyDocs:     make(map[string]bool),
+		Revisions:     make(map[string]int64),
 		Presence:      make(map[string]map[string]UserStatus),
+		docMeta:       make(map[string]docMeta),
+
+		presenceTimers: make(map[string]*time.Timer),
+		presenceFlush:  make(chan string, 64),
+		cursorSent:     make(map[cursorKey]time.Time),
+		cursorPending:  make(map[cursorKey]WSMessage),
+		cursorFlush:    make(chan cursorKey, 64),
+		direct:         make(chan directMessage),
+		appends:        make(chan appendRequest),
+		appendDone:     make(chan string),
+		storedAppends:  make(map[string]*heldForAppend),
+		prewarmed:      make(map[string]time.Time),
+		EmptyRoomGrace: env.Duration("ROOM_EMPTY_GRACE", DefaultEmptyRoomGrace),
+		Comments:       docrepo.NewDocumentRepository(db),
+		roomEpochs:     make(map[string]uint64),
+		resumeStates:   make(map[string]resumeState),
+
+		MaxRoomsPerUser:  env.Int("MAX_ROOMS_PER_USER", 20),
+		MaxPresenceUsers: env.Int("PRESENCE_MAX_USERS", DefaultMaxPresenceUsers),
+		MaxMessageBytes:  int64(env.Int("WS_MAX_MESSAGE_BYTES", 2<<20)),
+		Features:         flags.FromEnv(),
+		PingInterval:     env.Duration("WS_PING_INTERVAL", DefaultPingInterval),
+		PongTimeout:      env.Duration("WS_PONG_TIMEOUT", DefaultPongTimeout),
+		saveFailures:     make(map[string]int),
+		MaxSaveFailures:  env.Int("SAVE_MAX_FAILURES", 5),
+		DeadLetterDir:    env.String("DEAD_LETTER_DIR", "dead-letter"),
+
+		compressedCache:       make(map[string][]byte),
+		cacheTouched:          make(map[string]time.Time),
+		docLengths:            make(map[string]int),
+		CacheCompressMinBytes: env.Int("CACHE_COMPRESS_MIN_BYTES", DefaultCacheCompressMinBytes),
+		CacheCompressIdle:     env.Duration("CACHE_COMPRESS_IDLE", DefaultCacheCompressIdle),
+
+		previewSums:         make(map[string]uint64),
+		editors:             make(map[string]map[string]string),
+		lastEditors:         make(map[string]string),
+		Notifications:       notifrepo.NewNotificationRepository(db),
+		OwnerNotifyInterval: env.Duration("OWNER_NOTIFY_INTERVAL", time.Hour),
+
+		editLocks:   make(map[string]editLock),
+		EditLockTTL: env.Duration("EDIT_LOCK_TTL", DefaultEditLockTTL),
+		anchorEdits: make(map[string][]anchorEdit),
+
+		dashboards:        make(map[string]map[*Client]bool),
+		dashboardPending:  make(map[dashboardKey]bool),
+		DashboardDebounce: env.Duration("DASHBOARD_DEBOUNCE", DefaultDashboardDebounce),
+
+		rangeClaims:  make(map[string]map[string]RangeClaim),
+		RangeLockTTL: env.Duration("RANGE_LOCK_TTL", DefaultRangeLockTTL),
+
+		updatedBy: make(map[string]string),
+	}
+}
+
+// Keepalive normalizes and returns the ping interval and pong timeout. A pong
+// timeout that doesn't leave room for a ping is raised to twice the interval.
+// Call before Run.
+func (h *Hub) Keepalive() (time.Duration, time.Duration) {
+	if h.PingInterval <= 0 {
+		h.PingInterval = DefaultPingInterval
 	}
+	if h.PongTimeout <= h.PingInterval {
+		h.PongTimeout = 2 * h.PingInterval
+	}
+	return h.PingInterval, h.PongTimeout
 }
 
 func (h *Hub) Run() {
+	idleCheck := time.NewTicker(HeartbeatInterval / 2)
+	defer idleCheck.Stop()
+
 	for {
 		select {
 		case client := <-h.Register:
-			// 12. The Hub receives the new client from the `Register` channel (sent in step 11).
-			h.mu.Lock()
-			// Initialize room, presence, and load document if it's the first user.
-			if h.Rooms[client.DocID] == nil {
-				h.Rooms[client.DocID] = make(map[*Client]bool)
-				h.Presence[client.DocID] = make(map[string]UserStatus)
-
-				// If this is the first user in a room, the Hub loads the document content from the database.
-				var content []byte
-				err := h.db.QueryRow("SELECT content FROM documents WHERE id = $1", client.DocID).Scan(&content)
-				if err != nil {
-					logger.Sugar.Errorf("Failed to load document %s (or not found): %v", client.DocID, err)
-					content = []byte(`{"ops":[]}`) // Default to empty content on failure
-				}
-				h.DocumentCache[client.DocID] = content
+			if client.Dashboard {
+				h.addDashboard(client)
+				continue
+			}
+			if h.holdJoin(client) {
+				continue
 			}
-			// The client is added to the room for their specific document.
-			h.Rooms[client.DocID][client] = true
+			h.join(client)
 
-			// Add user to presence map.
-			h.Presence[client.DocID][client.UserID] = UserStatus{UserID: client.UserID, LastSeen: time.Now()}
+		case client := <-h.Unregister:
+			if client.Dashboard {
+				h.removeDashboard(client)
+				continue
+			}
+			h.removeClient(client)
 
-			// Get the current document content from the in-memory cache.
-			currentContent := h.DocumentCache[client.DocID]
+		case docID := <-h.presenceFlush:
+			// A debounce window has elapsed; send the room's current presence.
+			h.mu.Lock()
+			delete(h.presenceTimers, docID)
 			h.mu.Unlock()
+			h.broadcastPresenceUpdate(docID)
+
+		case key := <-h.cursorFlush:
+			// A throttle window has elapsed; relay the user's latest cursor.
+			if msg, ok := h.takePendingCursor(key); ok {
+				h.relay(msg)
+			}
 
-			// 13. The Hub sends the full, current document content directly to the new client so their editor is up-to-date.
-			// Send the full document state to the user who just joined.
-			initialMsgPayload, _ := json.Marshal(WSMessage{Type: UpdateType, DocID: client.DocID, Payload: json.RawMessage(currentContent)})
-			client.Send <- initialMsgPayload
+		case dm := <-h.direct:
+			h.deliver(dm)
 
-			// Send Metadata (Title)
-			metaPayload, _ := json.Marshal(map[string]string{"title": client.Title})
-			metaMsg, _ := json.Marshal(WSMessage{Type: MetadataType, DocID: client.DocID, UserID: client.UserID, Payload: json.RawMessage(metaPayload)})
-			client.Send <- metaMsg
+		case req := <-h.appends:
+			h.startAppend(req)
 
-			// 14. The Hub broadcasts a "presence update" to all other clients in the room to let them know a new user has joined.
-			// Notify everyone else in the room about the new user.
-			h.broadcastPresenceUpdate(client.DocID)
+		case docID := <-h.appendDone:
+			h.finishAppend(docID)
 
-		case client := <-h.Unregister:
-			// 19. The Hub receives a client to unregister (sent in step 18).
-			h.mu.Lock()
-			docID := client.DocID // Store docID before client is gone
-			if _, ok := h.Rooms[client.DocID][client]; ok {
-				// The client is removed from the room and presence list.
-				delete(h.Rooms[client.DocID], client)
-				delete(h.Presence[client.DocID], client.UserID)
-				close(client.Send)
-
-				// If the room is empty, clean up all associated resources.
-				if len(h.Rooms[client.DocID]) == 0 {
-					if h.DirtyDocs[client.DocID] {
-						_, err := h.db.Exec(`UPDATE documents SET content = $1, updated_at = NOW() WHERE id = $2`,
-							h.DocumentCache[client.DocID], client.DocID,
-						)
-						if err != nil {
-							logger.Sugar.Errorf("Failed to save doc %s on close: %v", client.DocID, err)
-						}
-					}
-					delete(h.Rooms, client.DocID)
-					delete(h.Presence, client.DocID)
-					delete(h.DocumentCache, client.DocID)
-					delete(h.DirtyDocs, client.DocID)
-					logger.Sugar.Infof("Closed and cleaned up empty room: %s", client.DocID)
-				}
+		case <-idleCheck.C:
+			for _, docID := range h.markIdle(time.Now()) {
+				h.schedulePresenceUpdate(docID)
 			}
+			h.mu.Lock()
+			expired := h.expireRangeClaims(time.Now())
 			h.mu.Unlock()
-
-			// 20. A final presence update is sent to remaining users so the departed user's icon disappears from their screen.
-			// Notify remaining users that someone left, only if the room still exists.
-			if h.Rooms[docID] != nil {
-				h.broadcastPresenceUpdate(docID)
+			for _, msg := range expired {
+				h.relay(msg)
 			}
 
 		case msg := <-h.Broadcast:
 			// 17. The Hub receives a message to broadcast (sent in step 16).
 			h.mu.Lock()
-			// If it's a document update, save the content and mark for DB persistence.
+			// Anything from a user shows they are still there; presence is
+			// resent only when that ends their idle state.
+			woke := msg.UserID != "" && h.touchPresence(msg.DocID, msg.UserID)
+			if msg.Type == HeartbeatType {
+				h.mu.Unlock()
+				if woke {
+					h.schedulePresenceUpdate(msg.DocID)
+				}
+				continue
+			}
+			// If it's a document update, save the content and mark for DB
+			// persistence. A malformed one is dropped before it can reach the
+			// cache, and from there the database.
 			if msg.Type == UpdateType {
-				h.DocumentCache[msg.DocID] = msg.Payload
+				if err := h.validUpdate(msg.Payload); err != nil {
+					h.mu.Unlock()
+					logger.Sugar.Warnf("Dropped invalid update from user %s on doc %s: %v", msg.UserID, msg.DocID, err)
+					continue
+				}
+				old, _ := h.cachedContent(msg.DocID)
+				if e, changed := h.recordAnchorEdit(msg.DocID, old, msg.Payload); changed {
+					h.shiftRangeClaims(msg.DocID, e)
+				}
+				h.touchRangeClaim(msg.DocID, msg.UserID)
+				h.setContent(msg.DocID, msg.Payload)
 				h.DirtyDocs[msg.DocID] = true
+				h.Revisions[msg.DocID]++
+				msg.Revision = h.Revisions[msg.DocID]
+				h.updatedBy[msg.DocID] = msg.from
+				h.recordEditor(msg.DocID, msg.UserID)
 				// 21. The document is now "dirty". The SaveWorker (see below) will pick this up and save it to the database.
 			}
-			// For other types like CURSOR, we just broadcast without saving.
-
-			// Marshal the message once to be sent to all clients.
-			payload, err := json.Marshal(msg)
-			if err != nil {
-				logger.Sugar.Errorf("Error marshalling broadcast message: %v", err)
+			// A rename, already persisted by the service or the sender's read
+			// loop, updates the cached title.
+			if msg.Type == MetadataType {
+				var meta MetadataPayload
+				if cached, ok := h.docMeta[msg.DocID]; ok && json.Unmarshal(msg.Payload, &meta) == nil {
+					cached.Title = meta.Title
+					h.docMeta[msg.DocID] = cached
+				}
+			}
+			h.dashboardEventFor(msg)
+			// Range claims are kept by the hub, which sends the room's list
+			// instead of relaying the claim.
+			if msg.Type == LockRangeType {
+				changed := h.applyRangeClaim(msg)
+				locks := h.rangeLocksMessage(msg.DocID)
 				h.mu.Unlock()
+				if woke {
+					h.schedulePresenceUpdate(msg.DocID)
+				}
+				if changed {
+					h.relay(locks)
+				}
 				continue
 			}
-
-			// It builds a list of clients who should receive this message (everyone in the room except the original sender).
-			// Create a list of clients to send to, to avoid holding the lock during I/O.
-			clientsToSend := make([]*Client, 0, len(h.Rooms[msg.DocID]))
-			for client := range h.Rooms[msg.DocID] {
-				if client.UserID != msg.UserID { // Don't send the message back to the sender.
-					clientsToSend = append(clientsToSend, client)
+			// Cursors are checked against the document, kept in presence and
+			// throttled per user; other types are broadcast without saving.
+			if msg.Type == CursorType && (!h.applyCursor(msg) || h.throttleCursor(msg)) {
+				h.mu.Unlock()
+				if woke {
+					h.schedulePresenceUpdate(msg.DocID)
 				}
+				continue
 			}
+
 			h.mu.Unlock()
+			if woke {
+				h.schedulePresenceUpdate(msg.DocID)
+			}
+			h.relay(msg)
+		}
+	}
+}
+
+// validUpdate checks that an UPDATE payload is a whole document: an ops array
+// whose every op inserts text or an embed, within MaxContentBytes and
+// MaxContentChars. Passing it also guarantees the message
+// marshals when relayed.
+func (h *Hub) validUpdate(payload json.RawMessage) error {
+	if h.MaxContentBytes > 0 && len(payload) > h.MaxContentBytes {
+		return fmt.Errorf("content exceeds %d bytes", h.MaxContentBytes)
+	}
+	d, err := delta.Parse(payload)
+	if err != nil {
+		return err
+	}
+	if d.Ops == nil {
+		return errors.New("payload has no ops")
+	}
+	// The payload replaces the cached document, so it must be a whole
+	// document, not a change against one.
+	if err := d.Validate(); err != nil {
+		return err
+	}
+	if n := d.CharCount(); h.MaxContentChars > 0 && n > h.MaxContentChars {
+		return fmt.Errorf("content has %d characters, the maximum is %d", n, h.MaxContentChars)
+	}
+	return nil
+}
+
+// relay sends msg to everyone in its room except the sender. Only Run calls
+// it, so sends never race with Unregister closing a client's channel.
+// Clients whose send buffer is full are dropped from the room on the spot.
+func (h *Hub) relay(msg WSMessage) {
+	// Marshal the message once to be sent to all clients.
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		logger.Sugar.Errorf("Error marshalling broadcast message: %v", err)
+		return
+	}
+	// Readers get a redacted copy of document updates.
+	readerPayload := payload
+	if msg.Type == UpdateType {
+		redacted := msg
+		redacted.Payload = ContentForRole(RoleReader, msg.Payload)
+		readerPayload, _ = json.Marshal(redacted)
+	}
+	// Reviewer-only comments don't reach readers at all.
+	hideFromReaders := msg.Type == CommentType && !CommentVisibleTo(RoleReader, commentVisibility(msg.Payload))
+
+	// It builds a list of clients who should receive this message (everyone in the room except the original sender).
+	// Create a list of clients to send to, to avoid holding the lock during I/O.
+	h.mu.Lock()
+	clientsToSend := make([]*Client, 0, len(h.Rooms[msg.DocID]))
+	for client := range h.Rooms[msg.DocID] {
+		if client.UserID != msg.UserID && !(hideFromReaders && client.Role == RoleReader) { // Don't send the message back to the sender.
+			clientsToSend = append(clientsToSend, client)
+		}
+	}
+	h.mu.Unlock()
+
+	// The message is sent to the `Send` channel of each recipient client.
+	// The client's `writePump` will handle writing it to the socket.
+	// Broadcast message outside of the lock.
+	var lagging []*Client
+	for _, client := range clientsToSend {
+		clientPayload := payload
+		if client.Role == RoleReader {
+			clientPayload = readerPayload
+		}
+		select {
+		case client.Send <- clientPayload:
+		default:
+			// If the send buffer is full, the client is lagging. It is removed
+			// here: sending on Unregister would block, as only Run reads it.
+			logger.Sugar.Warnf("Client %s's send buffer is full. Unregistering.", client.UserID)
+			client.setDisconnectReason(DisconnectBufferFull)
+			lagging = append(lagging, client)
+		}
+	}
+	// Its closed Send ends writePump; readPump's later Unregister finds it
+	// gone from the room.
+	for _, client := range lagging {
+		h.removeClient(client)
+	}
+}
+
+// removeClient takes client out of its room, closing the room when it was
+// the last one there. Only Run calls it.
+func (h *Hub) removeClient(client *Client) {
+	// 19. The Hub receives a client to unregister (sent in step 18).
+	h.mu.Lock()
+	docID := client.DocID // Store docID before client is gone
+	// Untracked even when RemoveDocument already dropped the room.
+	h.untrackUser(client)
+	var locks *WSMessage // Set when the user's range claim is dropped
+	if _, ok := h.Rooms[client.DocID][client]; ok {
+		// Remember the client's revision and presence so it can resume shortly.
+		h.saveResumeState(client)
 
-			// The message is sent to the `Send` channel of each recipient client.
-			// The client's `writePump` will handle writing it to the socket.
-			// Broadcast message outside of the lock.
-			for _, client := range clientsToSend {
-				select {
-				case client.Send <- payload:
-				default:
-					// If the send buffer is full, the client is lagging.
-					// Unregister the client to prevent blocking the hub.
-					logger.Sugar.Warnf("Client %s's send buffer is full. Unregistering.", client.UserID)
-					h.Unregister <- client
+		// The client is removed from the room. The user leaves the presence
+		// list only when this was their last connection (e.g. last tab).
+		delete(h.Rooms[client.DocID], client)
+		if remaining := h.userConnectionCount(client.DocID, client.UserID); remaining == 0 {
+			delete(h.Presence[client.DocID], client.UserID)
+			h.releaseEditLockOf(client.DocID, client.UserID)
+			h.forgetCursor(client.DocID, client.UserID)
+			if h.releaseRangeClaim(client.DocID, client.UserID) {
+				msg := h.rangeLocksMessage(client.DocID)
+				locks = &msg
+			}
+		} else if status, ok := h.Presence[client.DocID][client.UserID]; ok {
+			status.ConnectionCount = remaining
+			h.Presence[client.DocID][client.UserID] = status
+		}
+		close(client.Send)
+
+		// If the room is empty, save it right away and clean up. The
+		// content may be kept for EmptyRoomGrace in case it reopens.
+		if len(h.Rooms[client.DocID]) == 0 {
+			saved := true
+			if h.DirtyDocs[client.DocID] {
+				content, _ := h.cachedContent(client.DocID)
+				edits := h.takeAnchorEdits(client.DocID)
+				sum, preview := previewUpdate(content, h.previewSums[client.DocID])
+				if sum == h.previewSums[client.DocID] {
+					// Already stored, e.g. by a REST save; only the owner is told.
+					meta := h.docMeta[client.DocID]
+					go h.notifyOwnerOfEdits(client.DocID, meta.OwnerID, meta.Title, h.takeEditors(client.DocID))
+					go h.shiftCommentRanges(client.DocID, edits)
+				} else if _, ownerID, title, err := h.persist(client.DocID, content, preview, h.lastEditors[client.DocID]); err != nil {
+					logger.Sugar.Errorf("Failed to save doc %s on close: %v", client.DocID, err)
+					// The cache is about to be dropped, so keep a copy on disk.
+					h.writeDeadLetter(client.DocID, content, h.saveFailures[client.DocID]+1)
+					saved = false
+				} else {
+					go h.notifyOwnerOfEdits(client.DocID, ownerID, title, h.takeEditors(client.DocID))
+					go h.shiftCommentRanges(client.DocID, edits)
 				}
 			}
+			delete(h.editors, client.DocID)
+			delete(h.lastEditors, client.DocID)
+			delete(h.updatedBy, client.DocID)
+			delete(h.anchorEdits, client.DocID)
+			delete(h.rangeClaims, client.DocID)
+			delete(h.Rooms, client.DocID)
+			delete(h.Presence, client.DocID)
+			delete(h.DirtyDocs, client.DocID)
+			delete(h.saveFailures, client.DocID)
+			delete(h.Revisions, client.DocID)
+			delete(h.roomEpochs, client.DocID)
+			if saved && h.EmptyRoomGrace > 0 {
+				// Reopening takes it like prewarmed content; otherwise
+				// SweepWorker reclaims it once the grace period is over.
+				h.prewarmed[client.DocID] = time.Now().Add(h.EmptyRoomGrace)
+				logger.Sugar.Infof("Closed empty room %s; keeping its content for %s", client.DocID, h.EmptyRoomGrace)
+			} else {
+				delete(h.previewSums, client.DocID)
+				delete(h.docMeta, client.DocID)
+				h.dropContent(client.DocID)
+				logger.Sugar.Infof("Closed and cleaned up empty room: %s", client.DocID)
+			}
+		}
+	}
+	// Read under mu: SweepWorker also deletes rooms.
+	roomExists := h.Rooms[docID] != nil
+	h.mu.Unlock()
+
+	// 20. A final presence update is sent to remaining users so the departed user's icon disappears from their screen.
+	// Notify remaining users that someone left, only if the room still exists.
+	if roomExists {
+		h.schedulePresenceUpdate(docID)
+		if locks != nil {
+			h.relay(*locks)
+		}
+	}
+}
+
+// join adds client to its room, opening the room when it is the first,
+// and sends it the document. Only Run calls it.
+func (h *Hub) join(client *Client) {
+	// 12. The Hub receives the new client from the `Register` channel (sent in step 11).
+	h.mu.Lock()
+	// Checked here rather than in ServeWs so parallel dials can't both fit
+	// under the cap.
+	if h.roomCapReached(client.DocID, client.UserID) {
+		h.mu.Unlock()
+		logger.Sugar.Warnf("Connection rejected: User %s already has %d rooms open", client.UserID, h.MaxRoomsPerUser)
+		client.admitted <- false
+		return
+	}
+	// Initialize room, presence, and load document if it's the first user.
+	if h.Rooms[client.DocID] == nil {
+		h.Rooms[client.DocID] = make(map[*Client]bool)
+		h.Presence[client.DocID] = make(map[string]UserStatus)
+
+		// If this is the first user in a room, the Hub loads the document
+		// content from the database, unless it was prewarmed.
+		content, warm := h.takePrewarmed(client.DocID)
+		if !warm {
+			var err error
+			content, err = h.Content.Load(client.DocID)
+			if err != nil {
+				logger.Sugar.Errorf("Failed to load document %s (or not found): %v", client.DocID, err)
+				content = []byte(`{"ops":[]}`) // Default to empty content on failure
+			}
+		}
+		h.setContent(client.DocID, content)
+		h.Revisions[client.DocID] = 0
+		h.nextEpoch++
+		h.roomEpochs[client.DocID] = h.nextEpoch
+		// Later joiners and renames use this single copy.
+		h.docMeta[client.DocID] = client.meta
+	}
+	// A reconnect replaces its own stale connection, if still here.
+	h.evictReplaced(client)
+	// The client is added to the room for their specific document.
+	h.Rooms[client.DocID][client] = true
+	h.trackUser(client)
+
+	// Add user to presence map. There is one entry per user however many
+	// tabs they have open; a further tab keeps the existing status and
+	// only bumps ConnectionCount. A resume restores the last status.
+	status, alreadyPresent := h.Presence[client.DocID][client.UserID]
+	resume, current := h.takeResumeState(client)
+	if !alreadyPresent {
+		status = UserStatus{UserID: client.UserID}
+		if resume.UserID != "" {
+			status = resume.Status
 		}
+		status.DisplayName = client.DisplayName
+		status.Color = colorForUser(client.UserID)
+	}
+	status.LastSeen = time.Now()
+	status.ConnectionCount = h.userConnectionCount(client.DocID, client.UserID)
+	h.Presence[client.DocID][client.UserID] = status
+
+	// Get the current document content from the in-memory cache.
+	currentContent, _ := h.cachedContent(client.DocID)
+	revision := h.Revisions[client.DocID]
+	title := h.docMeta[client.DocID].Title
+	client.ResumeToken = newToken()
+	var locksMsg []byte
+	if len(h.rangeClaims[client.DocID]) > 0 {
+		locksMsg, _ = json.Marshal(h.rangeLocksMessage(client.DocID))
+	}
+	h.mu.Unlock()
+
+	// 13. The Hub sends the full, current document content directly to the new client so their editor is up-to-date.
+	// UPDATE messages carry the whole document, so a resuming client whose revision is
+	// current needs nothing; anyone else gets the latest snapshot.
+	if current {
+		resumedPayload, _ := json.Marshal(map[string]int64{"revision": revision})
+		resumedMsg, _ := json.Marshal(WSMessage{Type: ResumedType, DocID: client.DocID, Payload: resumedPayload})
+		client.Send <- resumedMsg
+	} else {
+		initialMsgPayload, _ := json.Marshal(WSMessage{Type: UpdateType, DocID: client.DocID, Payload: json.RawMessage(ContentForRole(client.Role, currentContent))})
+		client.Send <- initialMsgPayload
+	}
+
+	sessionPayload, _ := json.Marshal(SessionPayload{ResumeToken: client.ResumeToken, Revision: revision})
+	sessionMsg, _ := json.Marshal(WSMessage{Type: SessionType, DocID: client.DocID, UserID: client.UserID, Payload: sessionPayload})
+	client.Send <- sessionMsg
+
+	// Send Metadata (Title)
+	metaPayload, _ := json.Marshal(MetadataPayload{Title: title})
+	metaMsg, _ := json.Marshal(WSMessage{Type: MetadataType, DocID: client.DocID, UserID: client.UserID, Payload: json.RawMessage(metaPayload)})
+	client.Send <- metaMsg
+	if locksMsg != nil {
+		client.Send <- locksMsg
+	}
+
+	// 14. The Hub broadcasts a "presence update" to all other clients in the room to let them know a new user has joined.
+	// Notify everyone else in the room about the new user.
+	h.schedulePresenceUpdate(client.DocID)
+	client.admitted <- true
+}
+
+// persist writes content through the content store, then bumps updated_at,
+// stores preview (when non-nil) and records editorID (when set) as the last
+// editor on the document row, returning the row's owner and title.
+func (h *Hub) persist(docID string, content []byte, preview interface{}, editorID string) (updatedAt time.Time, ownerID, title string, err error) {
+	if err = h.Content.Save(docID, content); err != nil {
+		return
+	}
+	var editor interface{}
+	if editorID != "" {
+		editor = editorID
 	}
+	err = h.db.QueryRow(`
+		UPDATE documents SET preview = COALESCE($2::jsonb, preview), updated_at = NOW(),
+			last_editor_id = COALESCE($3::uuid, last_editor_id),
+			last_edited_at = CASE WHEN $3::uuid IS NULL THEN last_edited_at ELSE NOW() END
+		WHERE id = $1 RETURNING updated_at, owner_id, title`,
+		docID, preview, editor,
+	).Scan(&updatedAt, &ownerID, &title)
+	return
 }
 
 func (h *Hub) SaveWorker() {
@@ -205,58 +757,305 @@ func (h *Hub) SaveWorker() {
 	defer ticker.Stop()
 
 	for range ticker.C {
-		type docData struct {
-			Content []byte
-			OwnerID string
+		h.saveDirty()
+	}
+}
+
+// saveDirty persists every dirty document once. The save path only ever
+// updates: documents are created through the API, and ServeWs refuses to open
+// a room for a document that does not exist. A document deleted while its room
+// was open is therefore gone for good, and its content is dropped rather than
+// recreated.
+func (h *Hub) saveDirty() {
+	type docData struct {
+		Content []byte
+		Editors map[string]string
+		Editor  string
+		Edits   []anchorEdit
+		PrevSum uint64
+	}
+	docsToSave := make(map[string]docData)
+
+	h.mu.Lock()
+	// It finds all documents that have been marked as "dirty" (modified in memory).
+	// Find all dirty docs and copy their content to save later.
+	for docID, isDirty := range h.DirtyDocs {
+		if isDirty {
+			// Make a copy of the content to use outside the lock.
+			content, _ := h.cachedContent(docID)
+			contentCopy := make([]byte, len(content))
+			copy(contentCopy, content)
+			docsToSave[docID] = docData{Content: contentCopy, Editors: h.takeEditors(docID), Editor: h.lastEditors[docID], Edits: h.takeAnchorEdits(docID), PrevSum: h.previewSums[docID]}
 		}
-		docsToSave := make(map[string]docData)
+	}
+	h.mu.Unlock()
 
-		h.mu.Lock()
-		// It finds all documents that have been marked as "dirty" (modified in memory).
-		// Find all dirty docs and copy their content to save later.
-		for docID, isDirty := range h.DirtyDocs {
-			if isDirty {
-				// Make a copy of the content to use outside the lock.
-				contentCopy := make([]byte, len(h.DocumentCache[docID]))
-				copy(contentCopy, h.DocumentCache[docID])
-
-				// Try to find an owner from active clients to use if this is a new document
-				var ownerID string
-				if clients, ok := h.Rooms[docID]; ok {
-					for client := range clients {
-						ownerID = client.UserID
-						break
-					}
-				}
-				docsToSave[docID] = docData{Content: contentCopy, OwnerID: ownerID}
+	// 23. It performs the database write operation.
+	// Perform database I/O without holding the hub's lock.
+	for docID, data := range docsToSave {
+		sum, preview := previewUpdate(data.Content, data.PrevSum)
+		if sum == data.PrevSum {
+			h.skipSave(docID, data.Content, data.Editors)
+			h.shiftCommentRanges(docID, data.Edits)
+			continue
+		}
+		updatedAt, ownerID, title, err := h.persist(docID, data.Content, preview, data.Editor)
+		if errors.Is(err, storage.ErrNotFound) {
+			logger.Sugar.Warnf("Doc %s no longer exists; discarding its unsaved changes", docID)
+			h.mu.Lock()
+			h.DirtyDocs[docID] = false
+			delete(h.saveFailures, docID)
+			h.mu.Unlock()
+			continue
+		}
+		if err != nil {
+			logger.Sugar.Errorf("Failed to save doc %s: %v", docID, err)
+			h.mu.Lock()
+			h.restoreEditors(docID, data.Editors)
+			h.restoreAnchorEdits(docID, data.Edits)
+			h.saveFailures[docID]++
+			failures := h.saveFailures[docID]
+			h.mu.Unlock()
+			// Every MaxSaveFailures consecutive failures, snapshot the latest content to disk.
+			if h.MaxSaveFailures > 0 && failures%h.MaxSaveFailures == 0 {
+				h.writeDeadLetter(docID, data.Content, failures)
 			}
+			h.broadcastSaveStatus(docID, SaveStatusPayload{Status: "failed", Message: "save failed, retrying"})
+			continue // Leave the dirty flag as true, will retry on the next tick.
 		}
+
+		// Lock again to safely update the dirty flag.
+		// 24. If the save was successful, it marks the document as "clean" again,
+		//  so it won't be saved again on the next tick unless new changes arrive.
+		h.mu.Lock()
+		// Only mark as clean if the content hasn't changed again
+		// since we started the save operation.
+		if content, _ := h.cachedContent(docID); string(content) == string(data.Content) {
+			h.DirtyDocs[docID] = false
+		}
+		delete(h.saveFailures, docID)
+		h.previewSums[docID] = sum
 		h.mu.Unlock()
 
-		// 23. It performs the database write operation. Using "INSERT ... ON CONFLICT" is an efficient "upsert" that creates the doc if it's new or updates it if it exists.
-		// Perform database I/O without holding the hub's lock.
-		for docID, data := range docsToSave {
-			// Since documents are always created via the API, we only ever need to update them here.
-			_, err := h.db.Exec(`UPDATE documents SET content = $1, updated_at = NOW() WHERE id = $2`, data.Content, docID)
-			if err != nil {
-				logger.Sugar.Errorf("Failed to save doc %s: %v", docID, err)
-				continue // Leave the dirty flag as true, will retry on the next tick.
-			}
+		logger.Sugar.Infof("Auto-saved document: %s", docID)
+		h.broadcastSaveStatus(docID, SaveStatusPayload{Status: "saved", UpdatedAt: &updatedAt})
+		h.notifyOwnerOfEdits(docID, ownerID, title, data.Editors)
+		h.shiftCommentRanges(docID, data.Edits)
+	}
+}
 
-			// Lock again to safely update the dirty flag.
-			// 24. If the save was successful, it marks the document as "clean" again,
-			//  so it won't be saved again on the next tick unless new changes arrive.
-			h.mu.Lock()
-			// Only mark as clean if the content hasn't changed again
-			// since we started the save operation.
-			if string(h.DocumentCache[docID]) == string(data.Content) {
-				h.DirtyDocs[docID] = false
-			}
-			h.mu.Unlock()
+// skipSave clears the dirty flag of a document whose content is already
+// stored, e.g. by a REST save, and still tells the owner who edited it.
+func (h *Hub) skipSave(docID string, content []byte, editors map[string]string) {
+	h.mu.Lock()
+	if current, _ := h.cachedContent(docID); string(current) == string(content) {
+		h.DirtyDocs[docID] = false
+	}
+	delete(h.saveFailures, docID)
+	meta, cached := h.docMeta[docID]
+	h.mu.Unlock()
+
+	if len(editors) == 0 {
+		return
+	}
+	if !cached {
+		err := h.db.QueryRow("SELECT owner_id, title FROM documents WHERE id = $1", docID).Scan(&meta.OwnerID, &meta.Title)
+		if err != nil {
+			logger.Sugar.Errorf("Failed to look up owner of doc %s: %v", docID, err)
+			return
+		}
+	}
+	h.notifyOwnerOfEdits(docID, meta.OwnerID, meta.Title, editors)
+}
+
+// broadcastSaveStatus routes a transient SAVE_STATUS message to everyone in the
+// room through Run, which owns all sends to client channels.
+func (h *Hub) broadcastSaveStatus(docID string, status SaveStatusPayload) {
+	payload, err := json.Marshal(status)
+	if err != nil {
+		logger.Sugar.Errorf("Error marshalling save status: %v", err)
+		return
+	}
+	// An empty UserID means no client is treated as the sender.
+	h.Broadcast <- WSMessage{Type: SaveStatusType, DocID: docID, Payload: payload}
+}
+
+// SweepWorker periodically reclaims per-document state left behind without a
+// room, e.g. if unregister cleanup ever races or a REST save targets a closed room.
+func (h *Hub) SweepWorker() {
+	ticker := time.NewTicker(OrphanSweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		h.sweepOrphans()
+		h.compressIdle()
+	}
+}
+
+func (h *Hub) sweepOrphans() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+
+	orphans := make(map[string]bool)
+	for docID := range h.DocumentCache {
+		orphans[docID] = true
+	}
+	for docID := range h.compressedCache {
+		orphans[docID] = true
+	}
+	for docID := range h.Presence {
+		orphans[docID] = true
+	}
+	for docID := range h.Rooms {
+		orphans[docID] = true
+	}
+
+	for docID := range orphans {
+		if len(h.Rooms[docID]) > 0 {
+			continue
+		}
+		// Leave unsaved content for SaveWorker, and prewarmed or emptied rooms'
+		// content until it expires; both are reclaimed on a later sweep.
+		if h.DirtyDocs[docID] || h.prewarmFresh(docID, now) {
+			continue
+		}
+		delete(h.prewarmed, docID)
+		delete(h.Rooms, docID)
+		delete(h.Presence, docID)
+		delete(h.docMeta, docID)
+		h.dropContent(docID)
+		delete(h.DirtyDocs, docID)
+		delete(h.Revisions, docID)
+		delete(h.roomEpochs, docID)
+		delete(h.editors, docID)
+		delete(h.lastEditors, docID)
+		delete(h.updatedBy, docID)
+		delete(h.anchorEdits, docID)
+		delete(h.rangeClaims, docID)
+		delete(h.previewSums, docID)
+		logger.Sugar.Infof("Reclaimed orphaned room state: %s", docID)
+	}
+}
 
-			logger.Sugar.Infof("Auto-saved document: %s", docID)
+// userConnectionCount returns how many clients userID has in docID's room.
+// Must be called with h.mu held.
+func (h *Hub) userConnectionCount(docID, userID string) int {
+	count := 0
+	for client := range h.Rooms[docID] {
+		if client.UserID == userID {
+			count++
 		}
 	}
+	return count
+}
+
+// UserRoomCount returns how many distinct rooms userID currently has a connection in.
+func (h *Hub) UserRoomCount(userID string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	rooms := make(map[string]bool)
+	for client := range h.userClients[userID] {
+		rooms[client.DocID] = true
+	}
+	return len(rooms)
+}
+
+// roomCapReached reports whether joining docID would give userID more than
+// MaxRoomsPerUser rooms. Another tab on an already-open document is fine.
+// Must be called with h.mu held.
+func (h *Hub) roomCapReached(docID, userID string) bool {
+	if h.MaxRoomsPerUser <= 0 {
+		return false
+	}
+	rooms := make(map[string]bool)
+	for client := range h.userClients[userID] {
+		rooms[client.DocID] = true
+	}
+	return !rooms[docID] && len(rooms) >= h.MaxRoomsPerUser
+}
+
+// IsUserInRoom reports whether userID already has a connection to docID.
+func (h *Hub) IsUserInRoom(docID, userID string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for client := range h.Rooms[docID] {
+		if client.UserID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// DocMeta returns the cached title and owner of an open room.
+func (h *Hub) DocMeta(docID string) (title, ownerID string, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	meta, ok := h.docMeta[docID]
+	return meta.Title, meta.OwnerID, ok
+}
+
+// SetOwner updates the cached owner of an open room after ownership changes
+// hands. Closed rooms read the owner from the database when they reopen.
+func (h *Hub) SetOwner(docID, ownerID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if meta, ok := h.docMeta[docID]; ok {
+		meta.OwnerID = ownerID
+		h.docMeta[docID] = meta
+	}
+}
+
+// IsDirty reports whether docID has in-memory edits not yet saved.
+func (h *Hub) IsDirty(docID string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.DirtyDocs[docID]
+}
+
+// RoomSize returns the number of connections open to docID.
+func (h *Hub) RoomSize(docID string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.Rooms[docID])
+}
+
+// GetCachedContent returns a copy of the in-memory content for a document with
+// an active room, if any.
+func (h *Hub) GetCachedContent(docID string) ([]byte, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	content, ok := h.cachedContent(docID)
+	if !ok {
+		return nil, false
+	}
+	contentCopy := make([]byte, len(content))
+	copy(contentCopy, content)
+	return contentCopy, true
+}
+
+// DisconnectUser closes every connection userID has to docID, or to any
+// document when docID is empty (e.g. on account deletion), with an
+// application close code and reason, and returns how many it closed. Each
+// read pump then unregisters its client, which updates presence as usual.
+func (h *Hub) DisconnectUser(docID, userID string, code int, reason string) int {
+	h.mu.Lock()
+	clients := h.userConns(docID, userID)
+	h.mu.Unlock()
+
+	for _, client := range clients {
+		client.setDisconnectReason(DisconnectKicked)
+		closeWithReason(client.Conn, code, reason)
+		client.Conn.Close()
+	}
+	return len(clients)
 }
 
 // RemoveDocument forcefully removes a document from memory and disconnects clients.
@@ -266,19 +1065,71 @@ func (h *Hub) RemoveDocument(docID string) {
 	defer h.mu.Unlock()
 
 	// 1. Remove from memory so it doesn't get auto-saved back to DB
-	delete(h.DocumentCache, docID)
+	h.dropContent(docID)
 	delete(h.DirtyDocs, docID)
+	delete(h.prewarmed, docID)
 	delete(h.Presence, docID)
+	delete(h.docMeta, docID)
+	delete(h.Revisions, docID)
+	delete(h.roomEpochs, docID)
+	delete(h.editors, docID)
+	delete(h.lastEditors, docID)
+	delete(h.updatedBy, docID)
+	delete(h.anchorEdits, docID)
+	delete(h.rangeClaims, docID)
+	delete(h.previewSums, docID)
+	h.lockMu.Lock()
+	delete(h.editLocks, docID)
+	h.lockMu.Unlock()
 
 	// 2. Disconnect all clients currently in the room
 	if clients, ok := h.Rooms[docID]; ok {
 		for client := range clients {
+			client.setDisconnectReason(DisconnectDeleted)
 			client.Conn.Close() // This will trigger the readPump to exit and unregister safely
 		}
 		delete(h.Rooms, docID)
 	}
 }
 
+// schedulePresenceUpdate coalesces presence changes within PresenceDebounce
+// into one broadcast. The broadcast reads presence when the window closes, so
+// the final state is always sent and only intermediate states are dropped.
+func (h *Hub) schedulePresenceUpdate(docID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, pending := h.presenceTimers[docID]; pending {
+		return
+	}
+	// The flush is handed back to Run so sends never race with Unregister
+	// closing a client's channel.
+	h.presenceTimers[docID] = time.AfterFunc(PresenceDebounce, func() {
+		h.presenceFlush <- docID
+	})
+}
+
+// ContentForRole returns document content as a client with role may see it.
+// Readers have confidential ranges redacted in place so op indices still line
+// up with the full document that writers and reviewers receive.
+func ContentForRole(role string, content []byte) []byte {
+	if role != RoleReader || !bytes.Contains(content, []byte(ConfidentialAttr)) {
+		return content
+	}
+	d, err := delta.Parse(content)
+	if err != nil {
+		// Never fall back to unredacted content for readers.
+		logger.Sugar.Errorf("Failed to parse content for redaction: %v", err)
+		return []byte(delta.Empty)
+	}
+	redacted, err := json.Marshal(d.Redact(ConfidentialAttr))
+	if err != nil {
+		logger.Sugar.Errorf("Failed to encode redacted content: %v", err)
+		return []byte(delta.Empty)
+	}
+	return redacted
+}
+
 func (h *Hub) broadcastPresenceUpdate(docID string) {
 	var userStatuses []UserStatus
 	var clientsToSend []*Client
@@ -304,7 +1155,7 @@ func (h *Hub) broadcastPresenceUpdate(docID string) {
 	}
 
 	// Marshal the payload outside the lock
-	payload, err := json.Marshal(userStatuses)
+	payload, err := json.Marshal(roomPresence(userStatuses, h.MaxPresenceUsers))
 	if err != nil {
 		logger.Sugar.Errorf("Error marshalling presence broadcast: %v", err)
 		return
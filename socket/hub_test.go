@@ -2,12 +2,22 @@ package socket
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"satunaskah/internal/document/model"
+	"satunaskah/pkg/apperr"
+	"satunaskah/pkg/delta"
+	"satunaskah/pkg/flags"
+	"satunaskah/pkg/logger"
+
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
@@ -26,20 +36,37 @@ func readMessage(t *testing.T, conn *websocket.Conn) WSMessage {
 	return msg
 }
 
+// Helper function to read messages until one of the given type arrives.
+func readMessageOfType(t *testing.T, conn *websocket.Conn, msgType string) WSMessage {
+	for {
+		msg := readMessage(t, conn)
+		if msg.Type == msgType {
+			return msg
+		}
+	}
+}
+
+func TestMain(m *testing.M) {
+	logger.Init()
+	m.Run()
+}
+
 func TestHubIntegration(t *testing.T) {
 	// 1. Setup Mock DB and Hub
 	db, mock, err := sqlmock.New()
 	require.NoError(t, err)
 	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
 
 	hub := NewHub(db)
+	hub.DeadLetterDir = t.TempDir() // The final save on close fails once db is closed
 	go hub.Run()
 
 	// 2. Setup Test HTTP Server
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// For simplicity, we'll hardcode the user ID for tests.
 		userID := r.URL.Query().Get("user_id")
-		ServeWs(hub, w, r, userID)
+		ServeWs(hub, w, r, userID, "")
 	}))
 	defer server.Close()
 
@@ -49,9 +76,22 @@ func TestHubIntegration(t *testing.T) {
 	// --- Test Scenario ---
 
 	// 3. Client 1 Joins
-	docID := "test-doc-1"
+	docID := "1b4e28ba-2fa1-41d2-883f-0016d3cca427"
 	initialContent := `{"ops":[{"insert":"Hello World"}]}`
 
+	// The first connection looks up the document owner; later ones use the
+	// open room's cached copy. user1 owns the document and user2 is a writer
+	// collaborator.
+	mock.ExpectQuery("SELECT owner_id, title FROM documents WHERE id = \\$1").
+		WithArgs(docID).
+		WillReturnRows(sqlmock.NewRows([]string{"owner_id", "title"}).AddRow("user1", "Test Doc"))
+	mock.ExpectQuery("SELECT role FROM collaborators WHERE document_id = \\$1 AND user_id = \\$2").
+		WithArgs(docID, "user2").
+		WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(RoleWriter))
+
+	mock.ExpectExec("INSERT INTO document_access").WithArgs(docID, "user1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO document_access").WithArgs(docID, "user2").WillReturnResult(sqlmock.NewResult(0, 1))
+
 	// Expect a DB query when the first user joins a room.
 	mock.ExpectQuery("SELECT content FROM documents WHERE id = \\$1").
 		WithArgs(docID).
@@ -74,21 +114,24 @@ func TestHubIntegration(t *testing.T) {
 	defer conn2.Close()
 
 	// Client 2 receives its own initial content message.
-	_ = readMessage(t, conn2)
+	_ = readMessageOfType(t, conn2, UpdateType)
 
 	// Client 1 should receive a presence update about Client 2 joining.
-	presenceUpdateMsg := readMessage(t, conn1)
-	assert.Equal(t, "PRESENCE_UPDATE", presenceUpdateMsg.Type)
-	var statuses []UserStatus
-	err = json.Unmarshal(presenceUpdateMsg.Payload, &statuses)
-	require.NoError(t, err)
-	assert.Len(t, statuses, 2, "Should be two users in the room")
+	var presence PresencePayload
+	for len(presence.Users) < 2 {
+		presenceUpdateMsg := readMessageOfType(t, conn1, PresenceUpdateType)
+		err = json.Unmarshal(presenceUpdateMsg.Payload, &presence)
+		require.NoError(t, err)
+	}
+	statuses := presence.Users
+	assert.Equal(t, 2, presence.Total, "Should be two users in the room")
+	assert.Len(t, statuses, 2)
 	userIDs := []string{statuses[0].UserID, statuses[1].UserID}
 	assert.Contains(t, userIDs, "user1")
 	assert.Contains(t, userIDs, "user2")
 
-	// 5. Client 2 sends a document update
-	updatePayload := `{"ops":[{"retain":11},{"insert":"!"}]}`
+	// 5. Client 2 sends the updated document
+	updatePayload := `{"ops":[{"insert":"Hello World!"}]}`
 	msgToSend := WSMessage{
 		Type:    UpdateType,
 		Payload: json.RawMessage(updatePayload),
@@ -98,11 +141,1561 @@ func TestHubIntegration(t *testing.T) {
 	require.NoError(t, err, "Client 2 failed to send update message")
 
 	// Client 1 should receive the broadcasted update from Client 2.
-	broadcastMsg := readMessage(t, conn1)
+	broadcastMsg := readMessageOfType(t, conn1, UpdateType)
 	assert.Equal(t, UpdateType, broadcastMsg.Type)
 	assert.Equal(t, "user2", broadcastMsg.UserID, "Broadcast message should have correct UserID")
 	assert.JSONEq(t, updatePayload, string(broadcastMsg.Payload))
 
 	// Ensure all mock expectations were met.
 	assert.NoError(t, mock.ExpectationsWereMet())
+
+	conn1.Close()
+	conn2.Close()
+	waitForRoomClosed(t, hub, docID)
+}
+
+func TestServeWsClosesWithReason(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	hub := NewHub(db)
+	go hub.Run()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeWs(hub, w, r, r.URL.Query().Get("user_id"), "")
+	}))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	mock.ExpectQuery("SELECT owner_id, title FROM documents WHERE id = \\$1").
+		WithArgs("6fa459ea-ee8a-4ca4-894e-db77e160355e").
+		WillReturnRows(sqlmock.NewRows([]string{"owner_id", "title"}))
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId=6fa459ea-ee8a-4ca4-894e-db77e160355e&user_id=user1", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	_, _, err = conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, CloseDocumentNotFound, closeErr.Code)
+	assert.Equal(t, "document not found", closeErr.Text)
+}
+
+func TestRoomCapHoldsForParallelDials(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+
+	hub := NewHub(db)
+	hub.MaxRoomsPerUser = 1
+	go hub.Run()
+	wsURL := newTestServer(t, hub)
+
+	docs := []string{"3f2b8c1d-5e6a-4b7c-8d9e-0f1a2b3c4d5e", "7a8b9c0d-1e2f-4a3b-9c4d-5e6f7a8b9c0d"}
+	for _, docID := range docs {
+		expectJoin(mock, docID, "user1", "user1")
+		mock.ExpectQuery("SELECT content FROM documents WHERE id = \\$1").
+			WithArgs(docID).
+			WillReturnRows(sqlmock.NewRows([]string{"content"}).AddRow([]byte(`{"ops":[]}`)))
+	}
+
+	codes := make(chan int, len(docs))
+	for _, docID := range docs {
+		go func(docID string) {
+			conn, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+docID+"&user_id=user1", nil)
+			if err != nil {
+				codes <- -1
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, _, err = conn.ReadMessage()
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) {
+				codes <- closeErr.Code
+			} else {
+				codes <- 0 // Joined
+			}
+		}(docID)
+	}
+	got := []int{<-codes, <-codes}
+	assert.ElementsMatch(t, []int{0, CloseTooManyRooms}, got)
+	assert.Equal(t, 1, hub.UserRoomCount("user1"))
+}
+
+// newTestServer serves ServeWs with the user id taken from the user_id query param.
+func newTestServer(t *testing.T, hub *Hub) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeWs(hub, w, r, r.URL.Query().Get("user_id"), "")
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// expectJoin registers the queries ServeWs runs for userID joining docID owned
+// by ownerID. The owner lookup is only used when the room is not open yet.
+func expectJoin(mock sqlmock.Sqlmock, docID, userID, ownerID string) {
+	mock.ExpectQuery("SELECT owner_id, title FROM documents WHERE id = \\$1").
+		WithArgs(docID).
+		WillReturnRows(sqlmock.NewRows([]string{"owner_id", "title"}).AddRow(ownerID, "Test Doc"))
+	if userID != ownerID {
+		mock.ExpectQuery("SELECT role FROM collaborators WHERE document_id = \\$1 AND user_id = \\$2").
+			WithArgs(docID, userID).
+			WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(RoleWriter))
+	}
+	mock.ExpectExec("INSERT INTO document_access").WithArgs(docID, userID).WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+// readPresence reads presence updates until one lists wantUsers entries.
+func readPresence(t *testing.T, conn *websocket.Conn, wantUsers int) []UserStatus {
+	for {
+		var presence PresencePayload
+		msg := readMessageOfType(t, conn, PresenceUpdateType)
+		require.NoError(t, json.Unmarshal(msg.Payload, &presence))
+		if len(presence.Users) == wantUsers {
+			assert.Equal(t, wantUsers, presence.Total)
+			return presence.Users
+		}
+	}
+}
+
+// waitForRoomClosed waits until docID's room has been torn down. The room's
+// close-save, and any dead letter it writes, is done by then, so nothing is
+// written to the test's temp dirs while they are removed.
+func waitForRoomClosed(t *testing.T, hub *Hub, docID string) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		hub.mu.Lock()
+		defer hub.mu.Unlock()
+		return hub.Rooms[docID] == nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestPresenceSurvivesClosingOneOfTwoTabs(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+
+	hub := NewHub(db)
+	go hub.Run()
+	wsURL := newTestServer(t, hub)
+
+	docID := "9c5b94b1-35ad-49bb-b118-8e8fc24abf80"
+	expectJoin(mock, docID, "user1", "user1")
+	expectJoin(mock, docID, "user1", "user1")
+	expectJoin(mock, docID, "user2", "user1")
+	mock.ExpectQuery("SELECT content FROM documents WHERE id = \\$1").
+		WithArgs(docID).
+		WillReturnRows(sqlmock.NewRows([]string{"content"}).AddRow([]byte(`{"ops":[]}`)))
+
+	// user1 opens the document in two tabs, user2 watches.
+	tabA, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+docID+"&user_id=user1", nil)
+	require.NoError(t, err)
+	defer tabA.Close()
+	_ = readMessageOfType(t, tabA, UpdateType)
+
+	tabB, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+docID+"&user_id=user1", nil)
+	require.NoError(t, err)
+	defer tabB.Close()
+	_ = readMessageOfType(t, tabB, UpdateType)
+
+	observer, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+docID+"&user_id=user2", nil)
+	require.NoError(t, err)
+	defer observer.Close()
+	_ = readPresence(t, observer, 2)
+
+	// Closing one tab abruptly must not remove user1 from presence.
+	tabA.Close()
+
+	msg := readMessageOfType(t, observer, PresenceUpdateType)
+	var presence PresencePayload
+	require.NoError(t, json.Unmarshal(msg.Payload, &presence))
+	userIDs := make([]string, 0, len(presence.Users))
+	for _, s := range presence.Users {
+		userIDs = append(userIDs, s.UserID)
+	}
+	assert.ElementsMatch(t, []string{"user1", "user2"}, userIDs)
+}
+
+func TestSecondTabKeepsSinglePresenceEntry(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+
+	hub := NewHub(db)
+	go hub.Run()
+	wsURL := newTestServer(t, hub)
+
+	docID := "c2d3e4f5-a6b7-48c9-9d0e-1f2a3b4c5d6e"
+	expectJoin(mock, docID, "user2", "user1")
+	expectJoin(mock, docID, "user1", "user1")
+	expectJoin(mock, docID, "user1", "user1")
+	mock.ExpectQuery("SELECT content FROM documents WHERE id = \\$1").
+		WithArgs(docID).
+		WillReturnRows(sqlmock.NewRows([]string{"content"}).AddRow([]byte(`{"ops":[]}`)))
+
+	observer, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+docID+"&user_id=user2", nil)
+	require.NoError(t, err)
+	defer observer.Close()
+
+	tabA, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+docID+"&user_id=user1", nil)
+	require.NoError(t, err)
+	defer tabA.Close()
+	_ = readPresence(t, observer, 2)
+
+	tabB, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+docID+"&user_id=user1", nil)
+	require.NoError(t, err)
+	defer tabB.Close()
+
+	// The second tab is reported as another connection, not another user.
+	for {
+		statuses := readPresence(t, observer, 2)
+		var user1 UserStatus
+		for _, s := range statuses {
+			if s.UserID == "user1" {
+				user1 = s
+			}
+		}
+		if user1.ConnectionCount == 2 {
+			break
+		}
+	}
+
+	// Closing one tab drops the count back without removing the user.
+	tabA.Close()
+	for {
+		statuses := readPresence(t, observer, 2)
+		var user1 UserStatus
+		for _, s := range statuses {
+			if s.UserID == "user1" {
+				user1 = s
+			}
+		}
+		if user1.ConnectionCount == 1 {
+			break
+		}
+	}
+}
+
+func TestTitleChangeReachesConnectedAndNewClients(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+
+	hub := NewHub(db)
+	go hub.Run()
+	wsURL := newTestServer(t, hub)
+
+	docID := "3f2504e0-4f89-41d3-9a0c-0305e82c3301"
+	expectJoin(mock, docID, "user1", "user1")
+	expectJoin(mock, docID, "user2", "user1")
+	expectJoin(mock, docID, "user3", "user1")
+	mock.ExpectQuery("SELECT content FROM documents WHERE id = \\$1").
+		WithArgs(docID).
+		WillReturnRows(sqlmock.NewRows([]string{"content"}).AddRow([]byte(`{"ops":[]}`)))
+
+	owner, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+docID+"&user_id=user1", nil)
+	require.NoError(t, err)
+	defer owner.Close()
+	_ = readMessageOfType(t, owner, MetadataType)
+
+	editor, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+docID+"&user_id=user2", nil)
+	require.NoError(t, err)
+	defer editor.Close()
+	_ = readMessageOfType(t, editor, MetadataType)
+
+	// What DocumentService.UpdateTitle sends after renaming over REST.
+	payload, _ := json.Marshal(MetadataPayload{Title: "Renamed"})
+	hub.Broadcast <- WSMessage{Type: MetadataType, DocID: docID, Payload: payload}
+
+	for _, conn := range []*websocket.Conn{owner, editor} {
+		var meta MetadataPayload
+		require.NoError(t, json.Unmarshal(readMessageOfType(t, conn, MetadataType).Payload, &meta))
+		assert.Equal(t, "Renamed", meta.Title)
+	}
+
+	// A later joiner gets the current title, not the one read when it connected.
+	late, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+docID+"&user_id=user3", nil)
+	require.NoError(t, err)
+	defer late.Close()
+	var meta MetadataPayload
+	require.NoError(t, json.Unmarshal(readMessageOfType(t, late, MetadataType).Payload, &meta))
+	assert.Equal(t, "Renamed", meta.Title)
+}
+
+func TestIdleCacheCompressionRoundTrips(t *testing.T) {
+	hub := NewHub(nil)
+	hub.CacheCompressMinBytes = 1
+	hub.CacheCompressIdle = 0
+
+	docID := "8f14e45f-ceea-467f-a0e6-1b2f5c6d7e8f"
+	content := []byte(`{"ops":[{"insert":"` + strings.Repeat("héllo 😀 世界 ", 500) + `\n"}]}`)
+	hub.mu.Lock()
+	hub.setContent(docID, content)
+	hub.mu.Unlock()
+
+	hub.compressIdle()
+
+	hub.mu.Lock()
+	_, raw := hub.DocumentCache[docID]
+	compressed := hub.compressedCache[docID]
+	hub.mu.Unlock()
+	assert.False(t, raw, "idle entry should no longer be held raw")
+	assert.Less(t, len(compressed), len(content))
+
+	got, ok := hub.GetCachedContent(docID)
+	require.True(t, ok)
+	assert.Equal(t, content, got)
+
+	// Reading inflated the entry again; dirty entries are never compressed.
+	hub.mu.Lock()
+	hub.DirtyDocs[docID] = true
+	hub.mu.Unlock()
+	hub.compressIdle()
+	hub.mu.Lock()
+	_, raw = hub.DocumentCache[docID]
+	hub.mu.Unlock()
+	assert.True(t, raw)
+}
+
+func TestClientWithoutPongIsDisconnected(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+
+	hub := NewHub(db)
+	hub.PingInterval = 50 * time.Millisecond
+	hub.PongTimeout = 150 * time.Millisecond
+	hub.DeadLetterDir = t.TempDir()
+	go hub.Run()
+	wsURL := newTestServer(t, hub)
+
+	docID := "a87ff679-a2f3-471d-8181-a67b7542122c"
+	expectJoin(mock, docID, "user1", "user1")
+	mock.ExpectQuery("SELECT content FROM documents WHERE id = \\$1").
+		WithArgs(docID).
+		WillReturnRows(sqlmock.NewRows([]string{"content"}).AddRow([]byte(`{"ops":[]}`)))
+
+	// Pongs are only sent while the client reads, so a client that never
+	// reads behaves like a dead peer.
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+docID+"&user_id=user1", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.Eventually(t, func() bool { return hub.IsUserInRoom(docID, "user1") }, time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return !hub.IsUserInRoom(docID, "user1") }, 2*time.Second, 20*time.Millisecond)
+	waitForRoomClosed(t, hub, docID)
+}
+
+func TestAccessorsReturnCopies(t *testing.T) {
+	hub := NewHub(nil)
+	docID := "c9f0f895-fb98-4b91-8f5e-0a7e1c2d3b4a"
+
+	hub.mu.Lock()
+	hub.setContent(docID, []byte(`{"ops":[{"insert":"a\n"}]}`))
+	hub.DirtyDocs[docID] = true
+	hub.Rooms[docID] = map[*Client]bool{{UserID: "u1"}: true, {UserID: "u2"}: true}
+	hub.mu.Unlock()
+
+	got, ok := hub.GetCachedContent(docID)
+	require.True(t, ok)
+	got[0] = 'X'
+	again, _ := hub.GetCachedContent(docID)
+	assert.Equal(t, byte('{'), again[0], "callers must get a copy")
+
+	assert.True(t, hub.IsDirty(docID))
+	assert.Equal(t, 2, hub.RoomSize(docID))
+	assert.False(t, hub.IsDirty("other"))
+	assert.Equal(t, 0, hub.RoomSize("other"))
+}
+
+func TestCursorSelectionValidatedAndKeptInPresence(t *testing.T) {
+	hub := NewHub(nil)
+	docID := "45c48cce-2e2d-4fbd-8a3c-7b5f6e9d0c1a"
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	hub.setContent(docID, []byte(`{"ops":[{"insert":"hello\n"}]}`)) // Length 6
+	hub.Presence[docID] = map[string]UserStatus{"u1": {UserID: "u1"}}
+
+	cursor := func(payload string) bool {
+		return hub.applyCursor(WSMessage{Type: CursorType, DocID: docID, UserID: "u1", Payload: json.RawMessage(payload)})
+	}
+
+	assert.True(t, cursor(`{"index":1,"length":3}`))
+	status := hub.Presence[docID]["u1"]
+	require.NotNil(t, status.Selection)
+	assert.Equal(t, Selection{Index: 1, Length: 3}, *status.Selection)
+	assert.Equal(t, 1, status.CursorPos)
+
+	// Legacy clients send a bare position.
+	assert.True(t, cursor(`4`))
+	assert.Equal(t, Selection{Index: 4}, *hub.Presence[docID]["u1"].Selection)
+
+	assert.False(t, cursor(`{"index":4,"length":5}`), "past the end of the document")
+	assert.False(t, cursor(`{"index":-1,"length":0}`))
+	assert.False(t, cursor(`"nope"`))
+	assert.Equal(t, 4, hub.Presence[docID]["u1"].CursorPos, "rejected cursors leave presence alone")
+
+	// A longer document makes the range valid.
+	hub.setContent(docID, []byte(`{"ops":[{"insert":"hello world\n"}]}`))
+	assert.True(t, cursor(`{"index":4,"length":5}`))
+}
+
+func TestCursorThrottleSendsLatest(t *testing.T) {
+	hub := NewHub(nil)
+	docID := "d3d94468-02a4-4e9b-b1c2-3f4e5a6b7c8d"
+	cursor := func(index int) WSMessage {
+		return WSMessage{Type: CursorType, DocID: docID, UserID: "u1", Payload: json.RawMessage(strconv.Itoa(index))}
+	}
+
+	hub.mu.Lock()
+	assert.False(t, hub.throttleCursor(cursor(1)), "first update goes out at once")
+	assert.True(t, hub.throttleCursor(cursor(2)))
+	assert.True(t, hub.throttleCursor(cursor(3)))
+	// Another user's cursor has its own window.
+	assert.False(t, hub.throttleCursor(WSMessage{Type: CursorType, DocID: docID, UserID: "u2"}))
+	hub.mu.Unlock()
+
+	select {
+	case key := <-hub.cursorFlush:
+		msg, ok := hub.takePendingCursor(key)
+		require.True(t, ok)
+		assert.Equal(t, json.RawMessage("3"), msg.Payload, "only the latest held update is relayed")
+	case <-time.After(time.Second):
+		t.Fatal("throttled cursor was never flushed")
+	}
+	_, ok := hub.takePendingCursor(cursorKey{DocID: docID, UserID: "u1"})
+	assert.False(t, ok)
+}
+
+func TestDisconnectUserClosesAllTheirTabs(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+
+	hub := NewHub(db)
+	go hub.Run()
+	wsURL := newTestServer(t, hub)
+
+	docID := "1679091c-5a88-4faf-9fb2-a1b2c3d4e5f6"
+	expectJoin(mock, docID, "owner", "owner")
+	expectJoin(mock, docID, "guest", "owner")
+	expectJoin(mock, docID, "guest", "owner")
+	mock.ExpectQuery("SELECT content FROM documents WHERE id = \\$1").
+		WithArgs(docID).
+		WillReturnRows(sqlmock.NewRows([]string{"content"}).AddRow([]byte(`{"ops":[]}`)))
+
+	owner, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+docID+"&user_id=owner", nil)
+	require.NoError(t, err)
+	defer owner.Close()
+	_ = readMessageOfType(t, owner, UpdateType)
+
+	var tabs []*websocket.Conn
+	for i := 0; i < 2; i++ {
+		tab, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+docID+"&user_id=guest", nil)
+		require.NoError(t, err)
+		defer tab.Close()
+		_ = readMessageOfType(t, tab, UpdateType)
+		tabs = append(tabs, tab)
+	}
+	_ = readPresence(t, owner, 2)
+
+	assert.Equal(t, 2, hub.DisconnectUser(docID, "guest", CloseRemovedByOwner, "removed by owner"))
+
+	for _, tab := range tabs {
+		tab.SetReadDeadline(time.Now().Add(time.Second))
+		var closeErr *websocket.CloseError
+		for {
+			if _, _, err := tab.ReadMessage(); err != nil {
+				require.ErrorAs(t, err, &closeErr)
+				break
+			}
+		}
+		assert.Equal(t, CloseRemovedByOwner, closeErr.Code)
+		assert.Equal(t, "removed by owner", closeErr.Text)
+	}
+
+	statuses := readPresence(t, owner, 1)
+	assert.Equal(t, "owner", statuses[0].UserID)
+}
+
+func TestSubprotocolNegotiation(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	hub := NewHub(db)
+	go hub.Run()
+	wsURL := newTestServer(t, hub)
+	docID := "a87ff679-a2f3-471d-8181-a67b7542122c"
+
+	_, resp, err := (&websocket.Dialer{Subprotocols: []string{"satunaskah.v9"}}).Dial(wsURL+"/ws?docId="+docID+"&user_id=user1", nil)
+	require.Error(t, err)
+	require.NotNil(t, resp)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// A supported version among others is chosen and echoed.
+	mock.ExpectQuery("SELECT owner_id, title FROM documents WHERE id = \\$1").
+		WithArgs(docID).
+		WillReturnRows(sqlmock.NewRows([]string{"owner_id", "title"}))
+	conn, resp, err := (&websocket.Dialer{Subprotocols: []string{"satunaskah.v9", ProtocolV1}}).Dial(wsURL+"/ws?docId="+docID+"&user_id=user1", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, ProtocolV1, resp.Header.Get("Sec-WebSocket-Protocol"))
+	assert.Equal(t, ProtocolV1, conn.Subprotocol())
+}
+
+func TestWriterRenamesOverSocket(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+
+	hub := NewHub(db)
+	go hub.Run()
+	wsURL := newTestServer(t, hub)
+
+	docID := "8a1f0c3e-7b2d-4e5f-9a6b-0c1d2e3f4a5b"
+	expectJoin(mock, docID, "user1", "user1")
+	expectJoin(mock, docID, "user2", "user1")
+	mock.ExpectQuery("SELECT content FROM documents WHERE id = \\$1").
+		WithArgs(docID).
+		WillReturnRows(sqlmock.NewRows([]string{"content"}).AddRow([]byte(`{"ops":[]}`)))
+	mock.ExpectExec("UPDATE documents SET title").
+		WithArgs("Inline title", docID, "user2", RoleWriter).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	owner, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+docID+"&user_id=user1", nil)
+	require.NoError(t, err)
+	defer owner.Close()
+	_ = readMessageOfType(t, owner, MetadataType)
+
+	writer, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+docID+"&user_id=user2", nil)
+	require.NoError(t, err)
+	defer writer.Close()
+	_ = readMessageOfType(t, writer, MetadataType)
+
+	payload, _ := json.Marshal(MetadataPayload{Title: "  Inline title  "})
+	require.NoError(t, writer.WriteJSON(WSMessage{Type: MetadataType, Payload: payload}))
+
+	// Everyone, the sender included, gets the trimmed title.
+	for _, conn := range []*websocket.Conn{owner, writer} {
+		var meta MetadataPayload
+		require.NoError(t, json.Unmarshal(readMessageOfType(t, conn, MetadataType).Payload, &meta))
+		assert.Equal(t, "Inline title", meta.Title)
+	}
+	title, _, _ := hub.DocMeta(docID)
+	assert.Equal(t, "Inline title", title)
+
+	for _, bad := range []string{"", "   ", "\n\x00\t", strings.Repeat("x", MaxTitleLength+1)} {
+		_, ok := CleanTitle(bad)
+		assert.False(t, ok, "%q", bad)
+	}
+	cleaned, ok := CleanTitle(" Q3\tplan\r\nfinal\x07 ")
+	assert.True(t, ok)
+	assert.Equal(t, "Q3 plan  final", cleaned)
+}
+
+// fakeTitles numbers "Plan" and refuses "Taken", for ownerID "user1" only.
+type fakeTitles struct{}
+
+func (fakeTitles) ChooseTitle(ownerID, docID, title string) (string, error) {
+	if ownerID != "user1" {
+		return "", errors.New("wrong owner")
+	}
+	switch title {
+	case "Plan":
+		return "Plan (2)", nil
+	case "Taken":
+		return "", errors.New("title taken")
+	}
+	return title, nil
+}
+
+func TestSocketRenameFollowsTitleChooser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	hub := NewHub(db)
+	hub.Titles = fakeTitles{}
+	docID := "8a1f0c3e-7b2d-4e5f-9a6b-0c1d2e3f4a5b"
+	hub.docMeta[docID] = docMeta{Title: "Old", OwnerID: "user1"}
+	writer := &Client{Hub: hub, DocID: docID, UserID: "user2"}
+
+	mock.ExpectExec("UPDATE documents SET title").
+		WithArgs("Plan (2)", docID, "user2", RoleWriter).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	msg, ok := writer.rename(WSMessage{Type: MetadataType, Payload: json.RawMessage(`{"title":"Plan"}`)})
+	require.True(t, ok)
+	assert.JSONEq(t, `{"title":"Plan (2)"}`, string(msg.Payload))
+
+	// A refused title never reaches the database.
+	_, ok = writer.rename(WSMessage{Type: MetadataType, Payload: json.RawMessage(`{"title":"Taken"}`)})
+	assert.False(t, ok)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestHeartbeatKeepsViewerActive(t *testing.T) {
+	hub := NewHub(nil)
+	docID := "d3b07384-d9a0-4c9b-8f1e-2a3b4c5d6e7f"
+	start := time.Now()
+	hub.Presence[docID] = map[string]UserStatus{
+		"viewer":  {UserID: "viewer", LastSeen: start},
+		"watcher": {UserID: "watcher", LastSeen: start},
+	}
+
+	assert.Empty(t, hub.markIdle(start.Add(PresenceIdleAfter/2)))
+
+	// Only the viewer keeps sending heartbeats.
+	hub.mu.Lock()
+	assert.False(t, hub.touchPresence(docID, "viewer"), "already active, no presence broadcast")
+	hub.mu.Unlock()
+
+	later := start.Add(PresenceIdleAfter)
+	assert.Equal(t, []string{docID}, hub.markIdle(later))
+	assert.False(t, hub.Presence[docID]["viewer"].Idle)
+	assert.True(t, hub.Presence[docID]["watcher"].Idle)
+	assert.Empty(t, hub.markIdle(later), "already idle users don't flip again")
+
+	hub.mu.Lock()
+	assert.True(t, hub.touchPresence(docID, "watcher"), "coming back ends idle")
+	hub.mu.Unlock()
+	assert.False(t, hub.Presence[docID]["watcher"].Idle)
+}
+
+func TestSaveDirtyNeverRecreatesDeletedDocument(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	hub := NewHub(db)
+	hub.DeadLetterDir = t.TempDir()
+	docID := "e4da3b7f-bbce-4345-9d77-2c1b0a3f5e6d"
+	hub.setContent(docID, []byte(`{"ops":[{"insert":"orphaned\n"}]}`))
+	hub.DirtyDocs[docID] = true
+
+	// The document was deleted while its room was open: the update matches
+	// nothing, and nothing may insert it again.
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE documents SET content").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	hub.saveDirty()
+
+	assert.False(t, hub.IsDirty(docID), "not retried")
+	assert.Empty(t, hub.saveFailures, "not counted as a failure")
+	entries, err := os.ReadDir(hub.DeadLetterDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "not dead-lettered")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAutoSaveRecordsLastUpdatesEditor(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	hub := NewHub(db)
+	docID := "45c48cce-2e2d-4fbd-b0b8-3e1f5d6a7b8c"
+	content := []byte(`{"ops":[{"insert":"both wrote\n"}]}`)
+	hub.mu.Lock()
+	hub.setContent(docID, content)
+	hub.DirtyDocs[docID] = true
+	hub.recordEditor(docID, "user2")
+	hub.recordEditor(docID, "user3")
+	hub.recordEditor(docID, "user2")
+	hub.mu.Unlock()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE documents SET content").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("INSERT INTO document_revisions").
+		WillReturnRows(sqlmock.NewRows([]string{"revision"}).AddRow(1))
+	mock.ExpectCommit()
+	// Of several editors since the last save, the one whose update came last is recorded.
+	mock.ExpectQuery("last_editor_id = COALESCE\\(\\$3::uuid, last_editor_id\\)").
+		WithArgs(docID, sqlmock.AnyArg(), "user2").
+		WillReturnRows(sqlmock.NewRows([]string{"updated_at", "owner_id", "title"}).AddRow(time.Now(), "user1", "Doc"))
+	mock.ExpectExec("INSERT INTO notifications").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	go func() {
+		for range hub.Broadcast {
+		}
+	}()
+	hub.saveDirty()
+
+	assert.False(t, hub.IsDirty(docID))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+type fakeComments []model.CommentResponse
+
+func (f fakeComments) GetComments(docID string) ([]model.CommentResponse, error) {
+	return f, nil
+}
+
+func TestCommentsSnapshotGoesOnlyToRequester(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+
+	hub := NewHub(db)
+	hub.Comments = fakeComments{{ID: "c1", UserID: "user1", CommentRequest: model.CommentRequest{Content: "Typo here"}}}
+	go hub.Run()
+	wsURL := newTestServer(t, hub)
+
+	docID := "1f0e3dad-9990-4734-8a3b-5c6d7e8f9a0b"
+	expectJoin(mock, docID, "user1", "user1")
+	expectJoin(mock, docID, "user2", "user1")
+	mock.ExpectQuery("SELECT content FROM documents WHERE id = \\$1").
+		WithArgs(docID).
+		WillReturnRows(sqlmock.NewRows([]string{"content"}).AddRow([]byte(`{"ops":[]}`)))
+
+	other, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+docID+"&user_id=user1", nil)
+	require.NoError(t, err)
+	defer other.Close()
+	_ = readMessageOfType(t, other, MetadataType)
+
+	requester, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+docID+"&user_id=user2", nil)
+	require.NoError(t, err)
+	defer requester.Close()
+	_ = readMessageOfType(t, requester, MetadataType)
+
+	require.NoError(t, requester.WriteJSON(WSMessage{Type: CommentsSnapshotType}))
+	var comments []model.CommentResponse
+	require.NoError(t, json.Unmarshal(readMessageOfType(t, requester, CommentsSnapshotType).Payload, &comments))
+	require.Len(t, comments, 1)
+	assert.Equal(t, "Typo here", comments[0].Content)
+
+	// The other client sees presence traffic at most, never the snapshot.
+	other.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	for {
+		_, p, err := other.ReadMessage()
+		if err != nil {
+			break
+		}
+		var msg WSMessage
+		require.NoError(t, json.Unmarshal(p, &msg))
+		assert.NotEqual(t, CommentsSnapshotType, msg.Type)
+	}
+}
+
+func TestReviewerOnlyCommentsSkipReaders(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+
+	hub := NewHub(db)
+	go hub.Run()
+	wsURL := newTestServer(t, hub)
+
+	docID := "5e6f7a8b-9c0d-4e1f-8a2b-3c4d5e6f7a8b"
+	expectJoin(mock, docID, "user1", "user1")
+	mock.ExpectQuery("SELECT owner_id, title FROM documents WHERE id = \\$1").
+		WithArgs(docID).
+		WillReturnRows(sqlmock.NewRows([]string{"owner_id", "title"}).AddRow("user1", "Test Doc"))
+	mock.ExpectQuery("SELECT role FROM collaborators WHERE document_id = \\$1 AND user_id = \\$2").
+		WithArgs(docID, "user2").
+		WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(RoleReader))
+	mock.ExpectExec("INSERT INTO document_access").WithArgs(docID, "user2").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT content FROM documents WHERE id = \\$1").
+		WithArgs(docID).
+		WillReturnRows(sqlmock.NewRows([]string{"content"}).AddRow([]byte(`{"ops":[]}`)))
+
+	writer, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+docID+"&user_id=user1", nil)
+	require.NoError(t, err)
+	defer writer.Close()
+	_ = readMessageOfType(t, writer, MetadataType)
+
+	reader, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+docID+"&user_id=user2", nil)
+	require.NoError(t, err)
+	defer reader.Close()
+	_ = readMessageOfType(t, reader, MetadataType)
+
+	hub.Broadcast <- WSMessage{Type: CommentType, DocID: docID, UserID: "user3", Payload: json.RawMessage(`{"id":"c1","visibility":"reviewers"}`)}
+	hub.Broadcast <- WSMessage{Type: CommentType, DocID: docID, UserID: "user3", Payload: json.RawMessage(`{"id":"c2","visibility":"everyone"}`)}
+
+	assert.JSONEq(t, `{"id":"c1","visibility":"reviewers"}`, string(readMessageOfType(t, writer, CommentType).Payload))
+	assert.JSONEq(t, `{"id":"c2","visibility":"everyone"}`, string(readMessageOfType(t, writer, CommentType).Payload))
+	assert.JSONEq(t, `{"id":"c2","visibility":"everyone"}`, string(readMessageOfType(t, reader, CommentType).Payload), "the reviewer-only comment never reaches the reader")
+}
+
+// fakeCommentAdder stores comments in memory, refusing those marked "refuse".
+type fakeCommentAdder struct {
+	mu    sync.Mutex
+	added []model.CommentRequest
+}
+
+func (f *fakeCommentAdder) AddComment(userID string, req model.CommentRequest) (*model.CommentResponse, error) {
+	if req.Content == "refuse" {
+		return nil, apperr.New(http.StatusForbidden, "forbidden", "your role cannot comment")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.added = append(f.added, req)
+	return &model.CommentResponse{ID: "c" + strconv.Itoa(len(f.added)), UserID: userID, CommentRequest: req}, nil
+}
+
+func TestCommentOverSocketIsStoredAndAcked(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+
+	hub := NewHub(db)
+	adder := &fakeCommentAdder{}
+	hub.CommentAdder = adder
+	go hub.Run()
+	wsURL := newTestServer(t, hub)
+
+	docID := "7c8d9e0f-1a2b-4c3d-8e4f-5a6b7c8d9e0f"
+	expectJoin(mock, docID, "user1", "user1")
+	mock.ExpectQuery("SELECT content FROM documents WHERE id = \\$1").
+		WithArgs(docID).
+		WillReturnRows(sqlmock.NewRows([]string{"content"}).AddRow([]byte(`{"ops":[]}`)))
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+docID+"&user_id=user1", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	_ = readMessageOfType(t, conn, MetadataType)
+
+	require.NoError(t, conn.WriteJSON(WSMessage{Type: CommentType, DocID: "spoofed", Payload: json.RawMessage(`{"client_id":"tmp-1","content":"Typo here"}`)}))
+	var ack CommentAckPayload
+	require.NoError(t, json.Unmarshal(readMessageOfType(t, conn, CommentAckType).Payload, &ack))
+	assert.Equal(t, "tmp-1", ack.ClientID)
+	assert.Empty(t, ack.Error)
+	require.NotNil(t, ack.Comment)
+	assert.Equal(t, "c1", ack.Comment.ID)
+	assert.Equal(t, docID, ack.Comment.DocID)
+
+	require.NoError(t, conn.WriteJSON(WSMessage{Type: CommentType, Payload: json.RawMessage(`{"client_id":"tmp-2","content":"refuse"}`)}))
+	ack = CommentAckPayload{}
+	require.NoError(t, json.Unmarshal(readMessageOfType(t, conn, CommentAckType).Payload, &ack))
+	assert.Equal(t, "tmp-2", ack.ClientID)
+	assert.Nil(t, ack.Comment)
+	assert.Equal(t, "your role cannot comment", ack.Error)
+
+	adder.mu.Lock()
+	defer adder.mu.Unlock()
+	require.Len(t, adder.added, 1)
+	assert.Equal(t, "Typo here", adder.added[0].Content)
+}
+
+func TestDeniedCommentIsAckedWithError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+
+	hub := NewHub(db)
+	adder := &fakeCommentAdder{}
+	hub.CommentAdder = adder
+	go hub.Run()
+	wsURL := newTestServer(t, hub)
+
+	docID := "7c8d9e0f-1a2b-4c3d-8e4f-5a6b7c8d9e0f"
+	expectJoin(mock, docID, "user1", "user1")
+	mock.ExpectQuery("SELECT content FROM documents WHERE id = \\$1").
+		WithArgs(docID).
+		WillReturnRows(sqlmock.NewRows([]string{"content"}).AddRow([]byte(`{"ops":[]}`)))
+
+	// View-only connections act as readers, who may not comment.
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+docID+"&user_id=user1&mode=view", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	_ = readMessageOfType(t, conn, MetadataType)
+
+	require.NoError(t, conn.WriteJSON(WSMessage{Type: CommentType, Payload: json.RawMessage(`{"client_id":"tmp-1","content":"Typo here"}`)}))
+	var ack CommentAckPayload
+	require.NoError(t, json.Unmarshal(readMessageOfType(t, conn, CommentAckType).Payload, &ack))
+	assert.Equal(t, "tmp-1", ack.ClientID)
+	assert.Nil(t, ack.Comment)
+	assert.Equal(t, "your role cannot comment", ack.Error)
+
+	adder.mu.Lock()
+	defer adder.mu.Unlock()
+	assert.Empty(t, adder.added, "nothing reaches the comment store")
+}
+
+func TestSaveMovesOpenCommentRanges(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	hub := NewHub(db)
+	docID := "2b3c4d5e-6f7a-4b8c-9d0e-1f2a3b4c5d6e"
+	created := time.Now().Add(-time.Minute)
+	hub.mu.Lock()
+	hub.recordAnchorEdit(docID, []byte(`{"ops":[{"insert":"Hello world\n"}]}`), []byte(`{"ops":[{"insert":"Oh, hello world\n"}]}`))
+	edits := hub.takeAnchorEdits(docID)
+	hub.mu.Unlock()
+	require.Len(t, edits, 1)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, text_range, created_at FROM comments (.+) FOR UPDATE").
+		WithArgs(docID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "text_range", "created_at"}).
+			AddRow("before", `{"index":6,"length":5}`, created).
+			AddRow("newer", `{"index":10,"length":5}`, time.Now().Add(time.Minute)))
+	mock.ExpectExec("UPDATE comments SET text_range = \\$1 WHERE id = \\$2").
+		WithArgs(`{"index":10,"length":5}`, "before").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	hub.shiftCommentRanges(docID, edits)
+	assert.NoError(t, mock.ExpectationsWereMet(), "only the comment made before the edit moves")
+}
+
+func TestCommentVisibleTo(t *testing.T) {
+	assert.True(t, CommentVisibleTo(RoleReader, model.VisibilityEveryone))
+	assert.False(t, CommentVisibleTo(RoleReader, model.VisibilityReviewers))
+	assert.True(t, CommentVisibleTo(RoleWriter, model.VisibilityReviewers))
+	assert.True(t, CommentVisibleTo(RoleReviewer, model.VisibilityReviewers))
+}
+
+func TestPresencePayloadCapsLargeRooms(t *testing.T) {
+	now := time.Now()
+	statuses := make([]UserStatus, 5)
+	for i := range statuses {
+		statuses[i] = UserStatus{UserID: "u" + strconv.Itoa(i), LastSeen: now.Add(time.Duration(i) * time.Second)}
+	}
+
+	for _, max := range []int{5, 0} {
+		full := roomPresence(statuses, max)
+		assert.Equal(t, 5, full.Total)
+		assert.Len(t, full.Users, 5, "rooms at the cap, or with no cap, list everyone")
+	}
+
+	capped := roomPresence(statuses, 2)
+	assert.Equal(t, 5, capped.Total)
+	require.Len(t, capped.Users, 2)
+	assert.Equal(t, "u4", capped.Users[0].UserID, "most recently active first")
+	assert.Equal(t, "u3", capped.Users[1].UserID)
+}
+
+func TestAppendToOpenRoomIsRelayed(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+
+	hub := NewHub(db)
+	hub.DeadLetterDir = t.TempDir() // The room's close-save has no mocked query
+	go hub.Run()
+	wsURL := newTestServer(t, hub)
+
+	docID := "a1b2c3d4-e5f6-4789-8abc-def012345678"
+	expectJoin(mock, docID, "user1", "user1")
+	mock.ExpectQuery("SELECT content FROM documents WHERE id = \\$1").
+		WithArgs(docID).
+		WillReturnRows(sqlmock.NewRows([]string{"content"}).AddRow([]byte(`{"ops":[{"insert":"Agenda\n"}]}`)))
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+docID+"&user_id=user1", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	_ = readMessageOfType(t, conn, UpdateType)
+
+	accept := func([]byte) error { return nil }
+	content, err := hub.Append(docID, "bot", delta.Delta{Ops: []delta.Op{{Insert: "Notes"}}}, accept)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"ops":[{"insert":"Agenda\nNotes\n"}]}`, string(content))
+	assert.JSONEq(t, string(content), string(readMessageOfType(t, conn, UpdateType).Payload))
+	assert.True(t, hub.IsDirty(docID), "left for auto-save")
+
+	// A rejected result leaves the document alone.
+	_, err = hub.Append(docID, "bot", delta.Delta{Ops: []delta.Op{{Insert: "more"}}}, func([]byte) error { return assert.AnError })
+	assert.ErrorIs(t, err, assert.AnError)
+	cached, _ := hub.GetCachedContent(docID)
+	assert.JSONEq(t, string(content), string(cached))
+
+	conn.Close()
+	waitForRoomClosed(t, hub, docID)
+}
+
+// gatedStore is an in-memory ContentStore whose first load of gated waits
+// for release.
+type gatedStore struct {
+	mu      sync.Mutex
+	content map[string][]byte
+	gated   string
+	loading chan struct{}
+	release chan struct{}
+}
+
+func (s *gatedStore) Load(docID string) ([]byte, error) {
+	s.mu.Lock()
+	wait := docID == s.gated
+	if wait {
+		s.gated = ""
+	}
+	s.mu.Unlock()
+	if wait {
+		s.loading <- struct{}{}
+		<-s.release
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.content[docID], nil
+}
+
+func (s *gatedStore) Save(docID string, content []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.content[docID] = content
+	return nil
+}
+
+func (s *gatedStore) LoadRevision(string, int64) ([]byte, error) { return nil, nil }
+
+func TestAppendToClosedRoomLeavesRunFree(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+
+	closedDoc := "0d6f4c3a-8a27-4c1e-9f0a-3b5e2d7c9a10"
+	openDoc := "6e1d2c3b-4a59-4867-9c8b-7a6f5e4d3c2b"
+	store := &gatedStore{
+		content: map[string][]byte{
+			closedDoc: []byte(`{"ops":[{"insert":"Agenda\n"}]}`),
+			openDoc:   []byte(`{"ops":[{"insert":"Other\n"}]}`),
+		},
+		gated:   closedDoc,
+		loading: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	hub := NewHub(db)
+	hub.Content = store
+	go hub.Run()
+	wsURL := newTestServer(t, hub)
+
+	mock.ExpectQuery("UPDATE documents SET preview").
+		WithArgs(closedDoc, sqlmock.AnyArg(), "bot").
+		WillReturnRows(sqlmock.NewRows([]string{"updated_at", "owner_id", "title"}).AddRow(time.Now(), "user1", "Test Doc"))
+	type result struct {
+		content []byte
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		content, err := hub.Append(closedDoc, "bot", delta.Delta{Ops: []delta.Op{{Insert: "Notes"}}}, func([]byte) error { return nil })
+		done <- result{content, err}
+	}()
+	<-store.loading
+
+	// Run keeps serving other rooms while the stored copy is loaded.
+	expectJoin(mock, openDoc, "user1", "user1")
+	other, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+openDoc+"&user_id=user1", nil)
+	require.NoError(t, err)
+	defer other.Close()
+	assert.JSONEq(t, `{"ops":[{"insert":"Other\n"}]}`, string(readMessageOfType(t, other, UpdateType).Payload))
+
+	// A join meanwhile waits, and opens on the appended content.
+	expectJoin(mock, closedDoc, "user1", "user1")
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+closedDoc+"&user_id=user1", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	close(store.release)
+
+	res := <-done
+	require.NoError(t, res.err)
+	want := `{"ops":[{"insert":"Agenda\nNotes\n"}]}`
+	assert.JSONEq(t, want, string(res.content))
+	assert.JSONEq(t, want, string(readMessageOfType(t, conn, UpdateType).Payload))
+	store.mu.Lock()
+	assert.JSONEq(t, want, string(store.content[closedDoc]))
+	store.mu.Unlock()
+}
+
+func TestRelayDropsLaggingClientWithoutBlocking(t *testing.T) {
+	hub := NewHub(nil)
+	docID := "5d41402a-bc4b-4a76-b971-9d911017c592"
+	sender := &Client{Hub: hub, DocID: docID, UserID: "user1", Send: make(chan []byte, 1)}
+	lagging := &Client{Hub: hub, DocID: docID, UserID: "user2", Send: make(chan []byte)}
+	hub.Rooms[docID] = map[*Client]bool{sender: true, lagging: true}
+	hub.Presence[docID] = map[string]UserStatus{"user1": {UserID: "user1"}, "user2": {UserID: "user2"}}
+	hub.trackUser(sender)
+	hub.trackUser(lagging)
+
+	// Run isn't running, so a send on Unregister would block forever.
+	done := make(chan struct{})
+	go func() {
+		hub.relay(WSMessage{Type: CursorType, DocID: docID, UserID: "user1", Payload: json.RawMessage(`{"index":0,"length":0}`)})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("relay blocked on a lagging client")
+	}
+
+	assert.False(t, hub.IsUserInRoom(docID, "user2"))
+	assert.NotContains(t, hub.Presence[docID], "user2")
+	_, open := <-lagging.Send
+	assert.False(t, open, "Send is closed so writePump ends")
+}
+
+func TestAppendToClosedRoomResetsSaveDedup(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	docID := "c4ca4238-a0b9-4382-8dcc-509a6f75849b"
+	saved := []byte(`{"ops":[{"insert":"Draft\n"}]}`)
+	hub := NewHub(db)
+	hub.Content = &gatedStore{content: map[string][]byte{docID: saved}}
+	go hub.Run()
+
+	claimed, _ := hub.ClaimSave(docID, saved)
+	require.True(t, claimed)
+	mock.ExpectQuery("UPDATE documents SET preview").
+		WillReturnRows(sqlmock.NewRows([]string{"updated_at", "owner_id", "title"}).AddRow(time.Now(), "user1", "Test Doc"))
+	_, err = hub.Append(docID, "bot", delta.Delta{Ops: []delta.Op{{Insert: "Notes"}}}, func([]byte) error { return nil })
+	require.NoError(t, err)
+
+	claimed, _ = hub.ClaimSave(docID, saved)
+	assert.True(t, claimed, "saving the pre-append content again is a change")
+}
+
+func TestInvalidUpdateLeavesCacheAlone(t *testing.T) {
+	hub := NewHub(nil)
+	docID := "b6d767d2-f8ed-4a1c-9e0f-7a8b9c0d1e2f"
+	original := []byte(`{"ops":[{"insert":"keep me\n"}]}`)
+	hub.setContent(docID, original)
+	go hub.Run()
+
+	hub.MaxContentChars = 20
+	for _, payload := range []string{`{"ops":[{"insert":"cut off`, `null`, `{"text":"no ops"}`, `{"ops":[{"bogus":3}]}`, `{"ops":[{"insert":42}]}`, `"text"`, `{"ops":[{"insert":"well past twenty characters\n"}]}`, `{"ops":[{"retain":5},{"delete":3}]}`, `{"ops":[{"retain":4},{"insert":"!"}]}`} {
+		hub.Broadcast <- WSMessage{Type: UpdateType, DocID: docID, UserID: "u1", Payload: json.RawMessage(payload)}
+	}
+	// Run handles messages in order, so once this is taken the updates are done.
+	hub.Broadcast <- WSMessage{Type: HeartbeatType, DocID: docID, UserID: "u1"}
+
+	cached, _ := hub.GetCachedContent(docID)
+	assert.Equal(t, original, cached)
+	assert.False(t, hub.IsDirty(docID))
+}
+
+func TestUserRegistrySpansRooms(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+
+	hub := NewHub(db)
+	go hub.Run()
+	wsURL := newTestServer(t, hub)
+
+	docA := "c4ca4238-a0b9-4382-8dcc-509a6f75849b"
+	docB := "c81e728d-9d4c-4f63-8e7a-1b2c3d4e5f60"
+	for _, docID := range []string{docA, docB} {
+		expectJoin(mock, docID, "user1", "user1")
+		mock.ExpectQuery("SELECT content FROM documents WHERE id = \\$1").
+			WithArgs(docID).
+			WillReturnRows(sqlmock.NewRows([]string{"content"}).AddRow([]byte(`{"ops":[]}`)))
+	}
+
+	var conns []*websocket.Conn
+	for _, docID := range []string{docA, docB} {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+docID+"&user_id=user1", nil)
+		require.NoError(t, err)
+		defer conn.Close()
+		_ = readMessageOfType(t, conn, MetadataType)
+		conns = append(conns, conn)
+	}
+	assert.Equal(t, 2, hub.UserRoomCount("user1"))
+
+	n, err := hub.NotifyUser("user1", WSMessage{Type: "ACCOUNT", Payload: json.RawMessage(`{"plan":"pro"}`)})
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	for _, conn := range conns {
+		assert.JSONEq(t, `{"plan":"pro"}`, string(readMessageOfType(t, conn, "ACCOUNT").Payload))
+	}
+
+	assert.Equal(t, 2, hub.DisconnectUser("", "user1", CloseRemovedByOwner, "account deleted"))
+	require.Eventually(t, func() bool { return hub.UserRoomCount("user1") == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestPrewarmedRoomOpensWithoutLoading(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	hub := NewHub(db)
+	go hub.Run()
+	wsURL := newTestServer(t, hub)
+
+	docID := "eccbc87e-4b5c-4e2f-9a1d-0c3b2a190807"
+	mock.ExpectQuery("SELECT owner_id, title FROM documents WHERE id = \\$1").
+		WithArgs(docID).
+		WillReturnRows(sqlmock.NewRows([]string{"owner_id", "title"}).AddRow("user1", "Warm Doc"))
+	mock.ExpectQuery("SELECT content FROM documents WHERE id = \\$1").
+		WithArgs(docID).
+		WillReturnRows(sqlmock.NewRows([]string{"content"}).AddRow([]byte(`{"ops":[{"insert":"Ready\n"}]}`)))
+	require.NoError(t, hub.Prewarm(docID))
+
+	// Joining reads neither the owner nor the content again.
+	mock.ExpectExec("INSERT INTO document_access").WithArgs(docID, "user1").WillReturnResult(sqlmock.NewResult(0, 1))
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+docID+"&user_id=user1", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.JSONEq(t, `{"ops":[{"insert":"Ready\n"}]}`, string(readMessageOfType(t, conn, UpdateType).Payload))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSweepReclaimsAbandonedPrewarm(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	hub := NewHub(db)
+	docID := "a87ff679-a2f3-4e71-9181-a67b7542122c"
+	mock.ExpectQuery("SELECT owner_id, title FROM documents WHERE id = \\$1").
+		WithArgs(docID).
+		WillReturnRows(sqlmock.NewRows([]string{"owner_id", "title"}).AddRow("user1", "Warm Doc"))
+	mock.ExpectQuery("SELECT content FROM documents WHERE id = \\$1").
+		WithArgs(docID).
+		WillReturnRows(sqlmock.NewRows([]string{"content"}).AddRow([]byte(`{"ops":[]}`)))
+	require.NoError(t, hub.Prewarm(docID))
+
+	hub.sweepOrphans()
+	_, cached := hub.GetCachedContent(docID)
+	assert.True(t, cached, "kept while the join may still come")
+
+	hub.mu.Lock()
+	hub.prewarmed[docID] = time.Now().Add(-PrewarmTTL)
+	hub.mu.Unlock()
+	hub.sweepOrphans()
+	_, cached = hub.GetCachedContent(docID)
+	assert.False(t, cached)
+	_, _, cached = hub.DocMeta(docID)
+	assert.False(t, cached)
+}
+
+func TestEmptiedRoomReopensFromCache(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+
+	hub := NewHub(db)
+	hub.EmptyRoomGrace = time.Minute
+	go hub.Run()
+	wsURL := newTestServer(t, hub)
+
+	docID := "9a8b7c6d-5e4f-4a3b-8c2d-1e0f9a8b7c6d"
+	content := `{"ops":[{"insert":"Draft\n"}]}`
+	expectJoin(mock, docID, "user1", "user1")
+	mock.ExpectQuery("SELECT content FROM documents WHERE id = \\$1").
+		WithArgs(docID).
+		WillReturnRows(sqlmock.NewRows([]string{"content"}).AddRow([]byte(content)))
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+docID+"&user_id=user1", nil)
+	require.NoError(t, err)
+	_ = readMessageOfType(t, conn, UpdateType)
+	conn.Close()
+	require.Eventually(t, func() bool { return hub.RoomSize(docID) == 0 }, time.Second, 10*time.Millisecond)
+
+	_, cached := hub.GetCachedContent(docID)
+	assert.True(t, cached, "kept through the grace period")
+	hub.sweepOrphans()
+	_, cached = hub.GetCachedContent(docID)
+	assert.True(t, cached, "not swept before the grace period ends")
+
+	// Reopening needs neither the document row nor its content.
+	mock.ExpectExec("INSERT INTO document_access").WithArgs(docID, "user1").WillReturnResult(sqlmock.NewResult(0, 1))
+	conn, _, err = websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+docID+"&user_id=user1", nil)
+	require.NoError(t, err)
+	assert.JSONEq(t, content, string(readMessageOfType(t, conn, UpdateType).Payload))
+	conn.Close()
+	require.Eventually(t, func() bool { return hub.RoomSize(docID) == 0 }, time.Second, 10*time.Millisecond)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	hub.mu.Lock()
+	hub.prewarmed[docID] = time.Now()
+	hub.mu.Unlock()
+	hub.sweepOrphans()
+	_, cached = hub.GetCachedContent(docID)
+	assert.False(t, cached, "reclaimed once the grace period is over")
+}
+
+func TestRepeatedSaveIsNotWrittenAgain(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	hub := NewHub(db)
+	docID := "1679091c-5a88-4faf-afb5-e6087eb1b2dc"
+	content := []byte(`{"ops":[{"insert":"same\n"}]}`)
+
+	claimed, undo := hub.ClaimSave(docID, content)
+	require.True(t, claimed)
+	claimed, _ = hub.ClaimSave(docID, content)
+	assert.False(t, claimed, "identical save in flight")
+	undo() // The first save failed.
+	claimed, _ = hub.ClaimSave(docID, content)
+	require.True(t, claimed, "retried after a failure")
+
+	// The REST save's broadcast leaves the room dirty with what was just
+	// stored; auto-save must not write it again.
+	hub.setContent(docID, content)
+	hub.DirtyDocs[docID] = true
+	hub.saveDirty()
+
+	assert.False(t, hub.IsDirty(docID))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestReconnectReplacesStaleConnection(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+
+	hub := NewHub(db)
+	go hub.Run()
+	wsURL := newTestServer(t, hub)
+
+	docID := "8f14e45f-ceea-4e7a-9a1b-2c3d4e5f6a7b"
+	expectJoin(mock, docID, "user1", "user1")
+	mock.ExpectQuery("SELECT content FROM documents WHERE id = \\$1").
+		WithArgs(docID).
+		WillReturnRows(sqlmock.NewRows([]string{"content"}).AddRow([]byte(`{"ops":[]}`)))
+	mock.ExpectExec("INSERT INTO document_access").WithArgs(docID, "user1").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	stale, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+docID+"&user_id=user1", nil)
+	require.NoError(t, err)
+	defer stale.Close()
+	var session SessionPayload
+	require.NoError(t, json.Unmarshal(readMessageOfType(t, stale, SessionType).Payload, &session))
+
+	// The network drops without a close: the stale connection is still
+	// registered when the client comes back with its resume token.
+	fresh, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+docID+"&user_id=user1&resume="+session.ResumeToken+"&revision="+strconv.FormatInt(session.Revision, 10), nil)
+	require.NoError(t, err)
+	defer fresh.Close()
+	_ = readMessageOfType(t, fresh, ResumedType)
+
+	stale.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err := stale.ReadMessage(); err != nil {
+			break // Closed by the server
+		}
+	}
+	assert.Equal(t, 1, hub.RoomSize(docID))
+	statuses := readPresence(t, fresh, 1)
+	assert.Equal(t, 1, statuses[0].ConnectionCount)
+
+	// A later tab without the token is another connection, not a reconnect.
+	mock.ExpectExec("INSERT INTO document_access").WithArgs(docID, "user1").WillReturnResult(sqlmock.NewResult(0, 1))
+	tab, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+docID+"&user_id=user1", nil)
+	require.NoError(t, err)
+	defer tab.Close()
+	_ = readMessageOfType(t, tab, SessionType)
+	assert.Equal(t, 2, hub.RoomSize(docID))
+}
+
+func TestResumeComparesTheRevisionTheClientReceived(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+
+	hub := NewHub(db)
+	hub.DeadLetterDir = t.TempDir() // The final save on close fails once db is closed
+	go hub.Run()
+	wsURL := newTestServer(t, hub)
+
+	docID := "c4ca4238-a0b9-4382-8dcc-509a6f75849b"
+	for i := 0; i < 2; i++ {
+		expectJoin(mock, docID, "user1", "user1")
+		expectJoin(mock, docID, "user2", "user1")
+	}
+	mock.ExpectQuery("SELECT content FROM documents WHERE id = \\$1").
+		WithArgs(docID).
+		WillReturnRows(sqlmock.NewRows([]string{"content"}).AddRow([]byte(`{"ops":[]}`)))
+
+	dial := func(query string) (*websocket.Conn, SessionPayload) {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+docID+query, nil)
+		require.NoError(t, err)
+		var session SessionPayload
+		require.NoError(t, json.Unmarshal(readMessageOfType(t, conn, SessionType).Payload, &session))
+		return conn, session
+	}
+	reader, readerSession := dial("&user_id=user1")
+	writer, writerSession := dial("&user_id=user2")
+	readPresence(t, reader, 2)
+
+	for i, text := range []string{"one", "two"} {
+		update, _ := json.Marshal(WSMessage{Type: UpdateType, Payload: json.RawMessage(`{"ops":[{"insert":"` + text + `\n"}]}`)})
+		require.NoError(t, writer.WriteMessage(websocket.TextMessage, update))
+		assert.Equal(t, int64(i+1), readMessageOfType(t, reader, UpdateType).Revision)
+	}
+
+	// The reader lost revision 2 with its network; it gets the document again.
+	reader2, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+docID+"&user_id=user1&resume="+readerSession.ResumeToken+"&revision=1", nil)
+	require.NoError(t, err)
+	resent := readMessage(t, reader2)
+	require.Equal(t, UpdateType, resent.Type, "sent before SESSION, in place of RESUMED")
+	assert.JSONEq(t, `{"ops":[{"insert":"two\n"}]}`, string(resent.Payload))
+
+	// The writer never sees its own UPDATEs echoed, but it sent the latest,
+	// which holds the whole document.
+	writer2, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+docID+"&user_id=user2&resume="+writerSession.ResumeToken+"&revision=0", nil)
+	require.NoError(t, err)
+	_ = readMessageOfType(t, writer2, ResumedType)
+
+	for _, conn := range []*websocket.Conn{reader, writer, reader2, writer2} {
+		conn.Close()
+	}
+	waitForRoomClosed(t, hub, docID)
+}
+
+func TestDisconnectReasonKeepsTheFirstCause(t *testing.T) {
+	c := &Client{}
+	c.setDisconnectReason(DisconnectKicked)
+	// Closing the connection then fails the read pump.
+	c.setDisconnectReason(readErrorReason(&websocket.CloseError{Code: websocket.CloseAbnormalClosure}))
+	assert.Equal(t, DisconnectKicked, *c.disconnectReason.Load())
+
+	assert.Equal(t, DisconnectNormal, readErrorReason(&websocket.CloseError{Code: websocket.CloseGoingAway}))
+	assert.Equal(t, DisconnectError, readErrorReason(&websocket.CloseError{Code: websocket.CloseAbnormalClosure}))
+	assert.Equal(t, DisconnectTooLarge, readErrorReason(websocket.ErrReadLimit))
+}
+
+func TestDashboardEventsAreDebouncedAndScoped(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	hub := NewHub(db)
+	hub.DashboardDebounce = 50 * time.Millisecond
+	go hub.Run()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeDashboard(hub, w, r, r.URL.Query().Get("user_id"))
+	}))
+	defer server.Close()
+	dial := func(userID string) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?user_id="+userID, nil)
+		require.NoError(t, err)
+		return conn
+	}
+	writer, reader := dial("user2"), dial("user3")
+	defer writer.Close()
+	defer reader.Close()
+	require.Eventually(t, func() bool {
+		hub.mu.Lock()
+		defer hub.mu.Unlock()
+		return len(hub.dashboards) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	docID := "9c5b94b1-35ad-49bb-b118-8e8fc24abf80"
+	audience := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"user_id", "role"}).
+			AddRow("user1", "owner").AddRow("user2", RoleWriter).AddRow("user3", RoleReader)
+	}
+	readEvent := func(conn *websocket.Conn) DashboardPayload {
+		var event DashboardPayload
+		require.NoError(t, json.Unmarshal(readMessageOfType(t, conn, DashboardType).Payload, &event))
+		return event
+	}
+
+	// Two renames within the window reach each member once.
+	mock.ExpectQuery("SELECT owner_id, 'owner' FROM documents").WithArgs(docID).WillReturnRows(audience())
+	hub.Broadcast <- WSMessage{Type: MetadataType, DocID: docID, Payload: json.RawMessage(`{"title":"A"}`)}
+	hub.Broadcast <- WSMessage{Type: MetadataType, DocID: docID, Payload: json.RawMessage(`{"title":"B"}`)}
+	assert.Equal(t, DashboardPayload{DocID: docID, Event: DashboardUpdated}, readEvent(writer))
+	assert.Equal(t, DashboardPayload{DocID: docID, Event: DashboardUpdated}, readEvent(reader))
+
+	// A reviewer-only comment is not announced to readers.
+	mock.ExpectQuery("SELECT owner_id, 'owner' FROM documents").WithArgs(docID).WillReturnRows(audience())
+	hub.Broadcast <- WSMessage{Type: CommentType, DocID: docID, UserID: "user1", Payload: json.RawMessage(`{"visibility":"reviewers"}`)}
+	assert.Equal(t, DashboardPayload{DocID: docID, Event: DashboardComment}, readEvent(writer))
+
+	hub.NotifyDashboard("user3", "other-doc", DashboardInvited)
+	assert.Equal(t, DashboardPayload{DocID: "other-doc", Event: DashboardInvited}, readEvent(reader))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRangeClaimsFollowEditsAndExpire(t *testing.T) {
+	hub := NewHub(nil)
+	docID := "9c5b94b1-35ad-49bb-b118-8e8fc24abf80"
+	hub.setContent(docID, []byte(`{"ops":[{"insert":"Hello world\n"}]}`))
+	claim := func(userID, payload string) bool {
+		return hub.applyRangeClaim(WSMessage{Type: LockRangeType, DocID: docID, UserID: userID, Payload: json.RawMessage(payload)})
+	}
+
+	assert.False(t, claim("user1", `{"index":6,"length":20}`), "outside the document")
+	assert.False(t, claim("user1", `{"index":6,"length":9223372036854775807}`), "the end would overflow")
+	assert.True(t, claim("user1", `{"index":6,"length":5}`))
+	assert.True(t, claim("user2", `{"index":0,"length":5}`))
+
+	// user2 types at the start; user1's claim on "world" moves with it.
+	edit, changed := hub.recordAnchorEdit(docID, []byte(`{"ops":[{"insert":"Hello world\n"}]}`), []byte(`{"ops":[{"insert":"Oh, Hello world\n"}]}`))
+	require.True(t, changed)
+	hub.shiftRangeClaims(docID, edit)
+	var claims []RangeClaim
+	require.NoError(t, json.Unmarshal(hub.rangeLocksMessage(docID).Payload, &claims))
+	require.Len(t, claims, 2)
+	assert.Equal(t, "user2", claims[0].UserID)
+	assert.Equal(t, [2]int{4, 5}, [2]int{claims[0].Index, claims[0].Length})
+	assert.Equal(t, [2]int{10, 5}, [2]int{claims[1].Index, claims[1].Length})
+
+	assert.True(t, claim("user2", `{"index":0,"length":0}`), "length 0 releases")
+	assert.False(t, claim("user2", `{"index":0,"length":0}`), "nothing left to release")
+
+	assert.Empty(t, hub.expireRangeClaims(time.Now()))
+	expired := hub.expireRangeClaims(time.Now().Add(hub.RangeLockTTL))
+	require.Len(t, expired, 1)
+	assert.JSONEq(t, `[]`, string(expired[0].Payload))
+	assert.Empty(t, hub.rangeClaims)
+}
+
+func TestRangeClaimIsReleasedWhenItsWriterLeaves(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+
+	hub := NewHub(db)
+	hub.Features = flags.Flags{flags.RangeLocks: true}
+	go hub.Run()
+	wsURL := newTestServer(t, hub)
+
+	docID := "9c5b94b1-35ad-49bb-b118-8e8fc24abf80"
+	expectJoin(mock, docID, "user1", "user1")
+	expectJoin(mock, docID, "user2", "user1")
+	mock.ExpectQuery("SELECT content FROM documents WHERE id = \\$1").
+		WithArgs(docID).
+		WillReturnRows(sqlmock.NewRows([]string{"content"}).AddRow([]byte(`{"ops":[{"insert":"Hello world\n"}]}`)))
+
+	owner, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+docID+"&user_id=user1", nil)
+	require.NoError(t, err)
+	defer owner.Close()
+	_ = readMessageOfType(t, owner, UpdateType)
+	other, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws?docId="+docID+"&user_id=user2", nil)
+	require.NoError(t, err)
+	defer other.Close()
+	_ = readMessageOfType(t, other, UpdateType)
+
+	require.NoError(t, owner.WriteJSON(WSMessage{Type: LockRangeType, Payload: json.RawMessage(`{"index":0,"length":5}`)}))
+	var claims []RangeClaim
+	require.NoError(t, json.Unmarshal(readMessageOfType(t, other, RangeLocksType).Payload, &claims))
+	require.Len(t, claims, 1)
+	assert.Equal(t, "user1", claims[0].UserID)
+
+	owner.Close()
+	require.NoError(t, json.Unmarshal(readMessageOfType(t, other, RangeLocksType).Payload, &claims))
+	assert.Empty(t, claims)
 }
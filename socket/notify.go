@@ -0,0 +1,72 @@
+package socket
+
+import (
+	"encoding/json"
+	"satunaskah/internal/notification/model"
+	"satunaskah/pkg/logger"
+	"sort"
+)
+
+// recordEditor remembers that userID changed docID since the last save.
+// Must be called with h.mu held.
+func (h *Hub) recordEditor(docID, userID string) {
+	if h.editors[docID] == nil {
+		h.editors[docID] = make(map[string]string)
+	}
+	name := h.Presence[docID][userID].DisplayName
+	if name == "" {
+		name = h.editors[docID][userID]
+	}
+	h.editors[docID][userID] = name
+	h.lastEditors[docID] = userID
+}
+
+// takeEditors returns and clears the editors recorded for docID.
+// Must be called with h.mu held.
+func (h *Hub) takeEditors(docID string) map[string]string {
+	editors := h.editors[docID]
+	delete(h.editors, docID)
+	return editors
+}
+
+// restoreEditors merges editors back after a failed save so they are reported
+// with the next successful one. Must be called with h.mu held.
+func (h *Hub) restoreEditors(docID string, editors map[string]string) {
+	for userID, name := range editors {
+		if h.editors[docID] == nil {
+			h.editors[docID] = make(map[string]string)
+		}
+		if _, ok := h.editors[docID][userID]; !ok {
+			h.editors[docID][userID] = name
+		}
+	}
+}
+
+// notifyOwnerOfEdits tells the owner that collaborators changed a document
+// they don't currently have open. At most one notification per owner and
+// document is created per OwnerNotifyInterval.
+func (h *Hub) notifyOwnerOfEdits(docID, ownerID, title string, editors map[string]string) {
+	if h.Notifications == nil || ownerID == "" {
+		return
+	}
+	payload := model.DocumentEditedPayload{Title: title}
+	for userID, name := range editors {
+		if userID != ownerID {
+			payload.Editors = append(payload.Editors, model.Editor{UserID: userID, Name: name})
+		}
+	}
+	if len(payload.Editors) == 0 || h.IsUserInRoom(docID, ownerID) {
+		return
+	}
+	sort.Slice(payload.Editors, func(i, j int) bool { return payload.Editors[i].Name < payload.Editors[j].Name })
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		logger.Sugar.Errorf("Error marshalling edit notification for doc %s: %v", docID, err)
+		return
+	}
+	created, err := h.Notifications.CreateUnlessRecent(ownerID, docID, model.TypeDocumentEdited, data, h.OwnerNotifyInterval)
+	if err == nil && created {
+		logger.Sugar.Infof("Notified owner %s of %d editor(s) on doc %s", ownerID, len(payload.Editors), docID)
+	}
+}
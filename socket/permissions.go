@@ -0,0 +1,33 @@
+package socket
+
+// permissions lists the roles allowed to send each message type, and through
+// it the matching REST actions: editing or saving content is UpdateType,
+// renaming is MetadataType and commenting (a reviewer's way to suggest
+// changes) is CommentType. Types missing here are server-only or unknown and
+// no client may send them.
+var permissions = map[string][]string{
+	UpdateType:        {RoleWriter},
+	MetadataType:      {RoleWriter},
+	CommentType:       {RoleWriter, RoleReviewer},
+	CommentUpdateType: {RoleWriter, RoleReviewer},
+	CommentDeleteType: {RoleWriter, RoleReviewer},
+	CursorType:        {RoleWriter, RoleReviewer, RoleReader},
+	JoinType:          {RoleWriter, RoleReviewer, RoleReader},
+	LeaveType:         {RoleWriter, RoleReviewer, RoleReader},
+	HeartbeatType:     {RoleWriter, RoleReviewer, RoleReader},
+	// Anyone in the room may already read comments over REST.
+	CommentsSnapshotType: {RoleWriter, RoleReviewer, RoleReader},
+	// Advisory claims only matter to those who can edit.
+	LockRangeType: {RoleWriter},
+}
+
+// CanPerform reports whether role may perform the action behind messageType,
+// over the socket or REST. Owners act as writers.
+func CanPerform(role, messageType string) bool {
+	for _, allowed := range permissions[messageType] {
+		if allowed == role {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,47 @@
+package socket
+
+import (
+	"testing"
+
+	"satunaskah/pkg/flags"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanPerformEveryRoleAndAction(t *testing.T) {
+	roles := []string{RoleWriter, RoleReviewer, RoleReader}
+	// Allowed roles per action, in the order of roles.
+	cases := map[string][3]bool{
+		UpdateType:           {true, false, false},
+		MetadataType:         {true, false, false},
+		CommentType:          {true, true, false},
+		CommentUpdateType:    {true, true, false},
+		CommentDeleteType:    {true, true, false},
+		CursorType:           {true, true, true},
+		JoinType:             {true, true, true},
+		LeaveType:            {true, true, true},
+		HeartbeatType:        {true, true, true},
+		CommentsSnapshotType: {true, true, true},
+		LockRangeType:        {true, false, false},
+		RangeLocksType:       {false, false, false},
+		PresenceUpdateType:   {false, false, false},
+		SessionType:          {false, false, false},
+		ResumedType:          {false, false, false},
+		SaveStatusType:       {false, false, false},
+		"UNKNOWN":            {false, false, false},
+	}
+	for action, want := range cases {
+		for i, role := range roles {
+			assert.Equal(t, want[i], CanPerform(role, action), "%s %s", role, action)
+		}
+	}
+	assert.False(t, CanPerform("", CursorType), "no role, no actions")
+}
+
+func TestMessageEnabledFollowsFlags(t *testing.T) {
+	hub := &Hub{Features: flags.Flags{flags.CommentsSnapshot: false}}
+	assert.False(t, hub.MessageEnabled(CommentsSnapshotType))
+	assert.True(t, hub.MessageEnabled(MetadataType), "unset flags take their default")
+	assert.True(t, hub.MessageEnabled(UpdateType), "ungated types are always on")
+	assert.False(t, hub.MessageEnabled(LockRangeType), "new features start off")
+}
@@ -0,0 +1,55 @@
+package socket
+
+import (
+	"hash/fnv"
+	"sort"
+)
+
+// DefaultMaxPresenceUsers is the largest room whose presence is broadcast in
+// full when PRESENCE_MAX_USERS is unset.
+const DefaultMaxPresenceUsers = 50
+
+// PresencePayload is the PRESENCE_UPDATE payload: the room's user count and
+// their statuses. Rooms with more users than the hub's MaxPresenceUsers list
+// only the most recently active of them, so Total exceeds len(Users).
+type PresencePayload struct {
+	Total int          `json:"total"`
+	Users []UserStatus `json:"users"`
+}
+
+// roomPresence returns statuses as broadcast to a room, capped at max users
+// (no cap when max <= 0). It may reorder statuses.
+func roomPresence(statuses []UserStatus, max int) PresencePayload {
+	if max <= 0 || len(statuses) <= max {
+		return PresencePayload{Total: len(statuses), Users: statuses}
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].LastSeen.After(statuses[j].LastSeen)
+	})
+	return PresencePayload{Total: len(statuses), Users: statuses[:max]}
+}
+
+// presencePalette holds cursor colors that stay legible on a white editor
+// background and are distinct from each other.
+var presencePalette = []string{
+	"#E53935", // red
+	"#1E88E5", // blue
+	"#43A047", // green
+	"#8E24AA", // purple
+	"#FB8C00", // orange
+	"#00897B", // teal
+	"#D81B60", // pink
+	"#3949AB", // indigo
+	"#6D4C41", // brown
+	"#00ACC1", // cyan
+	"#7CB342", // light green
+	"#5E35B1", // deep purple
+}
+
+// colorForUser returns a stable palette color derived from the user id, so
+// every viewer sees the same user in the same color across sessions.
+func colorForUser(userID string) string {
+	h := fnv.New32a()
+	h.Write([]byte(userID))
+	return presencePalette[h.Sum32()%uint32(len(presencePalette))]
+}
@@ -0,0 +1,57 @@
+package socket
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"satunaskah/pkg/delta"
+)
+
+// contentSum is the hash previewSums records for content.
+func contentSum(content []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(content)
+	return h.Sum64()
+}
+
+// previewUpdate hashes content and, when the hash differs from lastSum,
+// returns the encoded preview to store. A nil preview leaves the stored one
+// untouched, so unchanged content is never re-summarized.
+func previewUpdate(content []byte, lastSum uint64) (uint64, interface{}) {
+	sum := contentSum(content)
+	if sum == lastSum {
+		return sum, nil
+	}
+	preview, err := json.Marshal(delta.PreviewOf(content))
+	if err != nil {
+		return sum, nil
+	}
+	return sum, string(preview)
+}
+
+// ClaimSave records content as docID's saved content ahead of a REST save
+// that stores it along with its preview. It returns false when content is
+// already what was last saved, or what an identical save in flight is
+// writing, so the caller can skip the write. Call undo if the save fails.
+func (h *Hub) ClaimSave(docID string, content []byte) (claimed bool, undo func()) {
+	sum := contentSum(content)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	prev, known := h.previewSums[docID]
+	if known && prev == sum {
+		return false, func() {}
+	}
+	h.previewSums[docID] = sum
+	return true, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if h.previewSums[docID] != sum {
+			return // A later save has claimed it since.
+		}
+		if known {
+			h.previewSums[docID] = prev
+		} else {
+			delete(h.previewSums, docID)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package socket
+
+import "time"
+
+// PrewarmTTL is how long prewarmed content waits for its room to open before
+// the sweeper may reclaim it.
+const PrewarmTTL = 30 * time.Second
+
+// DefaultEmptyRoomGrace is the default Hub.EmptyRoomGrace.
+const DefaultEmptyRoomGrace = 30 * time.Second
+
+// Prewarm loads docID's content and metadata into the cache ahead of an
+// expected socket join, so the join doesn't wait on the database. Content
+// whose room never opens is reclaimed by SweepWorker after PrewarmTTL.
+// Callers check access first.
+func (h *Hub) Prewarm(docID string) error {
+	h.mu.Lock()
+	_, warm := h.prewarmed[docID]
+	open := h.Rooms[docID] != nil
+	if warm && time.Until(h.prewarmed[docID]) < PrewarmTTL {
+		h.prewarmed[docID] = time.Now().Add(PrewarmTTL)
+	}
+	h.mu.Unlock()
+	if open || warm {
+		return nil
+	}
+
+	var meta docMeta
+	if err := h.db.QueryRow("SELECT owner_id, title FROM documents WHERE id = $1", docID).Scan(&meta.OwnerID, &meta.Title); err != nil {
+		return err
+	}
+	content, err := h.Content.Load(docID)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// The room may have opened meanwhile. Content already cached, e.g. a REST
+	// save not yet written, is newer than what was just loaded.
+	if h.Rooms[docID] != nil {
+		return nil
+	}
+	if _, cached := h.cachedContent(docID); !cached {
+		h.setContent(docID, content)
+	}
+	h.docMeta[docID] = meta
+	h.prewarmed[docID] = time.Now().Add(PrewarmTTL)
+	return nil
+}
+
+// takePrewarmed returns docID's prewarmed content, or that kept since its room
+// emptied, for a room that is opening, and stops tracking it as prewarmed.
+// Must be called with h.mu held.
+func (h *Hub) takePrewarmed(docID string) ([]byte, bool) {
+	if _, warm := h.prewarmed[docID]; !warm {
+		return nil, false
+	}
+	delete(h.prewarmed, docID)
+	return h.cachedContent(docID)
+}
+
+// prewarmFresh reports whether docID's prewarmed content is still to be kept.
+// Must be called with h.mu held.
+func (h *Hub) prewarmFresh(docID string, now time.Time) bool {
+	until, warm := h.prewarmed[docID]
+	return warm && now.Before(until)
+}
@@ -0,0 +1,43 @@
+package socket
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+
+	"github.com/gorilla/websocket"
+)
+
+// ProtocolV1 is the current message protocol, negotiated through the
+// Sec-WebSocket-Protocol header.
+const ProtocolV1 = "satunaskah.v1"
+
+// SupportedProtocols are the protocol versions the server speaks, preferred
+// first. Clients that request none are treated as ProtocolV1.
+var SupportedProtocols = []string{ProtocolV1}
+
+// protocolAcceptable reports whether r requests no subprotocol or at least
+// one the server supports.
+func protocolAcceptable(r *http.Request) bool {
+	requested := websocket.Subprotocols(r)
+	if len(requested) == 0 {
+		return true
+	}
+	for _, p := range requested {
+		if slices.Contains(SupportedProtocols, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeMessage parses a frame from c according to its negotiated protocol.
+// New versions add a case here so older clients keep their behaviour.
+func (c *Client) decodeMessage(raw []byte) (WSMessage, error) {
+	var msg WSMessage
+	switch c.Protocol {
+	default: // ProtocolV1
+		err := json.Unmarshal(raw, &msg)
+		return msg, err
+	}
+}
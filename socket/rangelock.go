@@ -0,0 +1,140 @@
+package socket
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"satunaskah/pkg/delta"
+	"satunaskah/pkg/logger"
+)
+
+const (
+	// LockRangeType is sent by a writer to claim the range they are editing,
+	// {index, length}; a length of 0 drops their claim.
+	LockRangeType = "LOCK_RANGE"
+	// RangeLocksType lists a room's claims, sent on join and when they change.
+	RangeLocksType = "RANGE_LOCKS"
+)
+
+// DefaultRangeLockTTL is used when RANGE_LOCK_TTL is unset.
+const DefaultRangeLockTTL = 30 * time.Second
+
+// RangeClaim is a writer's advisory claim on part of a document. Nothing
+// stops others from editing there; clients only warn.
+type RangeClaim struct {
+	UserID      string    `json:"user_id"`
+	DisplayName string    `json:"display_name"`
+	Index       int       `json:"index"`
+	Length      int       `json:"length"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// applyRangeClaim records, renews or drops the sender's claim from a
+// LOCK_RANGE message. It reports whether the room's claims changed. Must be
+// called with h.mu held.
+func (h *Hub) applyRangeClaim(msg WSMessage) bool {
+	var sel Selection
+	err := json.Unmarshal(msg.Payload, &sel)
+	if err == nil && (sel.Index < 0 || sel.Length < 0) {
+		err = fmt.Errorf("negative range %d+%d", sel.Index, sel.Length)
+	}
+	if err == nil {
+		if length := h.docLength(msg.DocID); sel.Index > length || sel.Length > length-sel.Index {
+			err = fmt.Errorf("range %d+%d is outside the document (length %d)", sel.Index, sel.Length, length)
+		}
+	}
+	if err != nil {
+		logger.Sugar.Debugf("Dropped range claim from user %s on doc %s: %v", msg.UserID, msg.DocID, err)
+		return false
+	}
+	if sel.Length == 0 {
+		return h.releaseRangeClaim(msg.DocID, msg.UserID)
+	}
+
+	if h.rangeClaims[msg.DocID] == nil {
+		h.rangeClaims[msg.DocID] = make(map[string]RangeClaim)
+	}
+	h.rangeClaims[msg.DocID][msg.UserID] = RangeClaim{
+		UserID:      msg.UserID,
+		DisplayName: h.Presence[msg.DocID][msg.UserID].DisplayName,
+		Index:       sel.Index,
+		Length:      sel.Length,
+		ExpiresAt:   time.Now().Add(h.RangeLockTTL),
+	}
+	return true
+}
+
+// touchRangeClaim keeps userID's claim on docID alive while they edit. Must
+// be called with h.mu held.
+func (h *Hub) touchRangeClaim(docID, userID string) {
+	if claim, ok := h.rangeClaims[docID][userID]; ok {
+		claim.ExpiresAt = time.Now().Add(h.RangeLockTTL)
+		h.rangeClaims[docID][userID] = claim
+	}
+}
+
+// shiftRangeClaims moves docID's claims through an edit so they stay on the
+// text they were made on. Clients are not told; the next RANGE_LOCKS has the
+// new positions. Must be called with h.mu held.
+func (h *Hub) shiftRangeClaims(docID string, e delta.Edit) {
+	for userID, claim := range h.rangeClaims[docID] {
+		claim.Index, claim.Length = e.TransformRange(claim.Index, claim.Length)
+		h.rangeClaims[docID][userID] = claim
+	}
+}
+
+// releaseRangeClaim drops userID's claim on docID, e.g. when their last
+// connection leaves, and reports whether they had one. Must be called with
+// h.mu held.
+func (h *Hub) releaseRangeClaim(docID, userID string) bool {
+	if _, ok := h.rangeClaims[docID][userID]; !ok {
+		return false
+	}
+	delete(h.rangeClaims[docID], userID)
+	if len(h.rangeClaims[docID]) == 0 {
+		delete(h.rangeClaims, docID)
+	}
+	return true
+}
+
+// expireRangeClaims drops claims not renewed within RangeLockTTL and returns
+// the RANGE_LOCKS messages for the rooms that lost one. Must be called with
+// h.mu held.
+func (h *Hub) expireRangeClaims(now time.Time) []WSMessage {
+	var msgs []WSMessage
+	for docID, claims := range h.rangeClaims {
+		expired := false
+		for userID, claim := range claims {
+			if !now.Before(claim.ExpiresAt) {
+				delete(claims, userID)
+				expired = true
+			}
+		}
+		if len(claims) == 0 {
+			delete(h.rangeClaims, docID)
+		}
+		if expired {
+			msgs = append(msgs, h.rangeLocksMessage(docID))
+		}
+	}
+	return msgs
+}
+
+// rangeLocksMessage lists docID's claims in document order. Must be called
+// with h.mu held.
+func (h *Hub) rangeLocksMessage(docID string) WSMessage {
+	claims := make([]RangeClaim, 0, len(h.rangeClaims[docID]))
+	for _, claim := range h.rangeClaims[docID] {
+		claims = append(claims, claim)
+	}
+	sort.Slice(claims, func(i, j int) bool {
+		if claims[i].Index != claims[j].Index {
+			return claims[i].Index < claims[j].Index
+		}
+		return claims[i].UserID < claims[j].UserID
+	})
+	payload, _ := json.Marshal(claims)
+	return WSMessage{Type: RangeLocksType, DocID: docID, Payload: payload}
+}
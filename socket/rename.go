@@ -0,0 +1,89 @@
+package socket
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"satunaskah/pkg/logger"
+
+	"github.com/lib/pq"
+)
+
+// MaxTitleLength bounds document titles, in characters.
+const MaxTitleLength = 200
+
+// CleanTitle is the title rule shared by renames over the socket and REST:
+// tabs and line breaks become spaces, other control characters are dropped
+// and surrounding whitespace is trimmed. It returns the cleaned title and
+// whether it is usable, i.e. neither empty nor longer than MaxTitleLength.
+func CleanTitle(title string) (string, bool) {
+	title = strings.TrimSpace(strings.Map(func(r rune) rune {
+		switch {
+		case r == '\t' || r == '\n' || r == '\r':
+			return ' '
+		case unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, title))
+	return title, title != "" && utf8.RuneCountInString(title) <= MaxTitleLength
+}
+
+// TitleChooser applies UNIQUE_TITLES to socket renames: it returns the title
+// to store for ownerID's document docID, or an error when title is refused.
+type TitleChooser interface {
+	ChooseTitle(ownerID, docID, title string) (string, error)
+}
+
+// rename persists a title sent by c over the socket and returns the METADATA
+// message to broadcast. It runs on c's read goroutine so the database write
+// never blocks Run. The update re-checks that the user still owns or writes
+// the document, since their role may have changed since they connected.
+func (c *Client) rename(msg WSMessage) (WSMessage, bool) {
+	var meta MetadataPayload
+	if err := json.Unmarshal(msg.Payload, &meta); err != nil {
+		logger.Sugar.Warnf("Dropped malformed title change from user %s on doc %s", c.UserID, c.DocID)
+		return WSMessage{}, false
+	}
+	title, ok := CleanTitle(meta.Title)
+	if !ok {
+		logger.Sugar.Warnf("Dropped invalid title change from user %s on doc %s", c.UserID, c.DocID)
+		return WSMessage{}, false
+	}
+	if c.Hub.Titles != nil {
+		_, ownerID, _ := c.Hub.DocMeta(c.DocID)
+		var err error
+		if title, err = c.Hub.Titles.ChooseTitle(ownerID, c.DocID, title); err != nil {
+			logger.Sugar.Warnf("Dropped title change from user %s on doc %s: %v", c.UserID, c.DocID, err)
+			return WSMessage{}, false
+		}
+	}
+
+	result, err := c.Hub.db.Exec(`
+		UPDATE documents SET title = $1, updated_at = NOW()
+		WHERE id = $2 AND (owner_id = $3 OR EXISTS (
+			SELECT 1 FROM collaborators WHERE document_id = $2 AND user_id = $3 AND role = $4))`,
+		title, c.DocID, c.UserID, RoleWriter)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		// The optional unique title index caught a concurrent rename.
+		logger.Sugar.Warnf("Dropped title change from user %s on doc %s: the owner already uses that title", c.UserID, c.DocID)
+		return WSMessage{}, false
+	}
+	if err != nil {
+		logger.Sugar.Errorf("Failed to rename doc %s for user %s: %v", c.DocID, c.UserID, err)
+		return WSMessage{}, false
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		logger.Sugar.Warnf("Permission Denied: User %s can no longer rename doc %s", c.UserID, c.DocID)
+		return WSMessage{}, false
+	}
+
+	// An empty UserID reaches every client, including the renaming user's
+	// other tabs, like a rename made over REST.
+	payload, _ := json.Marshal(MetadataPayload{Title: title})
+	return WSMessage{Type: MetadataType, DocID: c.DocID, Payload: payload}, true
+}
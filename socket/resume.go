@@ -0,0 +1,112 @@
+package socket
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"satunaskah/pkg/logger"
+	"strconv"
+	"time"
+)
+
+// ResumeGracePeriod is how long a disconnected client's session can be resumed.
+const ResumeGracePeriod = 30 * time.Second
+
+// resumeState is what the hub remembers about a disconnected client so a quick
+// reconnect can skip the full-document resend.
+type resumeState struct {
+	DocID     string
+	UserID    string
+	Epoch     uint64 // Room generation; revisions restart when a room is recreated
+	Status    UserStatus
+	ExpiresAt time.Time
+}
+
+// SessionPayload is sent to every client after it joins.
+type SessionPayload struct {
+	ResumeToken string `json:"resume_token"`
+	Revision    int64  `json:"revision"`
+}
+
+// newToken returns a random hex token for resume and edit-lock handles.
+func newToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// takeResumeState consumes the resume state for client's requested token and
+// reports whether the client's content is still current: it received the
+// room's latest revision, or sent the latest UPDATE itself, which holds the
+// whole document. Must be called with h.mu held.
+func (h *Hub) takeResumeState(client *Client) (resumeState, bool) {
+	if client.resumeFrom == "" {
+		return resumeState{}, false
+	}
+	state, ok := h.resumeStates[client.resumeFrom]
+	delete(h.resumeStates, client.resumeFrom)
+	if !ok || time.Now().After(state.ExpiresAt) || state.DocID != client.DocID || state.UserID != client.UserID {
+		return resumeState{}, false
+	}
+	if state.Epoch != h.roomEpochs[client.DocID] {
+		return state, false
+	}
+	current := client.resumeRevision == h.Revisions[client.DocID] || h.updatedBy[client.DocID] == client.resumeFrom
+	return state, current
+}
+
+// parseRevision reads the revision a reconnecting client presents, or -1
+// when it is missing or malformed, which never counts as current.
+func parseRevision(s string) int64 {
+	revision, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || revision < 0 {
+		return -1
+	}
+	return revision
+}
+
+// saveResumeState remembers a departing client's position for ResumeGracePeriod
+// and drops any expired entries. Must be called with h.mu held.
+func (h *Hub) saveResumeState(client *Client) {
+	now := time.Now()
+	for token, state := range h.resumeStates {
+		if now.After(state.ExpiresAt) {
+			delete(h.resumeStates, token)
+		}
+	}
+	if client.ResumeToken == "" {
+		return
+	}
+	h.resumeStates[client.ResumeToken] = resumeState{
+		DocID:     client.DocID,
+		UserID:    client.UserID,
+		Epoch:     h.roomEpochs[client.DocID],
+		Status:    h.Presence[client.DocID][client.UserID],
+		ExpiresAt: now.Add(ResumeGracePeriod),
+	}
+}
+
+// evictReplaced closes the connection a reconnecting client replaces: the
+// same user's earlier connection whose resume token the client presented,
+// which has not unregistered yet because it dropped without a close. Its
+// resume state is saved first, so the reconnect resumes from it, and its own
+// unregister later finds nothing to do. Other connections of the user, such
+// as further tabs, are left alone. Must be called with h.mu held.
+func (h *Hub) evictReplaced(client *Client) {
+	if client.resumeFrom == "" {
+		return
+	}
+	for old := range h.Rooms[client.DocID] {
+		if old.UserID != client.UserID || old.ResumeToken != client.resumeFrom || !old.ConnectedAt.Before(client.ConnectedAt) {
+			continue
+		}
+		h.saveResumeState(old)
+		delete(h.Rooms[client.DocID], old)
+		h.untrackUser(old)
+		close(old.Send)
+		old.setDisconnectReason(DisconnectReplaced)
+		old.Conn.Close()
+		logger.Sugar.Infof("Replaced stale connection of user %s on doc %s", client.UserID, client.DocID)
+	}
+}
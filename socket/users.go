@@ -0,0 +1,61 @@
+package socket
+
+import "encoding/json"
+
+// trackUser records client under its user in h.userClients, the per-user
+// index kept alongside Rooms for cross-room operations. Must be called with
+// h.mu held.
+func (h *Hub) trackUser(client *Client) {
+	if h.userClients[client.UserID] == nil {
+		h.userClients[client.UserID] = make(map[*Client]bool)
+	}
+	h.userClients[client.UserID][client] = true
+}
+
+// untrackUser removes client from h.userClients. Must be called with h.mu held.
+func (h *Hub) untrackUser(client *Client) {
+	delete(h.userClients[client.UserID], client)
+	if len(h.userClients[client.UserID]) == 0 {
+		delete(h.userClients, client.UserID)
+	}
+}
+
+// NotifyUser sends msg to every connection userID has open, whatever the
+// document, and returns how many connections it was queued for. Delivery goes
+// through Run like any other send, so it must not be called from Run.
+func (h *Hub) NotifyUser(userID string, msg WSMessage) (int, error) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return 0, err
+	}
+
+	h.mu.Lock()
+	clients := make([]*Client, 0, len(h.userClients[userID]))
+	for client := range h.userClients[userID] {
+		clients = append(clients, client)
+	}
+	h.mu.Unlock()
+
+	for _, client := range clients {
+		h.direct <- directMessage{client: client, payload: payload}
+	}
+	return len(clients), nil
+}
+
+// userConns returns the clients userID has connected to docID, or to any
+// document, and their dashboards, when docID is empty. Must be called with
+// h.mu held.
+func (h *Hub) userConns(docID, userID string) []*Client {
+	var conns []*Client
+	for client := range h.userClients[userID] {
+		if docID == "" || client.DocID == docID {
+			conns = append(conns, client)
+		}
+	}
+	if docID == "" {
+		for client := range h.dashboards[userID] {
+			conns = append(conns, client)
+		}
+	}
+	return conns
+}